@@ -0,0 +1,106 @@
+// Package address implements the human-friendly form of public keys that
+// outputs pay to. An address is the Base58Check encoding of
+//
+//	network prefix | version | 32 byte ed25519 public key | checksum
+//
+// where the checksum is the first four bytes of the double SHA-256 of the
+// rest, so mistyped addresses are rejected rather than paid to.
+package address
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"github.com/mr-tron/base58/base58"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// VERSION_PUBLIC_KEY addresses pay to an ed25519 public key. It's the
+	// only version so far.
+	VERSION_PUBLIC_KEY = 0x00
+
+	CHECKSUM_SIZE = 4
+	// ADDRESS_SIZE is the size of a decoded address.
+	ADDRESS_SIZE = 2 + ed25519.PublicKeySize + CHECKSUM_SIZE
+)
+
+var (
+	ErrInvalidAddress = errors.New("Invalid address")
+	ErrChecksum       = errors.New("Address checksum doesn't match")
+	ErrUnknownVersion = errors.New("Unknown address version")
+	ErrWrongNetwork   = errors.New("Address is for another network")
+	ErrPublicKeySize  = errors.New("Public key must be 32 bytes")
+)
+
+// Address pays to PublicKey on the network with Prefix.
+type Address struct {
+	Prefix    byte
+	Version   byte
+	PublicKey ed25519.PublicKey
+}
+
+// New returns the address of publicKey on the network with prefix.
+func New(prefix byte, publicKey []byte) (Address, error) {
+	if len(publicKey) != ed25519.PublicKeySize {
+		return Address{}, ErrPublicKeySize
+	}
+	return Address{prefix, VERSION_PUBLIC_KEY, publicKey}, nil
+}
+
+func checksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:CHECKSUM_SIZE]
+}
+
+// String returns the Base58Check encoding of the address.
+func (a Address) String() string {
+	payload := append([]byte{a.Prefix, a.Version}, a.PublicKey...)
+	return base58.Encode(append(payload, checksum(payload)...))
+}
+
+// Parse decodes an address of any network and verifies its checksum.
+func Parse(text string) (Address, error) {
+	data, err := base58.Decode(text)
+	if err != nil || len(data) != ADDRESS_SIZE {
+		return Address{}, ErrInvalidAddress
+	}
+	payload := data[:len(data)-CHECKSUM_SIZE]
+	if !bytes.Equal(checksum(payload), data[len(payload):]) {
+		return Address{}, ErrChecksum
+	}
+	if payload[1] != VERSION_PUBLIC_KEY {
+		return Address{}, ErrUnknownVersion
+	}
+	return Address{payload[0], payload[1], payload[2:]}, nil
+}
+
+// Decode parses an address of the network with prefix and returns the
+// public key it pays to.
+func Decode(text string, prefix byte) (ed25519.PublicKey, error) {
+	a, err := Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if a.Prefix != prefix {
+		return nil, ErrWrongNetwork
+	}
+	return a.PublicKey, nil
+}
+
+// Validate reports why text isn't an address of the network with prefix,
+// if it isn't.
+func Validate(text string, prefix byte) error {
+	_, err := Decode(text, prefix)
+	return err
+}
+
+// Encode returns the address of publicKey on the network with prefix.
+func Encode(prefix byte, publicKey []byte) (string, error) {
+	a, err := New(prefix, publicKey)
+	if err != nil {
+		return "", err
+	}
+	return a.String(), nil
+}
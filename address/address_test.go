@@ -0,0 +1,65 @@
+package address
+
+import (
+	"github.com/mr-tron/base58/base58"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func testKey() []byte {
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	return key
+}
+
+func TestEncode(t *testing.T) {
+	vectors := []struct {
+		prefix  byte
+		address string
+	}{
+		{0x4c, "CF4vTNDfZByoLayRyydDH9fftdJ1Y4TkoGeHbXd5EapjPJpifGLV"},
+		{0xb2, "TLDEmpyRQsRpjNKnPhtJUuKMGwnYgk7uQLBafrxjKPhL752E5j4W"},
+		{0xa5, "RQg3LjHj8sX34e9oCikh8e623JB4qJbTHb5tPxTVwAu5SmXDoxTv"},
+	}
+	for _, v := range vectors {
+		address, err := Encode(v.prefix, testKey())
+		assert.NoError(t, err)
+		assert.Equal(t, v.address, address)
+
+		publicKey, err := Decode(v.address, v.prefix)
+		assert.NoError(t, err)
+		assert.Equal(t, testKey(), []byte(publicKey))
+	}
+
+	_, err := Encode(0x4c, testKey()[:31])
+	assert.Equal(t, ErrPublicKeySize, err)
+}
+
+func TestParse(t *testing.T) {
+	address := "CF4vTNDfZByoLayRyydDH9fftdJ1Y4TkoGeHbXd5EapjPJpifGLV"
+	a, err := Parse(address)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0x4c), a.Prefix)
+	assert.Equal(t, byte(VERSION_PUBLIC_KEY), a.Version)
+	assert.Equal(t, address, a.String())
+
+	// a typo
+	_, err = Parse("CF4vTNDfZByoLayRyydDH9fftdJ1Y4TkoGeHbXd5EapjPJpifGLW")
+	assert.Equal(t, ErrChecksum, err)
+	_, err = Parse(address[:40])
+	assert.Equal(t, ErrInvalidAddress, err)
+	_, err = Parse("CF4vTNDfZByoLayRyydDH9fftdJ1Y4TkoGeHbXd5EapjPJpifGL0")
+	assert.Equal(t, ErrInvalidAddress, err)
+	// a raw public key isn't an address
+	_, err = Parse(base58.Encode(testKey()))
+	assert.Equal(t, ErrInvalidAddress, err)
+
+	unknown := Address{0x4c, 1, testKey()}
+	_, err = Parse(unknown.String())
+	assert.Equal(t, ErrUnknownVersion, err)
+
+	assert.Equal(t, ErrWrongNetwork, Validate(address, 0xa5))
+	assert.NoError(t, Validate(address, 0x4c))
+}
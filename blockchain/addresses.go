@@ -0,0 +1,186 @@
+package blockchain
+
+import (
+	"bytes"
+	"github.com/InitialShape/cryptocurrency/storage"
+	"golang.org/x/crypto/ed25519"
+	"sort"
+	"strconv"
+)
+
+// addressEntry is what the addresses bucket keeps of an output paid to a
+// public key. SpentBy is the hash of the transaction that spent it.
+type addressEntry struct {
+	Amount  int
+	Height  int
+	SpentBy []byte
+}
+
+// AddressOutput is an output paid to a public key. Height is the height of
+// the block that confirmed it, or of the snapshot the chain was started
+// from if the output predates it.
+type AddressOutput struct {
+	TransactionHash []byte `json:"transaction_hash"`
+	OutputID        int    `json:"output_id"`
+	Amount          int    `json:"amount"`
+	Height          int    `json:"height"`
+	SpentBy         []byte `json:"spent_by,omitempty"`
+}
+
+// addressKey is the key of an output in the addresses bucket: the public key
+// followed by the output's pointer, so a key's outputs are next to each
+// other.
+func addressKey(publicKey []byte, pointer []byte) []byte {
+	key := make([]byte, 0, len(publicKey)+len(pointer))
+	return append(append(key, publicKey...), pointer...)
+}
+
+// parsePointer splits the pointer of an output into its transaction's hash
+// and its index.
+func parsePointer(pointer []byte) ([]byte, int, error) {
+	dash := bytes.LastIndexByte(pointer, '-')
+	if dash < 0 {
+		return nil, 0, ErrNotFound
+	}
+	id, err := strconv.Atoi(string(pointer[dash+1:]))
+	if err != nil {
+		return nil, 0, err
+	}
+	return pointer[:dash], id, nil
+}
+
+// indexOutput adds an output to the addresses of its public key. Outputs
+// locked by a script aren't indexed.
+func indexOutput(addresses storage.Bucket, pointer []byte, output Output,
+	height int) error {
+	if len(output.PublicKey) != ed25519.PublicKeySize {
+		return nil
+	}
+	entry, err := encode(addressEntry{output.Amount, height, nil})
+	if err != nil {
+		return err
+	}
+	return addresses.Put(addressKey(output.PublicKey, pointer), entry)
+}
+
+// spendIndexedOutput records the transaction spending the output at pointer
+// in the addresses of its public key.
+func spendIndexedOutput(addresses storage.Bucket, utxo storage.Bucket,
+	pointer []byte, spender []byte) error {
+	data := utxo.Get(pointer)
+	if data == nil {
+		return nil
+	}
+	var output Output
+	err := decode(data, &output)
+	if err != nil {
+		return err
+	}
+	key := addressKey(output.PublicKey, pointer)
+	data = addresses.Get(key)
+	if data == nil {
+		return nil
+	}
+	var entry addressEntry
+	err = decode(data, &entry)
+	if err != nil {
+		return err
+	}
+	entry.SpentBy = spender
+	data, err = encode(entry)
+	if err != nil {
+		return err
+	}
+	return addresses.Put(key, data)
+}
+
+// AddressOutputs returns the confirmed outputs paid to publicKey, spent or
+// not, ordered by height.
+func (s *Store) AddressOutputs(publicKey []byte) ([]AddressOutput, error) {
+	outputs := []AddressOutput{}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return outputs, nil
+	}
+	err := s.DB.View(func(tx storage.Tx) error {
+		addresses := tx.Bucket(ADDRESSES_BUCKET)
+		if addresses == nil {
+			return nil
+		}
+		c := addresses.Cursor()
+		for k, v := c.Seek(publicKey); k != nil &&
+			bytes.HasPrefix(k, publicKey); k, v = c.Next() {
+			hash, id, err := parsePointer(k[len(publicKey):])
+			if err != nil {
+				return err
+			}
+			var entry addressEntry
+			err = decode(v, &entry)
+			if err != nil {
+				return err
+			}
+			// CBOR decodes nil as empty
+			if len(entry.SpentBy) == 0 {
+				entry.SpentBy = nil
+			}
+			outputs = append(outputs, AddressOutput{
+				append([]byte{}, hash...), id, entry.Amount, entry.Height,
+				entry.SpentBy})
+		}
+		return nil
+	})
+	sort.SliceStable(outputs, func(i, j int) bool {
+		return outputs[i].Height < outputs[j].Height
+	})
+	return outputs, err
+}
+
+// migrateAddresses builds the address index of the unspent outputs. The
+// history of spent ones needs the blocks, see Reindex.
+func migrateAddresses(s *Store, tx storage.Tx) error {
+	b, err := createBuckets(tx, UTXO_BUCKET, TRANSACTIONS_BUCKET,
+		BLOCKS_BUCKET, SNAPSHOT_BUCKET, ADDRESSES_BUCKET)
+	if err != nil {
+		return err
+	}
+	utxo, transactions, blocks, snapshot, addresses := b[0], b[1], b[2],
+		b[3], b[4]
+
+	// outputs that predate a snapshot aren't in the transaction index
+	snapshotHeight := 0
+	if data := snapshot.Get(SNAPSHOT_INFO_KEY); data != nil {
+		var info SnapshotInfo
+		err = decode(data, &info)
+		if err != nil {
+			return err
+		}
+		snapshotHeight = info.Height
+	}
+
+	return utxo.ForEach(func(k, v []byte) error {
+		var output Output
+		err := decode(v, &output)
+		if err != nil {
+			return err
+		}
+		hash, _, err := parsePointer(k)
+		if err != nil {
+			return err
+		}
+		height := snapshotHeight
+		if data := transactions.Get(hash); data != nil {
+			var location transactionEntry
+			err = decode(data, &location)
+			if err != nil {
+				return err
+			}
+			var entry blockEntry
+			err = decode(blocks.Get(location.Block), &entry)
+			if err != nil {
+				return err
+			}
+			height = entry.Header.Height
+		}
+		return indexOutput(addresses, append([]byte{}, k...), output,
+			height)
+	})
+}
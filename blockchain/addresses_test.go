@@ -0,0 +1,100 @@
+package blockchain_test
+
+import (
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/storage"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"testing"
+)
+
+// spendTwice confirms a spend of the coinbase of a new first block to a new
+// key and a spend of that to another key.
+func spendTwice(t *testing.T, store blockchain.Store) (blockchain.Transaction,
+	blockchain.Transaction) {
+	first := mineBlock(store.Params.GenesisBlock, nil)
+	assert.NoError(t, store.AddBlock(first))
+	parent, key := lockedSpend(t, first.Transactions[0], coinbaseKey, 0, 0)
+	second := mineBlock(first, []blockchain.Transaction{parent})
+	assert.NoError(t, store.AddBlock(second))
+	child, _ := lockedSpend(t, parent, key, 0, 0)
+	assert.NoError(t, store.AddBlock(mineBlock(second,
+		[]blockchain.Transaction{child})))
+	return parent, child
+}
+
+func TestAddressOutputs(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	parent, child := spendTwice(t, store)
+
+	outputs, err := store.AddressOutputs(parent.Outputs[0].PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, []blockchain.AddressOutput{
+		{parent.Hash, 0, 10, 2, child.Hash}}, outputs)
+	outputs, err = store.AddressOutputs(child.Outputs[0].PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, []blockchain.AddressOutput{{child.Hash, 0, 10, 3, nil}},
+		outputs)
+
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs, err = store.AddressOutputs(publicKey)
+	assert.NoError(t, err)
+	assert.Empty(t, outputs)
+}
+
+func TestMigrateAddresses(t *testing.T) {
+	db := storage.NewMemory()
+	files := storage.NewMemoryFiles(blockchain.BLOCK_FILE_SIZE)
+	store := blockchain.Store{}
+	peer := &blockchain.Peer{}
+	err := store.OpenDB(db, files, peer, &blockchain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.Store = store
+	defer peer.Stop()
+	parent, child := spendTwice(t, store)
+
+	// a version 2 database has no address index
+	err = db.Update(func(tx storage.Tx) error {
+		meta := tx.Bucket(blockchain.META_BUCKET)
+		err := meta.Put(blockchain.SCHEMA_VERSION_KEY,
+			[]byte{0, 0, 0, 0, 0, 0, 0, 2})
+		if err != nil {
+			return err
+		}
+		addresses := tx.Bucket(blockchain.ADDRESSES_BUCKET)
+		var keys [][]byte
+		addresses.ForEach(func(k, v []byte) error {
+			keys = append(keys, k)
+			return nil
+		})
+		for _, key := range keys {
+			addresses.Delete(key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := blockchain.Store{}
+	err = reopened.OpenDB(db, files, peer, &blockchain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs, err := reopened.AddressOutputs(child.Outputs[0].PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, []blockchain.AddressOutput{{child.Hash, 0, 10, 3, nil}},
+		outputs)
+
+	// the rehash of version 4 reindexes the spent ones as well
+	outputs, err = reopened.AddressOutputs(parent.Outputs[0].PublicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, []blockchain.AddressOutput{
+		{parent.Hash, 0, 10, 2, child.Hash}}, outputs)
+}
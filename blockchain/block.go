@@ -3,14 +3,21 @@ package blockchain
 import (
 	"bytes"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"github.com/mr-tron/base58/base58"
 	cbor "github.com/whyrusleeping/cbor/go"
 	"golang.org/x/crypto/ed25519"
-	"log"
+	"math"
 	"strings"
 )
 
+// HEADER_VERSION is the version of the canonical block header encoding, see
+// docs/block-encoding.md.
+const HEADER_VERSION = 1
+
+var ErrInvalidHeader = errors.New("Invalid block header encoding")
+
 type Block struct {
 	Height        int           `json:"height"`
 	Hash          []byte        `json:"hash"`
@@ -18,22 +25,27 @@ type Block struct {
 	PreviousBlock []byte        `json:"previous_block"`
 	Difficulty    int           `json:"difficulty"`
 	Nonce         int32         `json:"nonce"`
+	// Timestamp is a unix time, see locktime.go for the rules it follows
+	Timestamp int64 `json:"timestamp"`
 }
 
-const COINBASE_AMOUNT = 25
-
-func GenerateGenesisBlock(publicKey ed25519.PublicKey,
-	privateKey ed25519.PrivateKey,
+// GenerateGenesisBlock builds the first block of a chain. Its coinbase isn't
+// signed, so the block is fully determined by the arguments.
+func GenerateGenesisBlock(publicKey ed25519.PublicKey, amount int,
 	difficulty int) (Block, error) {
-	coinbase, err := GenerateCoinbase(publicKey, privateKey, COINBASE_AMOUNT)
+	outputs := []Output{Output{publicKey, amount, []byte{}}}
+	inputs := []Input{Input{[]byte{}, []byte{}, 0, nil, 0}}
+	coinbase := Transaction{[]byte{}, inputs, outputs, 0}
+	hash, err := coinbase.GetHash()
 	if err != nil {
 		return Block{}, err
 	}
+	coinbase.Hash = hash
 
 	// change this to a static nonce once mining algorithm is implemented
 	block := Block{0, []byte{}, []Transaction{coinbase}, []byte{}, difficulty,
-		1}
-	hash, err := block.GetHash()
+		1, GENESIS_TIMESTAMP}
+	hash, err = block.GetHash()
 	if err != nil {
 		return Block{}, err
 	}
@@ -48,25 +60,76 @@ func (b *Block) GetCBOR() ([]byte, error) {
 	err := enc.Encode(b)
 
 	if err != nil {
-		log.Fatal("Error decoding ", err)
 		return []byte{}, err
 	}
 
 	return buf.Bytes(), err
 }
 
-func (b *Block) GetHash() ([]byte, error) {
-	hash := b.Hash
-	b.Hash = []byte{}
-	block, err := b.GetCBOR()
+// MerkleRoot returns the root of the merkle tree over the IDs of
+// transactions. An inner node is the hash of a zero byte and its two
+// children, an odd node is moved up a level as it is. No transactions have
+// a root of all zeros.
+func MerkleRoot(transactions []Transaction) []byte {
+	if len(transactions) == 0 {
+		return make([]byte, sha256.Size)
+	}
+	level := make([][]byte, len(transactions))
+	for i, transaction := range transactions {
+		level[i] = transaction.Hash
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			hasher := sha256.New()
+			hasher.Write([]byte{0})
+			hasher.Write(level[i])
+			hasher.Write(level[i+1])
+			next = append(next, hasher.Sum(nil))
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// Encode returns the canonical encoding of the header, its hash is derived
+// from it. The hash itself isn't part of it.
+func (h *Header) Encode() ([]byte, error) {
+	if h.Height < 0 || int64(h.Height) > math.MaxUint32 ||
+		h.Difficulty < 0 || int64(h.Difficulty) > math.MaxUint32 ||
+		h.Timestamp < 0 || len(h.MerkleRoot) != sha256.Size {
+		return nil, ErrInvalidHeader
+	}
+	e := &encoder{}
+	e.buf.WriteByte(HEADER_VERSION)
+	e.uint32(uint32(h.Height))
+	e.bytes(h.PreviousBlock)
+	e.buf.Write(h.MerkleRoot)
+	e.uint32(uint32(h.Difficulty))
+	e.uint32(uint32(h.Nonce))
+	e.uint64(uint64(h.Timestamp))
+	return e.buf.Bytes(), nil
+}
+
+// GetHash returns the SHA-256 of the header's canonical encoding.
+func (h *Header) GetHash() ([]byte, error) {
+	data, err := h.Encode()
 	if err != nil {
-		log.Fatal("Error encoding to CBOR", err)
-		return []byte{}, err
+		return nil, err
 	}
-	hasher := sha256.New()
-	hasher.Write(block)
-	b.Hash = hash
-	return hasher.Sum(nil), err
+	hash := sha256.Sum256(data)
+	return hash[:], nil
+}
+
+// GetHash returns the hash of the block's header, which commits to the
+// transactions through their merkle root.
+func (b *Block) GetHash() ([]byte, error) {
+	header := b.Header()
+	return header.GetHash()
 }
 
 func (b *Block) GetBase58Hash() (string, error) {
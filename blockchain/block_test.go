@@ -3,16 +3,37 @@ package blockchain
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/mr-tron/base58/base58"
 	"github.com/stretchr/testify/assert"
 	cbor "github.com/whyrusleeping/cbor/go"
 	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
 	"log"
 	"testing"
 )
 
+// headerVectors are the golden merkle roots and header encodings of
+// testdata/headers.json. They must never change, an encoding that does is
+// a new HEADER_VERSION.
+type headerVectors struct {
+	MerkleRoots []struct {
+		Name         string   `json:"name"`
+		Transactions []string `json:"transactions"`
+		Root         string   `json:"root"`
+	} `json:"merkle_roots"`
+	Headers []struct {
+		Name     string `json:"name"`
+		Header   Header `json:"header"`
+		Encoding string `json:"encoding"`
+		Hash     string `json:"hash"`
+	} `json:"headers"`
+}
+
 func TestMarshal(t *testing.T) {
 	// change this to a static nonce once mining algorithm is implemented
-	block := Block{0, []byte{}, nil, []byte{}, 1, 1}
+	block := Block{0, []byte{}, nil, []byte{}, 1, 1, 0}
 	marshalledBlock, err := block.GetCBOR()
 	if err != nil {
 		t.Error(err)
@@ -29,21 +50,21 @@ func TestMarshal(t *testing.T) {
 
 func TestBlockGetBase58Hash(t *testing.T) {
 	// change this to a static nonce once mining algorithm is implemented
-	block := Block{0, []byte{}, nil, []byte{}, 1, 1}
+	block := Block{0, []byte{}, nil, []byte{}, 1, 1, 0}
 	hash, err := block.GetBase58Hash()
 	if err != nil {
 		t.Error(err)
 	}
-	expected := "DzqgSYkaavhwvZvaoRVbRnkeiK5FbTohPmZ9WCazuLmc"
+	expected := "5hmqETLAemzqVY5NwBANQm5BzxSCLnpEb8EgunpvP7EQ"
 	assert.Equal(t, expected, hash)
 }
 
 func TestUnmarshal(t *testing.T) {
-	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		log.Fatal(err)
 	}
-	block, err := GenerateGenesisBlock(publicKey, privateKey, 3)
+	block, err := GenerateGenesisBlock(publicKey, 25, 3)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -81,3 +102,63 @@ func TestHashMatchesDifficulty(t *testing.T) {
 	hash = []byte{0x00, 0x7F} // 00000000 01111111
 	assert.True(t, HashMatchesDifficulty(hash, 9))
 }
+
+func TestHeaderVectors(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/headers.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v headerVectors
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, vector := range v.MerkleRoots {
+		var transactions []Transaction
+		for _, id := range vector.Transactions {
+			hash, err := hex.DecodeString(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			transactions = append(transactions, Transaction{Hash: hash})
+		}
+		assert.Equal(t, vector.Root,
+			hex.EncodeToString(MerkleRoot(transactions)), vector.Name)
+	}
+	for _, vector := range v.Headers {
+		data, err := vector.Header.Encode()
+		assert.NoError(t, err, vector.Name)
+		assert.Equal(t, vector.Encoding, hex.EncodeToString(data), vector.Name)
+		hash, err := vector.Header.GetHash()
+		assert.NoError(t, err, vector.Name)
+		assert.Equal(t, vector.Hash, base58.Encode(hash), vector.Name)
+	}
+}
+
+func TestBlockHashCommitsToTransactions(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := GenerateGenesisBlock(publicKey, 25, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateGenesisBlock(publicKey, 24, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, block.Hash, other.Hash)
+
+	// signatures aren't part of the transaction IDs
+	block.Transactions[0].Inputs[0].Signature = []byte{1}
+	hash, err := block.GetHash()
+	assert.NoError(t, err)
+	assert.Equal(t, block.Hash, hash)
+
+	header := block.Header()
+	header.MerkleRoot = nil
+	_, err = header.Encode()
+	assert.Equal(t, ErrInvalidHeader, err)
+}
@@ -0,0 +1,208 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/InitialShape/cryptocurrency/storage"
+	cbor "github.com/whyrusleeping/cbor/go"
+	"log"
+)
+
+const BLOCK_FILE_SIZE = 128 << 20
+
+// blockEntry is what the blocks bucket keeps of a block. The block itself
+// lives in the block files.
+type blockEntry struct {
+	Header   Header
+	Location storage.Location
+}
+
+// transactionEntry locates a transaction within the block that confirmed
+// it.
+type transactionEntry struct {
+	Block []byte
+	Index int
+}
+
+// fileEntry tracks the highest block within a block file, which is what
+// decides when the file can be pruned.
+type fileEntry struct {
+	MaxHeight int
+	Pruned    bool
+}
+
+func encode(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := cbor.NewEncoder(buf)
+	err := enc.Encode(v)
+	return buf.Bytes(), err
+}
+
+func decode(data []byte, v interface{}) error {
+	dec := cbor.NewDecoder(bytes.NewReader(data))
+	return dec.Decode(v)
+}
+
+func fileKey(file int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(file))
+	return key
+}
+
+// putBlockEntry indexes a block appended at location and records its height
+// for the block file.
+func putBlockEntry(blocks storage.Bucket, blockfiles storage.Bucket,
+	block Block, location storage.Location) error {
+	entry, err := encode(blockEntry{block.Header(), location})
+	if err != nil {
+		return err
+	}
+	err = blocks.Put(block.Hash, entry)
+	if err != nil {
+		return err
+	}
+
+	var file fileEntry
+	if data := blockfiles.Get(fileKey(location.File)); data != nil {
+		err = decode(data, &file)
+		if err != nil {
+			return err
+		}
+	}
+	if block.Height > file.MaxHeight {
+		file.MaxHeight = block.Height
+	}
+	data, err := encode(file)
+	if err != nil {
+		return err
+	}
+	return blockfiles.Put(fileKey(location.File), data)
+}
+
+func (s *Store) getBlockEntry(hash []byte) (blockEntry, error) {
+	var entry blockEntry
+	data, err := s.Get(BLOCKS_BUCKET, hash)
+	if err != nil {
+		return entry, err
+	}
+	err = decode(data, &entry)
+	return entry, err
+}
+
+// readBlock reads a block body from the block files.
+func (s *Store) readBlock(location storage.Location) (Block, error) {
+	data, err := s.Files.Read(location)
+	if err == storage.ErrFileRemoved {
+		return Block{}, ErrPruned
+	} else if err != nil {
+		return Block{}, err
+	}
+	return decodeBlock(data)
+}
+
+// GetHeader returns a block's header, which is kept even once the block is
+// pruned.
+func (s *Store) GetHeader(hash []byte) (Header, error) {
+	entry, err := s.getBlockEntry(hash)
+	return entry.Header, err
+}
+
+// PruneHeight returns the height up to which blocks may have been pruned,
+// or -1 if no block was pruned.
+func (s *Store) PruneHeight() (int, error) {
+	data, err := s.Get(BLOCKS_BUCKET, PRUNED_KEY)
+	if err == ErrNotFound {
+		return -1, nil
+	} else if err != nil {
+		return -1, err
+	}
+	return int(binary.BigEndian.Uint64(data)), nil
+}
+
+// prune removes the block files whose blocks are all more than PruneDepth
+// blocks below height. The file appended to is never removed.
+func (s *Store) prune(height int) error {
+	if s.PruneDepth <= 0 || height-s.PruneDepth < 0 {
+		return nil
+	}
+	pruneHeight := height - s.PruneDepth
+	current := s.Files.Current()
+
+	var files []int
+	entries := make(map[int]fileEntry)
+	err := s.DB.Update(func(tx storage.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(BLOCKFILES_BUCKET)
+		if err != nil {
+			return err
+		}
+		blocks, err := tx.CreateBucketIfNotExists(BLOCKS_BUCKET)
+		if err != nil {
+			return err
+		}
+		pruned := -1
+		if data := blocks.Get(PRUNED_KEY); data != nil {
+			pruned = int(binary.BigEndian.Uint64(data))
+		}
+
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			file := int(binary.BigEndian.Uint64(k))
+			var entry fileEntry
+			err = decode(v, &entry)
+			if err != nil {
+				return err
+			}
+			if file == current || entry.Pruned ||
+				entry.MaxHeight > pruneHeight {
+				continue
+			}
+			files = append(files, file)
+			entries[file] = entry
+			if entry.MaxHeight > pruned {
+				pruned = entry.MaxHeight
+			}
+		}
+
+		// files are marked first and removed after the commit, a crash in
+		// between leaves nothing worse than a file that's still there
+		if len(files) == 0 {
+			return nil
+		}
+		for _, file := range files {
+			entry := entries[file]
+			entry.Pruned = true
+			data, err := encode(entry)
+			if err != nil {
+				return err
+			}
+			err = b.Put(fileKey(file), data)
+			if err != nil {
+				return err
+			}
+		}
+		return blocks.Put(PRUNED_KEY, heightKey(pruned))
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		log.Println("Pruning block file", file)
+		err = s.Files.Remove(file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetPeerPruned remembers that a peer pruned its blocks up to height.
+func (s *Store) SetPeerPruned(peer string, height int) error {
+	return s.Put(PRUNED_PEERS_BUCKET, []byte(peer), heightKey(height))
+}
+
+// IsPeerPruned reports whether a peer can't serve the full chain.
+func (s *Store) IsPeerPruned(peer string) bool {
+	_, err := s.Get(PRUNED_PEERS_BUCKET, []byte(peer))
+	return err == nil
+}
@@ -0,0 +1,103 @@
+package blockchain_test
+
+import (
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/storage"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+// newPrunedStore opens a store with small block files, so that only a few
+// blocks share a file and pruning kicks in early.
+func newPrunedStore(t *testing.T, depth int) (blockchain.Store, func()) {
+	s := blockchain.Store{PruneDepth: depth}
+	p := &blockchain.Peer{}
+	err := s.OpenDB(storage.NewMemory(), storage.NewMemoryFiles(2048), p,
+		&blockchain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Store = s
+	return s, func() {
+		p.Stop()
+		s.Close()
+	}
+}
+
+func TestPruneBlocks(t *testing.T) {
+	store, cleanup := newPrunedStore(t, 5)
+	defer cleanup()
+	blocks := mineChain(t, store, store.Params.GenesisBlock, 20)
+
+	pruneHeight, err := store.PruneHeight()
+	assert.NoError(t, err)
+	assert.True(t, pruneHeight > 0)
+	assert.True(t, pruneHeight <= 15)
+
+	_, err = store.BlockByHeight(1)
+	assert.Equal(t, blockchain.ErrPruned, err)
+	_, err = store.GetBlock(blocks[0].Hash)
+	assert.Equal(t, blockchain.ErrPruned, err)
+	_, err = store.GetChain()
+	assert.Equal(t, blockchain.ErrPruned, err)
+
+	// blocks within the prune depth are kept
+	block, err := store.BlockByHeight(16)
+	assert.NoError(t, err)
+	assert.Equal(t, blocks[15], block)
+	root, err := store.GetRoot()
+	assert.NoError(t, err)
+	assert.Equal(t, blocks[19], root)
+
+	// headers are kept for the whole chain
+	headers, err := store.HeaderRange(0, 20)
+	assert.NoError(t, err)
+	assert.Len(t, headers, 21)
+	header, err := store.GetHeader(blocks[0].Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, blocks[0].Header(), header)
+
+	// and so are the unspent outputs of pruned blocks
+	spend := spendCoinbase(t, blocks[0])
+	valid, err := store.VerifyTransaction(spend, 1)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+}
+
+func TestNoPruningByDefault(t *testing.T) {
+	store, cleanup := newPrunedStore(t, 0)
+	defer cleanup()
+	blocks := mineChain(t, store, store.Params.GenesisBlock, 10)
+
+	pruneHeight, err := store.PruneHeight()
+	assert.NoError(t, err)
+	assert.Equal(t, -1, pruneHeight)
+	block, err := store.BlockByHeight(1)
+	assert.NoError(t, err)
+	assert.Equal(t, blocks[0], block)
+}
+
+func TestPongAdvertisesPruneHeight(t *testing.T) {
+	store, cleanup := newPrunedStore(t, 5)
+	defer cleanup()
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	assert.Equal(t, "PONG 127.0.0.1", string(store.Peer.Pong(remote)))
+
+	mineChain(t, store, store.Params.GenesisBlock, 20)
+	pruneHeight, err := store.PruneHeight()
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("PONG 127.0.0.1 %d", pruneHeight),
+		string(store.Peer.Pong(remote)))
+}
+
+func TestPrunedPeer(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	assert.False(t, store.IsPeerPruned("127.0.0.1:1234"))
+	err := store.SetPeerPruned("127.0.0.1:1234", 100)
+	assert.NoError(t, err)
+	assert.True(t, store.IsPeerPruned("127.0.0.1:1234"))
+}
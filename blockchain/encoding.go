@@ -0,0 +1,291 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+)
+
+// TRANSACTION_VERSION is the latest version of the canonical transaction
+// encoding, see docs/transaction-encoding.md. Transactions are encoded with
+// the lowest version that can express them, so the hashes of transactions
+// that don't use the features of later versions don't change.
+const TRANSACTION_VERSION = 3
+
+var (
+	ErrInvalidEncoding = errors.New("Invalid transaction encoding")
+	ErrNonCanonical    = errors.New("Transaction not encoded with the lowest version")
+	ErrUnknownVersion  = errors.New("Unknown transaction encoding version")
+	ErrTrailingData    = errors.New("Trailing data after transaction")
+	ErrTrailingJSON    = errors.New("Trailing data after JSON value")
+)
+
+const (
+	// the smallest encodings of an input and an output, which bound the
+	// counts a decoder accepts
+	minInputSize  = 4 + 4 + 4
+	minOutputSize = 4 + 8
+
+	maxInt = int(^uint(0) >> 1)
+)
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint32(uint32(len(v)))
+	e.buf.Write(v)
+}
+
+// decoder reads the fields of an encoding. The first error sticks and
+// makes all further reads return zero values.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = ErrInvalidEncoding
+		return nil
+	}
+	v := d.data[:n]
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) uint8() uint8 {
+	v := d.next(1)
+	if v == nil {
+		return 0
+	}
+	return v[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	v := d.next(4)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+func (d *decoder) uint64() uint64 {
+	v := d.next(8)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func (d *decoder) bytes() []byte {
+	length := d.uint32()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(length) > uint64(len(d.data)) {
+		d.err = ErrInvalidEncoding
+		return nil
+	}
+	return append([]byte{}, d.next(int(length))...)
+}
+
+// count reads the number of items that follow, each at least size bytes.
+func (d *decoder) count(size int) int {
+	n := d.uint32()
+	if d.err != nil {
+		return 0
+	}
+	if uint64(n)*uint64(size) > uint64(len(d.data)) {
+		d.err = ErrInvalidEncoding
+		return 0
+	}
+	return int(n)
+}
+
+// version returns the lowest encoding version that can express the
+// transaction.
+func (t *Transaction) version() byte {
+	if t.LockTime != 0 {
+		return 3
+	}
+	for _, input := range t.Inputs {
+		if input.Sequence != 0 {
+			return 3
+		}
+	}
+	for _, input := range t.Inputs {
+		if len(input.Witness) > 0 {
+			return 2
+		}
+	}
+	for _, output := range t.Outputs {
+		if len(output.Script) > 0 {
+			return 2
+		}
+	}
+	return 1
+}
+
+func (e *encoder) outpoint(input Input) error {
+	if input.OutputID < 0 || int64(input.OutputID) > math.MaxUint32 {
+		return ErrInvalidEncoding
+	}
+	e.bytes(input.TransactionHash)
+	e.uint32(uint32(input.OutputID))
+	return nil
+}
+
+func (e *encoder) output(output Output, version byte) error {
+	if output.Amount < 0 {
+		return ErrInvalidEncoding
+	}
+	e.bytes(output.PublicKey)
+	e.uint64(uint64(output.Amount))
+	if version >= 2 {
+		e.bytes(output.Script)
+	}
+	return nil
+}
+
+// Encode returns the canonical encoding of the transaction. It covers the
+// inputs and outputs, the hash is derived from it.
+func (t *Transaction) Encode() ([]byte, error) {
+	version := t.version()
+	e := &encoder{}
+	e.buf.WriteByte(version)
+
+	e.uint32(uint32(len(t.Inputs)))
+	for _, input := range t.Inputs {
+		err := e.outpoint(input)
+		if err != nil {
+			return nil, err
+		}
+		e.bytes(input.Signature)
+		if version >= 2 {
+			e.uint32(uint32(len(input.Witness)))
+			for _, item := range input.Witness {
+				e.bytes(item)
+			}
+		}
+		if version >= 3 {
+			e.uint32(input.Sequence)
+		}
+	}
+
+	e.uint32(uint32(len(t.Outputs)))
+	for _, output := range t.Outputs {
+		err := e.output(output, version)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if version >= 3 {
+		e.uint32(t.LockTime)
+	}
+	return e.buf.Bytes(), nil
+}
+
+// DecodeJSON decodes a single JSON value from r into v as strictly as the
+// canonical encoding is decoded: unknown fields and anything but whitespace
+// after the value are rejected. Transactions and blocks received from peers
+// and clients are decoded with it.
+func DecodeJSON(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return ErrTrailingJSON
+	}
+	return nil
+}
+
+// DecodeTransaction decodes the canonical encoding of a transaction and
+// sets its hash. Anything but exactly one transaction of a known version is
+// rejected.
+func DecodeTransaction(data []byte) (Transaction, error) {
+	d := &decoder{data: data}
+	version := d.uint8()
+	if d.err == nil && (version < 1 || version > TRANSACTION_VERSION) {
+		return Transaction{}, ErrUnknownVersion
+	}
+
+	transaction := Transaction{Hash: []byte{}}
+	inputs := d.count(minInputSize)
+	transaction.Inputs = make([]Input, 0, inputs)
+	for i := 0; i < inputs; i++ {
+		var input Input
+		input.TransactionHash = d.bytes()
+		input.OutputID = int(d.uint32())
+		input.Signature = d.bytes()
+		if version >= 2 {
+			items := d.count(4)
+			for j := 0; j < items; j++ {
+				input.Witness = append(input.Witness, d.bytes())
+			}
+		}
+		if version >= 3 {
+			input.Sequence = d.uint32()
+		}
+		transaction.Inputs = append(transaction.Inputs, input)
+	}
+
+	outputs := d.count(minOutputSize)
+	transaction.Outputs = make([]Output, 0, outputs)
+	for i := 0; i < outputs; i++ {
+		var output Output
+		output.PublicKey = d.bytes()
+		amount := d.uint64()
+		if amount > uint64(maxInt) {
+			d.err = ErrInvalidEncoding
+		}
+		output.Amount = int(amount)
+		output.Script = []byte{}
+		if version >= 2 {
+			output.Script = d.bytes()
+		}
+		transaction.Outputs = append(transaction.Outputs, output)
+	}
+	if version >= 3 {
+		transaction.LockTime = d.uint32()
+	}
+
+	if d.err != nil {
+		return Transaction{}, d.err
+	}
+	if len(d.data) > 0 {
+		return Transaction{}, ErrTrailingData
+	}
+	if transaction.version() != version {
+		return Transaction{}, ErrNonCanonical
+	}
+
+	hash, err := transaction.GetHash()
+	if err != nil {
+		return Transaction{}, err
+	}
+	transaction.Hash = hash
+	return transaction, nil
+}
@@ -0,0 +1,121 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/mr-tron/base58/base58"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// vectors are the golden encodings of testdata/transactions.json. They must
+// never change, an encoding that does is a new TRANSACTION_VERSION.
+type vectors struct {
+	Valid []struct {
+		Name        string      `json:"name"`
+		Transaction Transaction `json:"transaction"`
+		Encoding    string      `json:"encoding"`
+		Hash        string      `json:"hash"`
+	} `json:"valid"`
+	Invalid []struct {
+		Name     string `json:"name"`
+		Encoding string `json:"encoding"`
+		Error    string `json:"error"`
+	} `json:"invalid"`
+}
+
+func readVectors(t *testing.T) vectors {
+	data, err := ioutil.ReadFile("testdata/transactions.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v vectors
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestEncodingVectors(t *testing.T) {
+	for _, vector := range readVectors(t).Valid {
+		data, err := vector.Transaction.Encode()
+		assert.NoError(t, err, vector.Name)
+		assert.Equal(t, vector.Encoding, hex.EncodeToString(data), vector.Name)
+
+		hash, err := vector.Transaction.GetBase58Hash()
+		assert.NoError(t, err, vector.Name)
+		assert.Equal(t, vector.Hash, hash, vector.Name)
+		assert.Equal(t, vector.Hash, base58.Encode(vector.Transaction.Hash),
+			vector.Name)
+
+		transaction, err := DecodeTransaction(data)
+		assert.NoError(t, err, vector.Name)
+		assert.Equal(t, vector.Transaction, transaction, vector.Name)
+	}
+}
+
+func TestDecodingInvalidVectors(t *testing.T) {
+	for _, vector := range readVectors(t).Invalid {
+		data, err := hex.DecodeString(vector.Encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = DecodeTransaction(data)
+		if assert.Error(t, err, vector.Name) {
+			assert.Equal(t, vector.Error, err.Error(), vector.Name)
+		}
+	}
+}
+
+func TestEncodeRejectsUnencodable(t *testing.T) {
+	publicKey, err := base58.Decode(PUBLIC_KEY)
+	if err != nil {
+		t.Error(err)
+	}
+	negative := Transaction{[]byte{}, []Input{},
+		[]Output{Output{publicKey, -1, []byte{}}}, 0}
+	_, err = negative.Encode()
+	assert.Equal(t, ErrInvalidEncoding, err)
+
+	output := Transaction{[]byte{},
+		[]Input{Input{[]byte{}, []byte{}, -1, nil, 0}}, []Output{}, 0}
+	_, err = output.Encode()
+	assert.Equal(t, ErrInvalidEncoding, err)
+}
+
+func TestHashIgnoresSignatures(t *testing.T) {
+	publicKey, err := base58.Decode(PUBLIC_KEY)
+	if err != nil {
+		t.Error(err)
+	}
+	transaction := Transaction{[]byte{},
+		[]Input{Input{[]byte{}, []byte{}, 0, nil, 0}},
+		[]Output{Output{publicKey, 100, []byte{}}}, 0}
+	hash, err := transaction.GetHash()
+	assert.NoError(t, err)
+
+	transaction.Inputs[0].Signature = []byte("signature")
+	signed, err := transaction.GetHash()
+	assert.NoError(t, err)
+	assert.Equal(t, hash, signed)
+	// hashing doesn't touch the transaction
+	assert.Equal(t, []byte("signature"), transaction.Inputs[0].Signature)
+}
+
+func TestDecodeJSON(t *testing.T) {
+	var transaction Transaction
+	err := DecodeJSON(strings.NewReader(`{"lock_time": 1} `), &transaction)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(1), transaction.LockTime)
+
+	err = DecodeJSON(strings.NewReader(`{"lock_time": 1, "fee": 2}`),
+		&transaction)
+	assert.Error(t, err)
+	err = DecodeJSON(strings.NewReader(`{"lock_time": 1} {}`), &transaction)
+	assert.Equal(t, ErrTrailingJSON, err)
+	err = DecodeJSON(strings.NewReader(`{"lock_time": 1}x`), &transaction)
+	assert.Equal(t, ErrTrailingJSON, err)
+}
@@ -0,0 +1,90 @@
+package blockchain
+
+import (
+	"errors"
+)
+
+var (
+	// ErrNotFound is returned when a key or its bucket doesn't exist.
+	ErrNotFound          = errors.New("Not found")
+	ErrTransactionExists = errors.New("Transaction exists already")
+	// ErrPruned is returned for blocks whose body was pruned.
+	ErrPruned = errors.New("Block was pruned")
+)
+
+// Reason tells why a block or transaction was rejected.
+type Reason string
+
+const (
+	REASON_GENESIS_EXISTS        Reason = "genesis-exists"
+	REASON_NO_PREVIOUS_BLOCK     Reason = "no-previous-block"
+	REASON_DIFFICULTY_TOO_LOW    Reason = "difficulty-too-low"
+	REASON_WRONG_DIFFICULTY      Reason = "wrong-difficulty"
+	REASON_WRONG_HEIGHT          Reason = "wrong-height"
+	REASON_COINBASE_TOO_HIGH     Reason = "coinbase-too-high"
+	REASON_COINBASE_HEIGHT       Reason = "coinbase-height"
+	REASON_DUPLICATE_TRANSACTION Reason = "duplicate-transaction"
+	REASON_MISSING_INPUT         Reason = "missing-input"
+	REASON_SPENT_OUTPUT          Reason = "spent-output"
+	REASON_DUPLICATE_INPUT       Reason = "duplicate-input"
+	REASON_INVALID_AMOUNT        Reason = "invalid-amount"
+	REASON_NEGATIVE_FEE          Reason = "negative-fee"
+	REASON_INVALID_SIGNATURE     Reason = "invalid-signature"
+	REASON_BELOW_SNAPSHOT        Reason = "below-snapshot"
+	REASON_INVALID_HASH          Reason = "invalid-hash"
+	REASON_INVALID_PUBLIC_KEY    Reason = "invalid-public-key"
+	REASON_INVALID_SCRIPT        Reason = "invalid-script"
+	REASON_SCRIPT_FAILED         Reason = "script-failed"
+	REASON_NON_FINAL             Reason = "non-final"
+	REASON_TIME_TOO_OLD          Reason = "time-too-old"
+	REASON_TIME_TOO_NEW          Reason = "time-too-new"
+)
+
+// ErrInvalidBlock is returned for blocks that break a consensus rule.
+type ErrInvalidBlock struct {
+	Reason  Reason
+	Message string
+}
+
+func (e *ErrInvalidBlock) Error() string {
+	return e.Message
+}
+
+// ErrInvalidTransaction is returned for transactions that can't be spent.
+type ErrInvalidTransaction struct {
+	Reason  Reason
+	Message string
+}
+
+func (e *ErrInvalidTransaction) Error() string {
+	return e.Message
+}
+
+func invalidBlock(reason Reason, message string) error {
+	return &ErrInvalidBlock{Reason: reason, Message: message}
+}
+
+func invalidTransaction(reason Reason, message string) error {
+	return &ErrInvalidTransaction{Reason: reason, Message: message}
+}
+
+// IsInvalid reports whether err rejects a block or transaction, as opposed
+// to a failure of the node itself.
+func IsInvalid(err error) bool {
+	switch err.(type) {
+	case *ErrInvalidBlock, *ErrInvalidTransaction:
+		return true
+	}
+	return false
+}
+
+// ReasonOf returns the reason a block or transaction was rejected, if any.
+func ReasonOf(err error) Reason {
+	switch e := err.(type) {
+	case *ErrInvalidBlock:
+		return e.Reason
+	case *ErrInvalidTransaction:
+		return e.Reason
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	cbor "github.com/whyrusleeping/cbor/go"
+)
+
+// The genesis blocks are fixed constants rather than being generated, so
+// that every node of a network starts from the very same block. They must
+// only ever be changed together with their hash, which Store.Open checks.
+
+// mainNetGenesisHash is the hash of the mainnet genesis block.
+const mainNetGenesisHash = "FasxCebVHHvmVinpFzGYnmGsN4pWVQrnXEJyZBANTTCM"
+
+// mainNetGenesisBlock is the serialized mainnet genesis block. It pays 25
+// coins to Gadh3UUPCnzbxiKjncjeba72S6usbh4sfPFWEmDotwPx.
+const mainNetGenesisBlock = "" +
+	"a7666865696768740064686173685820d8b1651d9700f695985753a388a6e592" +
+	"37c30340cef99059592201fb994829ba6c7472616e73616374696f6e7381a464" +
+	"686173685820920bf0141eb88ad6a7f2ace5dd7dfd8a1f71f6c0d3425e8a7c3e" +
+	"e043b4209ac666696e7075747381a5697369676e617475726540707472616e73" +
+	"616374696f6e5f6861736840696f75747075745f696400677769746e65737380" +
+	"6873657175656e636500676f75747075747381a36a7075626c69635f6b657958" +
+	"20e77cf4e09037f17d9f0fcf1cd21862ef526eb5117d47f7347dfeed1c041569" +
+	"a366616d6f756e7418196673637269707440696c6f636b5f74696d65006e7072" +
+	"6576696f75735f626c6f636b406a646966666963756c747914656e6f6e636501" +
+	"6974696d657374616d701a5a497a00"
+
+// testNetGenesisHash is the hash of the testnet genesis block.
+const testNetGenesisHash = "8rrv7ab5KrfHthq9e936AmZSxm4ZT4iTi6ppGQpwaiDe"
+
+// testNetGenesisBlock is the serialized testnet genesis block. It pays 25
+// coins to AKR8C3nye4DQELkkutqP33jP1ht7MwMcdjypnH7GQmQP.
+const testNetGenesisBlock = "" +
+	"a766686569676874006468617368582074c7b542858905b42a6710d8589a861d" +
+	"d0d1266337d0646802e33f0030c0b4c96c7472616e73616374696f6e7381a464" +
+	"686173685820b4cccfde68686fa4bc6df1af0e1eb03428d5d8caac5db125e025" +
+	"2c0536626e8f66696e7075747381a5697369676e617475726540707472616e73" +
+	"616374696f6e5f6861736840696f75747075745f696400677769746e65737380" +
+	"6873657175656e636500676f75747075747381a36a7075626c69635f6b657958" +
+	"208a70e9f9981be432f52526d32ebda07c8fdf210d6998c846db93cc7233507a" +
+	"4466616d6f756e7418196673637269707440696c6f636b5f74696d65006e7072" +
+	"6576696f75735f626c6f636b406a646966666963756c747910656e6f6e636501" +
+	"6974696d657374616d701a5a497a00"
+
+// regTestGenesisHash is the hash of the regtest genesis block.
+const regTestGenesisHash = "HrZHBNMrCFDXEViQy5BAX2LpMH1diZnfAU7uUoVZfqCq"
+
+// regTestGenesisBlock is the serialized regtest genesis block. It pays 25
+// coins to 3P7JdC98yn3KS7bKrUSDB5x3LydAeW7spaEGDEYuMmRx.
+const regTestGenesisBlock = "" +
+	"a7666865696768740064686173685820fa6cf2c959d7fb13bd3c77d5b8cdd1b9" +
+	"dc411b7defdf93d931a0e8b4e88639de6c7472616e73616374696f6e7381a464" +
+	"6861736858200bed5ee11e03fe172e830204d11326a7fd42e545daa53621fad9" +
+	"7db8dfb0bb2166696e7075747381a5697369676e617475726540707472616e73" +
+	"616374696f6e5f6861736840696f75747075745f696400677769746e65737380" +
+	"6873657175656e636500676f75747075747381a36a7075626c69635f6b657958" +
+	"202361478a29a7dd6fe3a0652095652f7ea71ece5a8cd7656a50fc0a9a06b824" +
+	"d766616d6f756e7418196673637269707440696c6f636b5f74696d65006e7072" +
+	"6576696f75735f626c6f636b406a646966666963756c747901656e6f6e636501" +
+	"6974696d657374616d701a5a497a00"
+
+func decodeGenesisBlock(data string) Block {
+	raw, err := hex.DecodeString(data)
+	if err != nil {
+		panic(err)
+	}
+
+	var block Block
+	dec := cbor.NewDecoder(bytes.NewReader(raw))
+	err = dec.Decode(&block)
+	if err != nil {
+		panic(err)
+	}
+	return block
+}
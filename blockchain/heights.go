@@ -0,0 +1,206 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/InitialShape/cryptocurrency/storage"
+	cbor "github.com/whyrusleeping/cbor/go"
+)
+
+// Header is a block without its transactions, which MerkleRoot commits to.
+type Header struct {
+	Height        int    `json:"height"`
+	Hash          []byte `json:"hash"`
+	PreviousBlock []byte `json:"previous_block"`
+	MerkleRoot    []byte `json:"merkle_root"`
+	Difficulty    int    `json:"difficulty"`
+	Nonce         int32  `json:"nonce"`
+	Timestamp     int64  `json:"timestamp"`
+}
+
+// BlockIterator walks the main chain upwards one block at a time, reading
+// each block only when it's reached.
+type BlockIterator struct {
+	store  *Store
+	height int
+	block  Block
+	err    error
+}
+
+func (b *Block) Header() Header {
+	return Header{b.Height, b.Hash, b.PreviousBlock,
+		MerkleRoot(b.Transactions), b.Difficulty, b.Nonce, b.Timestamp}
+}
+
+// heightKey is the key of a height in the heights bucket. Big endian keeps
+// the bucket sorted by height.
+func heightKey(height int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(height))
+	return key
+}
+
+func decodeBlock(data []byte) (Block, error) {
+	var block Block
+	dec := cbor.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&block)
+	return block, err
+}
+
+// indexMainChain points the heights bucket at the chain ending in block,
+// which has to be stored already. Only the heights that changed are
+// written, i.e. the walk stops where the new chain joins the indexed one.
+func indexMainChain(tx storage.Tx, block Header) error {
+	heights, err := tx.CreateBucketIfNotExists(HEIGHTS_BUCKET)
+	if err != nil {
+		return err
+	}
+	blocks, err := tx.CreateBucketIfNotExists(BLOCKS_BUCKET)
+	if err != nil {
+		return err
+	}
+
+	// drop heights above the new root, left over from a longer chain
+	var stale [][]byte
+	c := heights.Cursor()
+	for k, _ := c.Seek(heightKey(block.Height + 1)); k != nil; k, _ = c.Next() {
+		stale = append(stale, k)
+	}
+	for _, k := range stale {
+		err = heights.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		key := heightKey(block.Height)
+		if bytes.Equal(heights.Get(key), block.Hash) {
+			return nil
+		}
+		err = heights.Put(key, block.Hash)
+		if err != nil {
+			return err
+		}
+		if len(block.PreviousBlock) == 0 {
+			return nil
+		}
+
+		data := blocks.Get(block.PreviousBlock)
+		if data == nil {
+			return ErrNotFound
+		}
+		var entry blockEntry
+		err = decode(data, &entry)
+		if err != nil {
+			return err
+		}
+		block = entry.Header
+	}
+}
+
+// indexHeights builds the height index of databases that predate it.
+func (s *Store) indexHeights() error {
+	root, err := s.GetRoot()
+	if err != nil {
+		return err
+	}
+	hash, err := s.Get(HEIGHTS_BUCKET, heightKey(root.Height))
+	if err == nil && bytes.Equal(hash, root.Hash) {
+		return nil
+	} else if err != nil && err != ErrNotFound {
+		return err
+	}
+
+	return s.DB.Update(func(tx storage.Tx) error {
+		return indexMainChain(tx, root.Header())
+	})
+}
+
+// BlockByHeight returns the main chain's block at height.
+func (s *Store) BlockByHeight(height int) (Block, error) {
+	entry, err := s.entryByHeight(height)
+	if err != nil {
+		return Block{}, err
+	}
+	return s.readBlock(entry.Location)
+}
+
+func (s *Store) entryByHeight(height int) (blockEntry, error) {
+	var entry blockEntry
+	if height < 0 {
+		return entry, ErrNotFound
+	}
+	err := s.DB.View(func(tx storage.Tx) error {
+		heights := tx.Bucket(HEIGHTS_BUCKET)
+		blocks := tx.Bucket(BLOCKS_BUCKET)
+		if heights == nil || blocks == nil {
+			return ErrNotFound
+		}
+		hash := heights.Get(heightKey(height))
+		if hash == nil {
+			return ErrNotFound
+		}
+		data := blocks.Get(hash)
+		if data == nil {
+			return ErrNotFound
+		}
+		return decode(data, &entry)
+	})
+	return entry, err
+}
+
+// HeaderRange returns the headers of the main chain from height from up to
+// and including height to. It stops early at the root. Headers are kept
+// for pruned blocks, too.
+func (s *Store) HeaderRange(from int, to int) ([]Header, error) {
+	headers := []Header{}
+	if from < 0 {
+		from = 0
+	}
+	for height := from; height <= to; height++ {
+		entry, err := s.entryByHeight(height)
+		if err == ErrNotFound {
+			break
+		} else if err != nil {
+			return headers, err
+		}
+		headers = append(headers, entry.Header)
+	}
+	return headers, nil
+}
+
+// IterateBlocks returns an iterator over the main chain starting at height
+// from.
+func (s *Store) IterateBlocks(from int) *BlockIterator {
+	if from < 0 {
+		from = 0
+	}
+	return &BlockIterator{store: s, height: from}
+}
+
+// Next moves to the next block. It returns false at the end of the chain or
+// on errors, which are reported by Err.
+func (it *BlockIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	block, err := it.store.BlockByHeight(it.height)
+	if err == ErrNotFound {
+		return false
+	} else if err != nil {
+		it.err = err
+		return false
+	}
+	it.block = block
+	it.height++
+	return true
+}
+
+func (it *BlockIterator) Block() Block {
+	return it.block
+}
+
+func (it *BlockIterator) Err() error {
+	return it.err
+}
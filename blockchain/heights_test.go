@@ -0,0 +1,169 @@
+package blockchain_test
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/miner"
+	"github.com/InitialShape/cryptocurrency/storage"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"testing"
+)
+
+// mineChain adds count blocks on top of previous and returns them.
+func mineChain(t *testing.T, store blockchain.Store, previous blockchain.Block,
+	count int) []blockchain.Block {
+	var blocks []blockchain.Block
+	for i := 0; i < count; i++ {
+		previous = mineBlock(previous, []blockchain.Transaction{})
+		err := store.AddBlock(previous)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, previous)
+	}
+	return blocks
+}
+
+func TestBlockByHeight(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	blocks := mineChain(t, store, store.Params.GenesisBlock, 3)
+
+	for _, expected := range blocks {
+		block, err := store.BlockByHeight(expected.Height)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, block)
+	}
+	genesis, err := store.BlockByHeight(0)
+	assert.NoError(t, err)
+	assert.Equal(t, store.Params.GenesisBlock, genesis)
+
+	_, err = store.BlockByHeight(4)
+	assert.Equal(t, blockchain.ErrNotFound, err)
+	_, err = store.BlockByHeight(-1)
+	assert.Equal(t, blockchain.ErrNotFound, err)
+}
+
+func TestPutBlockWithWrongHeight(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	genesis := store.Params.GenesisBlock
+
+	block, err := miner.SearchBlock(context.Background(), coinbaseKey, 5,
+		genesis.Difficulty, store.Params.CoinbaseAmount, genesis.Hash,
+		genesis.Timestamp+1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.AddBlock(block)
+	if assert.Error(t, err) {
+		assert.Equal(t, blockchain.REASON_WRONG_HEIGHT,
+			blockchain.ReasonOf(err))
+	}
+}
+
+func TestHeaderRange(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	blocks := mineChain(t, store, store.Params.GenesisBlock, 5)
+
+	headers, err := store.HeaderRange(2, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, []blockchain.Header{blocks[1].Header(),
+		blocks[2].Header(), blocks[3].Header()}, headers)
+
+	headers, err = store.HeaderRange(4, 100)
+	assert.NoError(t, err)
+	assert.Len(t, headers, 2)
+
+	headers, err = store.HeaderRange(6, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, headers)
+}
+
+func TestIterateBlocks(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	blocks := mineChain(t, store, store.Params.GenesisBlock, 3)
+
+	var iterated []blockchain.Block
+	it := store.IterateBlocks(1)
+	for it.Next() {
+		iterated = append(iterated, it.Block())
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, blocks, iterated)
+}
+
+func TestHeightIndexFollowsRoot(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	genesis := store.Params.GenesisBlock
+	long := mineChain(t, store, genesis, 3)
+
+	// a block on top of the first one becomes the new root, mined by
+	// another key, whose coinbase differs from the one at its height
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork, err := miner.SearchBlock(context.Background(), otherKey, 2,
+		long[0].Difficulty, store.Params.CoinbaseAmount, long[0].Hash,
+		long[0].Timestamp+1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, store.AddBlock(fork))
+	block, err := store.BlockByHeight(2)
+	assert.NoError(t, err)
+	assert.Equal(t, fork, block)
+	_, err = store.BlockByHeight(3)
+	assert.Equal(t, blockchain.ErrNotFound, err)
+
+	chain, err := store.GetChain()
+	assert.NoError(t, err)
+	assert.Equal(t, []blockchain.Block{genesis, long[0], fork}, chain)
+}
+
+func TestIndexHeightsOfOldDatabase(t *testing.T) {
+	db := storage.NewMemory()
+	files := storage.NewMemoryFiles(blockchain.BLOCK_FILE_SIZE)
+	store := blockchain.Store{}
+	peer := &blockchain.Peer{}
+	err := store.OpenDB(db, files, peer, &blockchain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.Store = store
+	blocks := mineChain(t, store, store.Params.GenesisBlock, 2)
+
+	// drop the index as if the database was written before it existed
+	err = db.Update(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte("heights"))
+		var keys [][]byte
+		b.ForEach(func(k, v []byte) error {
+			keys = append(keys, k)
+			return nil
+		})
+		for _, k := range keys {
+			b.Delete(k)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.BlockByHeight(2)
+	assert.Equal(t, blockchain.ErrNotFound, err)
+
+	reopened := blockchain.Store{}
+	err = reopened.OpenDB(db, files, peer, &blockchain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := reopened.BlockByHeight(2)
+	assert.NoError(t, err)
+	assert.Equal(t, blocks[1], block)
+}
@@ -0,0 +1,140 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// HTLC_PREIMAGE_SIZE is the size of the secret whose hash locks an HTLC.
+// The script checks it, so a secret revealed on one chain fits the other.
+const HTLC_PREIMAGE_SIZE = 32
+
+var (
+	ErrNotHTLC        = errors.New("Not an HTLC script")
+	ErrHTLCHash       = errors.New("HTLC hash must be 32 bytes")
+	ErrHTLCLock       = errors.New("HTLC lock has to be a height")
+	ErrHTLCKey        = errors.New("Key can't spend the HTLC")
+	ErrHTLCPreimage   = errors.New("Preimage doesn't match the HTLC hash")
+	ErrHTLCNotExpired = errors.New(
+		"Lock time of the refund is before the HTLC lock height")
+)
+
+// HTLC is a hash time-locked contract. Its output can be claimed by the
+// claim key with the SHA-256 preimage of Hash, or refunded to the refund
+// key in blocks after LockHeight.
+type HTLC struct {
+	Hash       []byte `json:"hash"`
+	ClaimKey   []byte `json:"claim_key"`
+	RefundKey  []byte `json:"refund_key"`
+	LockHeight uint32 `json:"lock_height"`
+}
+
+// Script returns the script of the HTLC output:
+//
+//	OP_IF
+//	  OP_SIZE 32 OP_EQUALVERIFY OP_SHA256 <hash> OP_EQUALVERIFY <claim key>
+//	OP_ELSE
+//	  <lock height> OP_CHECKLOCKTIMEVERIFY OP_DROP <refund key>
+//	OP_ENDIF OP_CHECKSIG
+func (h HTLC) Script() ([]byte, error) {
+	if len(h.Hash) != sha256.Size {
+		return nil, ErrHTLCHash
+	}
+	if len(h.ClaimKey) != ed25519.PublicKeySize ||
+		len(h.RefundKey) != ed25519.PublicKeySize {
+		return nil, ErrPublicKeyEncoding
+	}
+	if h.LockHeight == 0 || h.LockHeight >= LOCKTIME_THRESHOLD {
+		return nil, ErrHTLCLock
+	}
+	b := &ScriptBuilder{}
+	b.AddOp(OP_IF).AddOp(OP_SIZE).AddData(scriptNumber(HTLC_PREIMAGE_SIZE))
+	b.AddOp(OP_EQUALVERIFY).AddOp(OP_SHA256).AddData(h.Hash)
+	b.AddOp(OP_EQUALVERIFY).AddData(h.ClaimKey)
+	b.AddOp(OP_ELSE).AddData(scriptNumber(int64(h.LockHeight)))
+	b.AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).AddData(h.RefundKey)
+	return b.AddOp(OP_ENDIF).AddOp(OP_CHECKSIG).Script(), nil
+}
+
+// ParseHTLCScript returns the HTLC of a script built by HTLC.Script.
+func ParseHTLCScript(script []byte) (HTLC, error) {
+	instructions, err := parseScript(script)
+	if err != nil {
+		return HTLC{}, err
+	}
+	if len(instructions) != 15 {
+		return HTLC{}, ErrNotHTLC
+	}
+	lock, err := readScriptNumber(instructions[9].data, 4)
+	if err != nil {
+		return HTLC{}, ErrNotHTLC
+	}
+	h := HTLC{instructions[5].data, instructions[7].data,
+		instructions[12].data, uint32(lock)}
+	// everything but the fields has to be exactly as built
+	built, err := h.Script()
+	if err != nil || !bytes.Equal(built, script) {
+		return HTLC{}, ErrNotHTLC
+	}
+	return h, nil
+}
+
+// ClaimHTLC signs input index, which spends the HTLC output spent, with the
+// claim key and reveals preimage in its witness.
+func (t *Transaction) ClaimHTLC(privateKey ed25519.PrivateKey, index int,
+	spent Output, preimage []byte, hashType SigHashType) error {
+	h, err := ParseHTLCScript(spent.Script)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(preimage)
+	if len(preimage) != HTLC_PREIMAGE_SIZE || !bytes.Equal(hash[:], h.Hash) {
+		return ErrHTLCPreimage
+	}
+	signature, err := t.signHTLC(privateKey, h.ClaimKey, index, spent,
+		hashType)
+	if err != nil {
+		return err
+	}
+	t.Inputs[index].Witness = [][]byte{signature, preimage, []byte{1}}
+	return nil
+}
+
+// RefundHTLC signs input index, which spends the HTLC output spent, with the
+// refund key. The signature commits to the lock time, which has to be set
+// to at least the lock height before.
+func (t *Transaction) RefundHTLC(privateKey ed25519.PrivateKey, index int,
+	spent Output, hashType SigHashType) error {
+	h, err := ParseHTLCScript(spent.Script)
+	if err != nil {
+		return err
+	}
+	if t.LockTime < h.LockHeight || t.LockTime >= LOCKTIME_THRESHOLD {
+		return ErrHTLCNotExpired
+	}
+	signature, err := t.signHTLC(privateKey, h.RefundKey, index, spent,
+		hashType)
+	if err != nil {
+		return err
+	}
+	t.Inputs[index].Witness = [][]byte{signature, []byte{}}
+	return nil
+}
+
+func (t *Transaction) signHTLC(privateKey ed25519.PrivateKey,
+	publicKey []byte, index int, spent Output,
+	hashType SigHashType) ([]byte, error) {
+	if index < 0 || index >= len(t.Inputs) {
+		return nil, ErrInputIndex
+	}
+	if !bytes.Equal(privateKey.Public().(ed25519.PublicKey), publicKey) {
+		return nil, ErrHTLCKey
+	}
+	hash, err := t.SignatureHash(index, spent, hashType)
+	if err != nil {
+		return nil, err
+	}
+	return append(ed25519.Sign(privateKey, hash), byte(hashType)), nil
+}
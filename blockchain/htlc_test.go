@@ -0,0 +1,140 @@
+package blockchain
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"testing"
+)
+
+// htlcTransaction returns a transaction spending an HTLC output locked until
+// height 10, the output, its preimage and the claim and refund keys.
+func htlcTransaction(t *testing.T) (Transaction, Output, []byte,
+	ed25519.PrivateKey, ed25519.PrivateKey) {
+	claimKey, claim, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refundKey, refund, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	preimage := make([]byte, HTLC_PREIMAGE_SIZE)
+	rand.Read(preimage)
+	hash := sha256.Sum256(preimage)
+	script, err := HTLC{hash[:], claimKey, refundKey, 10}.Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spent := Output{[]byte{}, 50, script}
+	transaction := Transaction{[]byte{},
+		[]Input{Input{[]byte{}, []byte("input"), 0, nil, 0}},
+		[]Output{Output{claimKey, 50, []byte{}}}, 0}
+	return transaction, spent, preimage, claim, refund
+}
+
+func TestHTLCScript(t *testing.T) {
+	_, spent, preimage, claim, refund := htlcTransaction(t)
+	h, err := ParseHTLCScript(spent.Script)
+	assert.NoError(t, err)
+	hash := sha256.Sum256(preimage)
+	assert.Equal(t, HTLC{hash[:], []byte(claim.Public().(ed25519.PublicKey)),
+		[]byte(refund.Public().(ed25519.PublicKey)), 10}, h)
+
+	invalid := h
+	invalid.Hash = []byte("short")
+	_, err = invalid.Script()
+	assert.Equal(t, ErrHTLCHash, err)
+	invalid = h
+	invalid.RefundKey = []byte("short")
+	_, err = invalid.Script()
+	assert.Equal(t, ErrPublicKeyEncoding, err)
+	invalid = h
+	invalid.LockHeight = LOCKTIME_THRESHOLD
+	_, err = invalid.Script()
+	assert.Equal(t, ErrHTLCLock, err)
+
+	_, err = ParseHTLCScript(spent.Script[:len(spent.Script)-1])
+	assert.Equal(t, ErrNotHTLC, err)
+	script, err := MultisigScript(1, [][]byte{h.ClaimKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseHTLCScript(script)
+	assert.Equal(t, ErrNotHTLC, err)
+}
+
+func TestClaimHTLC(t *testing.T) {
+	transaction, spent, preimage, claim, refund := htlcTransaction(t)
+
+	wrong := make([]byte, HTLC_PREIMAGE_SIZE)
+	err := transaction.ClaimHTLC(claim, 0, spent, wrong, SIGHASH_ALL)
+	assert.Equal(t, ErrHTLCPreimage, err)
+	err = transaction.ClaimHTLC(refund, 0, spent, preimage, SIGHASH_ALL)
+	assert.Equal(t, ErrHTLCKey, err)
+
+	err = transaction.ClaimHTLC(claim, 0, spent, preimage, SIGHASH_ALL)
+	assert.NoError(t, err)
+	valid, err := transaction.Verify(spent, 0)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	// the preimage can't be swapped
+	transaction.Inputs[0].Witness[1] = wrong
+	assert.Equal(t, ErrScriptVerify, transaction.runScript(0, spent))
+}
+
+func TestClaimHTLCPreimageSize(t *testing.T) {
+	transaction, spent, _, claim, refund := htlcTransaction(t)
+	preimage := []byte("abc")
+	hash := sha256.Sum256(preimage)
+	script, err := HTLC{hash[:],
+		[]byte(claim.Public().(ed25519.PublicKey)),
+		[]byte(refund.Public().(ed25519.PublicKey)), 10}.Script()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spent.Script = script
+
+	err = transaction.ClaimHTLC(claim, 0, spent, preimage, SIGHASH_ALL)
+	assert.Equal(t, ErrHTLCPreimage, err)
+	signature, err := transaction.signHTLC(claim,
+		claim.Public().(ed25519.PublicKey), 0, spent, SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction.Inputs[0].Witness = [][]byte{signature, preimage, []byte{1}}
+	assert.Equal(t, ErrScriptVerify, transaction.runScript(0, spent))
+}
+
+func TestRefundHTLC(t *testing.T) {
+	transaction, spent, _, claim, refund := htlcTransaction(t)
+
+	err := transaction.RefundHTLC(refund, 0, spent, SIGHASH_ALL)
+	assert.Equal(t, ErrHTLCNotExpired, err)
+	transaction.LockTime = LOCKTIME_THRESHOLD + 10
+	err = transaction.RefundHTLC(refund, 0, spent, SIGHASH_ALL)
+	assert.Equal(t, ErrHTLCNotExpired, err)
+
+	transaction.LockTime = 10
+	err = transaction.RefundHTLC(claim, 0, spent, SIGHASH_ALL)
+	assert.Equal(t, ErrHTLCKey, err)
+	err = transaction.RefundHTLC(refund, 0, spent, SIGHASH_ALL)
+	assert.NoError(t, err)
+	valid, err := transaction.Verify(spent, 0)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+	assert.False(t, transaction.IsFinal(10, 0))
+	assert.True(t, transaction.IsFinal(11, 0))
+
+	// a refund signed with an earlier lock time fails the script
+	transaction.LockTime = 9
+	signature, err := transaction.signHTLC(refund,
+		refund.Public().(ed25519.PublicKey), 0, spent, SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction.Inputs[0].Witness = [][]byte{signature, []byte{}}
+	assert.Equal(t, ErrUnsatisfiedLockTime, transaction.runScript(0, spent))
+}
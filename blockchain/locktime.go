@@ -0,0 +1,292 @@
+package blockchain
+
+import (
+	"errors"
+	"github.com/InitialShape/cryptocurrency/storage"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// LOCKTIME_THRESHOLD separates lock times that are heights, below it,
+	// from those that are unix times.
+	LOCKTIME_THRESHOLD = 500000000
+	// SEQUENCE_TYPE_FLAG makes the relative lock of an input a time in
+	// units of 2^SEQUENCE_GRANULARITY seconds rather than a number of
+	// blocks. The lock itself is the sequence masked by
+	// SEQUENCE_LOCKTIME_MASK, other bits are ignored.
+	SEQUENCE_TYPE_FLAG     = 1 << 22
+	SEQUENCE_LOCKTIME_MASK = 0x0000ffff
+	SEQUENCE_GRANULARITY   = 9
+
+	// MEDIAN_TIME_SPAN is the number of blocks whose median timestamp is
+	// the median time past. A block's timestamp has to be later than the
+	// median time past of its previous block.
+	MEDIAN_TIME_SPAN = 11
+	// MAX_FUTURE_BLOCK_TIME is how many seconds a block's timestamp may be
+	// ahead of the node's clock.
+	MAX_FUTURE_BLOCK_TIME = 2 * 60 * 60
+	// GENESIS_TIMESTAMP is the timestamp of the genesis blocks.
+	GENESIS_TIMESTAMP = 1514764800
+
+	// MAX_HELD_TRANSACTIONS bounds the transactions held until their locks
+	// expire.
+	MAX_HELD_TRANSACTIONS = 1000
+)
+
+var (
+	ErrHeldFull            = errors.New("Too many transactions held for their locks")
+	ErrUnsatisfiedLockTime = errors.New("Lock time is before the script's")
+)
+
+// IsFinal reports whether the lock time of the transaction allows it in a
+// block at height whose previous block has the median time past
+// medianTime.
+func (t *Transaction) IsFinal(height int, medianTime int64) bool {
+	if t.LockTime == 0 {
+		return true
+	}
+	if t.LockTime < LOCKTIME_THRESHOLD {
+		return int64(t.LockTime) < int64(height)
+	}
+	return int64(t.LockTime) < medianTime
+}
+
+// checkLockTime verifies OP_CHECKLOCKTIMEVERIFY. The lock time of the
+// transaction has to be the same kind, a height or a time, as the top item
+// and at least as late. The item is left on the stack.
+func (e *engine) checkLockTime() error {
+	if len(e.stack) == 0 {
+		return ErrEmptyStack
+	}
+	lock, err := readScriptNumber(e.stack[len(e.stack)-1], 4)
+	if err != nil {
+		return err
+	}
+	lockTime := int64(e.transaction.LockTime)
+	if (lock < LOCKTIME_THRESHOLD) != (lockTime < LOCKTIME_THRESHOLD) ||
+		lock > lockTime {
+		return ErrUnsatisfiedLockTime
+	}
+	return nil
+}
+
+// MedianTime returns the median timestamp of headers.
+func MedianTime(headers []Header) int64 {
+	if len(headers) == 0 {
+		return 0
+	}
+	timestamps := make([]int64, len(headers))
+	for i, header := range headers {
+		timestamps[i] = header.Timestamp
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	return timestamps[len(timestamps)/2]
+}
+
+// NextTimestamp returns the timestamp for a block on top of one with the
+// median time past medianTime: now, unless that's too early.
+func NextTimestamp(medianTime int64) int64 {
+	now := time.Now().Unix()
+	if now <= medianTime {
+		return medianTime + 1
+	}
+	return now
+}
+
+// MedianTimePast returns the median timestamp of the block with hash and
+// the MEDIAN_TIME_SPAN - 1 blocks before it. Fewer blocks count near the
+// genesis block or the snapshot the chain was started from.
+func (s *Store) MedianTimePast(hash []byte) (int64, error) {
+	var headers []Header
+	for len(headers) < MEDIAN_TIME_SPAN && len(hash) > 0 {
+		header, err := s.GetHeader(hash)
+		if err == ErrNotFound && len(headers) > 0 {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		headers = append(headers, header)
+		hash = header.PreviousBlock
+	}
+	return MedianTime(headers), nil
+}
+
+// checkBlockTime verifies the timestamp of a block on top of previous.
+func (s *Store) checkBlockTime(block Block, previous []byte) (int64, error) {
+	medianTime, err := s.MedianTimePast(previous)
+	if err != nil {
+		return 0, err
+	}
+	if block.Timestamp <= medianTime {
+		return 0, invalidBlock(REASON_TIME_TOO_OLD,
+			"Block timestamp isn't after the median time past")
+	}
+	if block.Timestamp > time.Now().Unix()+MAX_FUTURE_BLOCK_TIME {
+		return 0, invalidBlock(REASON_TIME_TOO_NEW,
+			"Block timestamp too far in the future")
+	}
+	return medianTime, nil
+}
+
+// confirmation returns the header of the block that confirmed the
+// transaction with hash. Outputs of a snapshot count as confirmed by the
+// snapshot block.
+func (s *Store) confirmation(hash []byte) (Header, error) {
+	data, err := s.Get(TRANSACTIONS_BUCKET, hash)
+	if err == ErrNotFound {
+		info, err := s.Snapshot()
+		if err == ErrNotFound {
+			return Header{}, invalidTransaction(REASON_MISSING_INPUT,
+				"Input transaction doesn't exist")
+		} else if err != nil {
+			return Header{}, err
+		}
+		return s.GetHeader(info.Block)
+	} else if err != nil {
+		return Header{}, err
+	}
+	var entry transactionEntry
+	err = decode(data, &entry)
+	if err != nil {
+		return Header{}, err
+	}
+	return s.GetHeader(entry.Block)
+}
+
+// CheckLocks verifies that the lock time and the relative locks of the
+// inputs allow transaction in a block at height whose previous block has
+// the median time past medianTime. Transactions that aren't allowed yet
+// are rejected with REASON_NON_FINAL.
+func (s *Store) CheckLocks(transaction Transaction, height int,
+	medianTime int64) error {
+	if !transaction.IsFinal(height, medianTime) {
+		return invalidTransaction(REASON_NON_FINAL,
+			"Transaction is locked until its lock time")
+	}
+	for _, input := range transaction.Inputs {
+		lock := int64(input.Sequence & SEQUENCE_LOCKTIME_MASK)
+		if lock == 0 {
+			continue
+		}
+		confirmed, err := s.confirmation(input.TransactionHash)
+		if err != nil {
+			return err
+		}
+		if input.Sequence&SEQUENCE_TYPE_FLAG == 0 {
+			if int64(height) < int64(confirmed.Height)+lock {
+				return invalidTransaction(REASON_NON_FINAL,
+					"Input is locked for more blocks")
+			}
+			continue
+		}
+		confirmedTime, err := s.MedianTimePast(confirmed.Hash)
+		if err != nil {
+			return err
+		}
+		if medianTime < confirmedTime+lock<<SEQUENCE_GRANULARITY {
+			return invalidTransaction(REASON_NON_FINAL,
+				"Input is locked for more time")
+		}
+	}
+	return nil
+}
+
+// nextBlockLocks returns the height and median time past the locks of a
+// transaction entering the mempool are checked against, those of the next
+// block.
+func (s *Store) nextBlockLocks() (int, int64, error) {
+	root, err := s.GetRoot()
+	if err != nil {
+		return 0, 0, err
+	}
+	medianTime, err := s.MedianTimePast(root.Hash)
+	return root.Height + 1, medianTime, err
+}
+
+// holdTransaction keeps a transaction that isn't final yet until it is.
+func (s *Store) holdTransaction(transaction Transaction, data []byte) error {
+	return s.DB.Update(func(tx storage.Tx) error {
+		held, err := tx.CreateBucketIfNotExists(HELD_BUCKET)
+		if err != nil {
+			return err
+		}
+		if held.Get(transaction.Hash) != nil {
+			return nil
+		}
+		count := 0
+		err = held.ForEach(func(k, v []byte) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if count >= MAX_HELD_TRANSACTIONS {
+			return ErrHeldFull
+		}
+		log.Println("Holding transaction until its locks expire")
+		return held.Put(transaction.Hash, data)
+	})
+}
+
+// GetHeldTransactions returns the transactions held for their locks.
+func (s *Store) GetHeldTransactions() ([]Transaction, error) {
+	var transactions []Transaction
+	err := s.DB.View(func(tx storage.Tx) error {
+		b := tx.Bucket(HELD_BUCKET)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			transaction, err := DecodeTransaction(v)
+			if err != nil {
+				return err
+			}
+			transactions = append(transactions, transaction)
+			return nil
+		})
+	})
+	return transactions, err
+}
+
+// releaseHeld moves the held transactions that are final for the next
+// block into the mempool. Those that became invalid are dropped.
+func (s *Store) releaseHeld() error {
+	transactions, err := s.GetHeldTransactions()
+	if err != nil || len(transactions) == 0 {
+		return err
+	}
+	height, medianTime, err := s.nextBlockLocks()
+	if err != nil {
+		return err
+	}
+	for _, transaction := range transactions {
+		_, err = s.Get(TRANSACTIONS_BUCKET, transaction.Hash)
+		if err == nil {
+			err = ErrTransactionExists
+		} else if err == ErrNotFound {
+			err = s.CheckLocks(transaction, height, medianTime)
+		}
+		if ReasonOf(err) == REASON_NON_FINAL {
+			continue
+		}
+		deleteErr := s.Delete(HELD_BUCKET, transaction.Hash)
+		if deleteErr != nil {
+			return deleteErr
+		}
+		if err != nil {
+			log.Println("Dropping held transaction", err)
+			continue
+		}
+		log.Println("Releasing held transaction into the mempool")
+		err = s.AddTransaction(transaction)
+		if err != nil {
+			log.Println("Error releasing held transaction", err)
+		}
+	}
+	return nil
+}
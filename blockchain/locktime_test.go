@@ -0,0 +1,265 @@
+package blockchain_test
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/miner"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"testing"
+	"time"
+)
+
+// mineBlockAt searches a block on top of previous with timestamp.
+func mineBlockAt(previous blockchain.Block, timestamp int64,
+	transactions []blockchain.Transaction) blockchain.Block {
+	block, err := miner.SearchBlock(context.Background(), coinbaseKey,
+		previous.Height+1, previous.Difficulty,
+		blockchain.RegTestParams.CoinbaseAmount, previous.Hash, timestamp,
+		transactions)
+	if err != nil {
+		panic(err)
+	}
+	return block
+}
+
+// lockedSpend spends the first output of spent, which belongs to
+// privateKey, with the lock time and the sequence given. It returns the key
+// of the new output.
+func lockedSpend(t *testing.T, spent blockchain.Transaction,
+	privateKey ed25519.PrivateKey, lockTime uint32,
+	sequence uint32) (blockchain.Transaction, ed25519.PrivateKey) {
+	publicKey, newKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction := blockchain.Transaction{[]byte{},
+		[]blockchain.Input{blockchain.Input{[]byte{}, spent.Hash, 0, nil,
+			sequence}},
+		[]blockchain.Output{blockchain.Output{publicKey, 10, []byte{}}},
+		lockTime}
+	transaction.Hash, err = transaction.GetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transaction.Sign(privateKey, 0, spent.Outputs[0],
+		blockchain.SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transaction, newKey
+}
+
+// spendLocked spends the coinbase of block with the lock time and the
+// sequence given.
+func spendLocked(t *testing.T, block blockchain.Block, lockTime uint32,
+	sequence uint32) blockchain.Transaction {
+	privateKey := coinbaseKey
+	transaction, _ := lockedSpend(t, block.Transactions[0], privateKey,
+		lockTime, sequence)
+	return transaction
+}
+
+func TestIsFinal(t *testing.T) {
+	transaction := blockchain.Transaction{}
+	assert.True(t, transaction.IsFinal(0, 0))
+
+	transaction.LockTime = 10
+	assert.False(t, transaction.IsFinal(10, 0))
+	assert.True(t, transaction.IsFinal(11, 0))
+
+	transaction.LockTime = blockchain.LOCKTIME_THRESHOLD + 10
+	medianTime := int64(blockchain.LOCKTIME_THRESHOLD + 10)
+	assert.False(t, transaction.IsFinal(1000000, medianTime))
+	assert.True(t, transaction.IsFinal(0, medianTime+1))
+}
+
+func TestMedianTime(t *testing.T) {
+	assert.Equal(t, int64(0), blockchain.MedianTime(nil))
+	headers := []blockchain.Header{{Timestamp: 5}, {Timestamp: 1},
+		{Timestamp: 3}, {Timestamp: 9}}
+	assert.Equal(t, int64(5), blockchain.MedianTime(headers))
+	assert.Equal(t, int64(3), blockchain.MedianTime(headers[:3]))
+}
+
+func TestBlockTimestamp(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	genesis := store.Params.GenesisBlock
+
+	block := mineBlockAt(genesis, genesis.Timestamp, nil)
+	err := store.AddBlock(block)
+	assert.Equal(t, blockchain.REASON_TIME_TOO_OLD, blockchain.ReasonOf(err))
+
+	future := time.Now().Unix() + blockchain.MAX_FUTURE_BLOCK_TIME + 60
+	block = mineBlockAt(genesis, future, nil)
+	err = store.AddBlock(block)
+	assert.Equal(t, blockchain.REASON_TIME_TOO_NEW, blockchain.ReasonOf(err))
+
+	// timestamps needn't increase, they have to pass the median
+	previous := genesis
+	for i := 1; i <= 3; i++ {
+		previous = mineBlockAt(previous, genesis.Timestamp+int64(10*i), nil)
+		assert.NoError(t, store.AddBlock(previous))
+	}
+	medianTime, err := store.MedianTimePast(previous.Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, genesis.Timestamp+20, medianTime)
+	block = mineBlockAt(previous, genesis.Timestamp+21, nil)
+	assert.NoError(t, store.AddBlock(block))
+	block = mineBlockAt(previous, genesis.Timestamp+20, nil)
+	err = store.AddBlock(block)
+	assert.Equal(t, blockchain.REASON_TIME_TOO_OLD, blockchain.ReasonOf(err))
+}
+
+func TestHeightLockTime(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	first := mineBlock(store.Params.GenesisBlock, nil)
+	assert.NoError(t, store.AddBlock(first))
+	transaction := spendLocked(t, first, 3, 0)
+
+	// the next block has height 2, the transaction is held
+	assert.NoError(t, store.AddTransaction(transaction))
+	mempool, err := store.GetTransactions()
+	assert.NoError(t, err)
+	assert.Empty(t, mempool)
+	held, err := store.GetHeldTransactions()
+	assert.NoError(t, err)
+	assert.Len(t, held, 1)
+
+	block := mineBlock(first, []blockchain.Transaction{transaction})
+	err = store.AddBlock(block)
+	assert.Equal(t, blockchain.REASON_NON_FINAL, blockchain.ReasonOf(err))
+
+	second := mineBlock(first, nil)
+	assert.NoError(t, store.AddBlock(second))
+	third := mineBlock(second, nil)
+	assert.NoError(t, store.AddBlock(third))
+
+	// it's released once the next block may include it
+	mempool, err = store.GetTransactions()
+	assert.NoError(t, err)
+	assert.Equal(t, []blockchain.Transaction{transaction}, mempool)
+	held, err = store.GetHeldTransactions()
+	assert.NoError(t, err)
+	assert.Empty(t, held)
+
+	block = mineBlock(third, []blockchain.Transaction{transaction})
+	assert.NoError(t, store.AddBlock(block))
+}
+
+func TestTimeLockTime(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	genesis := store.Params.GenesisBlock
+
+	first := mineBlock(genesis, nil)
+	assert.NoError(t, store.AddBlock(first))
+	lockTime := uint32(genesis.Timestamp + 500)
+	transaction := spendLocked(t, first, lockTime, 0)
+	assert.NoError(t, store.AddTransaction(transaction))
+
+	// the median time past has to pass the lock time, the timestamp of
+	// the block itself doesn't count
+	previous := first
+	for i := 1; i <= 2; i++ {
+		block := mineBlockAt(previous, genesis.Timestamp+int64(1000*i),
+			[]blockchain.Transaction{transaction})
+		err := store.AddBlock(block)
+		assert.Equal(t, blockchain.REASON_NON_FINAL,
+			blockchain.ReasonOf(err))
+		previous = mineBlockAt(previous, block.Timestamp, nil)
+		assert.NoError(t, store.AddBlock(previous))
+	}
+	held, err := store.GetHeldTransactions()
+	assert.NoError(t, err)
+	assert.Empty(t, held)
+	block := mineBlockAt(previous, previous.Timestamp+1,
+		[]blockchain.Transaction{transaction})
+	assert.NoError(t, store.AddBlock(block))
+}
+
+// confirmParent mines a block on top of a new first block that spends its
+// coinbase. Coinbases share their hash, their confirmation is ambiguous.
+func confirmParent(t *testing.T, store blockchain.Store,
+	timestamp int64) (blockchain.Block, blockchain.Transaction,
+	ed25519.PrivateKey) {
+	first := mineBlock(store.Params.GenesisBlock, nil)
+	assert.NoError(t, store.AddBlock(first))
+	privateKey := coinbaseKey
+	parent, key := lockedSpend(t, first.Transactions[0], privateKey, 0, 0)
+	second := mineBlockAt(first, timestamp,
+		[]blockchain.Transaction{parent})
+	assert.NoError(t, store.AddBlock(second))
+	return second, parent, key
+}
+
+func TestRelativeHeightLock(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	// the parent is confirmed at height 2
+	second, parent, key := confirmParent(t, store,
+		store.Params.GenesisBlock.Timestamp+2)
+	transaction, _ := lockedSpend(t, parent, key, 0, 2)
+	block := mineBlock(second, []blockchain.Transaction{transaction})
+	err := store.AddBlock(block)
+	assert.Equal(t, blockchain.REASON_NON_FINAL, blockchain.ReasonOf(err))
+
+	third := mineBlock(second, nil)
+	assert.NoError(t, store.AddBlock(third))
+	block = mineBlock(third, []blockchain.Transaction{transaction})
+	assert.NoError(t, store.AddBlock(block))
+}
+
+func TestRelativeTimeLock(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	genesis := store.Params.GenesisBlock
+
+	// the median time past of the parent's block is genesis + 1
+	second, parent, key := confirmParent(t, store, genesis.Timestamp+2)
+	transaction, _ := lockedSpend(t, parent, key, 0,
+		blockchain.SEQUENCE_TYPE_FLAG|1)
+
+	previous := second
+	for _, timestamp := range []int64{1000, 1001} {
+		previous = mineBlockAt(previous, genesis.Timestamp+timestamp, nil)
+		assert.NoError(t, store.AddBlock(previous))
+	}
+	block := mineBlock(previous, []blockchain.Transaction{transaction})
+	err := store.AddBlock(block)
+	assert.Equal(t, blockchain.REASON_NON_FINAL, blockchain.ReasonOf(err))
+
+	// now it's genesis + 1000, more than 512 seconds later
+	previous = mineBlock(previous, nil)
+	assert.NoError(t, store.AddBlock(previous))
+	block = mineBlock(previous, []blockchain.Transaction{transaction})
+	assert.NoError(t, store.AddBlock(block))
+}
+
+func TestSignatureCommitsToLocks(t *testing.T) {
+	first := mineBlock(blockchain.RegTestParams.GenesisBlock, nil)
+	spent := first.Transactions[0].Outputs[0]
+	transaction := spendLocked(t, first, 100, 5)
+	valid, err := transaction.Verify(spent, 0)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	changed := spendLocked(t, first, 100, 5)
+	changed.LockTime = 99
+	valid, err = changed.Verify(spent, 0)
+	assert.False(t, valid)
+	assert.Equal(t, blockchain.REASON_INVALID_SIGNATURE,
+		blockchain.ReasonOf(err))
+
+	changed = spendLocked(t, first, 100, 5)
+	changed.Inputs[0].Sequence = 0
+	valid, err = changed.Verify(spent, 0)
+	assert.False(t, valid)
+	assert.Equal(t, blockchain.REASON_INVALID_SIGNATURE,
+		blockchain.ReasonOf(err))
+}
@@ -0,0 +1,209 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// MAX_MULTISIG_KEYS is the most keys OP_CHECKMULTISIG checks signatures
+// against.
+const MAX_MULTISIG_KEYS = 16
+
+var (
+	ErrMultisigKeys      = errors.New("Invalid number of multisig keys")
+	ErrMultisigThreshold = errors.New("Invalid multisig threshold")
+	ErrSignatureOrder    = errors.New("Multisig signatures out of order")
+	ErrNotMultisig       = errors.New("Not a multisig script")
+	ErrUnknownKey        = errors.New("Key isn't part of the multisig script")
+	ErrMissingSignatures = errors.New("Not enough multisig signatures")
+)
+
+// MultisigScript returns the script of an output that m of publicKeys have
+// to sign to spend: OP_m <key>... OP_n OP_CHECKMULTISIG.
+func MultisigScript(m int, publicKeys [][]byte) ([]byte, error) {
+	if len(publicKeys) < 1 || len(publicKeys) > MAX_MULTISIG_KEYS {
+		return nil, ErrMultisigKeys
+	}
+	if m < 1 || m > len(publicKeys) {
+		return nil, ErrMultisigThreshold
+	}
+	b := &ScriptBuilder{}
+	b.AddInt(m)
+	for _, publicKey := range publicKeys {
+		if len(publicKey) != ed25519.PublicKeySize {
+			return nil, ErrPublicKeyEncoding
+		}
+		b.AddData(publicKey)
+	}
+	return b.AddInt(len(publicKeys)).AddOp(OP_CHECKMULTISIG).Script(), nil
+}
+
+// ParseMultisigScript returns the threshold and the keys of a script built
+// by MultisigScript.
+func ParseMultisigScript(script []byte) (int, [][]byte, error) {
+	instructions, err := parseScript(script)
+	if err != nil {
+		return 0, nil, err
+	}
+	count := len(instructions)
+	if count < 4 || instructions[count-1].op != OP_CHECKMULTISIG {
+		return 0, nil, ErrNotMultisig
+	}
+	small := func(ins instruction) int {
+		if ins.op < OP_1 || ins.op > OP_16 {
+			return 0
+		}
+		return int(ins.op-OP_1) + 1
+	}
+	m := small(instructions[0])
+	n := small(instructions[count-2])
+	if n != count-3 || m < 1 || m > n {
+		return 0, nil, ErrNotMultisig
+	}
+	var publicKeys [][]byte
+	for _, ins := range instructions[1 : count-2] {
+		if !ins.op.isPush() || len(ins.data) != ed25519.PublicKeySize {
+			return 0, nil, ErrNotMultisig
+		}
+		publicKeys = append(publicKeys, ins.data)
+	}
+	return m, publicKeys, nil
+}
+
+// SignMultisig signs input index, which spends the multisig output spent,
+// with privateKey. The signature is prefixed with the index of the key in
+// the script and added to the witness, which is kept ordered by key. A key
+// that already signed replaces its signature.
+func (t *Transaction) SignMultisig(privateKey ed25519.PrivateKey, index int,
+	spent Output, hashType SigHashType) error {
+	_, publicKeys, err := ParseMultisigScript(spent.Script)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(t.Inputs) {
+		return ErrInputIndex
+	}
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	keyIndex := -1
+	for i, key := range publicKeys {
+		if bytes.Equal(key, publicKey) {
+			keyIndex = i
+			break
+		}
+	}
+	if keyIndex < 0 {
+		return ErrUnknownKey
+	}
+
+	hash, err := t.SignatureHash(index, spent, hashType)
+	if err != nil {
+		return err
+	}
+	signature := append([]byte{byte(keyIndex)},
+		ed25519.Sign(privateKey, hash)...)
+	signature = append(signature, byte(hashType))
+
+	var witness [][]byte
+	for _, item := range t.Inputs[index].Witness {
+		if len(item) > 0 && int(item[0]) == keyIndex {
+			continue
+		}
+		if signature != nil && len(item) > 0 && int(item[0]) > keyIndex {
+			witness = append(witness, signature)
+			signature = nil
+		}
+		witness = append(witness, item)
+	}
+	if signature != nil {
+		witness = append(witness, signature)
+	}
+	t.Inputs[index].Witness = witness
+	return nil
+}
+
+// FinalizeMultisig drops the signatures input index carries beyond the
+// threshold of the multisig output spent, which the script doesn't take.
+func (t *Transaction) FinalizeMultisig(index int, spent Output) error {
+	m, _, err := ParseMultisigScript(spent.Script)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= len(t.Inputs) {
+		return ErrInputIndex
+	}
+	witness := t.Inputs[index].Witness
+	if len(witness) < m {
+		return ErrMissingSignatures
+	}
+	t.Inputs[index].Witness = witness[:m]
+	return nil
+}
+
+func (e *engine) popNumber() (int, error) {
+	item, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	n, err := readScriptNumber(item, 1)
+	return int(n), err
+}
+
+// checkMultisig verifies the signatures of OP_CHECKMULTISIG. It takes the
+// number of keys n, the keys, the threshold m and m signatures off the
+// stack. Each signature is prefixed with the index of its key and they are
+// in the order of their keys, so no key signs twice. An empty signature is
+// false, any other one that doesn't verify fails the script.
+func (e *engine) checkMultisig() (bool, error) {
+	n, err := e.popNumber()
+	if err != nil {
+		return false, err
+	}
+	if n < 1 || n > MAX_MULTISIG_KEYS {
+		return false, ErrMultisigKeys
+	}
+	publicKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		publicKeys[i], err = e.pop()
+		if err != nil {
+			return false, err
+		}
+	}
+	m, err := e.popNumber()
+	if err != nil {
+		return false, err
+	}
+	if m < 1 || m > n {
+		return false, ErrMultisigThreshold
+	}
+	signatures := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		signatures[i], err = e.pop()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	valid := true
+	last := -1
+	for _, signature := range signatures {
+		if len(signature) == 0 {
+			valid = false
+			continue
+		}
+		keyIndex := int(signature[0])
+		if keyIndex >= n || len(signature) == 1 {
+			return false, ErrSignatureEncoding
+		}
+		if keyIndex <= last {
+			return false, ErrSignatureOrder
+		}
+		last = keyIndex
+		ok, err := e.checkSig(signature[1:], publicKeys[keyIndex])
+		if err != nil {
+			return false, err
+		}
+		valid = valid && ok
+	}
+	return valid, nil
+}
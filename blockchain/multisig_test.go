@@ -0,0 +1,139 @@
+package blockchain
+
+import (
+	"crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"testing"
+)
+
+// multisigTransaction returns a transaction spending a 2-of-3 multisig
+// output, the output and its keys.
+func multisigTransaction(t *testing.T) (Transaction, Output,
+	[]ed25519.PrivateKey) {
+	var publicKeys [][]byte
+	var keys []ed25519.PrivateKey
+	for i := 0; i < 3; i++ {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKeys = append(publicKeys, publicKey)
+		keys = append(keys, privateKey)
+	}
+	script, err := MultisigScript(2, publicKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spent := Output{[]byte{}, 50, script}
+	transaction := Transaction{[]byte{},
+		[]Input{Input{[]byte{}, []byte("input"), 0, nil, 0}},
+		[]Output{Output{publicKeys[0], 50, []byte{}}}, 0}
+	return transaction, spent, keys
+}
+
+func TestMultisigScript(t *testing.T) {
+	_, spent, keys := multisigTransaction(t)
+	m, publicKeys, err := ParseMultisigScript(spent.Script)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, m)
+	if assert.Len(t, publicKeys, 3) {
+		assert.Equal(t, []byte(keys[2].Public().(ed25519.PublicKey)),
+			publicKeys[2])
+	}
+
+	_, err = MultisigScript(0, publicKeys)
+	assert.Equal(t, ErrMultisigThreshold, err)
+	_, err = MultisigScript(4, publicKeys)
+	assert.Equal(t, ErrMultisigThreshold, err)
+	_, err = MultisigScript(1, nil)
+	assert.Equal(t, ErrMultisigKeys, err)
+	_, err = MultisigScript(1, make([][]byte, MAX_MULTISIG_KEYS+1))
+	assert.Equal(t, ErrMultisigKeys, err)
+	_, err = MultisigScript(1, [][]byte{[]byte("short")})
+	assert.Equal(t, ErrPublicKeyEncoding, err)
+
+	script, err := ParseScript("OP_1 aabb OP_1 OP_CHECKMULTISIG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ParseMultisigScript(script)
+	assert.Equal(t, ErrNotMultisig, err)
+	_, _, err = ParseMultisigScript(spent.Script[:len(spent.Script)-1])
+	assert.Equal(t, ErrNotMultisig, err)
+}
+
+func TestSpendMultisig(t *testing.T) {
+	transaction, spent, keys := multisigTransaction(t)
+
+	// co-signers sign in any order, the witness stays ordered by key
+	err := transaction.SignMultisig(keys[2], 0, spent, SIGHASH_ALL)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrMissingSignatures,
+		transaction.FinalizeMultisig(0, spent))
+	valid, err := transaction.Verify(spent, 0)
+	assert.False(t, valid)
+	assert.Equal(t, REASON_SCRIPT_FAILED, ReasonOf(err))
+
+	err = transaction.SignMultisig(keys[0], 0, spent, SIGHASH_ALL)
+	assert.NoError(t, err)
+	witness := transaction.Inputs[0].Witness
+	if assert.Len(t, witness, 2) {
+		assert.Equal(t, byte(0), witness[0][0])
+		assert.Equal(t, byte(2), witness[1][0])
+	}
+	assert.NoError(t, transaction.FinalizeMultisig(0, spent))
+	valid, err = transaction.Verify(spent, 0)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	// signing again replaces the signature
+	err = transaction.SignMultisig(keys[0], 0, spent, SIGHASH_ALL)
+	assert.NoError(t, err)
+	assert.Len(t, transaction.Inputs[0].Witness, 2)
+
+	// the script takes exactly the threshold
+	err = transaction.SignMultisig(keys[1], 0, spent, SIGHASH_ALL)
+	assert.NoError(t, err)
+	assert.Len(t, transaction.Inputs[0].Witness, 3)
+	valid, err = transaction.Verify(spent, 0)
+	assert.False(t, valid)
+	assert.Equal(t, REASON_SCRIPT_FAILED, ReasonOf(err))
+	assert.NoError(t, transaction.FinalizeMultisig(0, spent))
+	valid, err = transaction.Verify(spent, 0)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	_, stranger, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transaction.SignMultisig(stranger, 0, spent, SIGHASH_ALL)
+	assert.Equal(t, ErrUnknownKey, err)
+	err = transaction.SignMultisig(keys[0], 1, spent, SIGHASH_ALL)
+	assert.Equal(t, ErrInputIndex, err)
+}
+
+func TestMultisigSignatureOrder(t *testing.T) {
+	transaction, spent, keys := multisigTransaction(t)
+	err := transaction.SignMultisig(keys[0], 0, spent, SIGHASH_ALL)
+	assert.NoError(t, err)
+	err = transaction.SignMultisig(keys[1], 0, spent, SIGHASH_ALL)
+	assert.NoError(t, err)
+	witness := transaction.Inputs[0].Witness
+
+	cases := []struct {
+		witness [][]byte
+		err     error
+	}{
+		{[][]byte{witness[1], witness[0]}, ErrSignatureOrder},
+		{[][]byte{witness[0], witness[0]}, ErrSignatureOrder},
+		// a valid signature claiming another key
+		{[][]byte{witness[0], append([]byte{2}, witness[1][1:]...)},
+			ErrNullFail},
+	}
+	for _, c := range cases {
+		transaction.Inputs[0].Witness = c.witness
+		assert.Equal(t, c.err, transaction.runScript(0, spent))
+	}
+}
@@ -0,0 +1,104 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/mr-tron/base58/base58"
+)
+
+// ChainParams holds everything that makes up a network: the genesis block
+// every node starts from, the magic prefixed to each p2p message, the seed
+// peers and the consensus rules.
+type ChainParams struct {
+	Name           string   `json:"name"`
+	Magic          uint32   `json:"magic"`
+	Seeds          []string `json:"seeds"`
+	GenesisBlock   Block    `json:"genesis_block"`
+	GenesisHash    []byte   `json:"genesis_hash"`
+	CoinbaseAmount int      `json:"coinbase_amount"`
+	// Difficulty is the number of leading zero bits the hash of every block
+	// has to have. The genesis block declares it too, but is fixed by its
+	// hash instead.
+	Difficulty int `json:"difficulty"`
+	// AddressPrefix is the first byte of the network's addresses, see the
+	// address package.
+	AddressPrefix byte `json:"address_prefix"`
+	// GenerateBlocks allows blocks to be generated on demand through the
+	// API, which is only sensible on a private regression test network.
+	GenerateBlocks bool `json:"generate_blocks"`
+}
+
+var MainNetParams = ChainParams{
+	Name:           "mainnet",
+	Magic:          0xf3c0a1e5,
+	Seeds:          []string{"52.29.168.57:1234"},
+	GenesisBlock:   decodeGenesisBlock(mainNetGenesisBlock),
+	GenesisHash:    mustDecodeHash(mainNetGenesisHash),
+	CoinbaseAmount: 25,
+	Difficulty:     20,
+	AddressPrefix:  0x4c,
+}
+
+var TestNetParams = ChainParams{
+	Name:           "testnet",
+	Magic:          0x74e5c0a1,
+	Seeds:          []string{},
+	GenesisBlock:   decodeGenesisBlock(testNetGenesisBlock),
+	GenesisHash:    mustDecodeHash(testNetGenesisHash),
+	CoinbaseAmount: 25,
+	Difficulty:     16,
+	AddressPrefix:  0xb2,
+}
+
+// RegTestParams describe a local network for integration tests. Its
+// difficulty is trivial and it has no seeds.
+var RegTestParams = ChainParams{
+	Name:           "regtest",
+	Magic:          0x5e9e7e57,
+	Seeds:          []string{},
+	GenesisBlock:   decodeGenesisBlock(regTestGenesisBlock),
+	GenesisHash:    mustDecodeHash(regTestGenesisHash),
+	CoinbaseAmount: 25,
+	Difficulty:     1,
+	AddressPrefix:  0xa5,
+	GenerateBlocks: true,
+}
+
+func ParamsForNetwork(name string) (*ChainParams, error) {
+	switch name {
+	case MainNetParams.Name:
+		return &MainNetParams, nil
+	case TestNetParams.Name:
+		return &TestNetParams, nil
+	case RegTestParams.Name:
+		return &RegTestParams, nil
+	}
+	return nil, fmt.Errorf("Unknown network %q", name)
+}
+
+// VerifyGenesisBlock checks that the serialized genesis block hashes to the
+// network's genesis hash and has the network's difficulty.
+func (p *ChainParams) VerifyGenesisBlock() error {
+	hash, err := p.GenesisBlock.GetHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, p.GenesisHash) ||
+		!bytes.Equal(p.GenesisBlock.Hash, p.GenesisHash) {
+		return fmt.Errorf("Genesis block of %s doesn't match its hash %s",
+			p.Name, base58.Encode(p.GenesisHash))
+	}
+	if p.GenesisBlock.Difficulty != p.Difficulty {
+		return fmt.Errorf("Genesis block of %s doesn't have its difficulty "+
+			"%d", p.Name, p.Difficulty)
+	}
+	return nil
+}
+
+func mustDecodeHash(hash string) []byte {
+	decoded, err := base58.Decode(hash)
+	if err != nil {
+		panic(err)
+	}
+	return decoded
+}
@@ -0,0 +1,45 @@
+package blockchain
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGenesisBlocks(t *testing.T) {
+	for _, params := range []*ChainParams{&MainNetParams, &TestNetParams,
+		&RegTestParams} {
+		assert.NoError(t, params.VerifyGenesisBlock(), params.Name)
+		assert.Equal(t, 0, params.GenesisBlock.Height)
+		assert.Empty(t, params.GenesisBlock.PreviousBlock)
+	}
+}
+
+func TestVerifyTamperedGenesisBlock(t *testing.T) {
+	params := RegTestParams
+	params.GenesisBlock.Nonce++
+	assert.Error(t, params.VerifyGenesisBlock())
+}
+
+func TestVerifyGenesisBlockOfOtherDifficulty(t *testing.T) {
+	params := RegTestParams
+	params.Difficulty = 2
+	assert.Error(t, params.VerifyGenesisBlock())
+}
+
+func TestParamsForNetwork(t *testing.T) {
+	params, err := ParamsForNetwork("testnet")
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, &TestNetParams, params)
+
+	_, err = ParamsForNetwork("moonnet")
+	assert.Error(t, err)
+}
+
+func TestAddressPrefixes(t *testing.T) {
+	// addresses of different networks can't be mixed up
+	assert.NotEqual(t, MainNetParams.AddressPrefix, TestNetParams.AddressPrefix)
+	assert.NotEqual(t, MainNetParams.AddressPrefix, RegTestParams.AddressPrefix)
+	assert.NotEqual(t, TestNetParams.AddressPrefix, RegTestParams.AddressPrefix)
+}
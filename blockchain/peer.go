@@ -1,126 +1,249 @@
 package blockchain
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
-	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	CONN_TYPE = "tcp"
+	CONN_TYPE          = "tcp"
+	CONN_TIMEOUT       = 10 * time.Second
+	HEARTBEAT_INTERVAL = 15 * time.Second
+	MAX_MESSAGE_SIZE   = 32 << 20
+	// HOST_QUORUM is how many distinct peers have to report the same host
+	// before it's advertised.
+	HOST_QUORUM = 3
 )
 
+// Peer is the p2p side of a node. ListenAddress is what the listener binds
+// to, AdvertiseAddress is what gets announced to other peers. If the
+// advertise host is left empty (e.g. ":1234") it's learned from the PONG
+// replies of remote peers once HOST_QUORUM of them agree. Until then the peer
+// simply doesn't announce itself.
 type Peer struct {
-	Port  string
-	Host  string
-	Store Store
+	ListenAddress    string
+	AdvertiseAddress string
+	Seeds            []string
+	Store            Store
+
+	mutex        sync.Mutex
+	observedHost string
+	hostReports  map[string]string
+	listener     net.Listener
+	cancel       context.CancelFunc
+	stopped      bool
+	wg           sync.WaitGroup
 }
 
-func (p *Peer) RegisterDefaultPeers() error {
-	file, err := os.Open("peers.txt")
+func (p *Peer) RegisterDefaultPeers() {
+	for _, peer := range p.Seeds {
+		p.RegisterPeer(peer)
+	}
+}
+
+// Start binds the listener and then serves peers, discovers new ones and
+// checks their heartbeat in the background until ctx is cancelled or Stop
+// is called.
+func (p *Peer) Start(ctx context.Context) error {
+	listener, err := net.Listen(CONN_TYPE, p.ListenAddress)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
+	log.Printf("Peer is listening on %s\n", listener.Addr().String())
 
-	for scanner.Scan() {
-		peer := scanner.Text()
-		p.RegisterPeer(peer)
+	// an advertised port of 0 stands for whatever port we were given
+	host, port, err := net.SplitHostPort(p.AdvertiseAddress)
+	if err == nil && port == "0" {
+		_, port, _ = net.SplitHostPort(listener.Addr().String())
+		p.AdvertiseAddress = net.JoinHostPort(host, port)
 	}
-	return err
-}
 
-func (p *Peer) Start() {
+	ctx, cancel := context.WithCancel(ctx)
+	p.mutex.Lock()
+	p.listener = listener
+	p.cancel = cancel
+	p.mutex.Unlock()
+
 	p.RegisterDefaultPeers()
-	go p.Discovery()
-	address := fmt.Sprintf(":%s", p.Port)
-	listener, err := net.Listen(CONN_TYPE, address)
-	if err != nil {
-		log.Fatal("Error listening: ", err)
+	p.spawn(func() { p.Discovery(ctx) })
+	p.spawn(func() { p.CheckHeartBeat(ctx) })
+	p.spawn(func() {
+		<-ctx.Done()
+		listener.Close()
+	})
+	p.spawn(func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Println("Error accepting connection: ", err)
+				continue
+			}
+
+			p.spawn(func() { p.Handle(conn) })
+		}
+	})
+	return nil
+}
+
+// Stop closes the listener and waits for open connections and gossip to
+// finish.
+func (p *Peer) Stop() {
+	p.mutex.Lock()
+	cancel := p.cancel
+	p.stopped = true
+	p.mutex.Unlock()
+
+	if cancel != nil {
+		cancel()
 	}
-	defer listener.Close()
-	log.Printf("Peer is listening on %s:%s\n", p.Host, p.Port)
+	p.wg.Wait()
+}
 
-	go p.CheckHeartBeat()
+// ListenerAddress returns the address the listener is bound to.
+func (p *Peer) ListenerAddress() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.listener == nil {
+		return ""
+	}
+	return p.listener.Addr().String()
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Println("Error accepting connection: ", err)
-		}
+// spawn runs f in the background, unless the peer is stopping, and lets
+// Stop wait for it.
+func (p *Peer) spawn(f func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stopped {
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		f()
+	}()
+}
+
+// dial connects to a peer. Peers that can't be reached are removed.
+func (p *Peer) dial(peer string) (net.Conn, error) {
+	conn, err := net.DialTimeout(CONN_TYPE, peer, CONN_TIMEOUT)
+	if err != nil {
+		log.Println("Error dialing peer, deleting peer: ", peer, err)
+		p.Store.DeletePeer(peer)
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(CONN_TIMEOUT))
+	return conn, nil
+}
 
-		go p.Handle(conn)
+// send writes a message to a peer and closes the write side of the
+// connection, which marks the end of the message.
+func (p *Peer) send(conn net.Conn, message []byte) error {
+	_, err := conn.Write(message)
+	if err != nil {
+		return err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		return tcp.CloseWrite()
 	}
+	return nil
 }
 
 func (p *Peer) Handle(conn net.Conn) {
-	buf := make([]byte, 1024)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CONN_TIMEOUT))
 
-	n, err := conn.Read(buf)
+	data, err := ioutil.ReadAll(io.LimitReader(conn, MAX_MESSAGE_SIZE))
 	if err != nil {
 		log.Println("Error reading: ", err)
+		return
 	}
 
-	req := string(buf[:n])
+	req := string(data)
 	resp := []byte{}
 
 	log.Printf("Received message from: %s %s\n", conn.RemoteAddr().String(), req)
 
-	if strings.Contains(req, "PING") {
-		peers := strings.Split(req, " ")
-		if len(peers) > 1 {
-			p.RegisterPeer(peers[1])
-		}
-		resp = p.Pong()
+	magic := string(p.message(""))
+	if !strings.HasPrefix(req, magic) {
+		log.Println("Ignoring message from other network: ",
+			conn.RemoteAddr().String())
+		return
 	}
-	if strings.Contains(req, "PEERS") {
+	req = strings.TrimPrefix(req, magic)
+
+	var command, payload string
+	fields := strings.SplitN(req, " ", 2)
+	command = fields[0]
+	if len(fields) > 1 {
+		payload = fields[1]
+	}
+
+	switch command {
+	case "PING":
+		p.RegisterPeer(payload)
+		resp = p.Pong(conn.RemoteAddr())
+	case "PEERS":
 		peers, err := p.GetPeers()
 		if err != nil {
 			log.Println("Error getting peers on request: ", err)
 		}
 		resp = peers
-	}
-	if strings.Contains(req, "TRANSACTION") {
-		// in new function also check for index
-		transactionJSON := strings.Split(req, " ")[1]
+	case "TRANSACTION":
 		var transaction Transaction
-		err := json.Unmarshal([]byte(transactionJSON), &transaction)
+		err := DecodeJSON(strings.NewReader(payload), &transaction)
 		if err != nil {
 			log.Println("Couldn't read transaction JSON: ", err)
+			return
 		}
 		err = p.Store.AddTransaction(transaction)
-		log.Println("Added new transaction: ", transactionJSON)
-	}
-	if strings.Contains(req, "BLOCK") {
-		// in new function also check for index
-		blockJSON := strings.Split(req, " ")[1]
+		if err != nil {
+			log.Println("Couldn't add transaction: ", err)
+			return
+		}
+		log.Println("Added new transaction: ", payload)
+	case "BLOCK":
 		var block Block
-		err := json.Unmarshal([]byte(blockJSON), &block)
+		err := DecodeJSON(strings.NewReader(payload), &block)
 		if err != nil {
 			log.Println("Couldn't read block JSON: ", err)
+			return
 		}
 		err = p.Store.AddBlock(block)
-		log.Println("Added new block: ", blockJSON)
-	}
-	if strings.Contains(req, "CHAIN") {
+		if err != nil {
+			log.Println("Couldn't add block: ", err)
+			return
+		}
+		log.Println("Added new block: ", payload)
+	case "CHAIN":
 		blocks, err := p.GetChain()
 		if err != nil {
-			log.Fatal("Error getting chain", err)
+			log.Println("Error getting chain", err)
+			return
 		}
 		resp = blocks
 	}
 
 	conn.Write(resp)
-	conn.Close()
+}
+
+// message prefixes a command with the network magic, so that nodes of
+// different networks ignore each other.
+func (p *Peer) message(command string) []byte {
+	return []byte(fmt.Sprintf("%08x %s", p.Store.Params.Magic, command))
 }
 
 func (p *Peer) GetChain() ([]byte, error) {
@@ -147,13 +270,72 @@ func (p *Peer) GetPeers() ([]byte, error) {
 	return []byte(strings.Join(peers, "\n")), err
 }
 
-func (p *Peer) Pong() []byte {
-	return []byte("PONG")
+// Pong answers a PING and reports the host the remote peer was seen
+// connecting from, so that it can learn its own address. Pruned nodes add
+// the height up to which they pruned, as they can't serve the full chain.
+func (p *Peer) Pong(remote net.Addr) []byte {
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return []byte("PONG")
+	}
+	pruneHeight, err := p.Store.PruneHeight()
+	if err == nil && pruneHeight >= 0 {
+		return []byte(fmt.Sprintf("PONG %s %d", host, pruneHeight))
+	}
+	return []byte(fmt.Sprintf("PONG %s", host))
+}
+
+// Address returns the address this peer announces to others or an empty
+// string if it isn't known yet.
+func (p *Peer) Address() string {
+	host, port, err := net.SplitHostPort(p.AdvertiseAddress)
+	if err != nil {
+		return ""
+	}
+	if host == "" {
+		p.mutex.Lock()
+		host = p.observedHost
+		p.mutex.Unlock()
+	}
+	if host == "" {
+		return ""
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// learnHost records the host the peer at reporter reported for us. A single
+// peer, wrong or malicious, can't decide what we announce, the host is only
+// used once HOST_QUORUM distinct peers agree on it. It's ignored when the
+// advertise address pins the host explicitly.
+func (p *Peer) learnHost(reporter string, host string) {
+	if net.ParseIP(host) == nil {
+		return
+	}
+	explicit, _, err := net.SplitHostPort(p.AdvertiseAddress)
+	if err != nil || explicit != "" {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.hostReports == nil {
+		p.hostReports = make(map[string]string)
+	}
+	p.hostReports[reporter] = host
+
+	agreeing := 0
+	for _, reported := range p.hostReports {
+		if reported == host {
+			agreeing++
+		}
+	}
+	if agreeing >= HOST_QUORUM && p.observedHost != host {
+		log.Println("Learned own host from peers: ", host)
+		p.observedHost = host
+	}
 }
 
 func (p *Peer) RegisterPeer(peer string) []byte {
-	self := fmt.Sprintf("%s:%s", p.Host, p.Port)
-	if peer != self {
+	if peer != "" && peer != p.Address() {
 		p.Store.AddPeer(peer)
 		log.Println("Registered new peer: ", peer)
 		return []byte("REGISTERED")
@@ -163,14 +345,16 @@ func (p *Peer) RegisterPeer(peer string) []byte {
 
 func (p *Peer) DiscoverPeers(peer string) error {
 	log.Println("Requesting new peers from: ", peer)
-	conn, err := net.Dial(CONN_TYPE, peer)
+	conn, err := p.dial(peer)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = p.send(conn, p.message("PEERS"))
 	if err != nil {
-		log.Println("Error dialing peer: ", peer, err)
-		log.Println("Removing peer: ", peer)
-		p.Store.DeletePeer(peer)
 		return err
 	}
-	conn.Write([]byte("PEERS"))
 	resp, err := ioutil.ReadAll(conn)
 	if err != nil {
 		log.Println("Error reading PEERS response: ", err)
@@ -187,36 +371,25 @@ func (p *Peer) DiscoverPeers(peer string) error {
 }
 
 func (p *Peer) SendTransaction(peer string, transaction Transaction) error {
-	conn, err := net.Dial(CONN_TYPE, peer)
-	if err != nil {
-		log.Println("Error dialing peer on sending transaction: ", err)
-		log.Println("Deleting peer: ", peer)
-		p.Store.DeletePeer(peer)
-		return err
-	}
-
-	header := []byte("TRANSACTION ")
 	transactionJSON, err := json.Marshal(transaction)
 	if err != nil {
-		log.Fatal("Error marshalling transaction: ", err)
+		return err
 	}
-	message := append(header, transactionJSON...)
-
-	conn.Write(message)
-	return err
+	return p.SendPayload(peer, []byte("TRANSACTION "), transactionJSON)
 }
 
 func (p *Peer) DownloadChain(peer string) ([]Block, error) {
 	var chain []Block
-	conn, err := net.Dial(CONN_TYPE, peer)
+	conn, err := p.dial(peer)
 	if err != nil {
-		log.Println("Error dialing peer, deleting peer: ", peer)
-		p.Store.DeletePeer(peer)
 		return chain, err
 	}
+	defer conn.Close()
 
-	msg := []byte("CHAIN")
-	conn.Write(msg)
+	err = p.send(conn, p.message("CHAIN"))
+	if err != nil {
+		return chain, err
+	}
 
 	resp, err := ioutil.ReadAll(conn)
 	if err != nil {
@@ -224,7 +397,7 @@ func (p *Peer) DownloadChain(peer string) ([]Block, error) {
 		p.Store.DeletePeer(peer)
 		return chain, err
 	}
-	err = json.Unmarshal(resp, &chain)
+	err = DecodeJSON(bytes.NewReader(resp), &chain)
 	if err != nil {
 		log.Println("Couldn't read chain JSON: ", err)
 	}
@@ -233,25 +406,47 @@ func (p *Peer) DownloadChain(peer string) ([]Block, error) {
 }
 
 func (p *Peer) Ping(peer string) error {
-	conn, err := net.Dial(CONN_TYPE, peer)
+	conn, err := p.dial(peer)
 	if err != nil {
-		log.Println("Error dialing peer, Deleting peer: ", peer)
-		p.Store.DeletePeer(peer)
 		return err
 	}
-	msg := fmt.Sprintf("PING %s:%s", p.Host, p.Port)
+	defer conn.Close()
+
+	msg := "PING"
+	if address := p.Address(); address != "" {
+		msg = fmt.Sprintf("PING %s", address)
+	}
 
-	conn.Write([]byte(msg))
+	err = p.send(conn, p.message(msg))
+	if err != nil {
+		p.Store.DeletePeer(peer)
+		return err
+	}
 	resp, err := ioutil.ReadAll(conn)
 	if err != nil {
 		p.Store.DeletePeer(peer)
 		return err
 	}
 
-	if string(resp) != "PONG" {
+	fields := strings.Fields(string(resp))
+	if len(fields) == 0 || fields[0] != "PONG" {
 		p.Store.DeletePeer(peer)
 	} else {
 		log.Println("Received message from: ", conn.RemoteAddr().String(), string(resp))
+		if len(fields) > 1 {
+			// peers are told apart by their IP, not by the ports they
+			// listen on
+			reporter, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+			if err == nil {
+				p.learnHost(reporter, fields[1])
+			}
+		}
+		if len(fields) > 2 {
+			height, err := strconv.Atoi(fields[2])
+			if err == nil {
+				p.Store.SetPeerPruned(peer, height)
+			}
+		}
 	}
 	return err
 }
@@ -260,13 +455,17 @@ func (p *Peer) Download() ([][]Block, error) {
 	var chains [][]Block
 	peers, err := p.Store.GetPeers()
 	if err != nil {
-		log.Fatal("Error getting peers: ", err)
+		log.Println("Error getting peers: ", err)
 		return chains, err
 	}
 
 	// TODO: Change this to a smaller set of peers when the network scales
 	//		 to more nodes than just a hand full.
 	for _, peer := range peers {
+		if p.Store.IsPeerPruned(peer) {
+			// pruned peers can't serve the blocks we're missing
+			continue
+		}
 		chain, err := p.DownloadChain(peer)
 		if err != nil {
 			log.Println("Couldn't download chain from", peer)
@@ -277,33 +476,37 @@ func (p *Peer) Download() ([][]Block, error) {
 	return chains, err
 }
 
-func (p *Peer) Discovery() error {
-	for range time.Tick(time.Second * 15) {
+func (p *Peer) Discovery(ctx context.Context) {
+	ticker := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		log.Println("Peer discovery initialized")
 		peers, err := p.Store.GetPeers()
 		if err != nil {
-			log.Fatal("Error getting peers: ", err)
-			return err
+			log.Println("Error getting peers: ", err)
+			continue
 		}
 		for _, peer := range peers {
 			p.DiscoverPeers(peer)
 		}
 	}
-	return errors.New("Cannot be reached")
 }
 
 func (p *Peer) SendPayload(peer string, header []byte, payload []byte) error {
-	conn, err := net.Dial(CONN_TYPE, peer)
+	conn, err := p.dial(peer)
 	if err != nil {
-		log.Println("Error dialing peer on sending payload: ", err)
-		log.Println("Deleting peer: ", peer)
-		p.Store.DeletePeer(peer)
 		return err
 	}
+	defer conn.Close()
 
-	message := append(header, payload...)
-	conn.Write(message)
-	return err
+	message := append(p.message(string(header)), payload...)
+	return p.send(conn, message)
 }
 
 func (p *Peer) GossipTransaction(transaction Transaction) {
@@ -313,7 +516,8 @@ func (p *Peer) GossipTransaction(transaction Transaction) {
 	}
 	transactionJSON, err := json.Marshal(transaction)
 	if err != nil {
-		log.Fatal("Error marshalling transaction: ", err)
+		log.Println("Error marshalling transaction: ", err)
+		return
 	}
 
 	for _, peer := range peers {
@@ -328,7 +532,8 @@ func (p *Peer) GossipBlock(block Block) {
 	}
 	blockJSON, err := json.Marshal(block)
 	if err != nil {
-		log.Fatal("Error marshalling transaction: ", err)
+		log.Println("Error marshalling block: ", err)
+		return
 	}
 
 	for _, peer := range peers {
@@ -336,15 +541,23 @@ func (p *Peer) GossipBlock(block Block) {
 	}
 }
 
-func (p *Peer) CheckHeartBeat() {
-	for range time.Tick(time.Second * 15) {
+func (p *Peer) CheckHeartBeat(ctx context.Context) {
+	ticker := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		peers, err := p.Store.GetPeers()
 		if err != nil {
-			log.Fatal("Error getting peers: ", err)
+			log.Println("Error getting peers: ", err)
+			continue
 		}
 		for _, peer := range peers {
 			p.Ping(peer)
 		}
 	}
-
 }
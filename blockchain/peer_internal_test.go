@@ -0,0 +1,33 @@
+package blockchain
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLearnHostFromQuorum(t *testing.T) {
+	p := Peer{AdvertiseAddress: ":4321"}
+	p.learnHost("10.0.0.1", "203.0.113.7")
+	p.learnHost("10.0.0.2", "203.0.113.7")
+	p.learnHost("10.0.0.3", "198.51.100.1")
+	assert.Equal(t, "", p.Address())
+
+	p.learnHost("10.0.0.3", "203.0.113.7")
+	assert.Equal(t, "203.0.113.7:4321", p.Address())
+
+	// until as many peers agree on another one
+	for _, reporter := range []string{"10.0.0.1", "10.0.0.2"} {
+		p.learnHost(reporter, "198.51.100.1")
+		assert.Equal(t, "203.0.113.7:4321", p.Address())
+	}
+	p.learnHost("10.0.0.3", "198.51.100.1")
+	assert.Equal(t, "198.51.100.1:4321", p.Address())
+}
+
+func TestLearnHostKeepsExplicitHost(t *testing.T) {
+	p := Peer{AdvertiseAddress: "192.0.2.1:4321"}
+	for _, reporter := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		p.learnHost(reporter, "203.0.113.7")
+	}
+	assert.Equal(t, "192.0.2.1:4321", p.Address())
+}
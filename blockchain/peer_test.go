@@ -1,52 +1,89 @@
 package blockchain_test
 
 import (
-	"github.com/stretchr/testify/assert"
-	"testing"
-	"github.com/InitialShape/cryptocurrency/blockchain"
-	"net"
 	"encoding/json"
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/stretchr/testify/assert"
 	"io/ioutil"
+	"net"
+	"testing"
 )
 
+func message(command string) []byte {
+	return []byte(fmt.Sprintf("%08x %s", blockchain.RegTestParams.Magic,
+		command))
+}
+
+// request writes a message and closes the write side, which marks the end of
+// the message for the peer.
+func request(conn net.Conn, message []byte) {
+	conn.Write(message)
+	conn.(*net.TCPConn).CloseWrite()
+}
+
 func TestPingPong(t *testing.T) {
 	conn, err := net.Dial("tcp", "localhost:1234")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	msg := "PING localhost:12345"
-
-	conn.Write([]byte(msg))
+	request(conn, message("PING localhost:12345"))
 	resp, err := ioutil.ReadAll(conn)
 	if err != nil {
 		t.Error(err)
 	}
-	assert.Equal(t, "PONG", string(resp))
+	assert.Equal(t, "PONG 127.0.0.1", string(resp))
 }
 
 func TestPingPongWithoutPeer(t *testing.T) {
 	conn, err := net.Dial("tcp", "localhost:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request(conn, message("PING"))
+	resp, err := ioutil.ReadAll(conn)
 	if err != nil {
 		t.Error(err)
 	}
-	msg := "PING"
+	assert.Equal(t, "PONG 127.0.0.1", string(resp))
+}
+
+func TestPingFromOtherNetwork(t *testing.T) {
+	conn, err := net.Dial("tcp", "localhost:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := fmt.Sprintf("%08x PING", blockchain.MainNetParams.Magic)
 
-	conn.Write([]byte(msg))
+	request(conn, []byte(msg))
 	resp, err := ioutil.ReadAll(conn)
 	if err != nil {
 		t.Error(err)
 	}
-	assert.Equal(t, "PONG", string(resp))
+	assert.Equal(t, "", string(resp))
+}
+
+func TestPingIgnoresSingleHostReport(t *testing.T) {
+	other := blockchain.Peer{ListenAddress: ":4321", AdvertiseAddress: ":4321",
+		Store: store}
+	assert.Equal(t, "", other.Address())
+
+	// a single peer reporting our host again and again isn't enough
+	for i := 0; i < blockchain.HOST_QUORUM; i++ {
+		err := other.Ping("localhost:1234")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	assert.Equal(t, "", other.Address())
 }
 
 func TestGettingPeers(t *testing.T) {
 	conn, err := net.Dial("tcp", "localhost:1234")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	msg := "PEERS"
-
-	conn.Write([]byte(msg))
+	request(conn, message("PEERS"))
 	resp, err := ioutil.ReadAll(conn)
 	if err != nil {
 		t.Error(err)
@@ -57,11 +94,9 @@ func TestGettingPeers(t *testing.T) {
 func TestGetChainFromPeer(t *testing.T) {
 	conn, err := net.Dial("tcp", "localhost:1234")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	msg := "CHAIN"
-
-	conn.Write([]byte(msg))
+	request(conn, message("CHAIN"))
 	resp, err := ioutil.ReadAll(conn)
 	if err != nil {
 		t.Error(err)
@@ -0,0 +1,419 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/InitialShape/cryptocurrency/storage"
+	"log"
+	"sort"
+)
+
+// SCHEMA_VERSION is the layout of the database this code reads and writes.
+// Older databases are migrated on Open.
+const SCHEMA_VERSION = 4
+
+// Buckets of the database and the keys with a fixed meaning within them.
+var (
+	BLOCKS_BUCKET       = []byte("blocks")
+	BLOCKFILES_BUCKET   = []byte("blockfiles")
+	TRANSACTIONS_BUCKET = []byte("transactions")
+	UTXO_BUCKET         = []byte("utxo")
+	MEMPOOL_BUCKET      = []byte("mempool")
+	PEERS_BUCKET        = []byte("peers")
+	PRUNED_PEERS_BUCKET = []byte("pruned_peers")
+	HEIGHTS_BUCKET      = []byte("heights")
+	SNAPSHOT_BUCKET     = []byte("snapshot")
+	META_BUCKET         = []byte("meta")
+	HELD_BUCKET         = []byte("held")
+	ADDRESSES_BUCKET    = []byte("addresses")
+
+	ROOT_KEY           = []byte("root")
+	GENESIS_KEY        = []byte("genesis")
+	PRUNED_KEY         = []byte("pruned")
+	SNAPSHOT_INFO_KEY  = []byte("info")
+	SCHEMA_VERSION_KEY = []byte("version")
+)
+
+var (
+	ErrUnknownSchema   = errors.New("Database was written by a newer version")
+	ErrReindexSnapshot = errors.New("Chains started from a snapshot can't be reindexed")
+)
+
+// migration upgrades a database from the previous version to version. It
+// runs in the same transaction that records the new version, so it's
+// applied fully or not at all.
+type migration struct {
+	version     int
+	description string
+	migrate     func(s *Store, tx storage.Tx) error
+}
+
+// migrations are applied in order, each to databases older than its
+// version.
+var migrations = []migration{
+	{1, "Move blocks into the block files", migrateBlockFiles},
+	{2, "Drop the mempool kept in the old transaction encoding",
+		migrateMempool},
+	{3, "Index the unspent outputs of each public key", migrateAddresses},
+	{4, "Rehash the blocks over their canonical headers",
+		migrateHeaderHashes},
+}
+
+// createBuckets returns the named buckets of tx, creating missing ones.
+func createBuckets(tx storage.Tx, names ...[]byte) ([]storage.Bucket, error) {
+	buckets := make([]storage.Bucket, len(names))
+	for i, name := range names {
+		b, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return nil, err
+		}
+		buckets[i] = b
+	}
+	return buckets, nil
+}
+
+// clearBucket deletes all keys of b.
+func clearBucket(b storage.Bucket) error {
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		keys = append(keys, append([]byte{}, k...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = b.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isBlockHash tells the blocks in the blocks bucket from its fixed keys.
+func isBlockHash(key []byte) bool {
+	for _, fixed := range [][]byte{ROOT_KEY, GENESIS_KEY, PRUNED_KEY} {
+		if string(key) == string(fixed) {
+			return false
+		}
+	}
+	return true
+}
+
+func versionKey(version int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(version))
+	return key
+}
+
+// SchemaVersion returns the version of the database's layout. Databases
+// that predate the version key are told apart by their buckets.
+func (s *Store) SchemaVersion() (int, error) {
+	data, err := s.Get(META_BUCKET, SCHEMA_VERSION_KEY)
+	if err == nil {
+		return int(binary.BigEndian.Uint64(data)), nil
+	} else if err != ErrNotFound {
+		return 0, err
+	}
+
+	_, err = s.Get(BLOCKS_BUCKET, ROOT_KEY)
+	if err == ErrNotFound {
+		// a new database
+		return SCHEMA_VERSION, nil
+	} else if err != nil {
+		return 0, err
+	}
+	_, err = s.Get(BLOCKFILES_BUCKET, fileKey(0))
+	if err == ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// migrate brings the database up to SCHEMA_VERSION.
+func (s *Store) migrate() error {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > SCHEMA_VERSION {
+		return ErrUnknownSchema
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		log.Printf("Migrating database to version %d: %s\n", m.version,
+			m.description)
+		err = s.DB.Update(func(tx storage.Tx) error {
+			err := m.migrate(s, tx)
+			if err != nil {
+				return err
+			}
+			return setSchemaVersion(tx, m.version)
+		})
+		if err != nil {
+			return err
+		}
+		version = m.version
+	}
+
+	return s.DB.Update(func(tx storage.Tx) error {
+		return setSchemaVersion(tx, version)
+	})
+}
+
+func setSchemaVersion(tx storage.Tx, version int) error {
+	meta, err := tx.CreateBucketIfNotExists(META_BUCKET)
+	if err != nil {
+		return err
+	}
+	return meta.Put(SCHEMA_VERSION_KEY, versionKey(version))
+}
+
+// migrateBlockFiles moves the whole blocks kept in the blocks bucket into the
+// block files and replaces the copies of transactions with the index into
+// their blocks.
+func migrateBlockFiles(s *Store, tx storage.Tx) error {
+	b, err := createBuckets(tx, BLOCKS_BUCKET, BLOCKFILES_BUCKET,
+		TRANSACTIONS_BUCKET)
+	if err != nil {
+		return err
+	}
+	blocks, blockfiles, transactions := b[0], b[1], b[2]
+
+	var hashes, values [][]byte
+	err = blocks.ForEach(func(k, v []byte) error {
+		if !isBlockHash(k) {
+			return nil
+		}
+		hashes = append(hashes, append([]byte{}, k...))
+		values = append(values, append([]byte{}, v...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, data := range values {
+		block, err := decodeBlock(data)
+		if err != nil {
+			return err
+		}
+		location, err := s.Files.Append(data)
+		if err != nil {
+			return err
+		}
+		block.Hash = hashes[i]
+		err = putBlockEntry(blocks, blockfiles, block, location)
+		if err != nil {
+			return err
+		}
+		err = indexTransactions(transactions, block)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.Files.Sync()
+	if err != nil {
+		return err
+	}
+
+	// the first block file marks databases that use the block files, even
+	// if they were empty
+	if blockfiles.Get(fileKey(0)) == nil {
+		data, err := encode(fileEntry{})
+		if err != nil {
+			return err
+		}
+		return blockfiles.Put(fileKey(0), data)
+	}
+	return nil
+}
+
+// migrateMempool drops the mempool. Its transactions were stored as CBOR and
+// hashed by the old rules, so their hashes are no longer valid.
+func migrateMempool(s *Store, tx storage.Tx) error {
+	mempool, err := tx.CreateBucketIfNotExists(MEMPOOL_BUCKET)
+	if err != nil {
+		return err
+	}
+	return clearBucket(mempool)
+}
+
+// migrateHeaderHashes rehashes the stored blocks over their canonical
+// headers, which commit to the transactions through their merkle root,
+// instead of their CBOR. Parents are rehashed before their children, whose
+// links are rewritten and which are appended to the block files again. The
+// indexes refer to the old hashes, so they're rebuilt like by Reindex. It
+// needs all blocks, which pruned nodes and chains started from a snapshot
+// don't have.
+func migrateHeaderHashes(s *Store, tx storage.Tx) error {
+	b, err := createBuckets(tx, BLOCKS_BUCKET, BLOCKFILES_BUCKET)
+	if err != nil {
+		return err
+	}
+	blocks, blockfiles := b[0], b[1]
+	if blocks.Get(PRUNED_KEY) != nil {
+		return ErrPruned
+	}
+	if hasSnapshot(tx) {
+		return ErrReindexSnapshot
+	}
+
+	var hashes [][]byte
+	var entries []blockEntry
+	err = blocks.ForEach(func(k, v []byte) error {
+		if !isBlockHash(k) {
+			return nil
+		}
+		var entry blockEntry
+		err := decode(append([]byte{}, v...), &entry)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, append([]byte{}, k...))
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return entries[order[i]].Header.Height <
+			entries[order[j]].Header.Height
+	})
+
+	rehashed := make(map[string][]byte)
+	for _, i := range order {
+		block, err := s.readBlock(entries[i].Location)
+		if err != nil {
+			return err
+		}
+		if len(block.PreviousBlock) > 0 {
+			previous, ok := rehashed[string(block.PreviousBlock)]
+			if !ok {
+				return ErrNotFound
+			}
+			block.PreviousBlock = previous
+		}
+		block.Hash, err = block.GetHash()
+		if err != nil {
+			return err
+		}
+		data, err := block.GetCBOR()
+		if err != nil {
+			return err
+		}
+		location, err := s.Files.Append(data)
+		if err != nil {
+			return err
+		}
+		err = blocks.Delete(hashes[i])
+		if err != nil {
+			return err
+		}
+		err = putBlockEntry(blocks, blockfiles, block, location)
+		if err != nil {
+			return err
+		}
+		rehashed[string(hashes[i])] = block.Hash
+	}
+	err = s.Files.Sync()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range [][]byte{ROOT_KEY, GENESIS_KEY} {
+		old := blocks.Get(key)
+		if old == nil {
+			continue
+		}
+		hash, ok := rehashed[string(old)]
+		if !ok {
+			return ErrNotFound
+		}
+		err = blocks.Put(key, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return s.reindex(tx)
+}
+
+// hasSnapshot reports whether the chain was started from a snapshot.
+func hasSnapshot(tx storage.Tx) bool {
+	snapshot := tx.Bucket(SNAPSHOT_BUCKET)
+	return snapshot != nil && snapshot.Get(SNAPSHOT_INFO_KEY) != nil
+}
+
+// Reindex rebuilds the utxo set, the transaction, height and address index
+// from the main chain's blocks. It needs all blocks, so it fails on pruned
+// nodes and on chains started from a snapshot.
+func (s *Store) Reindex() error {
+	return s.DB.Update(func(tx storage.Tx) error {
+		return s.reindex(tx)
+	})
+}
+
+func (s *Store) reindex(tx storage.Tx) error {
+	if hasSnapshot(tx) {
+		return ErrReindexSnapshot
+	}
+	b, err := createBuckets(tx, BLOCKS_BUCKET, TRANSACTIONS_BUCKET,
+		UTXO_BUCKET, MEMPOOL_BUCKET, HEIGHTS_BUCKET, ADDRESSES_BUCKET)
+	if err != nil {
+		return err
+	}
+	blocks, transactions, utxo, mempool := b[0], b[1], b[2], b[3]
+	heights, addresses := b[4], b[5]
+
+	hash := blocks.Get(ROOT_KEY)
+	if hash == nil {
+		return ErrNotFound
+	}
+	var chain []blockEntry
+	for len(hash) > 0 {
+		data := blocks.Get(hash)
+		if data == nil {
+			return ErrNotFound
+		}
+		var entry blockEntry
+		err = decode(append([]byte{}, data...), &entry)
+		if err != nil {
+			return err
+		}
+		chain = append([]blockEntry{entry}, chain...)
+		hash = entry.Header.PreviousBlock
+	}
+
+	log.Println("Reindexing", len(chain), "blocks")
+	for _, bucket := range []storage.Bucket{transactions, utxo, heights,
+		addresses} {
+		err = clearBucket(bucket)
+		if err != nil {
+			return err
+		}
+	}
+	for _, entry := range chain {
+		block, err := s.readBlock(entry.Location)
+		if err != nil {
+			return err
+		}
+		err = connectTransactions(transactions, utxo, mempool, addresses,
+			block)
+		if err != nil {
+			return err
+		}
+	}
+	return indexMainChain(tx, chain[len(chain)-1].Header)
+}
@@ -0,0 +1,340 @@
+package blockchain_test
+
+import (
+	"crypto/sha256"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// legacyDatabase writes chain the way databases of version 0 kept it: whole
+// blocks in the blocks bucket and copies of the transactions.
+func legacyDatabase(t *testing.T, chain []blockchain.Block,
+	utxo map[string][]byte) storage.DB {
+	db := storage.NewMemory()
+	err := db.Update(func(tx storage.Tx) error {
+		blocks, err := tx.CreateBucketIfNotExists(blockchain.BLOCKS_BUCKET)
+		if err != nil {
+			return err
+		}
+		transactions, err := tx.CreateBucketIfNotExists(
+			blockchain.TRANSACTIONS_BUCKET)
+		if err != nil {
+			return err
+		}
+		outputs, err := tx.CreateBucketIfNotExists(blockchain.UTXO_BUCKET)
+		if err != nil {
+			return err
+		}
+		for _, block := range chain {
+			data, err := block.GetCBOR()
+			if err != nil {
+				return err
+			}
+			blocks.Put(block.Hash, data)
+			for _, transaction := range block.Transactions {
+				data, err := transaction.GetCBOR()
+				if err != nil {
+					return err
+				}
+				transactions.Put(transaction.Hash, data)
+			}
+		}
+		for key, value := range utxo {
+			outputs.Put([]byte(key), value)
+		}
+		return blocks.Put(blockchain.ROOT_KEY, chain[len(chain)-1].Hash)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func readBucket(t *testing.T, db storage.DB, name []byte) map[string][]byte {
+	values := make(map[string][]byte)
+	err := db.View(func(tx storage.Tx) error {
+		b := tx.Bucket(name)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			values[string(k)] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func TestNewDatabaseHasSchemaVersion(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	version, err := store.SchemaVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, blockchain.SCHEMA_VERSION, version)
+}
+
+func TestMigrateBlockFiles(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	blocks := snapshotChain(t, store)
+	chain := append([]blockchain.Block{store.Params.GenesisBlock}, blocks...)
+	hash, err := store.UTXOHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := legacyDatabase(t, chain, readBucket(t, store.DB,
+		blockchain.UTXO_BUCKET))
+	migrated := blockchain.Store{}
+	peer := &blockchain.Peer{}
+	err = migrated.OpenDB(db, storage.NewMemoryFiles(blockchain.BLOCK_FILE_SIZE),
+		peer, &blockchain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.Store = migrated
+	defer migrated.Close()
+
+	version, err := migrated.SchemaVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, blockchain.SCHEMA_VERSION, version)
+	migratedChain, err := migrated.GetChain()
+	assert.NoError(t, err)
+	assert.Equal(t, chain, migratedChain)
+	migratedHash, err := migrated.UTXOHash()
+	assert.NoError(t, err)
+	assert.Equal(t, hash, migratedHash)
+	spend := blocks[2].Transactions[1]
+	transaction, err := migrated.GetTransaction(spend.Hash, false)
+	assert.NoError(t, err)
+	assert.Equal(t, spend, transaction)
+
+	// and it keeps growing
+	next := mineBlock(blocks[4], nil)
+	assert.NoError(t, migrated.AddBlock(next))
+}
+
+// legacyChain relinks chain by the hashes blocks had before their headers
+// were encoded canonically, the SHA-256 of their CBOR without the hash.
+func legacyChain(t *testing.T, chain []blockchain.Block) []blockchain.Block {
+	var legacy []blockchain.Block
+	for i, block := range chain {
+		if i > 0 {
+			block.PreviousBlock = legacy[i-1].Hash
+		}
+		block.Hash = []byte{}
+		data, err := block.GetCBOR()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := sha256.Sum256(data)
+		block.Hash = hash[:]
+		legacy = append(legacy, block)
+	}
+	return legacy
+}
+
+func TestMigrateHeaderHashes(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	blocks := snapshotChain(t, store)
+	chain := append([]blockchain.Block{store.Params.GenesisBlock}, blocks...)
+	utxo := readBucket(t, store.DB, blockchain.UTXO_BUCKET)
+	addresses := readBucket(t, store.DB, blockchain.ADDRESSES_BUCKET)
+
+	legacy := legacyChain(t, chain)
+	assert.NotEqual(t, chain[1].Hash, legacy[1].Hash)
+	db := legacyDatabase(t, legacy, utxo)
+	migrated := blockchain.Store{}
+	peer := &blockchain.Peer{}
+	err := migrated.OpenDB(db, storage.NewMemoryFiles(blockchain.BLOCK_FILE_SIZE),
+		peer, &blockchain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer.Store = migrated
+	defer migrated.Close()
+
+	version, err := migrated.SchemaVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, blockchain.SCHEMA_VERSION, version)
+	migratedChain, err := migrated.GetChain()
+	assert.NoError(t, err)
+	assert.Equal(t, chain, migratedChain)
+	_, err = migrated.GetBlock(legacy[3].Hash)
+	assert.Equal(t, blockchain.ErrNotFound, err)
+	block, err := migrated.BlockByHeight(3)
+	assert.NoError(t, err)
+	assert.Equal(t, blocks[2], block)
+	assert.Equal(t, utxo, readBucket(t, db, blockchain.UTXO_BUCKET))
+	assert.Equal(t, addresses, readBucket(t, db,
+		blockchain.ADDRESSES_BUCKET))
+
+	// the transaction index points at the new hashes
+	spend := blocks[2].Transactions[1]
+	transaction, err := migrated.GetTransaction(spend.Hash, false)
+	assert.NoError(t, err)
+	assert.Equal(t, spend, transaction)
+
+	next := mineBlock(blocks[4], nil)
+	assert.NoError(t, migrated.AddBlock(next))
+}
+
+func TestMigrateHeaderHashesOfPrunedNode(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	blocks := snapshotChain(t, store)
+	chain := append([]blockchain.Block{store.Params.GenesisBlock}, blocks...)
+
+	db := legacyDatabase(t, legacyChain(t, chain),
+		readBucket(t, store.DB, blockchain.UTXO_BUCKET))
+	err := db.Update(func(tx storage.Tx) error {
+		return tx.Bucket(blockchain.BLOCKS_BUCKET).Put(blockchain.PRUNED_KEY,
+			[]byte{0, 0, 0, 0, 0, 0, 0, 1})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated := blockchain.Store{}
+	err = migrated.OpenDB(db, storage.NewMemoryFiles(blockchain.BLOCK_FILE_SIZE),
+		&blockchain.Peer{}, &blockchain.RegTestParams)
+	assert.Equal(t, blockchain.ErrPruned, err)
+}
+
+func TestOpenNewerSchema(t *testing.T) {
+	db := storage.NewMemory()
+	files := storage.NewMemoryFiles(blockchain.BLOCK_FILE_SIZE)
+	store := blockchain.Store{}
+	err := store.OpenDB(db, files, &blockchain.Peer{},
+		&blockchain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Update(func(tx storage.Tx) error {
+		meta := tx.Bucket(blockchain.META_BUCKET)
+		return meta.Put(blockchain.SCHEMA_VERSION_KEY,
+			[]byte{0, 0, 0, 0, 0, 0, 0, 99})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened := blockchain.Store{}
+	err = reopened.OpenDB(db, files, &blockchain.Peer{},
+		&blockchain.RegTestParams)
+	assert.Equal(t, blockchain.ErrUnknownSchema, err)
+}
+
+func TestMigrateMempool(t *testing.T) {
+	db := storage.NewMemory()
+	files := storage.NewMemoryFiles(blockchain.BLOCK_FILE_SIZE)
+	store := blockchain.Store{}
+	err := store.OpenDB(db, files, &blockchain.Peer{},
+		&blockchain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a version 1 database with a transaction in the old encoding
+	err = db.Update(func(tx storage.Tx) error {
+		meta := tx.Bucket(blockchain.META_BUCKET)
+		err := meta.Put(blockchain.SCHEMA_VERSION_KEY,
+			[]byte{0, 0, 0, 0, 0, 0, 0, 1})
+		if err != nil {
+			return err
+		}
+		mempool, err := tx.CreateBucketIfNotExists(blockchain.MEMPOOL_BUCKET)
+		if err != nil {
+			return err
+		}
+		data, err := store.Params.GenesisBlock.Transactions[0].GetCBOR()
+		if err != nil {
+			return err
+		}
+		return mempool.Put([]byte("transaction"), data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := blockchain.Store{}
+	err = reopened.OpenDB(db, files, &blockchain.Peer{},
+		&blockchain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := reopened.SchemaVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, blockchain.SCHEMA_VERSION, version)
+	transactions, err := reopened.GetTransactions()
+	assert.NoError(t, err)
+	assert.Empty(t, transactions)
+}
+
+func TestReindex(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	blocks := snapshotChain(t, store)
+	utxo := readBucket(t, store.DB, blockchain.UTXO_BUCKET)
+	transactions := readBucket(t, store.DB, blockchain.TRANSACTIONS_BUCKET)
+	heights := readBucket(t, store.DB, blockchain.HEIGHTS_BUCKET)
+	addresses := readBucket(t, store.DB, blockchain.ADDRESSES_BUCKET)
+
+	// lose the derived indexes
+	err := store.DB.Update(func(tx storage.Tx) error {
+		for _, name := range [][]byte{blockchain.UTXO_BUCKET,
+			blockchain.TRANSACTIONS_BUCKET, blockchain.HEIGHTS_BUCKET,
+			blockchain.ADDRESSES_BUCKET} {
+			b := tx.Bucket(name)
+			var keys [][]byte
+			b.ForEach(func(k, v []byte) error {
+				keys = append(keys, k)
+				return nil
+			})
+			for _, key := range keys[1:] {
+				b.Delete(key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NoError(t, store.Reindex())
+	assert.Equal(t, utxo, readBucket(t, store.DB, blockchain.UTXO_BUCKET))
+	assert.Equal(t, transactions, readBucket(t, store.DB,
+		blockchain.TRANSACTIONS_BUCKET))
+	assert.Equal(t, heights, readBucket(t, store.DB, blockchain.HEIGHTS_BUCKET))
+	assert.Equal(t, addresses, readBucket(t, store.DB,
+		blockchain.ADDRESSES_BUCKET))
+	block, err := store.BlockByHeight(3)
+	assert.NoError(t, err)
+	assert.Equal(t, blocks[2], block)
+}
+
+func TestReindexSnapshot(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	snapshotChain(t, store)
+	path, remove := tempSnapshot(t)
+	defer remove()
+	header, err := store.ExportSnapshot(path, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, importedCleanup := newStore(t)
+	defer importedCleanup()
+	_, err = imported.ImportSnapshot(path, header.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, blockchain.ErrReindexSnapshot, imported.Reindex())
+}
@@ -0,0 +1,563 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ed25519"
+	"strings"
+)
+
+// Opcode is an instruction of a locking script. Scripts are a sequence of
+// opcodes and the data they push, run on a stack the input's witness is
+// pushed onto first. There are no loops or jumps, so a script runs at most
+// once through each of its opcodes.
+type Opcode byte
+
+const (
+	// OP_0 pushes an empty item, which is false
+	OP_0 Opcode = 0x00
+	// opcodes up to OP_PUSHDATA1 push the next that many bytes
+	OP_PUSHDATA1 Opcode = 0x4c
+	OP_PUSHDATA2 Opcode = 0x4d
+	// OP_1 to OP_16 push the number
+	OP_1  Opcode = 0x51
+	OP_16 Opcode = 0x60
+
+	OP_IF     Opcode = 0x63
+	OP_NOTIF  Opcode = 0x64
+	OP_ELSE   Opcode = 0x67
+	OP_ENDIF  Opcode = 0x68
+	OP_VERIFY Opcode = 0x69
+	OP_RETURN Opcode = 0x6a
+
+	OP_DROP Opcode = 0x75
+	OP_DUP  Opcode = 0x76
+	OP_SWAP Opcode = 0x7c
+	OP_SIZE Opcode = 0x82
+
+	OP_EQUAL       Opcode = 0x87
+	OP_EQUALVERIFY Opcode = 0x88
+	OP_NOT         Opcode = 0x91
+
+	OP_SHA256              Opcode = 0xa8
+	OP_CHECKSIG            Opcode = 0xac
+	OP_CHECKSIGVERIFY      Opcode = 0xad
+	OP_CHECKMULTISIG       Opcode = 0xae
+	OP_CHECKMULTISIGVERIFY Opcode = 0xaf
+
+	OP_CHECKLOCKTIMEVERIFY Opcode = 0xb1
+)
+
+// Resource limits of scripts and their witnesses.
+const (
+	MAX_SCRIPT_SIZE  = 1024
+	MAX_ELEMENT_SIZE = 520
+	MAX_STACK_SIZE   = 100
+	MAX_SCRIPT_OPS   = 100
+)
+
+var (
+	ErrScriptTooLarge        = errors.New("Script too large")
+	ErrElementTooLarge       = errors.New("Stack item too large")
+	ErrStackOverflow         = errors.New("Stack too large")
+	ErrTooManyOps            = errors.New("Too many opcodes")
+	ErrInvalidOpcode         = errors.New("Invalid opcode")
+	ErrTruncatedPush         = errors.New("Push past the end of the script")
+	ErrUnbalancedConditional = errors.New("Unbalanced conditional")
+	ErrMinimalIf             = errors.New("Condition neither empty nor 1")
+	ErrEmptyStack            = errors.New("Not enough stack items")
+	ErrScriptReturn          = errors.New("Script returned")
+	ErrScriptVerify          = errors.New("Verify failed")
+	ErrScriptFalse           = errors.New("Script evaluated to false")
+	ErrCleanStack            = errors.New("Script left more than one item")
+	ErrSignatureEncoding     = errors.New("Malformed signature")
+	ErrPublicKeyEncoding     = errors.New("Malformed public key")
+	ErrNullFail              = errors.New("Signature doesn't verify")
+	ErrLockedOutput          = errors.New("Output has both a public key and a script")
+	ErrNumberEncoding        = errors.New("Malformed number")
+)
+
+var opcodeNames = map[Opcode]string{
+	OP_0:                   "OP_0",
+	OP_IF:                  "OP_IF",
+	OP_NOTIF:               "OP_NOTIF",
+	OP_ELSE:                "OP_ELSE",
+	OP_ENDIF:               "OP_ENDIF",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_SWAP:                "OP_SWAP",
+	OP_SIZE:                "OP_SIZE",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_NOT:                 "OP_NOT",
+	OP_SHA256:              "OP_SHA256",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY:      "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+}
+
+func init() {
+	for op := OP_1; op <= OP_16; op++ {
+		opcodeNames[op] = fmt.Sprintf("OP_%d", op-OP_1+1)
+	}
+}
+
+func (op Opcode) String() string {
+	name, ok := opcodeNames[op]
+	if !ok {
+		return fmt.Sprintf("0x%02x", byte(op))
+	}
+	return name
+}
+
+// instruction is an opcode of a script and the data it pushes.
+type instruction struct {
+	op   Opcode
+	data []byte
+}
+
+// parseScript splits a script into its instructions.
+func parseScript(script []byte) ([]instruction, error) {
+	if len(script) > MAX_SCRIPT_SIZE {
+		return nil, ErrScriptTooLarge
+	}
+	var instructions []instruction
+	for i := 0; i < len(script); {
+		op := Opcode(script[i])
+		i++
+		length := 0
+		switch {
+		case op > OP_0 && op < OP_PUSHDATA1:
+			length = int(op)
+		case op == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, ErrTruncatedPush
+			}
+			length = int(script[i])
+			i++
+		case op == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, ErrTruncatedPush
+			}
+			length = int(script[i])<<8 | int(script[i+1])
+			i += 2
+		}
+		if i+length > len(script) {
+			return nil, ErrTruncatedPush
+		}
+		instructions = append(instructions,
+			instruction{op, script[i : i+length]})
+		i += length
+	}
+	return instructions, nil
+}
+
+// isPush reports whether the opcode only pushes data.
+func (op Opcode) isPush() bool {
+	return op <= OP_PUSHDATA2 || (op >= OP_1 && op <= OP_16)
+}
+
+// ScriptBuilder assembles a script from opcodes and data.
+type ScriptBuilder struct {
+	buf bytes.Buffer
+}
+
+func (b *ScriptBuilder) AddOp(op Opcode) *ScriptBuilder {
+	b.buf.WriteByte(byte(op))
+	return b
+}
+
+// AddData pushes data with the shortest push.
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	switch {
+	case len(data) == 0:
+		b.buf.WriteByte(byte(OP_0))
+	case len(data) < int(OP_PUSHDATA1):
+		b.buf.WriteByte(byte(len(data)))
+	case len(data) <= 0xff:
+		b.buf.WriteByte(byte(OP_PUSHDATA1))
+		b.buf.WriteByte(byte(len(data)))
+	default:
+		b.buf.WriteByte(byte(OP_PUSHDATA2))
+		b.buf.WriteByte(byte(len(data) >> 8))
+		b.buf.WriteByte(byte(len(data)))
+	}
+	b.buf.Write(data)
+	return b
+}
+
+// AddInt pushes a number from 0 to 16.
+func (b *ScriptBuilder) AddInt(n int) *ScriptBuilder {
+	if n == 0 {
+		return b.AddOp(OP_0)
+	}
+	return b.AddOp(OP_1 + Opcode(n-1))
+}
+
+func (b *ScriptBuilder) Script() []byte {
+	return append([]byte{}, b.buf.Bytes()...)
+}
+
+// ParseScript assembles a script written as opcode names and hex data, e.g.
+// "OP_SHA256 <hex> OP_EQUAL".
+func ParseScript(text string) ([]byte, error) {
+	b := &ScriptBuilder{}
+	for _, token := range strings.Fields(text) {
+		if strings.HasPrefix(token, "OP_") {
+			found := false
+			for op, name := range opcodeNames {
+				if name == token {
+					b.AddOp(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("Unknown opcode %s", token)
+			}
+			continue
+		}
+		data, err := hex.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid data %s", token)
+		}
+		b.AddData(data)
+	}
+	return b.Script(), nil
+}
+
+// DisassembleScript writes a script the way ParseScript reads it.
+func DisassembleScript(script []byte) (string, error) {
+	instructions, err := parseScript(script)
+	if err != nil {
+		return "", err
+	}
+	tokens := make([]string, len(instructions))
+	for i, ins := range instructions {
+		if ins.op > OP_0 && ins.op <= OP_PUSHDATA2 {
+			tokens[i] = hex.EncodeToString(ins.data)
+		} else {
+			tokens[i] = ins.op.String()
+		}
+	}
+	return strings.Join(tokens, " "), nil
+}
+
+// engine runs the script of an output an input spends.
+type engine struct {
+	transaction *Transaction
+	index       int
+	spent       Output
+	stack       [][]byte
+	// conditions holds for each open OP_IF whether its branch runs
+	conditions []bool
+}
+
+func (e *engine) push(item []byte) error {
+	if len(item) > MAX_ELEMENT_SIZE {
+		return ErrElementTooLarge
+	}
+	if len(e.stack) >= MAX_STACK_SIZE {
+		return ErrStackOverflow
+	}
+	e.stack = append(e.stack, item)
+	return nil
+}
+
+func (e *engine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, ErrEmptyStack
+	}
+	item := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return item, nil
+}
+
+func (e *engine) executing() bool {
+	for _, condition := range e.conditions {
+		if !condition {
+			return false
+		}
+	}
+	return true
+}
+
+func isTrue(item []byte) bool {
+	for _, b := range item {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func boolItem(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+// checkSig verifies signature, an input signature with its hash type, by
+// publicKey. An empty signature is false, any other that doesn't verify
+// fails the script, so a witness can't be changed to one that fails.
+func (e *engine) checkSig(signature, publicKey []byte) (bool, error) {
+	if len(signature) == 0 {
+		return false, nil
+	}
+	signature, hashType, ok := splitSignature(signature)
+	if !ok {
+		return false, ErrSignatureEncoding
+	}
+	if len(publicKey) != ed25519.PublicKeySize {
+		return false, ErrPublicKeyEncoding
+	}
+	hash, err := e.transaction.SignatureHash(e.index, e.spent, hashType)
+	if err != nil {
+		return false, err
+	}
+	if !ed25519.Verify(publicKey, hash, signature) {
+		return false, ErrNullFail
+	}
+	return true, nil
+}
+
+func (e *engine) step(ins instruction) error {
+	switch ins.op {
+	case OP_IF, OP_NOTIF:
+		condition := false
+		if e.executing() {
+			item, err := e.pop()
+			if err != nil {
+				return err
+			}
+			if len(item) > 1 || (len(item) == 1 && item[0] != 1) {
+				return ErrMinimalIf
+			}
+			condition = isTrue(item) == (ins.op == OP_IF)
+		}
+		e.conditions = append(e.conditions, condition)
+		return nil
+	case OP_ELSE:
+		if len(e.conditions) == 0 {
+			return ErrUnbalancedConditional
+		}
+		last := len(e.conditions) - 1
+		e.conditions[last] = !e.conditions[last]
+		return nil
+	case OP_ENDIF:
+		if len(e.conditions) == 0 {
+			return ErrUnbalancedConditional
+		}
+		e.conditions = e.conditions[:len(e.conditions)-1]
+		return nil
+	}
+
+	if !e.executing() {
+		return nil
+	}
+	if ins.op.isPush() {
+		if ins.op >= OP_1 {
+			return e.push([]byte{byte(ins.op - OP_1 + 1)})
+		}
+		return e.push(ins.data)
+	}
+
+	switch ins.op {
+	case OP_VERIFY:
+		item, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if !isTrue(item) {
+			return ErrScriptVerify
+		}
+	case OP_RETURN:
+		return ErrScriptReturn
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+	case OP_DUP:
+		if len(e.stack) == 0 {
+			return ErrEmptyStack
+		}
+		return e.push(e.stack[len(e.stack)-1])
+	case OP_SWAP:
+		if len(e.stack) < 2 {
+			return ErrEmptyStack
+		}
+		last := len(e.stack) - 1
+		e.stack[last], e.stack[last-1] = e.stack[last-1], e.stack[last]
+	case OP_SIZE:
+		if len(e.stack) == 0 {
+			return ErrEmptyStack
+		}
+		size := len(e.stack[len(e.stack)-1])
+		return e.push(scriptNumber(int64(size)))
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		equal := bytes.Equal(a, b)
+		if ins.op == OP_EQUALVERIFY {
+			if !equal {
+				return ErrScriptVerify
+			}
+			return nil
+		}
+		return e.push(boolItem(equal))
+	case OP_NOT:
+		item, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.push(boolItem(!isTrue(item)))
+	case OP_SHA256:
+		item, err := e.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(item)
+		return e.push(hash[:])
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		publicKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := e.pop()
+		if err != nil {
+			return err
+		}
+		valid, err := e.checkSig(signature, publicKey)
+		if err != nil {
+			return err
+		}
+		if ins.op == OP_CHECKSIGVERIFY {
+			if !valid {
+				return ErrScriptVerify
+			}
+			return nil
+		}
+		return e.push(boolItem(valid))
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		valid, err := e.checkMultisig()
+		if err != nil {
+			return err
+		}
+		if ins.op == OP_CHECKMULTISIGVERIFY {
+			if !valid {
+				return ErrScriptVerify
+			}
+			return nil
+		}
+		return e.push(boolItem(valid))
+	case OP_CHECKLOCKTIMEVERIFY:
+		return e.checkLockTime()
+	default:
+		return ErrInvalidOpcode
+	}
+	return nil
+}
+
+// scriptNumber encodes n as the shortest big-endian unsigned number, zero
+// being empty.
+func scriptNumber(n int64) []byte {
+	var number []byte
+	for ; n > 0; n >>= 8 {
+		number = append([]byte{byte(n)}, number...)
+	}
+	if number == nil {
+		return []byte{}
+	}
+	return number
+}
+
+// readScriptNumber decodes an item written by scriptNumber that is at most
+// size bytes long.
+func readScriptNumber(item []byte, size int) (int64, error) {
+	if len(item) > size || (len(item) > 0 && item[0] == 0) {
+		return 0, ErrNumberEncoding
+	}
+	var n int64
+	for _, b := range item {
+		n = n<<8 | int64(b)
+	}
+	return n, nil
+}
+
+// checkScript verifies that a new output's script can be parsed and doesn't
+// come with a public key.
+func (o *Output) checkScript() error {
+	if len(o.Script) == 0 {
+		return nil
+	}
+	if len(o.PublicKey) > 0 {
+		return ErrLockedOutput
+	}
+	_, err := parseScript(o.Script)
+	return err
+}
+
+// runScript runs the script of spent with the witness of input index. It
+// succeeds if exactly one true item is left.
+func (t *Transaction) runScript(index int, spent Output) error {
+	if len(spent.PublicKey) > 0 {
+		return ErrLockedOutput
+	}
+	instructions, err := parseScript(spent.Script)
+	if err != nil {
+		return err
+	}
+	ops := 0
+	for _, ins := range instructions {
+		if !ins.op.isPush() {
+			ops++
+		}
+		if _, ok := opcodeNames[ins.op]; !ok && !ins.op.isPush() {
+			// unknown opcodes fail the script wherever they are
+			return ErrInvalidOpcode
+		}
+	}
+	if ops > MAX_SCRIPT_OPS {
+		return ErrTooManyOps
+	}
+
+	e := &engine{transaction: t, index: index, spent: spent}
+	for _, item := range t.Inputs[index].Witness {
+		err = e.push(item)
+		if err != nil {
+			return err
+		}
+	}
+	for _, ins := range instructions {
+		err = e.step(ins)
+		if err != nil {
+			return err
+		}
+	}
+	if len(e.conditions) > 0 {
+		return ErrUnbalancedConditional
+	}
+	if len(e.stack) == 0 {
+		return ErrEmptyStack
+	}
+	if !isTrue(e.stack[len(e.stack)-1]) {
+		return ErrScriptFalse
+	}
+	if len(e.stack) != 1 {
+		return ErrCleanStack
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package blockchain
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"strings"
+	"testing"
+)
+
+// sha256("abc")
+const ABC_HASH = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+
+// scriptCases are run by TestScripts. Scripts are assembled by ParseScript
+// or, prefixed with raw:, given as hex. Witness items are hex, <empty> or
+// the signatures <sig>, <sig2> and <sig_none> of the keys <pubkey> and
+// <pubkey2>.
+var scriptCases = []struct {
+	name    string
+	witness string
+	script  string
+	err     error
+}{
+	{"true", "", "OP_1", nil},
+	{"false", "", "OP_0", ErrScriptFalse},
+	{"witness item", "01", "01 OP_EQUAL", nil},
+	{"wrong witness item", "02", "01 OP_EQUAL", ErrScriptFalse},
+	{"small number", "", "OP_16 10 OP_EQUAL", nil},
+	{"zeros are false", "0000", "OP_NOT", nil},
+	{"verify false", "00", "OP_VERIFY OP_1", ErrScriptVerify},
+	{"verify true", "01", "OP_VERIFY OP_1", nil},
+	{"items left", "01 01", "OP_1", ErrCleanStack},
+	{"nothing left", "", "OP_1 OP_DROP", ErrEmptyStack},
+	{"false on top", "01", "OP_0", ErrScriptFalse},
+
+	{"drop empty stack", "", "OP_DROP OP_1", ErrEmptyStack},
+	{"dup", "05", "OP_DUP OP_EQUAL", nil},
+	{"dup empty stack", "", "OP_DUP", ErrEmptyStack},
+	{"swap", "01 02", "OP_SWAP 01 OP_EQUALVERIFY 02 OP_EQUAL", nil},
+	{"swap one item", "01", "OP_SWAP", ErrEmptyStack},
+	{"size", "aabbcc", "OP_SIZE 03 OP_EQUALVERIFY OP_DROP OP_1", nil},
+	{"size of empty", "<empty>", "OP_SIZE OP_0 OP_EQUALVERIFY OP_DROP OP_1",
+		nil},
+	{"size empty stack", "", "OP_SIZE", ErrEmptyStack},
+	{"equal empty stack", "01", "OP_EQUAL", ErrEmptyStack},
+	{"equalverify", "01", "01 OP_EQUALVERIFY OP_1", nil},
+	{"equalverify fails", "01", "02 OP_EQUALVERIFY OP_1", ErrScriptVerify},
+	{"not true", "01", "OP_NOT OP_NOT", nil},
+	{"not empty stack", "", "OP_NOT", ErrEmptyStack},
+
+	{"return", "", "OP_RETURN", ErrScriptReturn},
+	{"return after true", "", "OP_1 OP_RETURN", ErrScriptReturn},
+	{"return not executed", "<empty>", "OP_IF OP_RETURN OP_ENDIF OP_1", nil},
+	{"if true", "01", "OP_IF OP_1 OP_ELSE OP_0 OP_ENDIF", nil},
+	{"if false", "<empty>", "OP_IF OP_1 OP_ELSE OP_0 OP_ENDIF",
+		ErrScriptFalse},
+	{"notif", "<empty>", "OP_NOTIF OP_1 OP_ELSE OP_0 OP_ENDIF", nil},
+	{"notif true", "01", "OP_NOTIF OP_1 OP_ELSE OP_0 OP_ENDIF",
+		ErrScriptFalse},
+	{"nested if", "<empty> <empty>",
+		"OP_IF OP_0 OP_ELSE OP_IF OP_0 OP_ELSE OP_1 OP_ENDIF OP_ENDIF", nil},
+	{"nested if not executed", "<empty>",
+		"OP_IF OP_IF OP_0 OP_ENDIF OP_ELSE OP_1 OP_ENDIF", nil},
+	{"if without else", "01", "OP_IF OP_1 OP_ENDIF", nil},
+	{"else twice", "01", "OP_IF OP_1 OP_ELSE OP_0 OP_ELSE OP_DROP OP_ENDIF",
+		ErrEmptyStack},
+	{"if two", "02", "OP_IF OP_1 OP_ENDIF", ErrMinimalIf},
+	{"if zero byte", "00", "OP_IF OP_1 OP_ENDIF", ErrMinimalIf},
+	{"if two bytes", "0101", "OP_IF OP_1 OP_ENDIF", ErrMinimalIf},
+	{"if empty stack", "", "OP_IF OP_1 OP_ENDIF", ErrEmptyStack},
+	{"endif without if", "", "OP_1 OP_ENDIF", ErrUnbalancedConditional},
+	{"else without if", "", "OP_ELSE OP_1", ErrUnbalancedConditional},
+	{"if without endif", "01", "OP_IF OP_1", ErrUnbalancedConditional},
+	{"if without endif not executed", "<empty>", "OP_IF OP_ELSE OP_1",
+		ErrUnbalancedConditional},
+
+	{"unknown opcode", "", "raw:b051", ErrInvalidOpcode},
+	{"unknown opcode not executed", "<empty>", "raw:63b06851",
+		ErrInvalidOpcode},
+	{"pushdata4", "", "raw:4e51", ErrInvalidOpcode},
+	{"truncated push", "", "raw:05aabb", ErrTruncatedPush},
+	{"truncated pushdata1", "", "raw:4c", ErrTruncatedPush},
+	{"truncated pushdata2", "", "raw:4d00", ErrTruncatedPush},
+	{"pushdata1", "", "raw:4c02aabb02aabb87", nil},
+	{"pushdata2", "", "raw:4d0001ff01ff87", nil},
+	{"push empty", "<empty>", "raw:00 87", nil},
+
+	{"largest script", "", "raw:51" +
+		strings.Repeat("4cff"+strings.Repeat("00", 255)+"75", 3) +
+		"4cf6" + strings.Repeat("00", 246) + "75", nil},
+	{"script too large", "", "raw:" + strings.Repeat("51", MAX_SCRIPT_SIZE+1),
+		ErrScriptTooLarge},
+	{"most ops", "",
+		"OP_1 " + strings.Repeat("OP_DUP OP_DROP ", MAX_SCRIPT_OPS/2), nil},
+	{"too many ops", "",
+		"OP_1 " + strings.Repeat("OP_DUP OP_DROP ", MAX_SCRIPT_OPS/2+1),
+		ErrTooManyOps},
+	{"ops not executed count", "<empty>", "OP_IF " +
+		strings.Repeat("OP_DUP OP_DROP ", MAX_SCRIPT_OPS/2) + "OP_ENDIF OP_1",
+		ErrTooManyOps},
+	{"largest item", strings.Repeat("00", MAX_ELEMENT_SIZE), "OP_DROP OP_1",
+		nil},
+	{"item too large", strings.Repeat("00", MAX_ELEMENT_SIZE+1),
+		"OP_DROP OP_1", ErrElementTooLarge},
+	{"largest stack", strings.Repeat("01 ", MAX_STACK_SIZE-1),
+		"OP_1 " + strings.Repeat("OP_DROP ", MAX_STACK_SIZE-1), nil},
+	{"stack too large", strings.Repeat("01 ", MAX_STACK_SIZE), "OP_1",
+		ErrStackOverflow},
+	{"witness too large", strings.Repeat("01 ", MAX_STACK_SIZE+1), "OP_1",
+		ErrStackOverflow},
+
+	{"hashlock", "616263", "OP_SHA256 " + ABC_HASH + " OP_EQUAL", nil},
+	{"hashlock wrong preimage", "616264",
+		"OP_SHA256 " + ABC_HASH + " OP_EQUAL", ErrScriptFalse},
+	{"hashlock without preimage", "", "OP_SHA256 " + ABC_HASH + " OP_EQUAL",
+		ErrEmptyStack},
+
+	{"checksig", "<sig>", "<pubkey> OP_CHECKSIG", nil},
+	{"checksig wrong key", "<sig>", "<pubkey2> OP_CHECKSIG", ErrNullFail},
+	{"checksig empty signature", "<empty>", "<pubkey> OP_CHECKSIG OP_NOT",
+		nil},
+	{"checksig malformed signature", "aabb", "<pubkey> OP_CHECKSIG",
+		ErrSignatureEncoding},
+	{"checksig malformed public key", "<sig>", "aabb OP_CHECKSIG",
+		ErrPublicKeyEncoding},
+	{"checksig empty stack", "", "OP_CHECKSIG", ErrEmptyStack},
+	{"checksig sighash none", "<sig_none>", "<pubkey> OP_CHECKSIG", nil},
+	{"checksigverify", "<sig>", "<pubkey> OP_CHECKSIGVERIFY OP_1", nil},
+	{"checksigverify empty signature", "<empty>",
+		"<pubkey> OP_CHECKSIGVERIFY OP_1", ErrScriptVerify},
+	{"either key, first", "<sig> 01",
+		"OP_IF <pubkey> OP_ELSE <pubkey2> OP_ENDIF OP_CHECKSIG", nil},
+	{"either key, second", "<sig2> <empty>",
+		"OP_IF <pubkey> OP_ELSE <pubkey2> OP_ENDIF OP_CHECKSIG", nil},
+	{"either key, wrong branch", "<sig> <empty>",
+		"OP_IF <pubkey> OP_ELSE <pubkey2> OP_ENDIF OP_CHECKSIG", ErrNullFail},
+	{"both keys", "<sig> <sig2>",
+		"<pubkey2> OP_CHECKSIGVERIFY <pubkey> OP_CHECKSIG", nil},
+	{"both keys swapped", "<sig2> <sig>",
+		"<pubkey2> OP_CHECKSIGVERIFY <pubkey> OP_CHECKSIG", ErrNullFail},
+	{"key and hashlock", "<sig> 616263", "OP_SHA256 " + ABC_HASH +
+		" OP_EQUALVERIFY <pubkey> OP_CHECKSIG", nil},
+	{"key and wrong hashlock", "<sig> 616264", "OP_SHA256 " + ABC_HASH +
+		" OP_EQUALVERIFY <pubkey> OP_CHECKSIG", ErrScriptVerify},
+
+	{"checkmultisig empty signature", "<empty>",
+		"OP_1 <pubkey> OP_1 OP_CHECKMULTISIG OP_NOT", nil},
+	{"checkmultisigverify empty signature", "<empty>",
+		"OP_1 <pubkey> OP_1 OP_CHECKMULTISIGVERIFY OP_1", ErrScriptVerify},
+	{"checkmultisig too many keys", "", "OP_1 11 OP_CHECKMULTISIG",
+		ErrMultisigKeys},
+	{"checkmultisig no keys", "", "OP_1 OP_0 OP_CHECKMULTISIG",
+		ErrMultisigKeys},
+	{"checkmultisig threshold above keys", "<empty> <empty>",
+		"OP_2 <pubkey> OP_1 OP_CHECKMULTISIG", ErrMultisigThreshold},
+	{"checkmultisig zero threshold", "",
+		"OP_0 <pubkey> OP_1 OP_CHECKMULTISIG", ErrMultisigThreshold},
+	{"checkmultisig long number", "<empty>",
+		"OP_1 <pubkey> 0001 OP_CHECKMULTISIG", ErrNumberEncoding},
+	{"checkmultisig missing keys", "", "OP_1 <pubkey> OP_2 OP_CHECKMULTISIG",
+		ErrEmptyStack},
+	{"checkmultisig missing signature", "",
+		"OP_1 <pubkey> OP_1 OP_CHECKMULTISIG", ErrEmptyStack},
+	{"checkmultisig key index out of range", "01aabb",
+		"OP_1 <pubkey> OP_1 OP_CHECKMULTISIG", ErrSignatureEncoding},
+	{"checkmultisig index without signature", "00",
+		"OP_1 <pubkey> OP_1 OP_CHECKMULTISIG", ErrSignatureEncoding},
+
+	{"checklocktimeverify zero", "",
+		"OP_0 OP_CHECKLOCKTIMEVERIFY OP_DROP OP_1", nil},
+	{"checklocktimeverify keeps item", "", "OP_0 OP_CHECKLOCKTIMEVERIFY",
+		ErrScriptFalse},
+	{"checklocktimeverify later", "",
+		"05 OP_CHECKLOCKTIMEVERIFY OP_DROP OP_1", ErrUnsatisfiedLockTime},
+	{"checklocktimeverify empty stack", "", "OP_CHECKLOCKTIMEVERIFY",
+		ErrEmptyStack},
+	{"checklocktimeverify long number", "",
+		"0102030405 OP_CHECKLOCKTIMEVERIFY", ErrNumberEncoding},
+}
+
+func TestScripts(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey2, privateKey2, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range scriptCases {
+		var script []byte
+		if strings.HasPrefix(c.script, "raw:") {
+			script, err = hex.DecodeString(strings.Replace(c.script[4:], " ",
+				"", -1))
+		} else {
+			text := strings.Replace(c.script, "<pubkey>",
+				hex.EncodeToString(publicKey), -1)
+			text = strings.Replace(text, "<pubkey2>",
+				hex.EncodeToString(publicKey2), -1)
+			script, err = ParseScript(text)
+		}
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+
+		spent := Output{[]byte{}, 50, script}
+		transaction := Transaction{[]byte{},
+			[]Input{Input{[]byte{}, []byte("input"), 0, nil, 0}},
+			[]Output{Output{publicKey, 50, []byte{}}}, 0}
+		sign := func(key ed25519.PrivateKey, hashType SigHashType) []byte {
+			hash, err := transaction.SignatureHash(0, spent, hashType)
+			if err != nil {
+				t.Fatal(c.name, err)
+			}
+			return append(ed25519.Sign(key, hash), byte(hashType))
+		}
+
+		var witness [][]byte
+		for _, token := range strings.Fields(c.witness) {
+			var item []byte
+			switch token {
+			case "<empty>":
+				item = []byte{}
+			case "<sig>":
+				item = sign(privateKey, SIGHASH_ALL)
+			case "<sig2>":
+				item = sign(privateKey2, SIGHASH_ALL)
+			case "<sig_none>":
+				item = sign(privateKey, SIGHASH_NONE)
+			default:
+				item, err = hex.DecodeString(token)
+				if err != nil {
+					t.Fatal(c.name, err)
+				}
+			}
+			witness = append(witness, item)
+		}
+		transaction.Inputs[0].Witness = witness
+
+		err = transaction.runScript(0, spent)
+		assert.Equal(t, c.err, err, c.name)
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	script, err := ParseScript("OP_SHA256 " + ABC_HASH + " OP_EQUAL")
+	assert.NoError(t, err)
+	hash, _ := hex.DecodeString(ABC_HASH)
+	expected := (&ScriptBuilder{}).AddOp(OP_SHA256).AddData(hash).
+		AddOp(OP_EQUAL).Script()
+	assert.Equal(t, expected, script)
+
+	text := "OP_IF OP_0 OP_ELSE OP_16 OP_ENDIF aabb OP_CHECKSIG"
+	script, err = ParseScript(text)
+	assert.NoError(t, err)
+	disassembled, err := DisassembleScript(script)
+	assert.NoError(t, err)
+	assert.Equal(t, text, disassembled)
+
+	_, err = ParseScript("OP_NOPE")
+	assert.Error(t, err)
+	_, err = ParseScript("xyz")
+	assert.Error(t, err)
+	_, err = DisassembleScript([]byte{0x05})
+	assert.Equal(t, ErrTruncatedPush, err)
+}
+
+func TestVerifyScriptOutput(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := ParseScript(hex.EncodeToString(publicKey) + " OP_CHECKSIG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spent := Output{[]byte{}, 50, script}
+	transaction := Transaction{[]byte{},
+		[]Input{Input{[]byte{}, []byte("input"), 0, nil, 0}},
+		[]Output{Output{publicKey, 50, []byte{}}}, 0}
+
+	// a plain signature doesn't unlock a script
+	transaction.Sign(privateKey, 0, spent, SIGHASH_ALL)
+	valid, err := transaction.Verify(spent, 0)
+	assert.False(t, valid)
+	assert.Equal(t, REASON_SCRIPT_FAILED, ReasonOf(err))
+
+	transaction.Inputs[0].Witness = [][]byte{transaction.Inputs[0].Signature}
+	transaction.Inputs[0].Signature = []byte{}
+	valid, err = transaction.Verify(spent, 0)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	// nor does a witness unlock a public key
+	valid, err = transaction.Verify(Output{publicKey, 50, []byte{}}, 0)
+	assert.False(t, valid)
+	assert.Equal(t, REASON_INVALID_SIGNATURE, ReasonOf(err))
+
+	// outputs are locked one way
+	locked := Output{publicKey, 50, script}
+	assert.Equal(t, ErrLockedOutput, locked.checkScript())
+	valid, err = transaction.Verify(locked, 0)
+	assert.False(t, valid)
+	assert.Equal(t, REASON_SCRIPT_FAILED, ReasonOf(err))
+	invalid := Output{[]byte{}, 50, []byte{0x05}}
+	assert.Equal(t, ErrTruncatedPush, invalid.checkScript())
+}
@@ -0,0 +1,111 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// SigHashType selects the parts of a transaction a signature commits to. It's
+// appended to the signature as its last byte.
+type SigHashType byte
+
+const (
+	// SIGHASH_ALL commits to all inputs and outputs.
+	SIGHASH_ALL SigHashType = 0x01
+	// SIGHASH_NONE commits to no outputs, anyone may change them.
+	SIGHASH_NONE SigHashType = 0x02
+	// SIGHASH_SINGLE commits to the output with the index of the input.
+	SIGHASH_SINGLE SigHashType = 0x03
+	// SIGHASH_ANYONECANPAY is combined with one of the above and commits
+	// to the signed input only, so others can add theirs.
+	SIGHASH_ANYONECANPAY SigHashType = 0x80
+)
+
+// SIGHASH_VERSION is the version of the signature hash. It doesn't depend on
+// the transaction's encoding version, which witnesses added after signing
+// may change, so every signature hash commits to scripts and locks.
+const SIGHASH_VERSION = 3
+
+var (
+	ErrInvalidSigHashType = errors.New("Invalid signature hash type")
+	ErrNoSingleOutput     = errors.New("No output for SIGHASH_SINGLE")
+	ErrInputIndex         = errors.New("Input index out of range")
+)
+
+func (h SigHashType) valid() bool {
+	base := h &^ SIGHASH_ANYONECANPAY
+	return base >= SIGHASH_ALL && base <= SIGHASH_SINGLE
+}
+
+// SignatureHash returns the hash the signature of input index signs. Besides
+// the parts of the transaction selected by hashType it commits to the output
+// the input spends, its amount and public key or script, and to the lock
+// time and the sequences of the committed inputs.
+func (t *Transaction) SignatureHash(index int, spent Output,
+	hashType SigHashType) ([]byte, error) {
+	if !hashType.valid() {
+		return nil, ErrInvalidSigHashType
+	}
+	if index < 0 || index >= len(t.Inputs) {
+		return nil, ErrInputIndex
+	}
+
+	e := &encoder{}
+	e.buf.WriteByte(SIGHASH_VERSION)
+	e.buf.WriteByte(byte(hashType))
+
+	inputs := t.Inputs
+	if hashType&SIGHASH_ANYONECANPAY != 0 {
+		inputs = t.Inputs[index : index+1]
+	}
+	e.uint32(uint32(len(inputs)))
+	for _, input := range inputs {
+		err := e.outpoint(input)
+		if err != nil {
+			return nil, err
+		}
+		e.uint32(input.Sequence)
+	}
+
+	e.uint32(uint32(index))
+	err := e.output(spent, SIGHASH_VERSION)
+	if err != nil {
+		return nil, err
+	}
+
+	var outputs []Output
+	switch hashType &^ SIGHASH_ANYONECANPAY {
+	case SIGHASH_ALL:
+		outputs = t.Outputs
+	case SIGHASH_SINGLE:
+		if index >= len(t.Outputs) {
+			return nil, ErrNoSingleOutput
+		}
+		outputs = t.Outputs[index : index+1]
+	}
+	e.uint32(uint32(len(outputs)))
+	for _, output := range outputs {
+		err := e.output(output, SIGHASH_VERSION)
+		if err != nil {
+			return nil, err
+		}
+	}
+	e.uint32(t.LockTime)
+
+	hash := sha256.Sum256(e.buf.Bytes())
+	return hash[:], nil
+}
+
+// splitSignature separates an input's signature into the ed25519 signature
+// and its hash type.
+func splitSignature(signature []byte) ([]byte, SigHashType, bool) {
+	if len(signature) != ed25519.SignatureSize+1 {
+		return nil, 0, false
+	}
+	hashType := SigHashType(signature[ed25519.SignatureSize])
+	if !hashType.valid() {
+		return nil, 0, false
+	}
+	return signature[:ed25519.SignatureSize], hashType, true
+}
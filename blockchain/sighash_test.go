@@ -0,0 +1,240 @@
+package blockchain
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+	"testing"
+)
+
+// sigHashVectors are the signature hashes and signatures of
+// testdata/sighash.json. The inputs spend spent and are signed with the keys
+// of seeds.
+type sigHashVectors struct {
+	Seeds       []string    `json:"seeds"`
+	Transaction Transaction `json:"transaction"`
+	Spent       []Output    `json:"spent"`
+	Cases       []struct {
+		Index     int    `json:"index"`
+		HashType  int    `json:"hash_type"`
+		Hash      string `json:"hash"`
+		Signature string `json:"signature"`
+	} `json:"cases"`
+}
+
+func TestSigHashVectors(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/sighash.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v sigHashVectors
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range v.Cases {
+		seed, err := hex.DecodeString(v.Seeds[c.Index])
+		if err != nil {
+			t.Fatal(err)
+		}
+		privateKey := ed25519.NewKeyFromSeed(seed)
+		hashType := SigHashType(c.HashType)
+
+		hash, err := v.Transaction.SignatureHash(c.Index, v.Spent[c.Index],
+			hashType)
+		assert.NoError(t, err)
+		assert.Equal(t, c.Hash, hex.EncodeToString(hash), c)
+
+		transaction := v.Transaction
+		transaction.Inputs = append([]Input{}, v.Transaction.Inputs...)
+		err = transaction.Sign(privateKey, c.Index, v.Spent[c.Index], hashType)
+		assert.NoError(t, err)
+		assert.Equal(t, c.Signature,
+			hex.EncodeToString(transaction.Inputs[c.Index].Signature), c)
+		valid, err := transaction.Verify(v.Spent[c.Index], c.Index)
+		assert.NoError(t, err)
+		assert.True(t, valid)
+	}
+}
+
+// sigHashTransaction returns a transaction with two inputs and two outputs
+// and the outputs its inputs spend, paying to keys.
+func sigHashTransaction(t *testing.T) (Transaction, []Output,
+	[]ed25519.PrivateKey) {
+	var spent []Output
+	var keys []ed25519.PrivateKey
+	for i := 0; i < 2; i++ {
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spent = append(spent, Output{publicKey, 50, []byte{}})
+		keys = append(keys, privateKey)
+	}
+	inputs := []Input{
+		Input{[]byte{}, []byte("first"), 0, nil, 0},
+		Input{[]byte{}, []byte("second"), 1, nil, 0},
+	}
+	outputs := []Output{spent[0], Output{spent[1].PublicKey, 40, []byte{}}}
+	return Transaction{[]byte{}, inputs, outputs, 0}, spent, keys
+}
+
+func TestSigHashCommitsToSpentOutput(t *testing.T) {
+	transaction, spent, keys := sigHashTransaction(t)
+	err := transaction.Sign(keys[0], 0, spent[0], SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid, err := transaction.Verify(spent[0], 0)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	// a different amount
+	valid, err = transaction.Verify(Output{spent[0].PublicKey, 49, []byte{}}, 0)
+	assert.False(t, valid)
+	assert.Equal(t, REASON_INVALID_SIGNATURE, ReasonOf(err))
+	// a different key
+	valid, err = transaction.Verify(spent[1], 0)
+	assert.False(t, valid)
+	assert.Equal(t, REASON_INVALID_SIGNATURE, ReasonOf(err))
+	// signed for another input
+	transaction.Inputs[1].Signature = transaction.Inputs[0].Signature
+	valid, err = transaction.Verify(spent[0], 1)
+	assert.False(t, valid)
+	assert.Equal(t, REASON_INVALID_SIGNATURE, ReasonOf(err))
+}
+
+func TestSigHashIgnoresWitnesses(t *testing.T) {
+	transaction, spent, keys := sigHashTransaction(t)
+	err := transaction.Sign(keys[0], 0, spent[0], SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the witness of another input raises the encoding version
+	transaction.Inputs[1].Witness = [][]byte{{1}}
+	valid, err := transaction.Verify(spent[0], 0)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+}
+
+func TestSigHashAll(t *testing.T) {
+	transaction, spent, keys := sigHashTransaction(t)
+	err := transaction.Sign(keys[0], 0, spent[0], SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transaction.Outputs[1].Amount = 45
+	valid, err := transaction.Verify(spent[0], 0)
+	assert.False(t, valid)
+	assert.Equal(t, REASON_INVALID_SIGNATURE, ReasonOf(err))
+}
+
+func TestSigHashNone(t *testing.T) {
+	transaction, spent, keys := sigHashTransaction(t)
+	err := transaction.Sign(keys[0], 0, spent[0], SIGHASH_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the outputs are anyone's to change, the inputs aren't
+	transaction.Outputs = []Output{Output{spent[1].PublicKey, 100, []byte{}}}
+	valid, err := transaction.Verify(spent[0], 0)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	transaction.Inputs[1].OutputID = 2
+	valid, err = transaction.Verify(spent[0], 0)
+	assert.False(t, valid)
+	assert.Equal(t, REASON_INVALID_SIGNATURE, ReasonOf(err))
+}
+
+func TestSigHashSingle(t *testing.T) {
+	transaction, spent, keys := sigHashTransaction(t)
+	err := transaction.Sign(keys[1], 1, spent[1], SIGHASH_SINGLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transaction.Outputs[0].Amount = 10
+	valid, err := transaction.Verify(spent[1], 1)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	transaction.Outputs[1].Amount = 45
+	valid, err = transaction.Verify(spent[1], 1)
+	assert.False(t, valid)
+	assert.Equal(t, REASON_INVALID_SIGNATURE, ReasonOf(err))
+
+	// without an output for the input there is nothing to sign
+	transaction.Outputs = transaction.Outputs[:1]
+	err = transaction.Sign(keys[1], 1, spent[1], SIGHASH_SINGLE)
+	assert.Equal(t, ErrNoSingleOutput, err)
+}
+
+func TestSigHashAnyoneCanPay(t *testing.T) {
+	transaction, spent, keys := sigHashTransaction(t)
+	transaction.Inputs = transaction.Inputs[:1]
+	err := transaction.Sign(keys[0], 0, spent[0],
+		SIGHASH_ALL|SIGHASH_ANYONECANPAY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := transaction
+	all.Inputs = []Input{transaction.Inputs[0]}
+	err = all.Sign(keys[0], 0, spent[0], SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// another party adds and signs its input
+	second := Input{[]byte{}, []byte("second"), 1, nil, 0}
+	transaction.Inputs = append(transaction.Inputs, second)
+	err = transaction.Sign(keys[1], 1, spent[1], SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := range transaction.Inputs {
+		valid, err := transaction.Verify(spent[index], index)
+		assert.NoError(t, err)
+		assert.True(t, valid)
+	}
+
+	all.Inputs = append(all.Inputs, second)
+	valid, err := all.Verify(spent[0], 0)
+	assert.False(t, valid)
+	assert.Equal(t, REASON_INVALID_SIGNATURE, ReasonOf(err))
+}
+
+func TestVerifyMalformedSignature(t *testing.T) {
+	transaction, spent, keys := sigHashTransaction(t)
+	err := transaction.Sign(keys[0], 0, spent[0], SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := transaction.Inputs[0].Signature
+
+	malformed := [][]byte{
+		[]byte{},
+		signature[:ed25519.SignatureSize],
+		append(append([]byte{}, signature[:ed25519.SignatureSize]...), 0x04),
+		append(append([]byte{}, signature...), 0x01),
+	}
+	for _, signature := range malformed {
+		transaction.Inputs[0].Signature = signature
+		valid, err := transaction.Verify(spent[0], 0)
+		assert.False(t, valid)
+		assert.Equal(t, REASON_INVALID_SIGNATURE, ReasonOf(err))
+	}
+
+	_, err = transaction.SignatureHash(0, spent[0], 0x04)
+	assert.Equal(t, ErrInvalidSigHashType, err)
+	_, err = transaction.SignatureHash(2, spent[0], SIGHASH_ALL)
+	assert.Equal(t, ErrInputIndex, err)
+}
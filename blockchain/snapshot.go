@@ -0,0 +1,520 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/InitialShape/cryptocurrency/storage"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+const (
+	SNAPSHOT_VERSION = 1
+	// MAX_SNAPSHOT_RECORD bounds a single record of a snapshot file, i.e.
+	// its header, block or one output.
+	MAX_SNAPSHOT_RECORD = MAX_MESSAGE_SIZE
+)
+
+var (
+	ErrInvalidSnapshot      = errors.New("Invalid snapshot file")
+	ErrSnapshotHashMismatch = errors.New("Snapshot doesn't match the expected hash")
+	ErrSnapshotNotEmpty     = errors.New("Snapshots can only be imported into a new database")
+	ErrSnapshotHeight       = errors.New("No block at the snapshot height")
+	ErrSnapshotHistory      = errors.New("Chain doesn't lead to the snapshot block")
+	ErrSnapshotReplay       = errors.New("Chains started from a snapshot can't replay older outputs")
+	ErrSnapshotInvalid      = errors.New("Snapshot doesn't match its history, the chain has to be synced again")
+)
+
+// SnapshotHeader starts a snapshot file. It's followed by the block at
+// Height and Count outputs in key order. Hash commits to the height, the
+// block and the outputs.
+type SnapshotHeader struct {
+	Version int
+	Magic   uint32
+	Height  int
+	Block   []byte
+	Count   int
+	Hash    []byte
+}
+
+// SnapshotInfo describes the snapshot a chain was started from. It's
+// Validated once the history below it was replayed and led to the same
+// outputs, and Invalid if it led to others. The chain isn't extended then.
+type SnapshotInfo struct {
+	Height    int
+	Block     []byte
+	Hash      []byte
+	Validated bool
+	Invalid   bool
+}
+
+type snapshotEntry struct {
+	Key    []byte
+	Output Output
+}
+
+// utxoHasher commits to a utxo set. Outputs have to be added in key order,
+// which makes the hash independent of how the set was built.
+type utxoHasher struct {
+	hash  hash.Hash
+	last  []byte
+	count int
+}
+
+func newUTXOHasher(height int, block []byte) *utxoHasher {
+	h := &utxoHasher{hash: sha256.New()}
+	h.hash.Write(heightKey(height))
+	h.write(block)
+	return h
+}
+
+func (h *utxoHasher) write(data []byte) {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(data)))
+	h.hash.Write(length)
+	h.hash.Write(data)
+}
+
+func (h *utxoHasher) add(key []byte, value []byte) error {
+	if h.count > 0 && bytes.Compare(key, h.last) <= 0 {
+		return ErrInvalidSnapshot
+	}
+	h.write(key)
+	h.write(value)
+	h.last = append(h.last[:0], key...)
+	h.count++
+	return nil
+}
+
+func (h *utxoHasher) Sum() []byte {
+	return h.hash.Sum(nil)
+}
+
+func writeRecord(w io.Writer, v interface{}) error {
+	data, err := encode(v)
+	if err != nil {
+		return err
+	}
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(data)))
+	_, err = w.Write(append(length, data...))
+	return err
+}
+
+func readRecord(r io.Reader, v interface{}) error {
+	length := make([]byte, 4)
+	_, err := io.ReadFull(r, length)
+	if err != nil {
+		return ErrInvalidSnapshot
+	}
+	size := binary.BigEndian.Uint32(length)
+	if size > MAX_SNAPSHOT_RECORD {
+		return ErrInvalidSnapshot
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return ErrInvalidSnapshot
+	}
+	err = decode(data, v)
+	if err != nil {
+		return ErrInvalidSnapshot
+	}
+	return nil
+}
+
+// utxoAt returns the utxo set as it was right after the main chain's block
+// at height. Older sets are rebuilt by replaying the chain, which needs all
+// of its blocks, so it fails on chains started from a snapshot and when
+// blocks up to height are missing.
+func (s *Store) utxoAt(height int) (map[string][]byte, error) {
+	hash, err := s.Get(BLOCKS_BUCKET, ROOT_KEY)
+	if err != nil {
+		return nil, err
+	}
+	root, err := s.GetHeader(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	utxo := make(map[string][]byte)
+	if height == root.Height {
+		err = s.DB.View(func(tx storage.Tx) error {
+			b := tx.Bucket(UTXO_BUCKET)
+			if b == nil {
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				utxo[string(k)] = append([]byte{}, v...)
+				return nil
+			})
+		})
+		return utxo, err
+	}
+
+	_, err = s.Snapshot()
+	if err == nil {
+		return nil, ErrSnapshotReplay
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	// the same changes connectBlock makes
+	replayed := -1
+	it := s.IterateBlocks(0)
+	for it.Next() && it.Block().Height <= height {
+		replayed = it.Block().Height
+		for _, transaction := range it.Block().Transactions {
+			if !transaction.IsCoinbase() {
+				for _, input := range transaction.Inputs {
+					delete(utxo, string(outputPointer(input.TransactionHash,
+						input.OutputID)))
+				}
+			}
+			for index, output := range transaction.Outputs {
+				data, err := output.GetCBOR()
+				if err != nil {
+					return nil, err
+				}
+				utxo[string(outputPointer(transaction.Hash, index))] = data
+			}
+		}
+	}
+	if it.Err() != nil {
+		return nil, it.Err()
+	}
+	if replayed != height {
+		return nil, ErrSnapshotHeight
+	}
+	return utxo, nil
+}
+
+func sortedKeys(utxo map[string][]byte) []string {
+	keys := make([]string, 0, len(utxo))
+	for key := range utxo {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// UTXOHash returns the commitment to the utxo set at the root, i.e. the hash
+// a snapshot taken now would have.
+func (s *Store) UTXOHash() ([]byte, error) {
+	root, err := s.GetRoot()
+	if err != nil {
+		return nil, err
+	}
+	utxo, err := s.utxoAt(root.Height)
+	if err != nil {
+		return nil, err
+	}
+	hasher := newUTXOHasher(root.Height, root.Hash)
+	for _, key := range sortedKeys(utxo) {
+		err = hasher.add([]byte(key), utxo[key])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hasher.Sum(), nil
+}
+
+// ExportSnapshot writes the utxo set after the main chain's block at height
+// to path.
+func (s *Store) ExportSnapshot(path string, height int) (SnapshotHeader, error) {
+	block, err := s.BlockByHeight(height)
+	if err == ErrNotFound {
+		return SnapshotHeader{}, ErrSnapshotHeight
+	} else if err != nil {
+		return SnapshotHeader{}, err
+	}
+	utxo, err := s.utxoAt(height)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+
+	keys := sortedKeys(utxo)
+	hasher := newUTXOHasher(height, block.Hash)
+	for _, key := range keys {
+		err = hasher.add([]byte(key), utxo[key])
+		if err != nil {
+			return SnapshotHeader{}, err
+		}
+	}
+	header := SnapshotHeader{SNAPSHOT_VERSION, s.Params.Magic, height,
+		block.Hash, len(keys), hasher.Sum()}
+
+	// written next to the target and moved into place once complete
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	defer os.Remove(tmp)
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	err = writeRecord(w, header)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	err = writeRecord(w, block)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	for _, key := range keys {
+		var output Output
+		err = decode(utxo[key], &output)
+		if err != nil {
+			return SnapshotHeader{}, err
+		}
+		err = writeRecord(w, snapshotEntry{[]byte(key), output})
+		if err != nil {
+			return SnapshotHeader{}, err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	err = file.Sync()
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	err = file.Close()
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	return header, os.Rename(tmp, path)
+}
+
+// ImportSnapshot starts a new chain from the snapshot at path, which has to
+// match hash. The snapshot's block becomes the root and syncing continues
+// from its height. The history below stays unvalidated until
+// ValidateSnapshot replayed it.
+func (s *Store) ImportSnapshot(path string, hash []byte) (SnapshotHeader,
+	error) {
+	root, err := s.GetRoot()
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	if root.Height != 0 {
+		return SnapshotHeader{}, ErrSnapshotNotEmpty
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+
+	var header SnapshotHeader
+	err = readRecord(r, &header)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	if header.Version != SNAPSHOT_VERSION || header.Magic != s.Params.Magic ||
+		header.Height < 1 || header.Count < 0 {
+		return SnapshotHeader{}, ErrInvalidSnapshot
+	}
+	if !bytes.Equal(header.Hash, hash) {
+		return SnapshotHeader{}, ErrSnapshotHashMismatch
+	}
+
+	var block Block
+	err = readRecord(r, &block)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	blockHash, err := block.GetHash()
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	if block.Height != header.Height || !bytes.Equal(block.Hash, blockHash) ||
+		!bytes.Equal(block.Hash, header.Block) {
+		return SnapshotHeader{}, ErrInvalidSnapshot
+	}
+
+	data, err := block.GetCBOR()
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	location, err := s.Files.Append(data)
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	err = s.Files.Sync()
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+
+	err = s.DB.Update(func(tx storage.Tx) error {
+		b, err := createBuckets(tx, BLOCKS_BUCKET, BLOCKFILES_BUCKET,
+			TRANSACTIONS_BUCKET, UTXO_BUCKET, HEIGHTS_BUCKET, SNAPSHOT_BUCKET,
+			ADDRESSES_BUCKET)
+		if err != nil {
+			return err
+		}
+		blocks, blockfiles, transactions := b[0], b[1], b[2]
+		utxo, heights, snapshot, addresses := b[3], b[4], b[5], b[6]
+
+		// the genesis outputs are part of the snapshot, if unspent
+		for _, bucket := range []storage.Bucket{utxo, addresses} {
+			err = clearBucket(bucket)
+			if err != nil {
+				return err
+			}
+		}
+
+		hasher := newUTXOHasher(header.Height, header.Block)
+		for i := 0; i < header.Count; i++ {
+			var entry snapshotEntry
+			err := readRecord(r, &entry)
+			if err != nil {
+				return err
+			}
+			value, err := entry.Output.GetCBOR()
+			if err != nil {
+				return err
+			}
+			err = hasher.add(entry.Key, value)
+			if err != nil {
+				return err
+			}
+			err = utxo.Put(entry.Key, value)
+			if err != nil {
+				return err
+			}
+			err = indexOutput(addresses, entry.Key, entry.Output,
+				header.Height)
+			if err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(hasher.Sum(), header.Hash) {
+			return ErrSnapshotHashMismatch
+		}
+
+		err = putBlockEntry(blocks, blockfiles, block, location)
+		if err != nil {
+			return err
+		}
+		err = indexTransactions(transactions, block)
+		if err != nil {
+			return err
+		}
+		err = blocks.Put(ROOT_KEY, block.Hash)
+		if err != nil {
+			return err
+		}
+		err = heights.Put(heightKey(block.Height), block.Hash)
+		if err != nil {
+			return err
+		}
+
+		info, err := encode(SnapshotInfo{header.Height, header.Block,
+			header.Hash, false, false})
+		if err != nil {
+			return err
+		}
+		return snapshot.Put(SNAPSHOT_INFO_KEY, info)
+	})
+	if err != nil {
+		return SnapshotHeader{}, err
+	}
+	log.Println("Imported snapshot at height", header.Height)
+	return header, nil
+}
+
+// Snapshot returns the snapshot the chain was started from or ErrNotFound
+// if it was synced from the genesis block.
+func (s *Store) Snapshot() (SnapshotInfo, error) {
+	var info SnapshotInfo
+	data, err := s.Get(SNAPSHOT_BUCKET, SNAPSHOT_INFO_KEY)
+	if err != nil {
+		return info, err
+	}
+	err = decode(data, &info)
+	return info, err
+}
+
+// ValidateSnapshot replays chain, which starts at the genesis block, up to
+// the snapshot's height in a separate in-memory store and checks that it
+// ends up with the snapshot's outputs. A chain that leads to the snapshot's
+// block but not to its outputs proves the snapshot wrong, which is recorded.
+func (s *Store) ValidateSnapshot(chain []Block) error {
+	info, err := s.Snapshot()
+	if err != nil || info.Validated {
+		return err
+	}
+	if info.Invalid {
+		return ErrSnapshotHashMismatch
+	}
+	if len(chain) <= info.Height ||
+		!bytes.Equal(chain[0].Hash, s.Params.GenesisHash) ||
+		!bytes.Equal(chain[info.Height].Hash, info.Block) {
+		return ErrSnapshotHistory
+	}
+
+	history := Store{}
+	peer := &Peer{}
+	err = history.OpenDB(storage.NewMemory(),
+		storage.NewMemoryFiles(BLOCK_FILE_SIZE), peer, s.Params)
+	if err != nil {
+		return err
+	}
+	peer.Store = history
+	defer history.Close()
+	defer peer.Stop()
+
+	for _, block := range chain[1 : info.Height+1] {
+		err = history.AddBlock(block)
+		if err != nil {
+			return err
+		}
+	}
+	hash, err := history.UTXOHash()
+	if err != nil {
+		return err
+	}
+	mismatch := !bytes.Equal(hash, info.Hash)
+	info.Validated = !mismatch
+	info.Invalid = mismatch
+	data, err := encode(info)
+	if err != nil {
+		return err
+	}
+	err = s.Put(SNAPSHOT_BUCKET, SNAPSHOT_INFO_KEY, data)
+	if err != nil {
+		return err
+	}
+	if mismatch {
+		return ErrSnapshotHashMismatch
+	}
+	return nil
+}
+
+// ValidateSnapshotFromPeers downloads the history below the snapshot from
+// the peers and validates it. It stops at the first chain that proves the
+// snapshot wrong.
+func (s *Store) ValidateSnapshotFromPeers() error {
+	chains, err := s.Peer.Download()
+	if err != nil {
+		return err
+	}
+	err = ErrSnapshotHistory
+	for _, chain := range chains {
+		err = s.ValidateSnapshot(chain)
+		if err == nil || err == ErrSnapshotHashMismatch {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package blockchain
+
+import (
+	"github.com/InitialShape/cryptocurrency/storage"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotWithWrongOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "utxo.snap")
+
+	source := openStore(t, filepath.Join(dir, "source"))
+	defer source.Close()
+	defer source.Peer.Stop()
+	chain := []Block{source.Params.GenesisBlock}
+	for height := 1; height <= 2; height++ {
+		coinbase, _ := newCoinbase(t, height)
+		block := newBlock(t, chain[height-1], []Transaction{coinbase})
+		assert.NoError(t, source.AddBlock(block))
+		chain = append(chain, block)
+	}
+	header, err := source.ExportSnapshot(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := Store{}
+	p := &Peer{}
+	err = s.OpenDB(storage.NewMemory(), storage.NewMemoryFiles(
+		BLOCK_FILE_SIZE), p, &RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Store = s
+	defer s.Close()
+	defer p.Stop()
+	_, err = s.ImportSnapshot(path, header.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as if the snapshot committed to other outputs
+	info, err := s.Snapshot()
+	assert.NoError(t, err)
+	info.Hash[0] ^= 1
+	data, err := encode(info)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put(SNAPSHOT_BUCKET, SNAPSHOT_INFO_KEY, data))
+
+	assert.Equal(t, ErrSnapshotHashMismatch, s.ValidateSnapshot(chain))
+	info, err = s.Snapshot()
+	assert.NoError(t, err)
+	assert.True(t, info.Invalid)
+	assert.False(t, info.Validated)
+	assert.Equal(t, ErrSnapshotHashMismatch, s.ValidateSnapshot(chain))
+
+	coinbase, _ := newCoinbase(t, 3)
+	block := newBlock(t, chain[2], []Transaction{coinbase})
+	assert.Equal(t, ErrSnapshotInvalid, s.AddBlock(block))
+}
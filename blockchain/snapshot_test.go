@@ -0,0 +1,175 @@
+package blockchain_test
+
+import (
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// snapshotChain mines five blocks, the third of which spends the first
+// block's coinbase.
+func snapshotChain(t *testing.T, store blockchain.Store) []blockchain.Block {
+	blocks := mineChain(t, store, store.Params.GenesisBlock, 2)
+	spend := spendCoinbase(t, blocks[0])
+	block := mineBlock(blocks[1], []blockchain.Transaction{spend})
+	err := store.AddBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks = append(blocks, block)
+	return append(blocks, mineChain(t, store, block, 2)...)
+}
+
+func tempSnapshot(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "utxo.snap"), func() { os.RemoveAll(dir) }
+}
+
+func TestExportImportSnapshot(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	blocks := snapshotChain(t, store)
+	path, remove := tempSnapshot(t)
+	defer remove()
+
+	header, err := store.ExportSnapshot(path, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := store.UTXOHash()
+	assert.NoError(t, err)
+	assert.Equal(t, hash, header.Hash)
+	assert.Equal(t, 5, header.Height)
+
+	imported, importedCleanup := newStore(t)
+	defer importedCleanup()
+	_, err = imported.ImportSnapshot(path, header.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := imported.GetRoot()
+	assert.NoError(t, err)
+	assert.Equal(t, blocks[4], root)
+	block, err := imported.BlockByHeight(5)
+	assert.NoError(t, err)
+	assert.Equal(t, blocks[4], block)
+	importedHash, err := imported.UTXOHash()
+	assert.NoError(t, err)
+	assert.Equal(t, hash, importedHash)
+	info, err := imported.Snapshot()
+	assert.NoError(t, err)
+	assert.False(t, info.Validated)
+
+	// syncing continues from the snapshot
+	next := mineBlock(root, []blockchain.Transaction{spendCoinbase(t, blocks[1])})
+	assert.NoError(t, imported.AddBlock(next))
+	err = imported.AddBlock(blocks[2])
+	assert.Equal(t, blockchain.REASON_BELOW_SNAPSHOT, blockchain.ReasonOf(err))
+
+	// the outputs the snapshot started from can't be replayed
+	_, err = imported.ExportSnapshot(path, 5)
+	assert.Equal(t, blockchain.ErrSnapshotReplay, err)
+}
+
+func TestExportSnapshotBelowRoot(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	blocks := snapshotChain(t, store)
+	path, remove := tempSnapshot(t)
+	defer remove()
+
+	// the same set as taken at the root back then
+	other, otherCleanup := newStore(t)
+	defer otherCleanup()
+	for _, block := range blocks[:3] {
+		assert.NoError(t, other.AddBlock(block))
+	}
+	hash, err := other.UTXOHash()
+	assert.NoError(t, err)
+
+	header, err := store.ExportSnapshot(path, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, header.Hash)
+
+	_, err = store.ExportSnapshot(path, 6)
+	assert.Equal(t, blockchain.ErrSnapshotHeight, err)
+}
+
+func TestImportSnapshotWithWrongHash(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	snapshotChain(t, store)
+	path, remove := tempSnapshot(t)
+	defer remove()
+	header, err := store.ExportSnapshot(path, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imported, importedCleanup := newStore(t)
+	defer importedCleanup()
+	wrong := append([]byte{}, header.Hash...)
+	wrong[0] ^= 1
+	_, err = imported.ImportSnapshot(path, wrong)
+	assert.Equal(t, blockchain.ErrSnapshotHashMismatch, err)
+	root, err := imported.GetRoot()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, root.Height)
+
+	// a tampered file doesn't match the hash it claims
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 1
+	assert.NoError(t, ioutil.WriteFile(path, data, 0600))
+	_, err = imported.ImportSnapshot(path, header.Hash)
+	assert.Error(t, err)
+	root, err = imported.GetRoot()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, root.Height)
+
+	// nor can a snapshot replace an existing chain
+	_, err = store.ImportSnapshot(path, header.Hash)
+	assert.Equal(t, blockchain.ErrSnapshotNotEmpty, err)
+}
+
+func TestValidateSnapshot(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	blocks := snapshotChain(t, store)
+	path, remove := tempSnapshot(t)
+	defer remove()
+	header, err := store.ExportSnapshot(path, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, importedCleanup := newStore(t)
+	defer importedCleanup()
+	_, err = imported.ImportSnapshot(path, header.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := append([]blockchain.Block{store.Params.GenesisBlock}, blocks...)
+	err = imported.ValidateSnapshot(chain[:4])
+	assert.Equal(t, blockchain.ErrSnapshotHistory, err)
+	other, otherCleanup := newStore(t)
+	defer otherCleanup()
+	fork := append([]blockchain.Block{store.Params.GenesisBlock},
+		mineChain(t, other, other.Params.GenesisBlock, 5)...)
+	err = imported.ValidateSnapshot(fork)
+	assert.Equal(t, blockchain.ErrSnapshotHistory, err)
+
+	err = imported.ValidateSnapshot(chain)
+	assert.NoError(t, err)
+	info, err := imported.Snapshot()
+	assert.NoError(t, err)
+	assert.True(t, info.Validated)
+}
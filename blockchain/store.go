@@ -4,31 +4,141 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"github.com/boltdb/bolt"
-	cbor "github.com/whyrusleeping/cbor/go"
-	"github.com/InitialShape/cryptocurrency/utils"
+	"github.com/InitialShape/cryptocurrency/storage"
+	"github.com/mr-tron/base58/base58"
+	"golang.org/x/crypto/ed25519"
 	"log"
-	"time"
+	"path/filepath"
 )
 
+// Store keeps the chain. Blocks are appended to the block files, the
+// database indexes them and holds the utxo set, the mempool and the peers.
+// With a PruneDepth, block files more than that many blocks below the root
+// are removed.
 type Store struct {
-	DB   *bolt.DB
-	Peer *Peer
+	DB         storage.DB
+	Files      storage.Files
+	Peer       *Peer
+	Params     *ChainParams
+	PruneDepth int
 }
 
-func (s *Store) Open(location string, peer *Peer) error {
-	db, err := bolt.Open(location, 0600, &bolt.Options{Timeout: 1 * time.Second})
+// Open opens the BoltDB file at location and the block files in the blocks
+// directory next to it.
+func (s *Store) Open(location string, peer *Peer, params *ChainParams) error {
+	db, err := storage.OpenBolt(location)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
+	files, err := storage.OpenFiles(filepath.Join(filepath.Dir(location),
+		"blocks"), BLOCK_FILE_SIZE)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	return s.OpenDB(db, files, peer, params)
+}
+
+// OpenDB sets the store up on any storage backend, e.g. storage.NewMemory()
+// and storage.NewMemoryFiles() in tests.
+func (s *Store) OpenDB(db storage.DB, files storage.Files, peer *Peer,
+	params *ChainParams) error {
 	s.DB = db
+	s.Files = files
 	s.Peer = peer
+	s.Params = params
+
+	err := s.migrate()
+	if err == nil {
+		err = s.initGenesisBlock()
+	}
+	if err != nil {
+		db.Close()
+		files.Close()
+		return err
+	}
 	return err
 }
 
+// Close flushes the database and the block files to disk and closes them.
+func (s *Store) Close() error {
+	err := s.Files.Sync()
+	if err == nil {
+		err = s.DB.Sync()
+	}
+	if err != nil {
+		s.Files.Close()
+		s.DB.Close()
+		return err
+	}
+	err = s.Files.Close()
+	if err != nil {
+		s.DB.Close()
+		return err
+	}
+	return s.DB.Close()
+}
+
+// initGenesisBlock stores the network's genesis block in a new database and
+// makes sure an existing database was created for the same network.
+func (s *Store) initGenesisBlock() error {
+	err := s.Params.VerifyGenesisBlock()
+	if err != nil {
+		return err
+	}
+
+	genesis, err := s.Get(BLOCKS_BUCKET, GENESIS_KEY)
+	if err == ErrNotFound {
+		_, err = s.Get(BLOCKS_BUCKET, ROOT_KEY)
+		if err == ErrNotFound {
+			log.Println("Initializing new database for", s.Params.Name)
+			err = s.storeGenesisBlock()
+			if err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		// databases that predate the genesis key are checked for the
+		// network's genesis block
+		genesis = []byte{}
+		if _, err := s.getBlockEntry(s.Params.GenesisHash); err == nil {
+			genesis = s.Params.GenesisHash
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(genesis, s.Params.GenesisHash) {
+		return fmt.Errorf("Database doesn't belong to %s, its genesis block "+
+			"is %s instead of %s", s.Params.Name, base58.Encode(genesis),
+			base58.Encode(s.Params.GenesisHash))
+	}
+	err = s.Put(BLOCKS_BUCKET, GENESIS_KEY, genesis)
+	if err != nil {
+		return err
+	}
+	return s.indexHeights()
+}
+
+func (s *Store) storeGenesisBlock() error {
+	block := s.Params.GenesisBlock
+
+	// the genesis block is connected like any other block, but without
+	// being gossiped
+	for index, transaction := range block.Transactions {
+		_, err := s.VerifyTransaction(transaction, index)
+		if err != nil {
+			return err
+		}
+	}
+	return s.storeBlock(block)
+}
+
 func (s *Store) Put(bucket []byte, key []byte, value []byte) error {
-	err := s.DB.Update(func(tx *bolt.Tx) error {
+	err := s.DB.Update(func(tx storage.Tx) error {
 		b, err := tx.CreateBucketIfNotExists(bucket)
 		if err != nil {
 			return err
@@ -42,17 +152,17 @@ func (s *Store) Put(bucket []byte, key []byte, value []byte) error {
 
 func (s *Store) Get(bucket []byte, key []byte) ([]byte, error) {
 	var data []byte
-	err := s.DB.View(func(tx *bolt.Tx) error {
+	err := s.DB.View(func(tx storage.Tx) error {
 		b := tx.Bucket(bucket)
 		if b != nil {
 			v := b.Get(key)
 			data = append(data, v...)
 			if v == nil {
-				return errors.New("EOF")
+				return ErrNotFound
 			}
 			return nil
 		} else {
-			return errors.New("Bucket access error")
+			return ErrNotFound
 		}
 	})
 
@@ -60,104 +170,122 @@ func (s *Store) Get(bucket []byte, key []byte) ([]byte, error) {
 }
 
 func (s *Store) Delete(bucket []byte, key []byte) error {
-	err := s.DB.Update(func(tx *bolt.Tx) error {
+	err := s.DB.Update(func(tx storage.Tx) error {
 		b := tx.Bucket(bucket)
 		if b != nil {
 			err := b.Delete(key)
 			return err
 		} else {
-			return errors.New("Bucket access error")
+			return ErrNotFound
 		}
 	})
 
 	return err
 }
 
-func (s *Store) StoreGenesisBlock(difficulty int) (Block, error) {
-	publicKey, privateKey, err := utils.GetWallet()
-
-	block, err := GenerateGenesisBlock(publicKey, privateKey, difficulty)
+// AddTransaction adds a transaction to the mempool. Its ID is derived if it
+// doesn't claim one. Of transactions with the same ID but different
+// signatures the first one is kept. Transactions whose locks don't allow
+// them in the next block are held until they do.
+func (s *Store) AddTransaction(transaction Transaction) error {
+	if len(transaction.Hash) == 0 {
+		hash, err := transaction.GetHash()
+		if err != nil {
+			return err
+		}
+		transaction.Hash = hash
+	}
+	err := transaction.CheckHash()
 	if err != nil {
-		return Block{}, err
+		return err
 	}
-
-	s.AddBlock(block)
-	base58Hash, err := block.GetBase58Hash()
+	data, err := transaction.Encode()
 	if err != nil {
-		return Block{}, err
+		return err
 	}
-	log.Println(base58Hash)
-	return block, err
-}
 
-func (s *Store) AddTransaction(transaction Transaction) error {
-	cbor, err := transaction.GetCBOR()
+	_, err = s.Get(MEMPOOL_BUCKET, transaction.Hash)
+	if err == nil {
+		return nil
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	// transactions that aren't final yet wait until they are
+	height, medianTime, err := s.nextBlockLocks()
 	if err != nil {
 		return err
 	}
+	err = s.CheckLocks(transaction, height, medianTime)
+	if ReasonOf(err) == REASON_NON_FINAL {
+		return s.holdTransaction(transaction, data)
+	} else if err != nil {
+		return err
+	}
 
-	transactionMempool, err := s.GetTransaction(transaction.Hash, true)
-	// TODO: Ideally we'd check for an empty struct here
-	if len(transactionMempool.Hash) == 0 {
-		transactionBlocks, _ := s.GetTransaction(transaction.Hash, false)
-		if len(transactionBlocks.Hash) == 0 {
-			go s.Peer.GossipTransaction(transaction)
-		}
+	_, err = s.Get(TRANSACTIONS_BUCKET, transaction.Hash)
+	if err == ErrNotFound {
+		s.Peer.spawn(func() { s.Peer.GossipTransaction(transaction) })
 	}
 
-	err = s.Put([]byte("mempool"), transaction.Hash, cbor)
+	err = s.Put(MEMPOOL_BUCKET, transaction.Hash, data)
 	return err
 }
 
 func (s *Store) AddPeer(peer string) error {
-	err := s.Put([]byte("peers"), []byte(peer), []byte(peer))
+	err := s.Put(PEERS_BUCKET, []byte(peer), []byte(peer))
 	return err
 }
 
+// GetTransaction returns a transaction of the mempool or, read from its
+// block, a confirmed one.
 func (s *Store) GetTransaction(hash []byte, mempool bool) (Transaction, error) {
-	var data []byte
-	var err error
 	if mempool {
-		data, err = s.Get([]byte("mempool"), hash)
-	} else {
-		data, err = s.Get([]byte("transactions"), hash)
+		data, err := s.Get(MEMPOOL_BUCKET, hash)
+		if err != nil {
+			return Transaction{}, err
+		}
+		return DecodeTransaction(data)
 	}
+
+	data, err := s.Get(TRANSACTIONS_BUCKET, hash)
 	if err != nil {
 		return Transaction{}, err
 	}
-
-	var transaction Transaction
-	dec := cbor.NewDecoder(bytes.NewReader(data))
-	err = dec.Decode(&transaction)
+	var entry transactionEntry
+	err = decode(data, &entry)
 	if err != nil {
 		return Transaction{}, err
 	}
-
-	return transaction, err
+	block, err := s.GetBlock(entry.Block)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if entry.Index >= len(block.Transactions) {
+		return Transaction{}, ErrNotFound
+	}
+	return block.Transactions[entry.Index], nil
 }
 
 func (s *Store) GetTransactions() ([]Transaction, error) {
 	var transactions []Transaction
 
-	err := s.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("mempool"))
+	err := s.DB.View(func(tx storage.Tx) error {
+		b := tx.Bucket(MEMPOOL_BUCKET)
 
-		if b != nil {
-			b.ForEach(func(k, v []byte) error {
-				var transaction Transaction
-				dec := cbor.NewDecoder(bytes.NewReader(v))
-				err := dec.Decode(&transaction)
-				if err != nil {
-					return err
-				}
-				transactions = append(transactions, transaction)
-
-				return nil
-			})
-		} else {
-			return errors.New("Bucket access error")
+		if b == nil {
+			// nothing was ever added to the mempool
+			return nil
 		}
-		return nil
+		return b.ForEach(func(k, v []byte) error {
+			transaction, err := DecodeTransaction(v)
+			if err != nil {
+				return err
+			}
+			transactions = append(transactions, transaction)
+
+			return nil
+		})
 	})
 
 	return transactions, err
@@ -165,8 +293,8 @@ func (s *Store) GetTransactions() ([]Transaction, error) {
 
 func (s *Store) GetPeers() ([]string, error) {
 	var peers []string
-	err := s.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("peers"))
+	err := s.DB.View(func(tx storage.Tx) error {
+		b := tx.Bucket(PEERS_BUCKET)
 
 		if b != nil {
 			b.ForEach(func(k, v []byte) error {
@@ -176,135 +304,327 @@ func (s *Store) GetPeers() ([]string, error) {
 			})
 			return nil
 		} else {
-			return errors.New("Bucket access error")
+			return ErrNotFound
 		}
 	})
 	return peers, err
 }
 
 func (s *Store) DeletePeer(peer string) error {
-	err := s.Delete([]byte("peers"), []byte(peer))
+	err := s.Delete(PEERS_BUCKET, []byte(peer))
 	return err
 }
 
+func (s *Store) GetBlock(hash []byte) (Block, error) {
+	entry, err := s.getBlockEntry(hash)
+	if err != nil {
+		return Block{}, err
+	}
+	return s.readBlock(entry.Location)
+}
+
+func (s *Store) GetRoot() (Block, error) {
+	hash, err := s.Get(BLOCKS_BUCKET, ROOT_KEY)
+	if err != nil {
+		return Block{}, err
+	}
+	return s.GetBlock(hash)
+}
+
 func (s *Store) GetChain() ([]Block, error) {
 	var blocks []Block
-	previousBlock, err := s.Get([]byte("blocks"), []byte("root"))
-	if err != nil {
-		return blocks, err
+	it := s.IterateBlocks(0)
+	for it.Next() {
+		blocks = append(blocks, it.Block())
 	}
+	return blocks, it.Err()
+}
 
-	for {
-		data, err := s.Get([]byte("blocks"), previousBlock)
-		if err != nil {
-			return blocks, err
-		}
+func (s *Store) VerifyTransaction(transaction Transaction, index int) (bool, error) {
+	_, err := s.TransactionFee(transaction, index)
+	return err == nil, err
+}
+
+// addAmount adds amount to total. It fails for negative amounts and sums
+// that overflow.
+func addAmount(total int, amount int) (int, error) {
+	if amount < 0 || total+amount < total {
+		return 0, invalidTransaction(REASON_INVALID_AMOUNT,
+			"Amount is negative or too large")
+	}
+	return total + amount, nil
+}
 
-		var root Block
-		dec := cbor.NewDecoder(bytes.NewReader(data))
-		err = dec.Decode(&root)
+// TransactionFee verifies transaction as the one at index of a block on top
+// of the root and returns what the outputs it spends are worth beyond its
+// outputs. A coinbase has no fee.
+func (s *Store) TransactionFee(transaction Transaction, index int) (int, error) {
+	outputs := 0
+	for _, output := range transaction.Outputs {
+		// outputs without a script could never be spent otherwise
+		if len(output.Script) == 0 &&
+			len(output.PublicKey) != ed25519.PublicKeySize {
+			return 0, invalidTransaction(REASON_INVALID_PUBLIC_KEY,
+				"Output isn't locked to a valid public key")
+		}
+		err := output.checkScript()
 		if err != nil {
-			return blocks, err
+			return 0, invalidTransaction(REASON_INVALID_SCRIPT,
+				err.Error())
 		}
-
-		// preprend
-		blocks = append([]Block{root}, blocks...)
-
-		if len(root.PreviousBlock) > 0 {
-			previousBlock = root.PreviousBlock
-		} else {
-			break
+		outputs, err = addAmount(outputs, output.Amount)
+		if err != nil {
+			return 0, err
 		}
 	}
-	return blocks, nil
-}
 
-func (s *Store) VerifyTransaction(transaction Transaction, index int) (bool, error) {
 	// TODO: Cannot verify if dependent transaction is in block
-	if index == 0 && len(transaction.Inputs[0].TransactionHash) == 0 &&
-		transaction.Inputs[0].OutputID == 0 {
-		return true, nil
+	if index == 0 && transaction.IsCoinbase() {
+		// its outputs would replace those of the existing one
+		_, err := s.Get(TRANSACTIONS_BUCKET, transaction.Hash)
+		if err == nil {
+			return 0, invalidTransaction(REASON_DUPLICATE_TRANSACTION,
+				"Coinbase exists already")
+		} else if err != ErrNotFound {
+			return 0, err
+		}
+		return 0, nil
 	}
 
-	_, err := s.GetTransaction(transaction.Hash, false)
-	if err != nil && (err.Error() == "Bucket access error" || err.Error() == "EOF") {
-		// Check if transactions are valid here
+	_, err := s.Get(TRANSACTIONS_BUCKET, transaction.Hash)
+	if err == ErrNotFound {
+		if len(transaction.Inputs) == 0 {
+			return 0, invalidTransaction(REASON_MISSING_INPUT,
+				"Transaction doesn't have inputs")
+		}
+		spent := make(map[string]bool)
+		for _, input := range transaction.Inputs {
+			pointer := string(outputPointer(input.TransactionHash,
+				input.OutputID))
+			if spent[pointer] {
+				return 0, invalidTransaction(REASON_DUPLICATE_INPUT,
+					"Transaction spends an output twice")
+			}
+			spent[pointer] = true
+		}
+		// every input signs its own signature hash
+		inputs := 0
 		for index, input := range transaction.Inputs {
-			inputTransaction, err := s.GetTransaction(input.TransactionHash, false)
-
-			if err != nil && (err.Error() == "Bucket access error" ||
-				err.Error() == "EOF") {
-				return false, errors.New("Input transaction doesn't exist")
-			} else {
-				pointer := fmt.Sprintf("-%d", index)
-				pointerBytes := append(input.TransactionHash, pointer...)
-				_, err := s.Get([]byte("utxo"), pointerBytes)
-				if err != nil && (err.Error() == "Bucket access error" ||
-					err.Error() == "EOF") {
-					// output unspendable as doesn't exist
-					return false, errors.New("Output doesn't exist (anymore?)")
-				} else {
-					inputPublicKey := inputTransaction.Outputs[index].PublicKey
-					return transaction.Verify(inputPublicKey, index)
+			// the output is read from the utxo set rather than its block,
+			// which may be pruned or predate the snapshot the chain was
+			// started from
+			data, err := s.Get(UTXO_BUCKET, outputPointer(
+				input.TransactionHash, input.OutputID))
+			if err == ErrNotFound {
+				_, err = s.Get(TRANSACTIONS_BUCKET, input.TransactionHash)
+				if err == ErrNotFound {
+					return 0, invalidTransaction(REASON_MISSING_INPUT,
+						"Input transaction doesn't exist")
+				} else if err != nil {
+					return 0, err
 				}
+				// output unspendable as doesn't exist
+				return 0, invalidTransaction(REASON_SPENT_OUTPUT,
+					"Output doesn't exist (anymore?)")
+			} else if err != nil {
+				return 0, err
+			}
+			var output Output
+			err = decode(data, &output)
+			if err != nil {
+				return 0, err
+			}
+			valid, err := transaction.Verify(output, index)
+			if !valid {
+				if err == nil {
+					err = invalidTransaction(REASON_INVALID_SIGNATURE,
+						"Invalid signature")
+				}
+				return 0, err
+			}
+			inputs, err = addAmount(inputs, output.Amount)
+			if err != nil {
+				return 0, err
 			}
 		}
-		return false, errors.New("Shouldn't reach statement")
+		// nothing is created but the coinbase
+		if inputs < outputs {
+			return 0, invalidTransaction(REASON_NEGATIVE_FEE,
+				"Outputs are worth more than the inputs")
+		}
+		return inputs - outputs, nil
 	} else if err == nil {
-		fmt.Println("Transaction with hash exists already", transaction.Hash, index)
-		return false, errors.New("Transaction exists already")
+		log.Println("Transaction with hash exists already", transaction.Hash, index)
+		return 0, ErrTransactionExists
 	} else {
-		// should not be reached
-		log.Fatal(err)
-		return false, err
+		return 0, err
 	}
 }
 
+// crashPoint is called between the writes of a block connection. Tests
+// replace it to simulate a crash halfway through.
+var crashPoint = func(step string) {}
+
+// storeBlock connects a verified block. The block is appended to the block
+// files and synced to disk first, then its index entries, the spent and
+// created outputs, the new root and the pruned mempool are written in a
+// single transaction, so a block is applied fully or not at all and the
+// database never refers to a record a power loss could drop. A crash in
+// between leaves just an unreferenced record in the block files.
 func (s *Store) storeBlock(block Block) error {
-	cbor, err := block.GetCBOR()
+	data, err := block.GetCBOR()
 	if err != nil {
 		return err
 	}
-
-	err = s.Put([]byte("blocks"), block.Hash, cbor)
+	location, err := s.Files.Append(data)
 	if err != nil {
-		log.Fatal("Error storing block", err)
 		return err
 	}
-	err = s.Put([]byte("blocks"), []byte("root"), block.Hash)
+	err = s.Files.Sync()
+	if err != nil {
+		return err
+	}
+	crashPoint("files")
+
+	err = s.DB.Update(func(tx storage.Tx) error {
+		return connectBlock(tx, block, location)
+	})
 	if err != nil {
-		log.Fatal("Error overwriting root", err)
 		return err
 	}
 	log.Println("Block added successfully")
 
-	// store transactions in transactions bucket
-	for _, transaction := range block.Transactions {
-		transactionCbor, err := transaction.GetCBOR()
+	err = s.prune(block.Height)
+	if err != nil {
+		log.Println("Error pruning block files", err)
+	}
+	return nil
+}
+
+func connectBlock(tx storage.Tx, block Block, location storage.Location) error {
+	b, err := createBuckets(tx, BLOCKS_BUCKET, BLOCKFILES_BUCKET,
+		TRANSACTIONS_BUCKET, UTXO_BUCKET, MEMPOOL_BUCKET, ADDRESSES_BUCKET)
+	if err != nil {
+		return err
+	}
+	blocks, blockfiles := b[0], b[1]
+
+	err = putBlockEntry(blocks, blockfiles, block, location)
+	if err != nil {
+		return err
+	}
+	crashPoint("block")
+
+	err = connectTransactions(b[2], b[3], b[4], b[5], block)
+	if err != nil {
+		return err
+	}
+
+	err = blocks.Put(ROOT_KEY, block.Hash)
+	if err != nil {
+		return err
+	}
+	crashPoint("root")
+
+	err = indexMainChain(tx, block.Header())
+	if err != nil {
+		return err
+	}
+	crashPoint("heights")
+	return nil
+}
+
+// connectTransactions indexes the block's transactions, spends their inputs,
+// adds their outputs to the utxo set and the addresses of their keys and
+// drops them from the mempool.
+func connectTransactions(transactions storage.Bucket, utxo storage.Bucket,
+	mempool storage.Bucket, addresses storage.Bucket, block Block) error {
+	for index, transaction := range block.Transactions {
+		if transactions.Get(transaction.Hash) != nil {
+			return invalidBlock(REASON_DUPLICATE_TRANSACTION,
+				"Transaction exists already")
+		}
+		entry, err := encode(transactionEntry{block.Hash, index})
 		if err != nil {
-			log.Fatal("Couldn't transform transaction to cbor: ", err)
 			return err
 		}
-		err = s.Put([]byte("transactions"), transaction.Hash,
-			transactionCbor)
+		err = transactions.Put(transaction.Hash, entry)
 		if err != nil {
-			log.Fatal("Error storing transaction", err)
 			return err
 		}
+		crashPoint("transaction")
+
+		if !transaction.IsCoinbase() {
+			for _, input := range transaction.Inputs {
+				pointer := outputPointer(input.TransactionHash,
+					input.OutputID)
+				// transactions are verified against the utxo set before
+				// the block, so one may spend an output another one of
+				// the block spent already
+				if utxo.Get(pointer) == nil {
+					return invalidBlock(REASON_SPENT_OUTPUT,
+						"Output is spent twice in the block")
+				}
+				err = spendIndexedOutput(addresses, utxo, pointer,
+					transaction.Hash)
+				if err != nil {
+					return err
+				}
+				err = utxo.Delete(pointer)
+				if err != nil {
+					return err
+				}
+				crashPoint("spend")
+			}
+		}
 
 		for index, output := range transaction.Outputs {
 			outputCbor, err := output.GetCBOR()
 			if err != nil {
-				log.Fatal("Error encoding output to cbor", err)
 				return err
 			}
+			pointer := outputPointer(transaction.Hash, index)
+			err = utxo.Put(pointer, outputCbor)
+			if err != nil {
+				return err
+			}
+			err = indexOutput(addresses, pointer, output, block.Height)
+			if err != nil {
+				return err
+			}
+			crashPoint("output")
+		}
 
-			pointer := fmt.Sprintf("-%d", index)
-			pointerBytes := append(transaction.Hash, pointer...)
-			err = s.Put([]byte("utxo"), pointerBytes, outputCbor)
+		err = mempool.Delete(transaction.Hash)
+		if err != nil {
+			return err
 		}
+		crashPoint("mempool")
 	}
-	return err
+	return nil
+}
+
+// indexTransactions points the transaction index at the block's
+// transactions.
+func indexTransactions(transactions storage.Bucket, block Block) error {
+	for index, transaction := range block.Transactions {
+		entry, err := encode(transactionEntry{block.Hash, index})
+		if err != nil {
+			return err
+		}
+		err = transactions.Put(transaction.Hash, entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outputPointer is the key of a transaction's output in the utxo bucket.
+func outputPointer(hash []byte, index int) []byte {
+	pointer := make([]byte, len(hash), len(hash)+8)
+	copy(pointer, hash)
+	return append(pointer, fmt.Sprintf("-%d", index)...)
 }
 
 func (s *Store) EvaluateChains(chains [][]Block) ([]Block, error) {
@@ -332,8 +652,38 @@ func (s *Store) EvaluateChains(chains [][]Block) ([]Block, error) {
 }
 
 func (s *Store) AddBlock(block Block) error {
-	if len(block.PreviousBlock) != 0 {
-		data, err := s.Get([]byte("blocks"), block.PreviousBlock)
+	if len(block.PreviousBlock) == 0 {
+		// there's only one block without predecessor and it's known
+		// already
+		if bytes.Equal(block.Hash, s.Params.GenesisHash) {
+			return invalidBlock(REASON_GENESIS_EXISTS,
+				"Genesis block exists already")
+		}
+		return invalidBlock(REASON_NO_PREVIOUS_BLOCK,
+			"Block doesn't have a previous block")
+	} else if info, err := s.Snapshot(); err == nil && info.Invalid {
+		// everything built on the snapshot's outputs is wrong as well
+		return ErrSnapshotInvalid
+	} else if err == nil && block.Height <= info.Height {
+		// the history below a snapshot isn't connected
+		return invalidBlock(REASON_BELOW_SNAPSHOT,
+			"Block is below the snapshot the chain was started from")
+	} else {
+		hash, err := block.GetHash()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash, block.Hash) {
+			return invalidBlock(REASON_INVALID_HASH,
+				"Block hash doesn't match its header")
+		}
+		// a block can't declare its own work, it's the network's
+		if block.Difficulty != s.Params.Difficulty {
+			return invalidBlock(REASON_WRONG_DIFFICULTY,
+				"Block difficulty isn't the network's")
+		}
+
+		root, err := s.GetHeader(block.PreviousBlock)
 		if err != nil {
 			log.Println("Chain ran out of sync, getting blocks from peers")
 			chains, err := s.Peer.Download()
@@ -352,60 +702,101 @@ func (s *Store) AddBlock(block Block) error {
 			}
 		}
 
-		var root Block
-		dec := cbor.NewDecoder(bytes.NewReader(data))
-		err = dec.Decode(&root)
+		root, err = s.GetHeader(block.PreviousBlock)
 		if err != nil {
 			return err
 		}
 
-		if HashMatchesDifficulty(block.Hash, root.Difficulty) {
+		if HashMatchesDifficulty(block.Hash, s.Params.Difficulty) {
 			// noop
 		} else {
-			return errors.New("Difficulty too low")
+			return invalidBlock(REASON_DIFFICULTY_TOO_LOW, "Difficulty too low")
+		}
+
+		if block.Height != root.Height+1 {
+			return invalidBlock(REASON_WRONG_HEIGHT,
+				"Block height doesn't follow its previous block")
 		}
 	}
 
+	medianTime, err := s.checkBlockTime(block, block.PreviousBlock)
+	if err != nil {
+		return err
+	}
+
+	// the coinbase commits to the height, so that it's unique
+	coinbase := len(block.Transactions) > 0 &&
+		block.Transactions[0].IsCoinbase()
+	if coinbase && block.Transactions[0].Inputs[0].OutputID != block.Height {
+		return invalidBlock(REASON_COINBASE_HEIGHT,
+			"Coinbase doesn't commit to the block height")
+	}
+
+	// transactions are indexed by their IDs, which they can't choose
+	for _, transaction := range block.Transactions {
+		err := transaction.CheckHash()
+		if err != nil {
+			return err
+		}
+	}
 
 	// check for duplicates in block
 	visited := make(map[string]bool)
 	for _, transaction := range block.Transactions {
 		if visited[string(transaction.Hash)] {
-			return errors.New("Transaction duplicate in block")
+			return invalidBlock(REASON_DUPLICATE_TRANSACTION,
+				"Transaction duplicate in block")
 		} else {
 			visited[string(transaction.Hash)] = true
 		}
 	}
 
 	// verify transactions' integrity
+	fees := 0
 	for index, transaction := range block.Transactions {
-		_, err := s.VerifyTransaction(transaction, index)
+		fee, err := s.TransactionFee(transaction, index)
+		if err != nil {
+			return err
+		}
+		err = s.CheckLocks(transaction, block.Height, medianTime)
+		if err != nil {
+			return err
+		}
+		fees, err = addAmount(fees, fee)
 		if err != nil {
 			return err
 		}
 	}
 
-	_, err := s.Get([]byte("blocks"), block.Hash)
-	if err != nil {
-		go s.Peer.GossipBlock(block)
+	// the coinbase may not mint more than the network allows, besides
+	// collecting the fees
+	if coinbase {
+		amount := 0
+		for _, output := range block.Transactions[0].Outputs {
+			amount += output.Amount
+		}
+		if amount-fees > s.Params.CoinbaseAmount {
+			return invalidBlock(REASON_COINBASE_TOO_HIGH,
+				"Coinbase amount too high")
+		}
 	}
 
+	_, err = s.Get(BLOCKS_BUCKET, block.Hash)
+	known := err == nil
+
 	err = s.storeBlock(block)
 	if err != nil {
-		log.Fatal("Error storing block", err)
+		log.Println("Error storing block", err)
 		return err
 	}
 
-	// delete all transactions from mempool
-	for _, transaction := range block.Transactions {
-		s.Delete([]byte("mempool"), transaction.Hash)
-
-		for index, input := range transaction.Inputs {
-			pointer := fmt.Sprintf("-%d", index)
-			pointerBytes := append(input.TransactionHash, pointer...)
-			s.Delete([]byte("utxo"), pointerBytes)
-		}
+	err = s.releaseHeld()
+	if err != nil {
+		log.Println("Error releasing held transactions", err)
 	}
 
-	return err
+	if !known {
+		s.Peer.spawn(func() { s.Peer.GossipBlock(block) })
+	}
+	return nil
 }
@@ -0,0 +1,184 @@
+package blockchain
+
+import (
+	"crypto/rand"
+	"github.com/InitialShape/cryptocurrency/storage"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openStore(t *testing.T, location string) Store {
+	s := Store{}
+	p := &Peer{}
+	err := s.Open(location, p, &RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Store = s
+	return s
+}
+
+// snapshot dumps every bucket of the store.
+func snapshot(t *testing.T, s Store) map[string]map[string]string {
+	buckets := make(map[string]map[string]string)
+	err := s.DB.View(func(tx storage.Tx) error {
+		return tx.ForEach(func(name []byte, b storage.Bucket) error {
+			values := make(map[string]string)
+			buckets[string(name)] = values
+			return b.ForEach(func(k, v []byte) error {
+				values[string(k)] = string(v)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buckets
+}
+
+func newCoinbase(t *testing.T, height int) (Transaction,
+	ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := GenerateCoinbase(publicKey, privateKey, height,
+		RegTestParams.CoinbaseAmount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return coinbase, privateKey
+}
+
+func newBlock(t *testing.T, previous Block, transactions []Transaction) Block {
+	block := Block{previous.Height + 1, []byte{}, transactions, previous.Hash,
+		previous.Difficulty, 0, previous.Timestamp + 1}
+	for {
+		hash, err := block.GetHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if HashMatchesDifficulty(hash, previous.Difficulty) {
+			block.Hash = hash
+			return block
+		}
+		block.Nonce++
+	}
+}
+
+func TestConnectBlockIsAtomic(t *testing.T) {
+	steps := []string{"files", "block", "transaction", "spend", "output",
+		"mempool", "root", "heights"}
+
+	for _, step := range steps {
+		dir, err := ioutil.TempDir("", "crash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		location := filepath.Join(dir, "db")
+		s := openStore(t, location)
+
+		coinbase, privateKey := newCoinbase(t, 1)
+		first := newBlock(t, s.Params.GenesisBlock, []Transaction{coinbase})
+		err = s.AddBlock(first)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		spend := Transaction{[]byte{},
+			[]Input{{[]byte{}, coinbase.Hash, 0, nil, 0}}, coinbase.Outputs, 0}
+		spend.Hash, err = spend.GetHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = spend.Sign(privateKey, 0, coinbase.Outputs[0], SIGHASH_ALL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.AddTransaction(spend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secondCoinbase, _ := newCoinbase(t, 2)
+		second := newBlock(t, first, []Transaction{secondCoinbase, spend})
+
+		before := snapshot(t, s)
+		crashPoint = func(current string) {
+			if current == step {
+				panic("crash at " + step)
+			}
+		}
+		assert.Panics(t, func() { s.AddBlock(second) }, step)
+		crashPoint = func(string) {}
+
+		// nothing of the block may survive a restart
+		s.Peer.Stop()
+		assert.NoError(t, s.Close())
+		s = openStore(t, location)
+		assert.Equal(t, before, snapshot(t, s), step)
+
+		err = s.AddBlock(second)
+		assert.NoError(t, err, step)
+		root, err := s.GetRoot()
+		assert.NoError(t, err)
+		assert.Equal(t, second, root, step)
+		_, err = s.Get([]byte("utxo"), outputPointer(coinbase.Hash, 0))
+		assert.Equal(t, ErrNotFound, err, step)
+		_, err = s.Get([]byte("utxo"), outputPointer(spend.Hash, 0))
+		assert.NoError(t, err, step)
+		_, err = s.GetTransaction(spend.Hash, true)
+		assert.Equal(t, ErrNotFound, err, step)
+
+		s.Peer.Stop()
+		s.Close()
+	}
+}
+
+// syncedFiles tracks whether the records appended to the block files were
+// synced.
+type syncedFiles struct {
+	storage.Files
+	unsynced bool
+}
+
+func (f *syncedFiles) Append(data []byte) (storage.Location, error) {
+	f.unsynced = true
+	return f.Files.Append(data)
+}
+
+func (f *syncedFiles) Sync() error {
+	f.unsynced = false
+	return f.Files.Sync()
+}
+
+func TestBlockFilesSyncedBeforeCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := openStore(t, filepath.Join(dir, "db"))
+	defer s.Close()
+	defer s.Peer.Stop()
+	files := &syncedFiles{s.Files, false}
+	s.Files = files
+
+	coinbase, _ := newCoinbase(t, 1)
+	block := newBlock(t, s.Params.GenesisBlock, []Transaction{coinbase})
+	checked := false
+	crashPoint = func(current string) {
+		if current == "block" {
+			assert.False(t, files.unsynced)
+			checked = true
+		}
+	}
+	defer func() { crashPoint = func(string) {} }()
+	assert.NoError(t, s.AddBlock(block))
+	assert.True(t, checked)
+}
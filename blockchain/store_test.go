@@ -1,68 +1,177 @@
 package blockchain_test
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
-	"errors"
+	"crypto/sha256"
+	"fmt"
 	"github.com/InitialShape/cryptocurrency/blockchain"
 	"github.com/InitialShape/cryptocurrency/miner"
-	"github.com/InitialShape/cryptocurrency/utils"
+	"github.com/InitialShape/cryptocurrency/storage"
 	"github.com/mr-tron/base58/base58"
 	"github.com/stretchr/testify/assert"
-	cbor "github.com/whyrusleeping/cbor/go"
 	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
-const DB = "/tmp/db098"
-
 var (
 	store blockchain.Store
 	peer  blockchain.Peer
+	// coinbaseKey is the key blocks mined by the tests pay to.
+	coinbaseKey ed25519.PrivateKey
 )
 
 func init() {
+	var err error
+	_, coinbaseKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "blockchain")
+	if err != nil {
+		log.Fatal(err)
+	}
 	store = blockchain.Store{}
-	store.Open(DB, &peer)
-	peer = blockchain.Peer{"1234", "localhost", store}
-	go peer.Start()
+	store.Open(filepath.Join(dir, "db"), &peer, &blockchain.RegTestParams)
+	peer = blockchain.Peer{ListenAddress: "localhost:1234",
+		AdvertiseAddress: "localhost:1234", Store: store}
+	err = peer.Start(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newStore opens a fresh in-memory regtest store, which holds just the
+// genesis block.
+func newStore(t *testing.T) (blockchain.Store, func()) {
+	s := blockchain.Store{}
+	p := &blockchain.Peer{}
+	err := s.OpenDB(storage.NewMemory(),
+		storage.NewMemoryFiles(blockchain.BLOCK_FILE_SIZE), p,
+		&blockchain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Store = s
+	return s, func() {
+		p.Stop()
+		s.Close()
+	}
+}
+
+// mineBlock searches a block on top of previous paying the coinbase to the
+// test key. Its timestamp is a second after the previous one.
+func mineBlock(previous blockchain.Block,
+	transactions []blockchain.Transaction) blockchain.Block {
+	return mineBlockAt(previous, previous.Timestamp+1, transactions)
 }
 
 func TestPutBlock(t *testing.T) {
-	genesis, err := store.StoreGenesisBlock(5)
+	store, cleanup := newStore(t)
+	defer cleanup()
+	genesis := store.Params.GenesisBlock
+
+	newBlock := mineBlock(genesis, []blockchain.Transaction{})
+
+	err := store.AddBlock(newBlock)
 	if err != nil {
 		t.Error(err)
 	}
+}
 
-	ch := make(chan blockchain.Block)
-	go miner.SearchBlock(2, 5, genesis.Hash, []blockchain.Transaction{}, ch)
-	newBlock := <-ch
+func TestGenesisBlockIsFixed(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	otherStore, otherCleanup := newStore(t)
+	defer otherCleanup()
 
-	err = store.AddBlock(newBlock)
+	root, err := store.GetRoot()
 	if err != nil {
 		t.Error(err)
 	}
+	otherRoot, err := otherStore.GetRoot()
+	if err != nil {
+		t.Error(err)
+	}
+	assert.Equal(t, blockchain.RegTestParams.GenesisBlock, root)
+	assert.Equal(t, root, otherRoot)
+	assert.NotEqual(t, blockchain.MainNetParams.GenesisBlock.Hash,
+		blockchain.RegTestParams.GenesisBlock.Hash)
+	assert.NotEqual(t, blockchain.MainNetParams.GenesisBlock.Hash,
+		blockchain.TestNetParams.GenesisBlock.Hash)
 }
 
-func TestGetChain(t *testing.T) {
-	genesis, err := store.StoreGenesisBlock(5)
+func TestOpenDatabaseOfOtherNetwork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
+	location := filepath.Join(dir, "db")
 
-	ch := make(chan blockchain.Block)
-	go miner.SearchBlock(1, 5, genesis.Hash, nil, ch)
-	firstBlock := <-ch
+	regtest := blockchain.Store{}
+	err = regtest.Open(location, &peer, &blockchain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regtest.DB.Close()
+
+	testnet := blockchain.Store{}
+	err = testnet.Open(location, &peer, &blockchain.TestNetParams)
+	assert.Error(t, err)
+
+	// the database is left alone and still works for its own network
+	err = regtest.Open(location, &peer, &blockchain.RegTestParams)
+	if assert.NoError(t, err) {
+		regtest.DB.Close()
+	}
+}
 
-	err = store.AddBlock(firstBlock)
+func TestPutBlockWithoutPreviousBlock(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	err := store.AddBlock(store.Params.GenesisBlock)
+	if assert.Error(t, err) {
+		assert.Equal(t, blockchain.REASON_GENESIS_EXISTS, blockchain.ReasonOf(err))
+	}
+
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := blockchain.GenerateGenesisBlock(publicKey, 25, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.AddBlock(block)
+	if assert.Error(t, err) {
+		assert.Equal(t, blockchain.REASON_NO_PREVIOUS_BLOCK, blockchain.ReasonOf(err))
+	}
+
+	root, err := store.GetRoot()
 	if err != nil {
 		t.Error(err)
 	}
+	assert.Equal(t, store.Params.GenesisBlock, root)
+}
 
-	ch = make(chan blockchain.Block)
-	go miner.SearchBlock(2, 5, firstBlock.Hash, nil, ch)
-	secondBlock := <-ch
+func TestGetChain(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	genesis := store.Params.GenesisBlock
 
+	firstBlock := mineBlock(genesis, nil)
+	err := store.AddBlock(firstBlock)
+	if err != nil {
+		t.Error(err)
+	}
+
+	secondBlock := mineBlock(firstBlock, nil)
 	err = store.AddBlock(secondBlock)
 	if err != nil {
 		t.Error(err)
@@ -77,20 +186,11 @@ func TestGetChain(t *testing.T) {
 }
 
 func TestEvaluateChains(t *testing.T) {
-	genesis, err := store.StoreGenesisBlock(5)
-	if err != nil {
-		t.Error(err)
-	}
+	genesis := store.Params.GenesisBlock
 
-	ch := make(chan blockchain.Block)
-	go miner.SearchBlock(1, 5, genesis.Hash, nil, ch)
-	firstBlock := <-ch
-	ch = make(chan blockchain.Block)
-	go miner.SearchBlock(2, 5, firstBlock.Hash, nil, ch)
-	secondBlock := <-ch
-	ch = make(chan blockchain.Block)
-	go miner.SearchBlock(3, 5, secondBlock.Hash, nil, ch)
-	thirdBlock := <-ch
+	firstBlock := mineBlock(genesis, nil)
+	secondBlock := mineBlock(firstBlock, nil)
+	thirdBlock := mineBlock(secondBlock, nil)
 
 	var firstChain = []blockchain.Block{firstBlock, secondBlock, thirdBlock}
 	var secondChain = []blockchain.Block{firstBlock}
@@ -108,86 +208,80 @@ func TestEvaluateChains(t *testing.T) {
 }
 
 func TestGetTransactionWithNothingInBucket(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
 	transaction, err := store.GetTransaction([]byte("transactions"), false)
 	if assert.Error(t, err) {
-		assert.Equal(t, err, errors.New("EOF"))
+		assert.Equal(t, blockchain.ErrNotFound, err)
 	}
 
-	privateKey, _ := base58.Decode("35DxrJipeuCAakHNnnPkBjwxQffYWKM1632kUFv9vKGRNREFSyM6awhyrucxTNbo9h693nPKeWonJ9sFkw6Tou4d")
-	publicKey, _ := base58.Decode("6zjRZQyp47BjwArFoLpvzo8SHwwWeW571kJNiqWfSrFT")
-	outputs := []blockchain.Output{blockchain.Output{publicKey, 100}}
-	inputs := []blockchain.Input{blockchain.Input{[]byte{}, []byte{}, 0}}
-	transaction = blockchain.Transaction{[]byte{}, inputs, outputs}
-	hash, err := transaction.GetHash()
-	if err != nil {
-		t.Error(err)
-	}
-	transaction.Hash = hash
-	transaction.Sign(privateKey, 0)
-	cbor, err := transaction.GetCBOR()
-	if err != nil {
-		t.Error(err)
-	}
-	err = store.Put([]byte("transactions"), transaction.Hash, cbor)
-
-	transaction, err = store.GetTransaction(transaction.Hash, false)
-
+	// confirmed transactions are read from the block that contains them
+	coinbase := store.Params.GenesisBlock.Transactions[0]
+	transaction, err = store.GetTransaction(coinbase.Hash, false)
+	assert.NoError(t, err)
+	assert.Equal(t, coinbase, transaction)
 }
 
 func TestPutBlockWithUnsignedTransferTransaction(t *testing.T) {
-	genesis, err := store.StoreGenesisBlock(5)
-	if err != nil {
-		t.Error(err)
-	}
+	store, cleanup := newStore(t)
+	defer cleanup()
+	genesis := store.Params.GenesisBlock
 
 	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
-	outputs := []blockchain.Output{blockchain.Output{publicKey, 123}}
+	outputs := []blockchain.Output{blockchain.Output{publicKey, 123, []byte{}}}
 	inputs := []blockchain.Input{blockchain.Input{[]byte{},
-		genesis.Transactions[0].Hash, 0}}
-	transaction := blockchain.Transaction{[]byte{}, inputs, outputs}
+		genesis.Transactions[0].Hash, 0, nil, 0}}
+	transaction := blockchain.Transaction{[]byte{}, inputs, outputs, 0}
 	hash, err := transaction.GetHash()
 	if err != nil {
 		t.Error(err)
 	}
 	transaction.Hash = hash
 
-	coinbase, err := blockchain.GenerateCoinbase(publicKey, privateKey, 100)
+	coinbase, err := blockchain.GenerateCoinbase(publicKey, privateKey, 1, 100)
 	if err != nil {
 		t.Error(err)
 	}
 
-	ch := make(chan blockchain.Block)
-	go miner.SearchBlock(2, 5, genesis.Hash,
-		[]blockchain.Transaction{coinbase, transaction}, ch)
-	newBlock := <-ch
+	newBlock := mineBlock(genesis,
+		[]blockchain.Transaction{coinbase, transaction})
 
 	err = store.AddBlock(newBlock)
 	assert.Error(t, err)
 }
 
-func TestPutBlockWithTransferTransaction(t *testing.T) {
-	genesis, err := store.StoreGenesisBlock(5)
+// spendCoinbase returns a transaction spending the coinbase of block, which
+// must pay to the test key, to a new key.
+func spendCoinbase(t *testing.T, block blockchain.Block) blockchain.Transaction {
+	privateKey := coinbaseKey
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	outputs := []blockchain.Output{blockchain.Output{publicKey, 23, []byte{}}}
+	inputs := []blockchain.Input{blockchain.Input{[]byte{},
+		block.Transactions[0].Hash, 0, nil, 0}}
+	transaction := blockchain.Transaction{[]byte{}, inputs, outputs, 0}
+	hash, err := transaction.GetHash()
 	if err != nil {
 		t.Error(err)
 	}
+	transaction.Hash = hash
+	transaction.Sign(privateKey, 0, block.Transactions[0].Outputs[0],
+		blockchain.SIGHASH_ALL)
+	return transaction
+}
 
-	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
-	_, privateKey, _ := utils.GetWallet()
-	outputs := []blockchain.Output{blockchain.Output{publicKey, 123}}
-	inputs := []blockchain.Input{blockchain.Input{[]byte{},
-		genesis.Transactions[0].Hash, 0}}
-	transaction := blockchain.Transaction{[]byte{}, inputs, outputs}
-	hash, err := transaction.GetHash()
+func TestPutBlockWithTransferTransaction(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	firstBlock := mineBlock(store.Params.GenesisBlock, nil)
+	err := store.AddBlock(firstBlock)
 	if err != nil {
 		t.Error(err)
 	}
-	transaction.Hash = hash
-	transaction.Sign(privateKey, 0)
 
-	ch := make(chan blockchain.Block)
-	go miner.SearchBlock(2, 5, genesis.Hash,
-		[]blockchain.Transaction{transaction}, ch)
-	newBlock := <-ch
+	transaction := spendCoinbase(t, firstBlock)
+	newBlock := mineBlock(firstBlock, []blockchain.Transaction{transaction})
 
 	err = store.AddBlock(newBlock)
 	if err != nil {
@@ -196,96 +290,329 @@ func TestPutBlockWithTransferTransaction(t *testing.T) {
 }
 
 func TestSpendTransactionTwice(t *testing.T) {
-	genesis, err := store.StoreGenesisBlock(5)
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	firstBlock := mineBlock(store.Params.GenesisBlock, nil)
+	err := store.AddBlock(firstBlock)
 	if err != nil {
 		t.Error(err)
 	}
 
-	_, privateKey, err := utils.GetWallet()
-	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
-	outputs := []blockchain.Output{blockchain.Output{publicKey, 123}}
-	inputs := []blockchain.Input{blockchain.Input{[]byte{},
-		genesis.Transactions[0].Hash, 0}}
-	transaction := blockchain.Transaction{[]byte{}, inputs, outputs}
-	hash, err := transaction.GetHash()
+	transaction := spendCoinbase(t, firstBlock)
+	secondBlock := mineBlock(firstBlock, []blockchain.Transaction{transaction})
+	err = store.AddBlock(secondBlock)
 	if err != nil {
 		t.Error(err)
 	}
-	transaction.Hash = hash
-	transaction.Sign(privateKey, 0)
 
-	ch := make(chan blockchain.Block)
-	go miner.SearchBlock(2, 5, genesis.Hash,
-		[]blockchain.Transaction{transaction}, ch)
-	newBlock := <-ch
-	err = store.AddBlock(newBlock)
+	transaction = spendCoinbase(t, firstBlock)
+	thirdBlock := mineBlock(secondBlock, []blockchain.Transaction{transaction})
+
+	err = store.AddBlock(thirdBlock)
+	if assert.Error(t, err) {
+		assert.Equal(t, blockchain.REASON_SPENT_OUTPUT, blockchain.ReasonOf(err))
+	}
+}
+
+func TestSpendOutputTwiceInBlock(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	firstBlock := mineBlock(store.Params.GenesisBlock, nil)
+	err := store.AddBlock(firstBlock)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
+	}
+
+	// both pay to new keys, so they're different transactions
+	secondBlock := mineBlock(firstBlock, []blockchain.Transaction{
+		spendCoinbase(t, firstBlock), spendCoinbase(t, firstBlock)})
+	err = store.AddBlock(secondBlock)
+	if assert.Error(t, err) {
+		assert.Equal(t, blockchain.REASON_SPENT_OUTPUT,
+			blockchain.ReasonOf(err))
 	}
+	root, err := store.GetRoot()
+	assert.NoError(t, err)
+	assert.Equal(t, firstBlock, root)
+}
+
+func TestSpendOutputTwiceInTransaction(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
 
-	_, privateKey, err = utils.GetWallet()
-	publicKey, _, _ = ed25519.GenerateKey(rand.Reader)
-	outputs = []blockchain.Output{blockchain.Output{publicKey, 123}}
-	inputs = []blockchain.Input{blockchain.Input{[]byte{},
-		genesis.Transactions[0].Hash, 0}}
-	transaction = blockchain.Transaction{[]byte{}, inputs, outputs}
-	hash, err = transaction.GetHash()
+	block := mineBlock(store.Params.GenesisBlock, nil)
+	err := store.AddBlock(block)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	transaction.Hash = hash
-	transaction.Sign(privateKey, 0)
 
-	ch = make(chan blockchain.Block)
-	go miner.SearchBlock(2, 5, genesis.Hash,
-		[]blockchain.Transaction{transaction}, ch)
-	newBlock = <-ch
+	coinbase := block.Transactions[0]
+	input := blockchain.Input{[]byte{}, coinbase.Hash, 0, nil, 0}
+	transaction := blockchain.Transaction{[]byte{},
+		[]blockchain.Input{input, input}, []blockchain.Output{
+			{coinbase.Outputs[0].PublicKey, 2 * coinbase.Outputs[0].Amount,
+				[]byte{}}}, 0}
+	transaction.Hash, err = transaction.GetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range transaction.Inputs {
+		err = transaction.Sign(coinbaseKey, i, coinbase.Outputs[0],
+			blockchain.SIGHASH_ALL)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	err = store.AddBlock(newBlock)
+	_, err = store.VerifyTransaction(transaction, 1)
 	if assert.Error(t, err) {
-		assert.Equal(t, errors.New("Output doesn't exist (anymore?)"), err)
+		assert.Equal(t, blockchain.REASON_DUPLICATE_INPUT,
+			blockchain.ReasonOf(err))
 	}
 }
 
 func TestPutCoinbaseTwiceInBlock(t *testing.T) {
-	genesis, err := store.StoreGenesisBlock(5)
-	if err != nil {
-		t.Error(err)
-	}
+	store, cleanup := newStore(t)
+	defer cleanup()
 
 	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		t.Error(err)
 	}
-	transaction, err := blockchain.GenerateCoinbase(publicKey, privateKey, 100)
+	transaction, err := blockchain.GenerateCoinbase(publicKey, privateKey, 1, 100)
 	if err != nil {
 		t.Error(err)
 	}
 
-	ch := make(chan blockchain.Block)
-	go miner.SearchBlock(2, 5, genesis.Hash,
-		[]blockchain.Transaction{transaction, transaction}, ch)
-	newBlock := <-ch
+	newBlock := mineBlock(store.Params.GenesisBlock,
+		[]blockchain.Transaction{transaction, transaction})
 
 	err = store.AddBlock(newBlock)
 	if assert.Error(t, err) {
-		assert.Equal(t, errors.New("Transaction duplicate in block"), err)
+		assert.Equal(t, blockchain.REASON_DUPLICATE_TRANSACTION, blockchain.ReasonOf(err))
 	}
 }
 
-func TestPutBlockWithTooLowDifficulty(t *testing.T) {
-	// TODO: This function fails every once in a while
-	genesis, err := store.StoreGenesisBlock(6)
+func TestPutBlockWithTooHighCoinbase(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	genesis := store.Params.GenesisBlock
+
+	newBlock, err := miner.SearchBlock(context.Background(), coinbaseKey, 1,
+		genesis.Difficulty, store.Params.CoinbaseAmount+1, genesis.Hash,
+		genesis.Timestamp+1, nil)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	ch := make(chan blockchain.Block)
-	go miner.SearchBlock(2, 5, genesis.Hash, []blockchain.Transaction{}, ch)
-	newBlock := <-ch
-
 	err = store.AddBlock(newBlock)
-	assert.Error(t, err)
+	if assert.Error(t, err) {
+		assert.Equal(t, blockchain.REASON_COINBASE_TOO_HIGH, blockchain.ReasonOf(err))
+	}
+}
+
+func TestPutBlockWithCoinbaseCollectingFees(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	first := mineBlock(store.Params.GenesisBlock, nil)
+	assert.NoError(t, store.AddBlock(first))
+
+	// the spend pays 23 of the 25 it spends
+	spend := spendCoinbase(t, first)
+	for _, test := range []struct {
+		reward int
+		reason blockchain.Reason
+	}{
+		{store.Params.CoinbaseAmount + 3, blockchain.REASON_COINBASE_TOO_HIGH},
+		{store.Params.CoinbaseAmount + 2, ""},
+	} {
+		block, err := miner.SearchBlock(context.Background(), coinbaseKey, 2,
+			first.Difficulty, test.reward, first.Hash, first.Timestamp+1,
+			[]blockchain.Transaction{spend})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.AddBlock(block)
+		if test.reason == "" {
+			assert.NoError(t, err)
+		} else if assert.Error(t, err) {
+			assert.Equal(t, test.reason, blockchain.ReasonOf(err))
+		}
+	}
+}
+
+func TestVerifyTransactionAmounts(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	block := mineBlock(store.Params.GenesisBlock, nil)
+	assert.NoError(t, store.AddBlock(block))
+	coinbase := block.Transactions[0]
+	publicKey := coinbase.Outputs[0].PublicKey
+
+	for _, test := range []struct {
+		amounts []int
+		fee     int
+		reason  blockchain.Reason
+	}{
+		{[]int{25}, 0, ""},
+		{[]int{20, 3}, 2, ""},
+		{[]int{26}, 0, blockchain.REASON_NEGATIVE_FEE},
+		{[]int{26, -1}, 0, blockchain.REASON_INVALID_AMOUNT},
+		{[]int{int(^uint(0) >> 1), 2}, 0, blockchain.REASON_INVALID_AMOUNT},
+	} {
+		var outputs []blockchain.Output
+		for _, amount := range test.amounts {
+			outputs = append(outputs,
+				blockchain.Output{publicKey, amount, []byte{}})
+		}
+		// negative amounts can't be encoded, the ID is made up
+		transaction := blockchain.Transaction{[]byte(fmt.Sprint(test)),
+			[]blockchain.Input{{[]byte{}, coinbase.Hash, 0, nil, 0}},
+			outputs, 0}
+		// the outputs aren't signed, so that any amount can be tried
+		err := transaction.Sign(coinbaseKey, 0, coinbase.Outputs[0],
+			blockchain.SIGHASH_NONE)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fee, err := store.TransactionFee(transaction, 1)
+		if test.reason == "" {
+			assert.NoError(t, err, test.amounts)
+			assert.Equal(t, test.fee, fee, test.amounts)
+		} else if assert.Error(t, err, test.amounts) {
+			assert.Equal(t, test.reason, blockchain.ReasonOf(err),
+				test.amounts)
+		}
+	}
+}
+
+// grindBlock returns the block on top of previous with the transactions
+// given, searching its nonce without adding a coinbase.
+func grindBlock(t *testing.T, previous blockchain.Block, timestamp int64,
+	transactions []blockchain.Transaction) blockchain.Block {
+	block := blockchain.Block{previous.Height + 1, []byte{}, transactions,
+		previous.Hash, previous.Difficulty, 0, timestamp}
+	for {
+		hash, err := block.GetHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blockchain.HashMatchesDifficulty(hash, block.Difficulty) {
+			block.Hash = hash
+			return block
+		}
+		block.Nonce++
+	}
+}
+
+func TestPutBlockWithCoinbaseOfOtherHeight(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	publicKey := coinbaseKey.Public().(ed25519.PublicKey)
+	coinbase, err := blockchain.GenerateCoinbase(publicKey, coinbaseKey, 2,
+		store.Params.CoinbaseAmount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := grindBlock(t, store.Params.GenesisBlock,
+		store.Params.GenesisBlock.Timestamp+1,
+		[]blockchain.Transaction{coinbase})
+
+	err = store.AddBlock(block)
+	if assert.Error(t, err) {
+		assert.Equal(t, blockchain.REASON_COINBASE_HEIGHT,
+			blockchain.ReasonOf(err))
+	}
+}
+
+func TestPutBlockWithExistingCoinbase(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	genesis := store.Params.GenesisBlock
+	first := mineBlock(genesis, nil)
+	assert.NoError(t, store.AddBlock(first))
+
+	// a fork at the same height can't replace the coinbase's outputs
+	fork := grindBlock(t, genesis, genesis.Timestamp+2,
+		first.Transactions[:1])
+	err := store.AddBlock(fork)
+	if assert.Error(t, err) {
+		assert.Equal(t, blockchain.REASON_DUPLICATE_TRANSACTION,
+			blockchain.ReasonOf(err))
+	}
+}
+
+func TestPutBlockWithForgedHash(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	// a hash of all zeros meets any difficulty
+	block := mineBlock(store.Params.GenesisBlock, nil)
+	block.Hash = make([]byte, sha256.Size)
+	err := store.AddBlock(block)
+	if assert.Error(t, err) {
+		assert.Equal(t, blockchain.REASON_INVALID_HASH,
+			blockchain.ReasonOf(err))
+	}
+}
+
+func TestPutBlockWithTooLowDifficulty(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+	genesis := store.Params.GenesisBlock
+
+	newBlock := blockchain.Block{1, []byte{}, nil, genesis.Hash,
+		genesis.Difficulty, 0, genesis.Timestamp + 1}
+	for {
+		hash, err := newBlock.GetHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !blockchain.HashMatchesDifficulty(hash, genesis.Difficulty) {
+			newBlock.Hash = hash
+			break
+		}
+		newBlock.Nonce++
+	}
+
+	err := store.AddBlock(newBlock)
+	if assert.Error(t, err) {
+		assert.Equal(t, blockchain.REASON_DIFFICULTY_TOO_LOW, blockchain.ReasonOf(err))
+	}
+}
+
+func TestPutBlockWithOtherDifficulty(t *testing.T) {
+	for _, params := range []*blockchain.ChainParams{
+		&blockchain.MainNetParams, &blockchain.RegTestParams} {
+		store := blockchain.Store{}
+		peer := &blockchain.Peer{}
+		err := store.OpenDB(storage.NewMemory(),
+			storage.NewMemoryFiles(blockchain.BLOCK_FILE_SIZE), peer, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer.Store = store
+		genesis := store.Params.GenesisBlock
+
+		// every hash matches a difficulty of 0
+		block := blockchain.Block{1, []byte{}, nil, genesis.Hash, 0, 0,
+			genesis.Timestamp + 1}
+		block.Hash, err = block.GetHash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.AddBlock(block)
+		if assert.Error(t, err, params.Name) {
+			assert.Equal(t, blockchain.REASON_WRONG_DIFFICULTY,
+				blockchain.ReasonOf(err), params.Name)
+		}
+		peer.Stop()
+		store.Close()
+	}
 }
 
 func TestPutAndGetData(t *testing.T) {
@@ -312,9 +639,10 @@ func TestGetTransactions(t *testing.T) {
 		t.Error(err)
 	}
 
-	outputs := []blockchain.Output{blockchain.Output{publicKey, 10}}
-	inputs := []blockchain.Input{blockchain.Input{[]byte{}, []byte{}, 0}}
-	transaction := blockchain.Transaction{[]byte{}, inputs, outputs}
+	outputs := []blockchain.Output{blockchain.Output{publicKey, 10, []byte{}}}
+	inputs := []blockchain.Input{
+		blockchain.Input{[]byte{}, []byte{}, 0, nil, 0}}
+	transaction := blockchain.Transaction{[]byte{}, inputs, outputs, 0}
 	hash, err := transaction.GetHash()
 	if err != nil {
 		t.Error(err)
@@ -331,9 +659,10 @@ func TestGetTransactions(t *testing.T) {
 
 func TestAddTransaction(t *testing.T) {
 	publicKey, _ := base58.Decode("6zjRZQyp47BjwArFoLpvzo8SHwwWeW571kJNiqWfSrFT")
-	outputs := []blockchain.Output{blockchain.Output{publicKey, 10}}
-	inputs := []blockchain.Input{blockchain.Input{[]byte{}, []byte{}, 0}}
-	transaction := blockchain.Transaction{[]byte{}, inputs, outputs}
+	outputs := []blockchain.Output{blockchain.Output{publicKey, 10, []byte{}}}
+	inputs := []blockchain.Input{
+		blockchain.Input{[]byte{}, []byte{}, 0, nil, 0}}
+	transaction := blockchain.Transaction{[]byte{}, inputs, outputs, 0}
 	hash, err := transaction.GetHash()
 	if err != nil {
 		t.Error(err)
@@ -345,9 +674,7 @@ func TestAddTransaction(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	var storeTransaction blockchain.Transaction
-	dec := cbor.NewDecoder(bytes.NewReader(data))
-	err = dec.Decode(&storeTransaction)
+	storeTransaction, err := blockchain.DecodeTransaction(data)
 	if err != nil {
 		t.Error(err)
 	}
@@ -355,3 +682,181 @@ func TestAddTransaction(t *testing.T) {
 	assert.Equal(t, transaction, storeTransaction)
 
 }
+
+func TestAddTransactionWrongHash(t *testing.T) {
+	publicKey, _ := base58.Decode("6zjRZQyp47BjwArFoLpvzo8SHwwWeW571kJNiqWfSrFT")
+	outputs := []blockchain.Output{blockchain.Output{publicKey, 20, []byte{}}}
+	inputs := []blockchain.Input{
+		blockchain.Input{[]byte{}, []byte{}, 0, nil, 0}}
+	transaction := blockchain.Transaction{[]byte("hash"), inputs, outputs, 0}
+
+	err := store.AddTransaction(transaction)
+	assert.Equal(t, blockchain.REASON_INVALID_HASH, blockchain.ReasonOf(err))
+	_, err = store.GetTransaction(transaction.Hash, true)
+	assert.Equal(t, blockchain.ErrNotFound, err)
+}
+
+func TestVerifyTransactionWithMalformedPublicKey(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	block := mineBlock(store.Params.GenesisBlock, nil)
+	err := store.AddBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an output no signature could ever spend
+	coinbase := block.Transactions[0]
+	transaction := blockchain.Transaction{[]byte{}, []blockchain.Input{
+		{[]byte{}, coinbase.Hash, 0, nil, 0}}, []blockchain.Output{
+		{[]byte("key"), coinbase.Outputs[0].Amount, []byte{}}}, 0}
+	transaction.Hash, err = transaction.GetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transaction.Sign(coinbaseKey, 0, coinbase.Outputs[0],
+		blockchain.SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.VerifyTransaction(transaction, 1)
+	if assert.Error(t, err) {
+		assert.Equal(t, blockchain.REASON_INVALID_PUBLIC_KEY,
+			blockchain.ReasonOf(err))
+	}
+}
+
+func TestVerifyTransactionChecksAllInputs(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	firstBlock := mineBlock(store.Params.GenesisBlock, nil)
+	assert.NoError(t, store.AddBlock(firstBlock))
+	secondBlock := mineBlock(firstBlock, nil)
+	assert.NoError(t, store.AddBlock(secondBlock))
+
+	privateKey := coinbaseKey
+	first := firstBlock.Transactions[0]
+	second := secondBlock.Transactions[0]
+	inputs := []blockchain.Input{
+		blockchain.Input{[]byte{}, first.Hash, 0, nil, 0},
+		blockchain.Input{[]byte{}, second.Hash, 0, nil, 0},
+	}
+	transaction := blockchain.Transaction{[]byte{}, inputs,
+		[]blockchain.Output{first.Outputs[0]}, 0}
+	hash, err := transaction.GetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction.Hash = hash
+	transaction.Sign(privateKey, 0, first.Outputs[0], blockchain.SIGHASH_ALL)
+	// the second input signs for a smaller output than it spends
+	spent := blockchain.Output{second.Outputs[0].PublicKey, 1, []byte{}}
+	transaction.Sign(privateKey, 1, spent, blockchain.SIGHASH_ALL)
+
+	block := mineBlock(secondBlock, []blockchain.Transaction{transaction})
+	err = store.AddBlock(block)
+	assert.Equal(t, blockchain.REASON_INVALID_SIGNATURE,
+		blockchain.ReasonOf(err))
+
+	transaction.Sign(privateKey, 1, second.Outputs[0], blockchain.SIGHASH_ALL)
+	block = mineBlock(secondBlock, []blockchain.Transaction{transaction})
+	assert.NoError(t, store.AddBlock(block))
+}
+
+func TestAddTransactionKeepsFirstWitness(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spent := blockchain.Output{publicKey, 30, []byte{}}
+	inputs := []blockchain.Input{blockchain.Input{[]byte{}, []byte("input"), 0,
+		nil, 0}}
+	transaction := blockchain.Transaction{[]byte{}, inputs,
+		[]blockchain.Output{spent}, 0}
+	transaction.Sign(privateKey, 0, spent, blockchain.SIGHASH_ALL)
+	assert.NoError(t, store.AddTransaction(transaction))
+
+	// the same transaction, signed differently
+	malleated := transaction
+	malleated.Inputs = []blockchain.Input{inputs[0]}
+	malleated.Sign(privateKey, 0, spent, blockchain.SIGHASH_NONE)
+	malleated.Hash, err = malleated.GetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, store.AddTransaction(malleated))
+
+	stored, err := store.GetTransaction(malleated.Hash, true)
+	assert.NoError(t, err)
+	witnessHash, err := stored.WitnessHash()
+	assert.NoError(t, err)
+	expected, err := transaction.WitnessHash()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, witnessHash)
+}
+
+func TestBlockWithForgedTransactionHash(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	firstBlock := mineBlock(store.Params.GenesisBlock, nil)
+	assert.NoError(t, store.AddBlock(firstBlock))
+	transaction := spendCoinbase(t, firstBlock)
+	transaction.Hash = []byte("forged")
+
+	block := mineBlock(firstBlock, []blockchain.Transaction{transaction})
+	err := store.AddBlock(block)
+	assert.Equal(t, blockchain.REASON_INVALID_HASH, blockchain.ReasonOf(err))
+}
+
+func TestSpendScriptOutput(t *testing.T) {
+	store, cleanup := newStore(t)
+	defer cleanup()
+
+	firstBlock := mineBlock(store.Params.GenesisBlock, nil)
+	assert.NoError(t, store.AddBlock(firstBlock))
+	privateKey := coinbaseKey
+	coinbase := firstBlock.Transactions[0]
+
+	// lock the coinbase to the preimage of a hash
+	hash := sha256.Sum256([]byte("preimage"))
+	script := (&blockchain.ScriptBuilder{}).AddOp(blockchain.OP_SHA256).
+		AddData(hash[:]).AddOp(blockchain.OP_EQUAL).Script()
+	locked := blockchain.Output{[]byte{}, coinbase.Outputs[0].Amount, script}
+	lock := blockchain.Transaction{[]byte{},
+		[]blockchain.Input{
+			blockchain.Input{[]byte{}, coinbase.Hash, 0, nil, 0}},
+		[]blockchain.Output{locked}, 0}
+	lockHash, err := lock.GetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Hash = lockHash
+	lock.Sign(privateKey, 0, coinbase.Outputs[0], blockchain.SIGHASH_ALL)
+	secondBlock := mineBlock(firstBlock, []blockchain.Transaction{lock})
+	assert.NoError(t, store.AddBlock(secondBlock))
+
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	unlock := blockchain.Transaction{[]byte{},
+		[]blockchain.Input{blockchain.Input{[]byte{}, lock.Hash, 0,
+			[][]byte{[]byte("wrong")}, 0}},
+		[]blockchain.Output{blockchain.Output{publicKey, locked.Amount,
+			[]byte{}}}, 0}
+	unlock.Hash, err = unlock.GetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := mineBlock(secondBlock, []blockchain.Transaction{unlock})
+	err = store.AddBlock(block)
+	assert.Equal(t, blockchain.REASON_SCRIPT_FAILED, blockchain.ReasonOf(err))
+
+	unlock.Inputs[0].Witness = [][]byte{[]byte("preimage")}
+	block = mineBlock(secondBlock, []blockchain.Transaction{unlock})
+	assert.NoError(t, store.AddBlock(block))
+}
@@ -3,52 +3,74 @@ package blockchain
 import (
 	"bytes"
 	"crypto/sha256"
-	"errors"
 	"github.com/mr-tron/base58/base58"
 	cbor "github.com/whyrusleeping/cbor/go"
 	"golang.org/x/crypto/ed25519"
-	"log"
 )
 
+// Input spends an output. Outputs locked to a public key are unlocked by the
+// Signature, outputs locked by a script by the Witness, the items the script
+// starts with on its stack. A non-zero Sequence is a relative lock, see
+// locktime.go.
 type Input struct {
-	Signature       []byte `json:"signature"`
-	TransactionHash []byte `json:"transaction_hash"`
-	OutputID        int    `json:"output_id"`
+	Signature       []byte   `json:"signature"`
+	TransactionHash []byte   `json:"transaction_hash"`
+	OutputID        int      `json:"output_id"`
+	Witness         [][]byte `json:"witness,omitempty"`
+	Sequence        uint32   `json:"sequence"`
 }
 
+// Output is locked either to a PublicKey or, if it has one, by a Script,
+// see script.go.
 type Output struct {
 	PublicKey ed25519.PublicKey `json:"public_key"`
 	Amount    int               `json:"amount"`
+	Script    []byte            `json:"script"`
 }
 
+// Transaction moves the outputs its inputs spend to new outputs. Its Hash is
+// its ID and is derived from it by GetHash, a claimed hash that doesn't match
+// is rejected. It can't be included in a block before its LockTime, a
+// height or a unix time.
 type Transaction struct {
-	Hash    []byte   `json:"hash"`
-	Inputs  []Input  `json:"inputs"`
-	Outputs []Output `json:"outputs"`
+	Hash     []byte   `json:"hash"`
+	Inputs   []Input  `json:"inputs"`
+	Outputs  []Output `json:"outputs"`
+	LockTime uint32   `json:"lock_time"`
 }
 
+// GenerateCoinbase returns the coinbase of the block at height. Its input
+// commits to the height as its output ID, so the coinbases of different
+// blocks paying the same amount to the same key still differ.
 func GenerateCoinbase(publicKey ed25519.PublicKey,
-	privateKey ed25519.PrivateKey, amount int) (Transaction,
+	privateKey ed25519.PrivateKey, height int, amount int) (Transaction,
 	error) {
-	outputs := []Output{Output{publicKey, amount}}
-	inputs := []Input{Input{[]byte{}, []byte{}, 0}}
-	transaction := Transaction{[]byte{}, inputs, outputs}
+	outputs := []Output{Output{publicKey, amount, []byte{}}}
+	inputs := []Input{Input{[]byte{}, []byte{}, height, nil, 0}}
+	transaction := Transaction{[]byte{}, inputs, outputs, 0}
 	hash, err := transaction.GetHash()
 	if err != nil {
 		return transaction, err
 	}
 	transaction.Hash = hash
-	transaction.Sign(privateKey, 0)
+	// a coinbase spends no output
+	err = transaction.Sign(privateKey, 0, Output{}, SIGHASH_ALL)
 	return transaction, err
 }
 
+// IsCoinbase reports whether the transaction mints new coins rather than
+// spending existing outputs. The output ID of its input is the height of
+// its block.
+func (t *Transaction) IsCoinbase() bool {
+	return len(t.Inputs) == 1 && len(t.Inputs[0].TransactionHash) == 0
+}
+
 func (o *Output) GetCBOR() ([]byte, error) {
 	buf := new(bytes.Buffer)
 	enc := cbor.NewEncoder(buf)
 	err := enc.Encode(o)
 
 	if err != nil {
-		log.Fatal("Error encoding", err)
 		return []byte{}, err
 	}
 
@@ -61,32 +83,52 @@ func (t *Transaction) GetCBOR() ([]byte, error) {
 	err := enc.Encode(t)
 
 	if err != nil {
-		log.Fatal("Error encoding", err)
 		return []byte{}, err
 	}
 
 	return buf.Bytes(), err
 }
 
+// GetHash hashes the canonical encoding of the transaction without its
+// signatures and witnesses.
 func (t *Transaction) GetHash() ([]byte, error) {
-	hash := t.Hash
-	var signatures [][]byte
+	unsigned := Transaction{Inputs: make([]Input, len(t.Inputs)),
+		Outputs: t.Outputs, LockTime: t.LockTime}
 	for index, input := range t.Inputs {
-		signatures = append(signatures, input.Signature)
-		t.Inputs[index].Signature = []byte{}
+		unsigned.Inputs[index] = Input{[]byte{}, input.TransactionHash,
+			input.OutputID, nil, input.Sequence}
 	}
-	t.Hash = []byte{}
-	transaction, err := t.GetCBOR()
+	data, err := unsigned.Encode()
 	if err != nil {
 		return []byte{}, err
 	}
-	hasher := sha256.New()
-	hasher.Write(transaction)
-	t.Hash = hash
-	for index, _ := range t.Inputs {
-		t.Inputs[index].Signature = signatures[index]
+	hash := sha256.Sum256(data)
+	return hash[:], nil
+}
+
+// WitnessHash hashes the whole canonical encoding, signatures included. The
+// signatures of a transaction can change without changing its ID, its
+// witness hash tells the variants apart.
+func (t *Transaction) WitnessHash() ([]byte, error) {
+	data, err := t.Encode()
+	if err != nil {
+		return []byte{}, err
+	}
+	hash := sha256.Sum256(data)
+	return hash[:], nil
+}
+
+// CheckHash verifies that the hash the transaction claims is its ID.
+func (t *Transaction) CheckHash() error {
+	hash, err := t.GetHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, t.Hash) {
+		return invalidTransaction(REASON_INVALID_HASH,
+			"Transaction hash doesn't match its contents")
 	}
-	return hasher.Sum(nil), err
+	return nil
 }
 
 func (t *Transaction) GetBase58Hash() (string, error) {
@@ -97,25 +139,65 @@ func (t *Transaction) GetBase58Hash() (string, error) {
 	return base58.Encode(hash), err
 }
 
-func (t *Transaction) Sign(privateKey ed25519.PrivateKey, index int) error {
-	hash, err := t.GetHash()
+// Sign signs input index, which spends the output spent, with the parts of
+// the transaction selected by hashType.
+func (t *Transaction) Sign(privateKey ed25519.PrivateKey, index int,
+	spent Output, hashType SigHashType) error {
+	hash, err := t.SignatureHash(index, spent, hashType)
 	if err != nil {
-		log.Fatal("Error signing transaction: ", err)
+		return err
 	}
-	t.Inputs[index].Signature = ed25519.Sign(privateKey, hash)
-	return err
+	signature := ed25519.Sign(privateKey, hash)
+	t.Inputs[index].Signature = append(signature, byte(hashType))
+	return nil
 }
 
-func (t *Transaction) Verify(publicKey ed25519.PublicKey, index int) (bool, error) {
-	hash, err := t.GetHash()
-	if err != nil {
-		log.Fatal("Error validating transaction: ", err)
+// Verify checks that input index unlocks the output spent, with its
+// signature or, if spent is locked by a script, its witness.
+func (t *Transaction) Verify(spent Output, index int) (bool, error) {
+	if index < 0 || index >= len(t.Inputs) {
+		return false, ErrInputIndex
+	}
+	input := t.Inputs[index]
+	if len(spent.Script) > 0 {
+		if len(input.Signature) > 0 {
+			return false, invalidTransaction(REASON_SCRIPT_FAILED,
+				"Signature for an output locked by a script")
+		}
+		err := t.runScript(index, spent)
+		if err != nil {
+			return false, invalidTransaction(REASON_SCRIPT_FAILED,
+				err.Error())
+		}
+		return true, nil
+	}
+	if len(input.Witness) > 0 {
+		return false, invalidTransaction(REASON_INVALID_SIGNATURE,
+			"Witness for an output locked to a public key")
+	}
+
+	signature, hashType, ok := splitSignature(t.Inputs[index].Signature)
+	if !ok {
+		return false, invalidTransaction(REASON_INVALID_SIGNATURE,
+			"Malformed signature")
+	}
+	hash, err := t.SignatureHash(index, spent, hashType)
+	if err == ErrNoSingleOutput {
+		return false, invalidTransaction(REASON_INVALID_SIGNATURE,
+			"No output for SIGHASH_SINGLE")
+	} else if err != nil {
 		return false, err
 	}
 
-	if ed25519.Verify(publicKey, hash, t.Inputs[index].Signature) {
+	// ed25519.Verify panics on keys of another size
+	if len(spent.PublicKey) != ed25519.PublicKeySize {
+		return false, invalidTransaction(REASON_INVALID_PUBLIC_KEY,
+			"Malformed public key")
+	}
+	if ed25519.Verify(spent.PublicKey, hash, signature) {
 		return true, nil
 	} else {
-		return false, errors.New("Invalid signature")
+		return false, invalidTransaction(REASON_INVALID_SIGNATURE,
+			"Invalid signature")
 	}
 }
@@ -16,14 +16,14 @@ func TestCoinbaseTransaction(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	transaction, err := GenerateCoinbase(publicKey, privateKey, 100)
+	transaction, err := GenerateCoinbase(publicKey, privateKey, 0, 100)
 	if err != nil {
 		t.Error(err)
 	}
 
-	outputs := []Output{Output{publicKey, 100}}
-	inputs := []Input{Input{[]byte{}, []byte{}, 0}}
-	expected := Transaction{[]byte{}, inputs, outputs}
+	outputs := []Output{Output{publicKey, 100, []byte{}}}
+	inputs := []Input{Input{[]byte{}, []byte{}, 0, nil, 0}}
+	expected := Transaction{[]byte{}, inputs, outputs, 0}
 
 	assert.Equal(t, transaction, expected)
 }
@@ -33,15 +33,15 @@ func TestTransactionGetBase58Hash(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	outputs := []Output{Output{publicKey, 100}}
-	inputs := []Input{Input{[]byte{}, []byte{}, 0}}
-	transaction := Transaction{[]byte{}, inputs, outputs}
+	outputs := []Output{Output{publicKey, 100, []byte{}}}
+	inputs := []Input{Input{[]byte{}, []byte{}, 0, nil, 0}}
+	transaction := Transaction{[]byte{}, inputs, outputs, 0}
 	hash, err := transaction.GetBase58Hash()
 	if err != nil {
 		t.Error(err)
 	}
 
-	assert.Equal(t, "4LFP1GFFMRaB3ay6ooisKzzEUbDqnFNpWFCrqKrxhhi1", hash)
+	assert.Equal(t, "E7Sr8hMmmKrYL81cjRoqEfr2hq7TCcSqJ9dJCs6bijra", hash)
 }
 
 func TestTransactionSign(t *testing.T) {
@@ -49,15 +49,16 @@ func TestTransactionSign(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	outputs := []Output{Output{publicKey, 100}}
-	inputs := []Input{Input{[]byte{}, []byte{}, 0}}
-	transaction := Transaction{[]byte{}, inputs, outputs}
-	hash, err := transaction.GetHash()
+	outputs := []Output{Output{publicKey, 100, []byte{}}}
+	inputs := []Input{Input{[]byte{}, []byte{}, 0, nil, 0}}
+	transaction := Transaction{[]byte{}, inputs, outputs, 0}
+	spent := Output{publicKey, 50, []byte{}}
+	hash, err := transaction.SignatureHash(0, spent, SIGHASH_ALL)
 	if err != nil {
 		t.Error(err)
 	}
-	signature := ed25519.Sign(privateKey, hash)
-	transaction.Sign(privateKey, 0)
+	signature := append(ed25519.Sign(privateKey, hash), byte(SIGHASH_ALL))
+	transaction.Sign(privateKey, 0, spent, SIGHASH_ALL)
 
 	assert.Equal(t, transaction.Inputs[0].Signature, signature)
 }
@@ -68,24 +69,71 @@ func TestTransactionVerifySignature(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	outputs := []Output{Output{publicKey, 100}}
+	outputs := []Output{Output{publicKey, 100, []byte{}}}
 	inputs := []Input{
-		Input{[]byte{}, []byte{}, 0},
-		Input{[]byte{}, []byte{}, 0},
+		Input{[]byte{}, []byte{}, 0, nil, 0},
+		Input{[]byte{}, []byte{}, 0, nil, 0},
 	}
-	transaction := Transaction{[]byte{}, inputs, outputs}
-	transaction.Sign(privateKey, 0)
-	transaction.Sign(privateKey2, 1)
+	transaction := Transaction{[]byte{}, inputs, outputs, 0}
+	spent := Output{publicKey, 60, []byte{}}
+	spent2 := Output{publicKey2, 40, []byte{}}
+	transaction.Sign(privateKey, 0, spent, SIGHASH_ALL)
+	transaction.Sign(privateKey2, 1, spent2, SIGHASH_ALL)
 
-	result, err := transaction.Verify(publicKey, 0)
+	result, err := transaction.Verify(spent, 0)
 	if err != nil {
 		t.Error(err)
 	}
 
 	assert.True(t, result)
-	result2, err := transaction.Verify(publicKey2, 1)
+	result2, err := transaction.Verify(spent2, 1)
 	if err != nil {
 		t.Error(err)
 	}
 	assert.True(t, result2)
 }
+
+func TestTransactionVerifyMalformedPublicKey(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputs := []Output{Output{publicKey, 100, []byte{}}}
+	inputs := []Input{Input{[]byte{}, []byte{}, 0, nil, 0}}
+	transaction := Transaction{[]byte{}, inputs, outputs, 0}
+	spent := Output{publicKey[:31], 100, []byte{}}
+	transaction.Sign(privateKey, 0, spent, SIGHASH_ALL)
+
+	result, err := transaction.Verify(spent, 0)
+	assert.False(t, result)
+	assert.Equal(t, REASON_INVALID_PUBLIC_KEY, ReasonOf(err))
+}
+
+func TestTransactionWitnessHash(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Error(err)
+	}
+	spent := Output{publicKey, 100, []byte{}}
+	inputs := []Input{Input{[]byte{}, []byte("input"), 0, nil, 0}}
+	transaction := Transaction{[]byte{}, inputs, []Output{spent}, 0}
+	hash, err := transaction.GetHash()
+	assert.NoError(t, err)
+	unsigned, err := transaction.WitnessHash()
+	assert.NoError(t, err)
+
+	transaction.Sign(privateKey, 0, spent, SIGHASH_ALL)
+	signedHash, err := transaction.GetHash()
+	assert.NoError(t, err)
+	signed, err := transaction.WitnessHash()
+	assert.NoError(t, err)
+
+	// signing changes the witness hash, but not the ID
+	assert.Equal(t, hash, signedHash)
+	assert.NotEqual(t, unsigned, signed)
+
+	transaction.Hash = hash
+	assert.NoError(t, transaction.CheckHash())
+	transaction.Outputs[0].Amount = 99
+	assert.Equal(t, REASON_INVALID_HASH, ReasonOf(transaction.CheckHash()))
+}
@@ -1,28 +1,42 @@
 package main
 
 import (
-	"github.com/InitialShape/cryptocurrency/blockchain"
+	"context"
 	"github.com/InitialShape/cryptocurrency/miner"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"golang.org/x/crypto/ed25519"
 	"log"
 	"os"
 	"strconv"
 )
 
+const usage = "usage: miner <node> <workers> <wallet> [key]"
+
 func main() {
+	if len(os.Args) < 4 {
+		log.Fatal(usage)
+	}
+	name := wallet.DEFAULT_KEY
+	if len(os.Args) > 4 {
+		name = os.Args[4]
+	}
+	privateKey, err := wallet.OpenKey(os.Args[3], name,
+		os.Getenv(wallet.PASSPHRASE_ENV))
+	if err != nil {
+		log.Fatal(err)
+	}
 	for {
-		mine()
+		mine(privateKey)
 	}
 }
 
-func mine() {
-	ch := make(chan blockchain.Block)
+func mine(privateKey ed25519.PrivateKey) {
 	workers, err := strconv.Atoi(os.Args[2])
 	if err != nil {
 		log.Fatal(err)
 	}
-	for i := 0; i < workers; i++ {
-		go miner.GenerateBlock(os.Args[1], ch)
+	err = miner.Mine(context.Background(), os.Args[1], privateKey, workers)
+	if err != nil {
+		log.Println(err)
 	}
-	newBlock := <-ch
-	miner.SubmitBlock(newBlock)
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/address"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"github.com/mr-tron/base58/base58"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// decodedInput is signed once it has enough signatures, Missing counts
+// those a partially signed transaction still needs.
+type decodedInput struct {
+	Outpoint string `json:"outpoint"`
+	Sequence uint32 `json:"sequence"`
+	Signed   bool   `json:"signed"`
+	Missing  int    `json:"missing,omitempty"`
+}
+
+type decodedOutput struct {
+	Address string `json:"address,omitempty"`
+	Script  string `json:"script,omitempty"`
+	Amount  int    `json:"amount"`
+}
+
+// decodedTransaction is a transaction as decode prints it. The fee is only
+// known for partially signed transactions, which carry the spent outputs.
+type decodedTransaction struct {
+	Hash        string          `json:"hash"`
+	WitnessHash string          `json:"witness_hash"`
+	Size        int             `json:"size"`
+	LockTime    uint32          `json:"lock_time"`
+	Fee         *int            `json:"fee,omitempty"`
+	Inputs      []decodedInput  `json:"inputs"`
+	Outputs     []decodedOutput `json:"outputs"`
+}
+
+func (d decodedTransaction) String() string {
+	lines := []string{"hash " + d.Hash, "witness hash " + d.WitnessHash,
+		fmt.Sprintf("size %d", d.Size),
+		fmt.Sprintf("lock time %d", d.LockTime)}
+	for index, input := range d.Inputs {
+		line := fmt.Sprintf("input %d %s sequence %d", index, input.Outpoint,
+			input.Sequence)
+		if input.Missing > 0 {
+			line += fmt.Sprintf(" missing %d signatures", input.Missing)
+		} else if !input.Signed {
+			line += " unsigned"
+		}
+		lines = append(lines, line)
+	}
+	for index, output := range d.Outputs {
+		to := output.Address
+		if to == "" {
+			to = "script " + output.Script
+		}
+		lines = append(lines, fmt.Sprintf("output %d %s %d", index, to,
+			output.Amount))
+	}
+	if d.Fee != nil {
+		lines = append(lines, fmt.Sprintf("fee %d", *d.Fee))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// readTransaction reads a transaction, in JSON or a partially signed
+// transaction if arg is a file and hex encoded otherwise. The partially
+// signed transaction is nil unless the file is one.
+func readTransaction(arg string) (blockchain.Transaction,
+	*wallet.PartialTransaction, error) {
+	var transaction blockchain.Transaction
+	data, err := ioutil.ReadFile(arg)
+	if os.IsNotExist(err) {
+		data, err = hex.DecodeString(strings.TrimSpace(arg))
+		if err != nil {
+			return transaction, nil,
+				fmt.Errorf("Neither a file nor hex: %s", arg)
+		}
+		transaction, err = blockchain.DecodeTransaction(data)
+		return transaction, nil, err
+	} else if err != nil {
+		return transaction, nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return transaction, nil, err
+	}
+	if _, ok := fields["inputs"]; ok {
+		if _, ok := fields["transaction"]; ok {
+			partial, err := wallet.DecodePartialTransaction(data)
+			if err != nil {
+				return transaction, nil, err
+			}
+			return partial.Transaction, partial, nil
+		}
+	}
+	err = json.Unmarshal(data, &transaction)
+	return transaction, nil, err
+}
+
+// decode prints a transaction, see readTransaction. Addresses are of
+// --network, or of the node's network.
+func decode(c *cli, args []string) error {
+	if len(args) != 1 {
+		return ErrUsage
+	}
+	transaction, partial, err := readTransaction(args[0])
+	if err != nil {
+		return err
+	}
+	prefix, err := c.prefix()
+	if err != nil {
+		return err
+	}
+
+	hash, err := transaction.GetHash()
+	if err != nil {
+		return err
+	}
+	witnessHash, err := transaction.WitnessHash()
+	if err != nil {
+		return err
+	}
+	data, err := transaction.Encode()
+	if err != nil {
+		return err
+	}
+	d := decodedTransaction{Hash: base58.Encode(hash),
+		WitnessHash: base58.Encode(witnessHash), Size: len(data),
+		LockTime: transaction.LockTime, Inputs: []decodedInput{},
+		Outputs: []decodedOutput{}}
+	for index, input := range transaction.Inputs {
+		decoded := decodedInput{Outpoint: fmt.Sprintf("%s:%d",
+			base58.Encode(input.TransactionHash), input.OutputID),
+			Sequence: input.Sequence,
+			Signed:   len(input.Signature) > 0 || len(input.Witness) > 0}
+		if partial != nil {
+			decoded.Missing = partial.Missing(index)
+			decoded.Signed = decoded.Missing == 0
+		}
+		d.Inputs = append(d.Inputs, decoded)
+	}
+	for _, output := range transaction.Outputs {
+		decoded := decodedOutput{Amount: output.Amount}
+		if len(output.Script) > 0 {
+			decoded.Script = hex.EncodeToString(output.Script)
+		} else {
+			decoded.Address, err = address.Encode(prefix, output.PublicKey)
+			if err != nil {
+				return err
+			}
+		}
+		d.Outputs = append(d.Outputs, decoded)
+	}
+	if partial != nil {
+		fee := partial.Fee()
+		d.Fee = &fee
+	}
+	return c.print(d)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/address"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"github.com/mr-tron/base58/base58"
+	"sort"
+	"strings"
+)
+
+type keyBalance struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Balance int    `json:"balance"`
+	Outputs int    `json:"outputs"`
+}
+
+// balanceResult sums the coins of the keys that have any.
+type balanceResult struct {
+	Balance int          `json:"balance"`
+	Keys    []keyBalance `json:"keys"`
+}
+
+func (r balanceResult) String() string {
+	lines := []string{}
+	for _, key := range r.Keys {
+		lines = append(lines, fmt.Sprintf("%s %s %d in %d outputs",
+			key.Name, key.Address, key.Balance, key.Outputs))
+	}
+	lines = append(lines, fmt.Sprintf("balance %d", r.Balance))
+	return strings.Join(lines, "\n")
+}
+
+type historyEntry struct {
+	Height   int    `json:"height"`
+	Outpoint string `json:"outpoint"`
+	Amount   int    `json:"amount"`
+	Key      string `json:"key"`
+	Address  string `json:"address"`
+	SpentBy  string `json:"spent_by,omitempty"`
+}
+
+// historyResult lists the outputs paid to the wallet by height.
+type historyResult []historyEntry
+
+func (r historyResult) String() string {
+	lines := []string{}
+	for _, entry := range r {
+		line := fmt.Sprintf("%d %s %d %s %s", entry.Height, entry.Outpoint,
+			entry.Amount, entry.Key, entry.Address)
+		if entry.SpentBy != "" {
+			line += " spent by " + entry.SpentBy
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// balance prints the coins of the wallet, which doesn't need to be
+// unlocked.
+func balance(c *cli, args []string) error {
+	k, err := wallet.Open(c.wallet)
+	if err != nil {
+		return err
+	}
+	prefix, err := c.prefix()
+	if err != nil {
+		return err
+	}
+	coins, err := k.Coins(c.client())
+	if err != nil {
+		return err
+	}
+	result := balanceResult{Keys: []keyBalance{}}
+	for _, coin := range coins {
+		result.Balance += coin.Amount
+		last := len(result.Keys) - 1
+		if last < 0 || result.Keys[last].Name != coin.Key {
+			text, err := address.Encode(prefix, coin.PublicKey)
+			if err != nil {
+				return err
+			}
+			result.Keys = append(result.Keys,
+				keyBalance{Name: coin.Key, Address: text})
+			last++
+		}
+		result.Keys[last].Balance += coin.Amount
+		result.Keys[last].Outputs++
+	}
+	return c.print(result)
+}
+
+// history prints the outputs paid to the wallet's keys, spent or not.
+func history(c *cli, args []string) error {
+	k, err := wallet.Open(c.wallet)
+	if err != nil {
+		return err
+	}
+	prefix, err := c.prefix()
+	if err != nil {
+		return err
+	}
+	client := c.client()
+	result := historyResult{}
+	for _, name := range k.Names() {
+		publicKey, err := k.PublicKey(name)
+		if err != nil {
+			return err
+		}
+		text, err := address.Encode(prefix, publicKey)
+		if err != nil {
+			return err
+		}
+		outputs, err := client.Address(text)
+		if err != nil {
+			return err
+		}
+		for _, output := range outputs.Outputs {
+			entry := historyEntry{output.Height,
+				fmt.Sprintf("%s:%d", base58.Encode(output.TransactionHash),
+					output.OutputID), output.Amount, name, text, ""}
+			if output.SpentBy != nil {
+				entry.SpentBy = base58.Encode(output.SpentBy)
+			}
+			result = append(result, entry)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Height < result[j].Height
+	})
+	return c.print(result)
+}
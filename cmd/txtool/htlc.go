@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"golang.org/x/crypto/ed25519"
+)
+
+const htlcUsage = `usage: txtool htlc <command> [flags]
+
+Commands:
+  create  lock an output of the wallet key in an HTLC
+  claim   spend an HTLC output with the claim key and the preimage
+  refund  spend an HTLC output with the refund key after its lock height`
+
+// decodeKey returns the public key of an address, the wallet's if text is
+// empty.
+func decodeKey(text string, wallet []byte, prefix byte) ([]byte, error) {
+	if text == "" {
+		return wallet, nil
+	}
+	return decodeAddress(text, prefix)
+}
+
+func htlc(c *cli, args []string) error {
+	if len(args) == 0 || (args[0] != "create" && args[0] != "claim" &&
+		args[0] != "refund") {
+		fmt.Fprintln(c.out, htlcUsage)
+		return ErrUnknownCommand
+	}
+	flags := flag.NewFlagSet("htlc "+args[0], flag.ExitOnError)
+	input := flags.String("input", "", "spent output as <hash>:<output id>")
+	amount := flags.Int("amount", 0, "amount of the spent output")
+	claimKey := flags.String("claim", "", "address that claims")
+	refundKey := flags.String("refund", "",
+		"address that is refunded, the wallet's by default")
+	lock := flags.Int("lock", 0, "height after which the HTLC is refunded")
+	hash := flags.String("hash", "",
+		"hex SHA-256 hash locking the HTLC, a new preimage by default")
+	script := flags.String("script", "", "hex script of the HTLC output")
+	preimage := flags.String("preimage", "", "hex preimage to claim with")
+	to := flags.String("to", "", "address to pay, the wallet's by default")
+	walletPath := flags.String("wallet", c.wallet, "wallet to sign with")
+	key := flags.String("key", wallet.DEFAULT_KEY, "wallet key to sign with")
+	node := flags.String("node", c.node, "node to send the transaction to")
+	flags.Parse(args[1:])
+
+	privateKey, err := openKey(*walletPath, *key)
+	if err != nil {
+		return err
+	}
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	params, err := wallet.NewClient(*node).Params()
+	if err != nil {
+		return err
+	}
+	outpoint, id, err := parseOutpoint(*input)
+	if err != nil {
+		return err
+	}
+	transaction := blockchain.Transaction{[]byte{},
+		[]blockchain.Input{blockchain.Input{[]byte{}, outpoint, id, nil, 0}},
+		nil, 0}
+	spent := blockchain.Output{publicKey, *amount, []byte{}}
+
+	switch args[0] {
+	case "create":
+		h := blockchain.HTLC{LockHeight: uint32(*lock)}
+		if *hash == "" {
+			secret := make([]byte, blockchain.HTLC_PREIMAGE_SIZE)
+			_, err = rand.Read(secret)
+			if err != nil {
+				return err
+			}
+			digest := sha256.Sum256(secret)
+			h.Hash = digest[:]
+			fmt.Fprintln(c.out, "preimage", hex.EncodeToString(secret))
+		} else if h.Hash, err = hex.DecodeString(*hash); err != nil {
+			return fmt.Errorf("Invalid hash %s", *hash)
+		}
+		h.ClaimKey, err = decodeKey(*claimKey, nil, params.AddressPrefix)
+		if err != nil {
+			return err
+		}
+		h.RefundKey, err = decodeKey(*refundKey, publicKey,
+			params.AddressPrefix)
+		if err != nil {
+			return err
+		}
+		locking, err := h.Script()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, "hash", hex.EncodeToString(h.Hash))
+		fmt.Fprintln(c.out, "script", hex.EncodeToString(locking))
+		transaction.Outputs = []blockchain.Output{
+			blockchain.Output{[]byte{}, *amount, locking}}
+		transaction.Hash, err = transaction.GetHash()
+		if err != nil {
+			return err
+		}
+		err = transaction.Sign(privateKey, 0, spent, blockchain.SIGHASH_ALL)
+		if err != nil {
+			return err
+		}
+	case "claim", "refund":
+		locking, err := hex.DecodeString(*script)
+		if err != nil {
+			return fmt.Errorf("Invalid script %s", *script)
+		}
+		h, err := blockchain.ParseHTLCScript(locking)
+		if err != nil {
+			return err
+		}
+		payee, err := decodeKey(*to, publicKey, params.AddressPrefix)
+		if err != nil {
+			return err
+		}
+		transaction.Outputs = []blockchain.Output{
+			blockchain.Output{payee, *amount, []byte{}}}
+		if args[0] == "refund" {
+			// the node holds the refund until the lock height passed
+			transaction.LockTime = h.LockHeight
+		}
+		transaction.Hash, err = transaction.GetHash()
+		if err != nil {
+			return err
+		}
+		spent = blockchain.Output{[]byte{}, *amount, locking}
+		if args[0] == "claim" {
+			var secret []byte
+			secret, err = hex.DecodeString(*preimage)
+			if err != nil {
+				return fmt.Errorf("Invalid preimage %s", *preimage)
+			}
+			err = transaction.ClaimHTLC(privateKey, 0, spent, secret,
+				blockchain.SIGHASH_ALL)
+		} else {
+			err = transaction.RefundHTLC(privateKey, 0, spent,
+				blockchain.SIGHASH_ALL)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.putTransaction(*node, transaction,
+		[]blockchain.Output{spent})
+}
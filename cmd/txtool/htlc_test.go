@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/address"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/config"
+	"github.com/InitialShape/cryptocurrency/node"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"github.com/mr-tron/base58/base58"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// startNode starts a regtest node of its own chain in dir. Its blocks pay
+// to the default key of walletPath.
+func startNode(t *testing.T, dir string, walletPath string) *node.Node {
+	cfg := config.Default()
+	cfg.DataDir = dir
+	cfg.Network = "regtest"
+	cfg.Wallet = walletPath
+	cfg.P2P = config.P2PConfig{Listen: "127.0.0.1:0",
+		Advertise: "127.0.0.1:0", Seeds: []string{}}
+	cfg.HTTP.Listen = "127.0.0.1:0"
+	n, err := node.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// newWallet writes a wallet with a new default key to dir and returns its
+// path and regtest address.
+func newWallet(t *testing.T, dir string, name string) (string, string) {
+	path := filepath.Join(dir, name)
+	k, err := wallet.Create(path, os.Getenv(wallet.PASSPHRASE_ENV))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer k.Lock()
+	publicKey, err := k.Generate(wallet.DEFAULT_KEY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := address.Encode(blockchain.RegTestParams.AddressPrefix,
+		publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, text
+}
+
+// generate mines count blocks on n.
+func generate(t *testing.T, n *node.Node, count int) blockchain.Block {
+	res, err := http.Post(fmt.Sprintf("%s/generate/%d", n.HTTPAddress(),
+		count), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	res, err = http.Get(fmt.Sprintf("%s/root", n.HTTPAddress()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var block blockchain.Block
+	err = json.NewDecoder(res.Body).Decode(&block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func outpoint(transaction blockchain.Transaction) string {
+	return base58.Encode(transaction.Hash) + ":0"
+}
+
+func TestAtomicSwap(t *testing.T) {
+	c := newCLI()
+	dir, err := ioutil.TempDir("", "swap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aliceWallet, alice := newWallet(t, dir, "alice.json")
+	bobWallet, bob := newWallet(t, dir, "bob.json")
+	amount := strconv.Itoa(blockchain.RegTestParams.CoinbaseAmount)
+
+	// alice has coins on one chain, bob on the other
+	chainA := startNode(t, filepath.Join(dir, "a"), aliceWallet)
+	defer chainA.Stop()
+	chainB := startNode(t, filepath.Join(dir, "b"), bobWallet)
+	defer chainB.Stop()
+	coinA := generate(t, chainA, 1).Transactions[0]
+	coinB := generate(t, chainB, 1).Transactions[0]
+
+	// alice locks hers to bob's key and her secret, bob locks his to
+	// alice's key and the same hash, with an earlier refund
+	preimage := make([]byte, blockchain.HTLC_PREIMAGE_SIZE)
+	rand.Read(preimage)
+	hash := sha256.Sum256(preimage)
+	hashHex := hex.EncodeToString(hash[:])
+	err = htlc(c, []string{"create", "-input", outpoint(coinA), "-amount",
+		amount, "-claim", bob, "-lock", "20", "-hash", hashHex, "-wallet",
+		aliceWallet, "-node", chainA.HTTPAddress()})
+	assert.NoError(t, err)
+	lockedA := generate(t, chainA, 1).Transactions[1]
+	err = htlc(c, []string{"create", "-input", outpoint(coinB), "-amount",
+		amount, "-claim", alice, "-lock", "10", "-hash", hashHex, "-wallet",
+		bobWallet, "-node", chainB.HTTPAddress()})
+	assert.NoError(t, err)
+	lockedB := generate(t, chainB, 1).Transactions[1]
+
+	// alice claims bob's coins and reveals the secret
+	err = htlc(c, []string{"claim", "-input", outpoint(lockedB), "-amount",
+		amount, "-script", hex.EncodeToString(lockedB.Outputs[0].Script),
+		"-preimage", hex.EncodeToString(preimage), "-wallet", aliceWallet,
+		"-node", chainB.HTTPAddress()})
+	assert.NoError(t, err)
+	claimB := generate(t, chainB, 1).Transactions[1]
+	assert.Equal(t, lockedB.Hash, claimB.Inputs[0].TransactionHash)
+	revealed := claimB.Inputs[0].Witness[1]
+	assert.Equal(t, preimage, revealed)
+
+	// which bob uses to claim alice's
+	err = htlc(c, []string{"claim", "-input", outpoint(lockedA), "-amount",
+		amount, "-script", hex.EncodeToString(lockedA.Outputs[0].Script),
+		"-preimage", hex.EncodeToString(revealed), "-wallet", bobWallet,
+		"-node", chainA.HTTPAddress()})
+	assert.NoError(t, err)
+	claimA := generate(t, chainA, 1).Transactions[1]
+	assert.Equal(t, lockedA.Hash, claimA.Inputs[0].TransactionHash)
+	a, err := address.Parse(bob)
+	assert.NoError(t, err)
+	assert.Equal(t, a.PublicKey, claimA.Outputs[0].PublicKey)
+
+	// only the claim key can claim
+	err = htlc(c, []string{"claim", "-input", outpoint(lockedA), "-amount",
+		amount, "-script", hex.EncodeToString(lockedA.Outputs[0].Script),
+		"-preimage", hex.EncodeToString(revealed), "-wallet", aliceWallet,
+		"-node", chainA.HTTPAddress()})
+	assert.Equal(t, blockchain.ErrHTLCKey, err)
+}
+
+func TestRefundHTLC(t *testing.T) {
+	c := newCLI()
+	dir, err := ioutil.TempDir("", "refund")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	aliceWallet, _ := newWallet(t, dir, "alice.json")
+	bobWallet, bob := newWallet(t, dir, "bob.json")
+	amount := strconv.Itoa(blockchain.RegTestParams.CoinbaseAmount)
+
+	chain := startNode(t, filepath.Join(dir, "chain"), aliceWallet)
+	defer chain.Stop()
+	coin := generate(t, chain, 1).Transactions[0]
+
+	// keys are only taken as addresses of the node's network
+	bobAddress, err := address.Parse(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainnet, err := address.Encode(blockchain.MainNetParams.AddressPrefix,
+		bobAddress.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, claim := range []string{mainnet,
+		base58.Encode(bobAddress.PublicKey)} {
+		err = htlc(c, []string{"create", "-input", outpoint(coin), "-amount",
+			amount, "-claim", claim, "-lock", "4", "-wallet", aliceWallet,
+			"-node", chain.HTTPAddress()})
+		assert.Error(t, err)
+	}
+
+	err = htlc(c, []string{"create", "-input", outpoint(coin), "-amount",
+		amount, "-claim", bob, "-lock", "4", "-wallet", aliceWallet,
+		"-node", chain.HTTPAddress()})
+	assert.NoError(t, err)
+	locked := generate(t, chain, 1).Transactions[1]
+	script := hex.EncodeToString(locked.Outputs[0].Script)
+
+	// bob doesn't know the secret
+	err = htlc(c, []string{"claim", "-input", outpoint(locked), "-amount",
+		amount, "-script", script, "-preimage", hex.EncodeToString(
+			make([]byte, blockchain.HTLC_PREIMAGE_SIZE)), "-wallet",
+		bobWallet, "-node", chain.HTTPAddress()})
+	assert.Equal(t, blockchain.ErrHTLCPreimage, err)
+
+	// the refund is held until blocks after the lock height
+	err = htlc(c, []string{"refund", "-input", outpoint(locked), "-amount",
+		amount, "-script", script, "-wallet", aliceWallet, "-node",
+		chain.HTTPAddress()})
+	assert.NoError(t, err)
+	root := generate(t, chain, 1)
+	assert.Equal(t, 3, root.Height)
+	assert.Len(t, root.Transactions, 1)
+	root = generate(t, chain, 1)
+	assert.Len(t, root.Transactions, 1)
+	root = generate(t, chain, 1)
+	if assert.Len(t, root.Transactions, 2) {
+		refund := root.Transactions[1]
+		assert.Equal(t, locked.Hash, refund.Inputs[0].TransactionHash)
+		assert.Equal(t, uint32(4), refund.LockTime)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"github.com/mr-tron/base58/base58"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const multisigUsage = `usage: txtool multisig <command> [flags]
+
+Commands:
+  script  print the script of an m-of-n output
+  create  write an unsigned spend of an m-of-n output to a file
+  sign    add the signature of the wallet key to a spend
+  send    send a spend that has enough signatures to the node`
+
+// multisigScript parses a comma-separated list of addresses of the network
+// with prefix into the script that m of their keys have to sign.
+func multisigScript(m int, addresses string, prefix byte) ([]byte, error) {
+	var publicKeys [][]byte
+	for _, text := range strings.Split(addresses, ",") {
+		publicKey, err := decodeAddress(text, prefix)
+		if err != nil {
+			return nil, err
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	return blockchain.MultisigScript(m, publicKeys)
+}
+
+// parseOutpoint parses an input written as <base58 hash>:<output id>.
+func parseOutpoint(outpoint string) ([]byte, int, error) {
+	parts := strings.Split(outpoint, ":")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("Invalid input %s", outpoint)
+	}
+	hash, err := base58.Decode(parts[0])
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid input %s", outpoint)
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil || id < 0 {
+		return nil, 0, fmt.Errorf("Invalid input %s", outpoint)
+	}
+	return hash, id, nil
+}
+
+func multisig(c *cli, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(c.out, multisigUsage)
+		return ErrUnknownCommand
+	}
+	flags := flag.NewFlagSet("multisig "+args[0], flag.ExitOnError)
+	m := flags.Int("m", 2, "signatures required to spend")
+	keys := flags.String("keys", "", "comma-separated addresses of the keys")
+	input := flags.String("input", "", "spent output as <hash>:<output id>")
+	amount := flags.Int("amount", 0, "amount of the spent output")
+	to := flags.String("to", "", "address to pay")
+	file := flags.String("file", "multisig.json",
+		"partially signed transaction file")
+	walletPath := flags.String("wallet", c.wallet, "wallet to sign with")
+	node := flags.String("node", c.node,
+		"node to send the transaction to and take the network from")
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "script":
+		params, err := wallet.NewClient(*node).Params()
+		if err != nil {
+			return err
+		}
+		script, err := multisigScript(*m, *keys, params.AddressPrefix)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, hex.EncodeToString(script))
+		return nil
+	case "create":
+		params, err := wallet.NewClient(*node).Params()
+		if err != nil {
+			return err
+		}
+		script, err := multisigScript(*m, *keys, params.AddressPrefix)
+		if err != nil {
+			return err
+		}
+		hash, id, err := parseOutpoint(*input)
+		if err != nil {
+			return err
+		}
+		publicKey, err := decodeAddress(*to, params.AddressPrefix)
+		if err != nil {
+			return err
+		}
+		transaction := blockchain.Transaction{[]byte{},
+			[]blockchain.Input{blockchain.Input{[]byte{}, hash, id, nil, 0}},
+			[]blockchain.Output{
+				blockchain.Output{publicKey, *amount, []byte{}}}, 0}
+		spent := blockchain.Output{[]byte{}, *amount, script}
+		partial, err := wallet.NewPartialTransaction(transaction,
+			[]blockchain.Output{spent})
+		if err != nil {
+			return err
+		}
+		return writePartial(*file, partial)
+	case "sign":
+		partial, err := readPartial(*file)
+		if err != nil {
+			return err
+		}
+		k, err := unlockWallet(*walletPath)
+		if err != nil {
+			return err
+		}
+		defer k.Lock()
+		_, err = k.SignPartial(partial)
+		if err != nil {
+			return err
+		}
+		for index := range partial.Inputs {
+			log.Printf("Input %d needs %d more signatures", index,
+				partial.Missing(index))
+		}
+		return writePartial(*file, partial)
+	case "send":
+		partial, err := readPartial(*file)
+		if err != nil {
+			return err
+		}
+		transaction, err := partial.Finalize()
+		if err != nil {
+			return err
+		}
+		return c.putTransaction(*node, transaction, partial.Spent())
+	}
+	fmt.Fprintln(c.out, multisigUsage)
+	return ErrUnknownCommand
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"github.com/mr-tron/base58/base58"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	TRANSACTION_PATH = "transaction.json"
+	SIGNED_PATH      = "signed.json"
+)
+
+// transactionResult is what txtool prints of a transaction it built,
+// signed or sent.
+type transactionResult struct {
+	Hash        string `json:"hash"`
+	WitnessHash string `json:"witness_hash,omitempty"`
+	Fee         *int   `json:"fee,omitempty"`
+	Inputs      int    `json:"inputs"`
+	Signed      int    `json:"signed"`
+	File        string `json:"file,omitempty"`
+}
+
+func (r transactionResult) String() string {
+	lines := []string{"hash " + r.Hash}
+	if r.WitnessHash != "" {
+		lines = append(lines, "witness hash "+r.WitnessHash)
+	}
+	if r.Fee != nil {
+		lines = append(lines, fmt.Sprintf("fee %d", *r.Fee))
+	}
+	lines = append(lines,
+		fmt.Sprintf("signed %d of %d inputs", r.Signed, r.Inputs))
+	if r.File != "" {
+		lines = append(lines, "file "+r.File)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// describe returns the result of transaction, whose inputs spend spent.
+// Without the spent outputs the fee is unknown and the inputs that carry a
+// signature count as signed.
+func describe(transaction blockchain.Transaction,
+	spent []blockchain.Output) transactionResult {
+	result := transactionResult{Hash: base58.Encode(transaction.Hash),
+		Inputs: len(transaction.Inputs)}
+	if spent == nil {
+		for _, input := range transaction.Inputs {
+			if len(input.Signature) > 0 || len(input.Witness) > 0 {
+				result.Signed++
+			}
+		}
+		return result
+	}
+	fee := 0
+	for index, output := range spent {
+		fee += output.Amount
+		valid, _ := transaction.Verify(output, index)
+		if valid {
+			result.Signed++
+		}
+	}
+	for _, output := range transaction.Outputs {
+		fee -= output.Amount
+	}
+	result.Fee = &fee
+	return result
+}
+
+// describePartial returns the result of a partially signed transaction,
+// whose inputs count as signed once they have enough signatures.
+func describePartial(partial *wallet.PartialTransaction,
+	file string) transactionResult {
+	fee := partial.Fee()
+	result := transactionResult{Hash: base58.Encode(partial.Transaction.Hash),
+		Fee: &fee, Inputs: len(partial.Inputs), File: file}
+	for index := range partial.Inputs {
+		if partial.Missing(index) == 0 {
+			result.Signed++
+		}
+	}
+	return result
+}
+
+func readPartial(path string) (*wallet.PartialTransaction, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return wallet.DecodePartialTransaction(data)
+}
+
+func writePartial(path string, partial *wallet.PartialTransaction) error {
+	data, err := partial.Encode()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// putTransaction sends transaction, whose inputs spend spent, to the
+// mempool of the node at the URL node.
+func (c *cli) putTransaction(node string, transaction blockchain.Transaction,
+	spent []blockchain.Output) error {
+	id, err := wallet.NewClient(node).PutTransaction(transaction)
+	if err != nil {
+		return err
+	}
+	result := describe(transaction, spent)
+	result.Hash, result.WitnessHash = id.Hash, id.WitnessHash
+	return c.print(result)
+}
+
+// buildPayment builds the unsigned payment of args with the coins of k.
+func (c *cli) buildPayment(k *wallet.Keystore, args []string,
+	feeRate int) (*wallet.PartialTransaction, error) {
+	client := c.client()
+	params, err := client.Params()
+	if err != nil {
+		return nil, err
+	}
+	payments, err := parsePayment(args, params.AddressPrefix)
+	if err != nil {
+		return nil, err
+	}
+	coins, err := k.Coins(client)
+	if err != nil {
+		return nil, err
+	}
+	transaction, spent, err := k.BuildTransaction(coins, payments, feeRate)
+	if err != nil {
+		return nil, err
+	}
+	var outputs []blockchain.Output
+	for _, coin := range spent {
+		outputs = append(outputs, coin.Output())
+	}
+	return wallet.NewPartialTransaction(transaction, outputs)
+}
+
+func paymentFlags(name string) (*flag.FlagSet, *int) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	feeRate := flags.Int("fee-rate", wallet.DEFAULT_FEE_RATE,
+		"fee per 1000 bytes")
+	return flags, feeRate
+}
+
+// send pays an address from the wallet's coins and sends the payment.
+func send(c *cli, args []string) error {
+	flags, feeRate := paymentFlags("send")
+	flags.Parse(args)
+
+	k, err := unlockWallet(c.wallet)
+	if err != nil {
+		return err
+	}
+	defer k.Lock()
+	partial, err := c.buildPayment(k, flags.Args(), *feeRate)
+	if err != nil {
+		return err
+	}
+	_, err = k.SignPartial(partial)
+	if err != nil {
+		return err
+	}
+	transaction, err := partial.Finalize()
+	if err != nil {
+		return err
+	}
+	return c.putTransaction(c.node, transaction, partial.Spent())
+}
+
+// build writes an unsigned payment to a partially signed transaction file,
+// for sign, combine, finalize and broadcast. Only a wallet with an HD seed
+// is unlocked, for the change key.
+func build(c *cli, args []string) error {
+	flags, feeRate := paymentFlags("build")
+	file := flags.String("out", TRANSACTION_PATH, "file to write")
+	flags.Parse(args)
+
+	k, err := wallet.Open(c.wallet)
+	if err != nil {
+		return err
+	}
+	if k.HasSeed() {
+		k, err = unlockWallet(c.wallet)
+		if err != nil {
+			return err
+		}
+		defer k.Lock()
+	}
+	partial, err := c.buildPayment(k, flags.Args(), *feeRate)
+	if err != nil {
+		return err
+	}
+	err = writePartial(*file, partial)
+	if err != nil {
+		return err
+	}
+	return c.print(describePartial(partial, *file))
+}
+
+// sign adds the signatures of the wallet's keys to a partially signed
+// transaction file. It doesn't need the node, so the wallet can stay on a
+// machine that's offline.
+func sign(c *cli, args []string) error {
+	flags := flag.NewFlagSet("sign", flag.ExitOnError)
+	in := flags.String("in", TRANSACTION_PATH, "file to sign")
+	out := flags.String("out", "", "file to write, the one signed by default")
+	flags.Parse(args)
+	if *out == "" {
+		out = in
+	}
+
+	partial, err := readPartial(*in)
+	if err != nil {
+		return err
+	}
+	k, err := unlockWallet(c.wallet)
+	if err != nil {
+		return err
+	}
+	defer k.Lock()
+	_, err = k.SignPartial(partial)
+	if err != nil {
+		return err
+	}
+	err = writePartial(*out, partial)
+	if err != nil {
+		return err
+	}
+	return c.print(describePartial(partial, *out))
+}
+
+// combine merges the signatures of copies of a partially signed
+// transaction file signed by different wallets.
+func combine(c *cli, args []string) error {
+	flags := flag.NewFlagSet("combine", flag.ExitOnError)
+	out := flags.String("out", TRANSACTION_PATH, "file to write")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		return ErrUsage
+	}
+
+	var partials []*wallet.PartialTransaction
+	for _, path := range flags.Args() {
+		partial, err := readPartial(path)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		partials = append(partials, partial)
+	}
+	partial, err := wallet.CombinePartial(partials...)
+	if err != nil {
+		return err
+	}
+	err = writePartial(*out, partial)
+	if err != nil {
+		return err
+	}
+	return c.print(describePartial(partial, *out))
+}
+
+// finalize writes the signed transaction of a partially signed transaction
+// file whose inputs all have enough signatures.
+func finalize(c *cli, args []string) error {
+	flags := flag.NewFlagSet("finalize", flag.ExitOnError)
+	in := flags.String("in", TRANSACTION_PATH, "file to finalize")
+	out := flags.String("out", SIGNED_PATH, "file to write")
+	flags.Parse(args)
+
+	partial, err := readPartial(*in)
+	if err != nil {
+		return err
+	}
+	transaction, err := partial.Finalize()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(transaction, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(*out, data, 0644)
+	if err != nil {
+		return err
+	}
+	result := describe(transaction, partial.Spent())
+	result.File = *out
+	return c.print(result)
+}
+
+// broadcast sends a signed transaction to the node, see readTransaction.
+// A partially signed transaction file is finalized first.
+func broadcast(c *cli, args []string) error {
+	flags := flag.NewFlagSet("broadcast", flag.ExitOnError)
+	in := flags.String("in", TRANSACTION_PATH, "file or hex to send")
+	flags.Parse(args)
+
+	transaction, partial, err := readTransaction(*in)
+	if err != nil {
+		return err
+	}
+	if partial == nil {
+		return c.putTransaction(c.node, transaction, nil)
+	}
+	transaction, err = partial.Finalize()
+	if err != nil {
+		return err
+	}
+	return c.putTransaction(c.node, transaction, partial.Spent())
+}
@@ -1,54 +1,167 @@
 package main
 
 import (
-	"bytes"
-	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"github.com/InitialShape/cryptocurrency/address"
 	"github.com/InitialShape/cryptocurrency/blockchain"
-	"golang.org/x/crypto/ed25519"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"io"
 	"log"
-	"net/http"
+	"os"
+	"strconv"
 )
 
-const server = "http://localhost:8000"
+const (
+	DEFAULT_NODE = "http://localhost:8000"
+	// NODE_ENV is the environment variable the node is read from.
+	NODE_ENV = "CRYPTOCURRENCY_NODE"
+)
+
+const usage = `usage: txtool [flags] <command> [flags] [args]
+
+Commands:
+  keygen     add a new key to the wallet, creating it, and print its address
+  address    print the address of a key, or of a new HD receive key
+  balance    print the unspent outputs of the wallet's keys
+  send       pay <address> <amount> from the wallet right away
+  build      write an unsigned payment of <address> <amount> to a file
+  sign       sign a transaction file with the wallet's keys, offline
+  combine    merge the signatures of copies of a transaction file
+  finalize   write the signed transaction of a transaction file
+  broadcast  send a transaction file, or a signed transaction, to the node
+  decode     print a transaction of a file or in hex
+  history    print the outputs paid to the wallet's keys
+  wallet     manage the wallet's keys
+  multisig   spend outputs locked to m of n keys
+  htlc       lock and spend hash time-locked outputs
+
+Flags:
+  --node     URL of the node, ` + NODE_ENV + ` or ` + DEFAULT_NODE + `
+             by default
+  --wallet   wallet file, ` + WALLET_PATH + ` by default
+  --network  network of addresses, the node's by default
+  --json     print JSON instead of text`
+
+var (
+	ErrUnknownCommand = errors.New("Unknown command")
+	ErrUsage          = errors.New("Wrong arguments")
+)
+
+// cli holds the flags every command shares and where it prints to.
+type cli struct {
+	node    string
+	wallet  string
+	network string
+	json    bool
+	out     io.Writer
+}
+
+var commands = map[string]func(*cli, []string) error{
+	"keygen":    keygen,
+	"address":   addressCommand,
+	"balance":   balance,
+	"send":      send,
+	"build":     build,
+	"sign":      sign,
+	"combine":   combine,
+	"finalize":  finalize,
+	"broadcast": broadcast,
+	"decode":    decode,
+	"history":   history,
+	"wallet":    walletCommand,
+	"multisig":  multisig,
+	"htlc":      htlc,
+}
 
-var transactionsUrl string
+// run parses the shared flags of args and runs the command that follows
+// them.
+func run(args []string, out io.Writer) error {
+	node := os.Getenv(NODE_ENV)
+	if node == "" {
+		node = DEFAULT_NODE
+	}
+	c := &cli{out: out}
+	flags := flag.NewFlagSet("txtool", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
+	flags.StringVar(&c.node, "node", node, "URL of the node")
+	flags.StringVar(&c.wallet, "wallet", WALLET_PATH, "wallet file")
+	flags.StringVar(&c.network, "network", "", "network of addresses")
+	flags.BoolVar(&c.json, "json", false, "print JSON")
+	flags.Parse(args)
 
-func init() {
-	transactionsUrl = fmt.Sprintf("%s/mempool/transactions", server)
+	args = flags.Args()
+	if len(args) == 0 || commands[args[0]] == nil {
+		fmt.Fprintln(os.Stderr, usage)
+		return ErrUnknownCommand
+	}
+	return commands[args[0]](c, args[1:])
 }
 
 func main() {
-	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
-	outputs := []blockchain.Output{blockchain.Output{publicKey, 10}}
-	inputs := []blockchain.Input{blockchain.Input{[]byte{}, []byte{}, 0}}
-	transaction := blockchain.Transaction{[]byte{}, inputs, outputs}
-	hash, err := transaction.GetHash()
+	err := run(os.Args[1:], os.Stdout)
 	if err != nil {
 		log.Fatal(err)
 	}
-	transaction.Hash = hash
-	transaction.Sign(privateKey, 0)
+}
 
-	transactionJSON, err := json.Marshal(transaction)
-	if err != nil {
-		log.Fatal(err)
+func (c *cli) client() *wallet.Client {
+	return wallet.NewClient(c.node)
+}
+
+// prefix returns the address prefix of --network, or of the node's network
+// if it isn't set.
+func (c *cli) prefix() (byte, error) {
+	if c.network != "" {
+		params, err := blockchain.ParamsForNetwork(c.network)
+		if err != nil {
+			return 0, err
+		}
+		return params.AddressPrefix, nil
 	}
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodPut, transactionsUrl,
-		bytes.NewReader(transactionJSON))
+	params, err := c.client().Params()
+	return params.AddressPrefix, err
+}
+
+// print writes v as indented JSON with --json and as text otherwise.
+func (c *cli) print(v fmt.Stringer) error {
+	if !c.json {
+		_, err := fmt.Fprintln(c.out, v)
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	res, err := client.Do(req)
+	_, err = fmt.Fprintln(c.out, string(data))
+	return err
+}
+
+// decodeAddress returns the public key an address of the network with
+// prefix pays to.
+func decodeAddress(text string, prefix byte) ([]byte, error) {
+	publicKey, err := address.Decode(text, prefix)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("%s: %s", err, text)
 	}
-	log.Println(transaction.GetBase58Hash())
+	return publicKey, nil
+}
 
-	if res.StatusCode != 201 {
-		log.Fatal(errors.New("Transaction wasn't created"))
+// parsePayment parses the <address> <amount> arguments of a payment.
+func parsePayment(args []string, prefix byte) ([]blockchain.Output, error) {
+	if len(args) != 2 {
+		return nil, ErrUsage
+	}
+	publicKey, err := decodeAddress(args[0], prefix)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := strconv.Atoi(args[1])
+	if err != nil || amount <= 0 {
+		return nil, fmt.Errorf("Invalid amount %s", args[1])
 	}
+	return []blockchain.Output{
+		blockchain.Output{publicKey, amount, []byte{}}}, nil
 }
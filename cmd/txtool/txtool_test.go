@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/InitialShape/cryptocurrency/address"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/miner"
+	"github.com/InitialShape/cryptocurrency/storage"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"github.com/InitialShape/cryptocurrency/web"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newStore returns a regtest store in memory and a server of its API.
+func newStore(t *testing.T) (*blockchain.Store, *httptest.Server) {
+	store := &blockchain.Store{}
+	peer := &blockchain.Peer{}
+	err := store.OpenDB(storage.NewMemory(),
+		storage.NewMemoryFiles(blockchain.BLOCK_FILE_SIZE), peer,
+		&blockchain.RegTestParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*peer = blockchain.Peer{ListenAddress: "localhost:1234",
+		AdvertiseAddress: "localhost:1234", Store: *store}
+	return store, httptest.NewServer(web.Handlers(*store, nil))
+}
+
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "txtool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wallet.json")
+	file := filepath.Join(dir, "payment.json")
+	signed := filepath.Join(dir, "signed.json")
+	combined := filepath.Join(dir, "combined.json")
+	final := filepath.Join(dir, "final.json")
+	store, server := newStore(t)
+	defer server.Close()
+
+	payee, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := address.Encode(blockchain.RegTestParams.AddressPrefix, payee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, minerKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// mine pays the wallet's default key, a coinbase of the same key would
+	// have the same hash
+	mine := func(privateKey ed25519.PrivateKey) func() {
+		return func() {
+			if privateKey == nil {
+				var err error
+				privateKey, err = wallet.OpenKey(path, wallet.DEFAULT_KEY,
+					"passphrase")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := miner.GenerateBlocks(store, privateKey, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	encoded, err := (&blockchain.Transaction{[]byte{},
+		[]blockchain.Input{{[]byte{}, []byte("a"), 1, nil, 0}},
+		[]blockchain.Output{{payee, 3, []byte{}}}, 0}).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		before func()
+		args   []string
+		want   []string
+		err    string
+	}{
+		{nil, []string{"keygen"}, []string{"default R"}, ""},
+		{nil, []string{"keygen"}, nil, wallet.ErrKeyExists.Error()},
+		{nil, []string{"--json", "address"},
+			[]string{`"name": "default"`, `"address": "R`}, ""},
+		{nil, []string{"address", "-key", "other"}, nil,
+			wallet.ErrKeyNotFound.Error()},
+		{nil, []string{"balance"}, []string{"balance 0"}, ""},
+		{mine(nil), []string{"balance"},
+			[]string{"default R", "25 in 1 outputs", "balance 25"}, ""},
+		{nil, []string{"--json", "balance"}, []string{`"balance": 25`}, ""},
+		{nil, []string{"send", to}, nil, ErrUsage.Error()},
+		{nil, []string{"send", to, "ten"}, nil, "Invalid amount ten"},
+		{nil, []string{"send", to, "30"}, nil,
+			wallet.ErrInsufficientFunds.Error()},
+		{nil, []string{"send", to, "10"},
+			[]string{"witness hash", "fee 1", "signed 1 of 1 inputs"}, ""},
+		// the coin is spent by the mempool, the change isn't confirmed
+		{nil, []string{"balance"}, []string{"balance 0"}, ""},
+		{mine(minerKey), []string{"balance"}, []string{"balance 14"}, ""},
+		{nil, []string{"history"},
+			[]string{"1 ", " 25 default R", "spent by", "2 ", " 14 default"},
+			""},
+		{nil, []string{"--json", "history"},
+			[]string{`"amount": 14`, `"spent_by"`}, ""},
+		{nil, []string{"build", "-out", file, to, "5"},
+			[]string{"fee 1", "signed 0 of 1 inputs", "file " + file}, ""},
+		{nil, []string{"decode", file}, []string{"output 0 " + to + " 5",
+			"missing 1 signatures", "fee 1"}, ""},
+		{nil, []string{"broadcast", "-in", file}, nil,
+			"Input 0: " + wallet.ErrMissingSignatures.Error()},
+		{nil, []string{"finalize", "-in", file, "-out", final}, nil,
+			"Input 0: " + wallet.ErrMissingSignatures.Error()},
+		// signing doesn't need the node
+		{nil, []string{"--node", "http://127.0.0.1:1", "sign", "-in", file,
+			"-out", signed}, []string{"signed 1 of 1 inputs"}, ""},
+		{nil, []string{"combine", "-out", combined}, nil, ErrUsage.Error()},
+		{nil, []string{"combine", "-out", combined, file, signed},
+			[]string{"fee 1", "signed 1 of 1 inputs", "file " + combined}, ""},
+		{nil, []string{"--json", "decode", combined},
+			[]string{`"signed": true`, `"fee": 1`}, ""},
+		{nil, []string{"finalize", "-in", combined, "-out", final},
+			[]string{"signed 1 of 1 inputs", "file " + final}, ""},
+		{nil, []string{"decode", final}, []string{"output 0 " + to + " 5"},
+			""},
+		{nil, []string{"broadcast", "-in", final},
+			[]string{"witness hash", "signed 1 of 1 inputs"}, ""},
+		{nil, []string{"--network", "regtest", "--json", "decode",
+			hex.EncodeToString(encoded)},
+			[]string{`"amount": 3`, `"signed": false`, `"address": "` + to},
+			""},
+		{nil, []string{"decode", "nothing"}, nil,
+			"Neither a file nor hex: nothing"},
+		{nil, []string{"unknown"}, nil, ErrUnknownCommand.Error()},
+	} {
+		if test.before != nil {
+			test.before()
+		}
+		var out bytes.Buffer
+		args := append([]string{"--node", server.URL, "--wallet", path},
+			test.args...)
+		err := run(args, &out)
+		if test.err != "" {
+			assert.EqualError(t, err, test.err, "%v", test.args)
+		} else {
+			assert.NoError(t, err, "%v", test.args)
+		}
+		for _, want := range test.want {
+			assert.Contains(t, out.String(), want, "%v", test.args)
+		}
+	}
+}
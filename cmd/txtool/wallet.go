@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/address"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"github.com/mr-tron/base58/base58"
+	"golang.org/x/crypto/ed25519"
+	"os"
+	"strings"
+)
+
+const WALLET_PATH = "wallet.json"
+
+const walletUsage = `usage: txtool wallet <command> [flags]
+
+Commands:
+  create    create a new, empty wallet
+  generate  add a new key to the wallet
+  list      print the names and addresses of the wallet's keys
+  import    add a base58 private key or a wallet.txt of older versions
+  export    print the base58 private key of a key
+  mnemonic  add a new HD seed and print its mnemonic
+  restore   add the HD seed of a mnemonic and scan for its keys
+  scan      add the HD keys that received outputs on the node
+  receive   add a fresh HD receive key and print its address
+
+The passphrase is read from ` + wallet.PASSPHRASE_ENV + ` or asked for.`
+
+// readPassphrase returns the passphrase of the environment, or asks for it
+// on the terminal.
+func readPassphrase() (string, error) {
+	passphrase, ok := os.LookupEnv(wallet.PASSPHRASE_ENV)
+	if ok {
+		return passphrase, nil
+	}
+	fmt.Fprint(os.Stderr, "Wallet passphrase: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// openKey returns the private key name of the wallet at path.
+func openKey(path string, name string) (ed25519.PrivateKey, error) {
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return wallet.OpenKey(path, name, passphrase)
+}
+
+// unlockWallet opens the wallet at path and unlocks it.
+func unlockWallet(path string) (*wallet.Keystore, error) {
+	k, err := wallet.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := readPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	return k, k.Unlock(passphrase, 0)
+}
+
+// scanWallet adds the HD keys of k whose addresses received outputs on the
+// node.
+func (c *cli) scanWallet(k *wallet.Keystore, node string) error {
+	client := wallet.NewClient(node)
+	params, err := client.Params()
+	if err != nil {
+		return err
+	}
+	found, err := k.Scan(func(publicKey ed25519.PublicKey) (bool, error) {
+		text, err := address.Encode(params.AddressPrefix, publicKey)
+		if err != nil {
+			return false, err
+		}
+		outputs, err := client.Address(text)
+		if err != nil {
+			return false, err
+		}
+		return len(outputs.Outputs) > 0, nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "Found %d HD keys\n", found)
+	return nil
+}
+
+func walletCommand(c *cli, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(c.out, walletUsage)
+		return ErrUnknownCommand
+	}
+	flags := flag.NewFlagSet("wallet "+args[0], flag.ExitOnError)
+	path := flags.String("wallet", c.wallet, "wallet file")
+	name := flags.String("key", wallet.DEFAULT_KEY, "name of the key")
+	privateKey := flags.String("private", "", "base58 private key to import")
+	legacy := flags.String("legacy", "", "wallet.txt to import")
+	mnemonic := flags.String("mnemonic", "", "mnemonic to restore")
+	password := flags.String("password", "",
+		"optional password of the mnemonic")
+	account := flags.Uint("account", 0, "HD account")
+	node := flags.String("node", c.node,
+		"node to take the network of addresses from")
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "create":
+		passphrase, err := readPassphrase()
+		if err != nil {
+			return err
+		}
+		k, err := wallet.Create(*path, passphrase)
+		if err != nil {
+			return err
+		}
+		k.Lock()
+		return nil
+	case "generate", "import":
+		k, err := unlockWallet(*path)
+		if err != nil {
+			return err
+		}
+		defer k.Lock()
+		if args[0] == "generate" {
+			_, err = k.Generate(*name)
+			return err
+		}
+		var key ed25519.PrivateKey
+		if *legacy != "" {
+			key, err = wallet.ReadLegacyWallet(*legacy)
+		} else {
+			key, err = base58.Decode(*privateKey)
+		}
+		if err != nil {
+			return err
+		}
+		return k.Import(*name, key)
+	case "list":
+		k, err := wallet.Open(*path)
+		if err != nil {
+			return err
+		}
+		params, err := wallet.NewClient(*node).Params()
+		if err != nil {
+			return err
+		}
+		for _, keyName := range k.Names() {
+			publicKey, err := k.PublicKey(keyName)
+			if err != nil {
+				return err
+			}
+			text, err := address.Encode(params.AddressPrefix, publicKey)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(c.out, keyName, text)
+		}
+		return nil
+	case "mnemonic", "restore":
+		k, err := unlockWallet(*path)
+		if err != nil {
+			return err
+		}
+		defer k.Lock()
+		words := *mnemonic
+		if args[0] == "mnemonic" {
+			words, err = wallet.NewMnemonic()
+			if err != nil {
+				return err
+			}
+		}
+		err = k.SetMnemonic(words, *password)
+		if err != nil {
+			return err
+		}
+		if args[0] == "mnemonic" {
+			fmt.Fprintln(c.out, words)
+			return nil
+		}
+		return c.scanWallet(k, *node)
+	case "scan":
+		k, err := unlockWallet(*path)
+		if err != nil {
+			return err
+		}
+		defer k.Lock()
+		return c.scanWallet(k, *node)
+	case "receive":
+		k, err := unlockWallet(*path)
+		if err != nil {
+			return err
+		}
+		defer k.Lock()
+		params, err := wallet.NewClient(*node).Params()
+		if err != nil {
+			return err
+		}
+		keyName, publicKey, err := k.NewReceiveAddress(uint32(*account))
+		if err != nil {
+			return err
+		}
+		text, err := address.Encode(params.AddressPrefix, publicKey)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, keyName, text)
+		return nil
+	case "export":
+		key, err := openKey(*path, *name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, base58.Encode(key))
+		return nil
+	}
+	fmt.Fprintln(c.out, walletUsage)
+	return ErrUnknownCommand
+}
+
+// keyResult is a key of the wallet and its address.
+type keyResult struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+func (r keyResult) String() string {
+	return r.Name + " " + r.Address
+}
+
+func (c *cli) printKey(name string, publicKey ed25519.PublicKey) error {
+	prefix, err := c.prefix()
+	if err != nil {
+		return err
+	}
+	text, err := address.Encode(prefix, publicKey)
+	if err != nil {
+		return err
+	}
+	return c.print(keyResult{name, text})
+}
+
+// keygen adds a new key to the wallet, creating the wallet if there is
+// none.
+func keygen(c *cli, args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	name := flags.String("key", wallet.DEFAULT_KEY, "name of the key")
+	flags.Parse(args)
+
+	k, err := wallet.Open(c.wallet)
+	if os.IsNotExist(err) {
+		var passphrase string
+		passphrase, err = readPassphrase()
+		if err != nil {
+			return err
+		}
+		k, err = wallet.Create(c.wallet, passphrase)
+	} else if err == nil {
+		k, err = unlockWallet(c.wallet)
+	}
+	if err != nil {
+		return err
+	}
+	defer k.Lock()
+	publicKey, err := k.Generate(*name)
+	if err != nil {
+		return err
+	}
+	return c.printKey(*name, publicKey)
+}
+
+// addressCommand prints the address of a key, or hands out a new HD
+// receive key.
+func addressCommand(c *cli, args []string) error {
+	flags := flag.NewFlagSet("address", flag.ExitOnError)
+	name := flags.String("key", wallet.DEFAULT_KEY, "name of the key")
+	fresh := flags.Bool("new", false, "hand out a new HD receive key")
+	account := flags.Uint("account", 0, "HD account of the new key")
+	flags.Parse(args)
+
+	if !*fresh {
+		k, err := wallet.Open(c.wallet)
+		if err != nil {
+			return err
+		}
+		publicKey, err := k.PublicKey(*name)
+		if err != nil {
+			return err
+		}
+		return c.printKey(*name, publicKey)
+	}
+	k, err := unlockWallet(c.wallet)
+	if err != nil {
+		return err
+	}
+	defer k.Lock()
+	keyName, publicKey, err := k.NewReceiveAddress(uint32(*account))
+	if err != nil {
+		return err
+	}
+	return c.printKey(keyName, publicKey)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"github.com/mr-tron/base58/base58"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func init() {
+	wallet.ScryptN = 1 << 10
+	os.Setenv(wallet.PASSPHRASE_ENV, "passphrase")
+}
+
+// newCLI returns the shared flags' defaults, printing nowhere.
+func newCLI() *cli {
+	return &cli{DEFAULT_NODE, WALLET_PATH, "", false, ioutil.Discard}
+}
+
+func TestWalletCommand(t *testing.T) {
+	c := newCLI()
+	dir, err := ioutil.TempDir("", "wallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wallet.json")
+
+	assert.NoError(t, walletCommand(c, []string{"create", "-wallet", path}))
+	assert.Equal(t, wallet.ErrWalletExists,
+		walletCommand(c, []string{"create", "-wallet", path}))
+	assert.NoError(t, walletCommand(c, []string{"generate", "-wallet", path}))
+	assert.Equal(t, wallet.ErrKeyExists,
+		walletCommand(c, []string{"generate", "-wallet", path}))
+
+	// a legacy wallet.txt and a base58 key are imported
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := filepath.Join(dir, "wallet.txt")
+	err = ioutil.WriteFile(legacy, []byte(base58.Encode(publicKey)+"\n"+
+		base58.Encode(privateKey)), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, walletCommand(c, []string{"import", "-wallet", path,
+		"-key", "legacy", "-legacy", legacy}))
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, walletCommand(c, []string{"import", "-wallet", path,
+		"-key", "other", "-private", base58.Encode(other)}))
+
+	key, err := openKey(path, "legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey, key)
+	key, err = openKey(path, "other")
+	assert.NoError(t, err)
+	assert.Equal(t, other, key)
+
+	os.Setenv(wallet.PASSPHRASE_ENV, "wrong")
+	defer os.Setenv(wallet.PASSPHRASE_ENV, "passphrase")
+	_, err = openKey(path, wallet.DEFAULT_KEY)
+	assert.Equal(t, wallet.ErrWrongPassphrase, err)
+}
+
+func TestRestoreWallet(t *testing.T) {
+	c := newCLI()
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	minerWallet, _ := newWallet(t, dir, "miner.json")
+	chain := startNode(t, filepath.Join(dir, "chain"), minerWallet)
+	defer chain.Stop()
+	coin := generate(t, chain, 1).Transactions[0]
+
+	// the third receive key of a wallet is paid
+	mnemonic, err := wallet.NewMnemonic()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "hd.json")
+	k, err := wallet.Create(path, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, k.SetMnemonic(mnemonic, ""))
+	var publicKey ed25519.PublicKey
+	for i := 0; i < 3; i++ {
+		_, publicKey, err = k.NewReceiveAddress(0)
+		assert.NoError(t, err)
+	}
+	k.Lock()
+	privateKey, err := wallet.OpenKey(minerWallet, wallet.DEFAULT_KEY,
+		"passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payment := blockchain.Transaction{[]byte{},
+		[]blockchain.Input{blockchain.Input{[]byte{}, coin.Hash, 0, nil, 0}},
+		[]blockchain.Output{blockchain.Output{publicKey,
+			coin.Outputs[0].Amount, []byte{}}}, 0}
+	payment.Hash, err = payment.GetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = payment.Sign(privateKey, 0, coin.Outputs[0],
+		blockchain.SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = wallet.NewClient(chain.HTTPAddress()).PutTransaction(payment)
+	assert.NoError(t, err)
+	generate(t, chain, 1)
+
+	// the restored wallet finds it and hands out the next key
+	restored := filepath.Join(dir, "restored.json")
+	assert.NoError(t, walletCommand(c, []string{"create", "-wallet", restored}))
+	assert.NoError(t, walletCommand(c, []string{"restore", "-wallet", restored,
+		"-mnemonic", mnemonic, "-node", chain.HTTPAddress()}))
+	k, err = wallet.Open(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"hd-0-0-0", "hd-0-0-1", "hd-0-0-2"}, k.Names())
+	assert.Equal(t, []wallet.Account{{0, 3, 0}}, k.Accounts())
+	assert.Equal(t, wallet.ErrInvalidMnemonic, walletCommand(c, []string{
+		"restore", "-wallet", restored, "-mnemonic", "not a mnemonic"}))
+}
@@ -0,0 +1,336 @@
+package config
+
+import (
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/mr-tron/base58/base58"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const ENV_PREFIX = "CRYPTOCURRENCY_"
+
+var (
+	Networks  = []string{"mainnet", "testnet", "regtest"}
+	LogLevels = []string{"debug", "info", "silent"}
+)
+
+type Config struct {
+	DataDir  string         `toml:"data_dir"`
+	Network  string         `toml:"network"`
+	Wallet   string         `toml:"wallet"`
+	LogLevel string         `toml:"log_level"`
+	P2P      P2PConfig      `toml:"p2p"`
+	HTTP     HTTPConfig     `toml:"http"`
+	Mining   MiningConfig   `toml:"mining"`
+	Storage  StorageConfig  `toml:"storage"`
+	Snapshot SnapshotConfig `toml:"snapshot"`
+}
+
+type P2PConfig struct {
+	Listen    string   `toml:"listen"`
+	Advertise string   `toml:"advertise"`
+	Seeds     []string `toml:"seeds"`
+}
+
+type HTTPConfig struct {
+	Listen string `toml:"listen"`
+}
+
+// MiningConfig controls in-process mining. Blocks pay to the wallet key
+// named Key.
+type MiningConfig struct {
+	Enabled bool   `toml:"enabled"`
+	Workers int    `toml:"workers"`
+	Key     string `toml:"key"`
+}
+
+// StorageConfig controls pruning. With a PruneDepth of 0 all blocks are
+// kept.
+type StorageConfig struct {
+	PruneDepth int `toml:"prune_depth"`
+}
+
+// SnapshotConfig names a utxo snapshot a new node starts from instead of the
+// genesis block. Hash is the base58 commitment the snapshot must match.
+type SnapshotConfig struct {
+	File string `toml:"file"`
+	Hash string `toml:"hash"`
+}
+
+// setting is a single configuration value that can be overridden from the
+// command line and the environment. The flag name doubles as the name of the
+// environment variable: "p2p-listen" becomes CRYPTOCURRENCY_P2P_LISTEN.
+type setting struct {
+	name    string
+	usage   string
+	boolean bool
+	set     func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{name: "datadir", usage: "Directory holding the chain database",
+		set: func(c *Config, v string) error { c.DataDir = v; return nil }},
+	{name: "network", usage: "Network to join (mainnet, testnet or regtest)",
+		set: func(c *Config, v string) error { c.Network = v; return nil }},
+	{name: "wallet", usage: "Path of the wallet file (default <datadir>/wallet.json)",
+		set: func(c *Config, v string) error { c.Wallet = v; return nil }},
+	{name: "log-level", usage: "Log level (debug, info or silent)",
+		set: func(c *Config, v string) error { c.LogLevel = v; return nil }},
+	{name: "p2p-listen", usage: "Address the p2p listener binds to",
+		set: func(c *Config, v string) error { c.P2P.Listen = v; return nil }},
+	{name: "p2p-advertise", usage: "Address announced to peers (host learned from peers if empty)",
+		set: func(c *Config, v string) error { c.P2P.Advertise = v; return nil }},
+	{name: "p2p-seeds", usage: "Comma separated list of seed peers (default the network's seeds)",
+		set: func(c *Config, v string) error { c.P2P.Seeds = splitList(v); return nil }},
+	{name: "http-listen", usage: "Address the HTTP API binds to",
+		set: func(c *Config, v string) error { c.HTTP.Listen = v; return nil }},
+	{name: "mining", usage: "Mine blocks in-process", boolean: true,
+		set: func(c *Config, v string) (err error) {
+			c.Mining.Enabled, err = strconv.ParseBool(v)
+			return err
+		}},
+	{name: "mining-workers", usage: "Number of mining workers",
+		set: func(c *Config, v string) (err error) {
+			c.Mining.Workers, err = strconv.Atoi(v)
+			return err
+		}},
+	{name: "mining-key", usage: "Name of the wallet key mined blocks pay to",
+		set: func(c *Config, v string) error { c.Mining.Key = v; return nil }},
+	{name: "prune-depth", usage: "Remove blocks this many blocks below the root (0 keeps all blocks)",
+		set: func(c *Config, v string) (err error) {
+			c.Storage.PruneDepth, err = strconv.Atoi(v)
+			return err
+		}},
+	{name: "snapshot-file", usage: "UTXO snapshot a new node starts from",
+		set: func(c *Config, v string) error { c.Snapshot.File = v; return nil }},
+	{name: "snapshot-hash", usage: "Base58 hash the UTXO snapshot must match",
+		set: func(c *Config, v string) error { c.Snapshot.Hash = v; return nil }},
+}
+
+func Default() Config {
+	return Config{
+		DataDir:  "data",
+		Network:  "mainnet",
+		LogLevel: "info",
+		P2P: P2PConfig{
+			Listen:    ":1234",
+			Advertise: ":1234",
+		},
+		HTTP:   HTTPConfig{Listen: ":8000"},
+		Mining: MiningConfig{Workers: 1, Key: "default"},
+	}
+}
+
+// Load reads a TOML configuration file on top of the defaults. Unknown keys
+// are rejected so that typos don't silently fall back to a default.
+func Load(path string) (Config, error) {
+	config := Default()
+	meta, err := toml.DecodeFile(path, &config)
+	if err != nil {
+		return Config{}, err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return Config{}, fmt.Errorf("Unknown configuration key %q in %s",
+			undecoded[0].String(), path)
+	}
+	return config, nil
+}
+
+// Parse builds the configuration from, in increasing order of precedence,
+// the defaults, the file given with -config, CRYPTOCURRENCY_* environment
+// variables and the command line flags. The settings are registered on fs,
+// which may carry additional flags of the caller. The result is validated.
+func Parse(fs *flag.FlagSet, args []string) (Config, error) {
+	path := fs.String("config", os.Getenv(ENV_PREFIX+"CONFIG"),
+		"Path of a TOML configuration file")
+
+	flags := make(map[string]string)
+	for _, s := range settings {
+		fs.Var(&flagValue{name: s.name, boolean: s.boolean, values: flags},
+			s.name, s.usage)
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+	if fs.NArg() > 0 {
+		return Config{}, fmt.Errorf("Unexpected argument %q", fs.Arg(0))
+	}
+
+	config := Default()
+	if *path != "" {
+		config, err = Load(*path)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	err = config.ApplyEnv()
+	if err != nil {
+		return Config{}, err
+	}
+
+	for _, s := range settings {
+		if value, ok := flags[s.name]; ok {
+			err = s.set(&config, value)
+			if err != nil {
+				return Config{}, fmt.Errorf("Invalid value for -%s: %s",
+					s.name, err)
+			}
+		}
+	}
+
+	return config, config.Validate()
+}
+
+// ApplyEnv overrides the configuration with CRYPTOCURRENCY_* environment
+// variables.
+func (c *Config) ApplyEnv() error {
+	for _, s := range settings {
+		key := EnvName(s.name)
+		if value, ok := os.LookupEnv(key); ok {
+			err := s.set(c, value)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s: %s", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if c.DataDir == "" {
+		return errors.New("Data directory must not be empty")
+	}
+	if !contains(Networks, c.Network) {
+		return fmt.Errorf("Unknown network %q, expected one of %s", c.Network,
+			strings.Join(Networks, ", "))
+	}
+	if !contains(LogLevels, c.LogLevel) {
+		return fmt.Errorf("Unknown log level %q, expected one of %s",
+			c.LogLevel, strings.Join(LogLevels, ", "))
+	}
+
+	err := validateAddress(c.P2P.Listen)
+	if err != nil {
+		return fmt.Errorf("Invalid p2p listen address: %s", err)
+	}
+	if c.P2P.Advertise != "" {
+		err = validateAddress(c.P2P.Advertise)
+		if err != nil {
+			return fmt.Errorf("Invalid p2p advertise address: %s", err)
+		}
+	}
+	for _, seed := range c.P2P.Seeds {
+		host, _, _ := net.SplitHostPort(seed)
+		if host == "" {
+			return fmt.Errorf("Invalid seed peer %q: missing host", seed)
+		}
+		err = validateAddress(seed)
+		if err != nil {
+			return fmt.Errorf("Invalid seed peer %q: %s", seed, err)
+		}
+	}
+	err = validateAddress(c.HTTP.Listen)
+	if err != nil {
+		return fmt.Errorf("Invalid http listen address: %s", err)
+	}
+
+	if c.Mining.Workers < 1 {
+		return errors.New("Number of mining workers must be at least 1")
+	}
+	if c.Mining.Key == "" {
+		return errors.New("Mining needs the name of a wallet key")
+	}
+	if c.Storage.PruneDepth < 0 {
+		return errors.New("Prune depth must not be negative")
+	}
+	if c.Snapshot.File != "" {
+		hash, err := base58.Decode(c.Snapshot.Hash)
+		if err != nil || len(hash) != sha256.Size {
+			return errors.New("A snapshot needs the base58 hash it must match")
+		}
+	}
+	return nil
+}
+
+// DatabasePath returns the location of the chain database.
+func (c *Config) DatabasePath() string {
+	return filepath.Join(c.DataDir, "chain.db")
+}
+
+// WalletPath returns the configured wallet or its default location within
+// the data directory.
+func (c *Config) WalletPath() string {
+	if c.Wallet != "" {
+		return c.Wallet
+	}
+	return filepath.Join(c.DataDir, "wallet.json")
+}
+
+func EnvName(name string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+func validateAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	number, err := strconv.Atoi(port)
+	if err != nil || number < 0 || number > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// flagValue records the flags that were actually given so they can be
+// applied after the configuration file and the environment.
+type flagValue struct {
+	name    string
+	boolean bool
+	values  map[string]string
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.boolean
+}
+
+func (f *flagValue) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return f.values[f.name]
+}
+
+func (f *flagValue) Set(value string) error {
+	f.values[f.name] = value
+	return nil
+}
@@ -0,0 +1,140 @@
+package config
+
+import (
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "node.toml")
+	err = ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func parse(args ...string) (Config, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return Parse(fs, args)
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	config := Default()
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, filepath.Join("data", "chain.db"), config.DatabasePath())
+	assert.Equal(t, filepath.Join("data", "wallet.json"), config.WalletPath())
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+data_dir = "/var/lib/node"
+network = "testnet"
+wallet = "/etc/node/wallet.json"
+
+[p2p]
+listen = "0.0.0.0:4000"
+seeds = ["10.0.0.1:4000", "10.0.0.2:4000"]
+
+[mining]
+enabled = true
+workers = 4
+key = "miner"
+
+[storage]
+prune_depth = 1000
+`)
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/var/lib/node", config.DataDir)
+	assert.Equal(t, "testnet", config.Network)
+	assert.Equal(t, "/etc/node/wallet.json", config.WalletPath())
+	assert.Equal(t, "0.0.0.0:4000", config.P2P.Listen)
+	assert.Equal(t, []string{"10.0.0.1:4000", "10.0.0.2:4000"},
+		config.P2P.Seeds)
+	assert.True(t, config.Mining.Enabled)
+	assert.Equal(t, 4, config.Mining.Workers)
+	assert.Equal(t, "miner", config.Mining.Key)
+	assert.Equal(t, 1000, config.Storage.PruneDepth)
+	// untouched values keep their defaults
+	assert.Equal(t, ":8000", config.HTTP.Listen)
+	assert.Equal(t, "info", config.LogLevel)
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	path := writeConfig(t, "datadir = \"typo\"\n")
+	_, err := Load(path)
+	assert.Error(t, err)
+}
+
+func TestParsePrecedence(t *testing.T) {
+	path := writeConfig(t, `
+network = "testnet"
+log_level = "debug"
+
+[http]
+listen = ":9000"
+`)
+	os.Setenv(EnvName("network"), "regtest")
+	os.Setenv(EnvName("http-listen"), ":9100")
+	defer os.Unsetenv(EnvName("network"))
+	defer os.Unsetenv(EnvName("http-listen"))
+
+	config, err := parse("-config", path, "-http-listen", ":9200",
+		"-mining", "-p2p-seeds", "a:1, b:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "debug", config.LogLevel)
+	assert.Equal(t, "regtest", config.Network)
+	assert.Equal(t, ":9200", config.HTTP.Listen)
+	assert.True(t, config.Mining.Enabled)
+	assert.Equal(t, []string{"a:1", "b:2"}, config.P2P.Seeds)
+}
+
+func TestParseInvalid(t *testing.T) {
+	var cases = []struct {
+		name string
+		args []string
+	}{
+		{"network", []string{"-network", "moonnet"}},
+		{"log level", []string{"-log-level", "verbose"}},
+		{"empty data dir", []string{"-datadir", ""}},
+		{"p2p listen", []string{"-p2p-listen", "1234"}},
+		{"p2p port", []string{"-p2p-listen", ":99999"}},
+		{"advertise", []string{"-p2p-advertise", "host"}},
+		{"seed without host", []string{"-p2p-seeds", ":1234"}},
+		{"http listen", []string{"-http-listen", "localhost"}},
+		{"workers", []string{"-mining-workers", "0"}},
+		{"workers number", []string{"-mining-workers", "many"}},
+		{"prune depth", []string{"-prune-depth", "-1"}},
+		{"snapshot without hash", []string{"-snapshot-file", "utxo.snap"}},
+		{"snapshot hash", []string{"-snapshot-file", "utxo.snap",
+			"-snapshot-hash", "0OIl"}},
+		{"positional", []string{"db"}},
+	}
+
+	for _, c := range cases {
+		_, err := parse(c.args...)
+		assert.Error(t, err, c.name)
+	}
+}
+
+func TestParseInvalidEnv(t *testing.T) {
+	os.Setenv(EnvName("mining"), "maybe")
+	defer os.Unsetenv(EnvName("mining"))
+
+	_, err := parse()
+	assert.Error(t, err)
+}
@@ -1,47 +1,161 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"github.com/InitialShape/cryptocurrency/address"
 	"github.com/InitialShape/cryptocurrency/blockchain"
-	"github.com/InitialShape/cryptocurrency/web"
+	"github.com/InitialShape/cryptocurrency/config"
+	"github.com/InitialShape/cryptocurrency/node"
 	"github.com/InitialShape/cryptocurrency/utils"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"github.com/mr-tron/base58/base58"
 	"log"
-	"net/http"
 	"os"
-	"flag"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	var store blockchain.Store
-	var peer blockchain.Peer
-
-	keys := flag.Bool("generate_keys", false,
-					  "Generates keys for the wallet and miner")
-	flag.Parse()
-	if *keys {
-			// key generation mode
-			utils.GenerateWallet()
-	} else {
-		// normal operation mode
-		store = blockchain.Store{}
-		// TODO: For other os.Args use flag lib
-		store.Open(os.Args[1], &peer)
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	keys := fs.Bool("generate_keys", false,
+		"Generates the mining key in the wallet, creating the wallet")
+	legacy := fs.String("import_wallet", "",
+		"Imports the key of a wallet.txt of older versions as the mining key")
+	dump := fs.String("dump_snapshot", "",
+		"Writes the utxo set to the given snapshot file and exits")
+	height := fs.Int("snapshot_height", -1,
+		"Height of the dumped snapshot (default the root)")
+	reindex := fs.Bool("reindex", false,
+		"Rebuilds the utxo set, transaction, height and address index and exits")
+	cfg, err := config.Parse(fs, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = utils.SetLogLevel(cfg.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.MkdirAll(cfg.DataDir, 0700)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		ip, err := utils.GetExternalIP()
+	if *keys || *legacy != "" {
+		// key generation mode
+		text, err := addMiningKey(cfg, *legacy)
 		if err != nil {
 			log.Fatal(err)
 		}
+		fmt.Println("Address", text)
+		return
+	}
 
-		peer = blockchain.Peer{os.Args[2], ip, store}
-		go peer.Start()
+	// normal operation mode
+	n, err := node.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		_, err = store.StoreGenesisBlock(20)
+	if *reindex {
+		// reindex mode
+		err = n.Store.Reindex()
+		n.Stop()
 		if err != nil {
 			log.Fatal(err)
 		}
+		return
+	}
+
+	if *dump != "" {
+		// snapshot mode
+		err = dumpSnapshot(n, *dump, *height)
+		n.Stop()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = n.Start(ctx)
+	if err != nil {
+		n.Stop()
+		log.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Println("Received signal, shutting down: ", sig)
+
+	cancel()
+	err = n.Stop()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func dumpSnapshot(n *node.Node, path string, height int) error {
+	if height < 0 {
+		root, err := n.Store.GetRoot()
+		if err != nil {
+			return err
+		}
+		height = root.Height
+	}
+	header, err := n.Store.ExportSnapshot(path, height)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d outputs at height %d to %s\nhash: %s\n",
+		header.Count, header.Height, path, base58.Encode(header.Hash))
+	return nil
+}
 
-		r := web.Handlers(store)
-		log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", os.Args[3]), r))
+// addMiningKey adds the mining key to the wallet, creating the wallet if
+// there is none, and returns its address. The key is imported from a legacy
+// wallet.txt if one is given and generated otherwise.
+func addMiningKey(cfg config.Config, legacy string) (string, error) {
+	params, err := blockchain.ParamsForNetwork(cfg.Network)
+	if err != nil {
+		return "", err
+	}
+	passphrase := os.Getenv(wallet.PASSPHRASE_ENV)
+	if passphrase == "" {
+		return "", fmt.Errorf("Set the wallet passphrase in %s",
+			wallet.PASSPHRASE_ENV)
+	}
+	k, err := wallet.Open(cfg.WalletPath())
+	if os.IsNotExist(err) {
+		k, err = wallet.Create(cfg.WalletPath(), passphrase)
+	} else if err == nil {
+		err = k.Unlock(passphrase, 0)
+	}
+	if err != nil {
+		return "", err
 	}
+	defer k.Lock()
 
+	if legacy != "" {
+		privateKey, err := wallet.ReadLegacyWallet(legacy)
+		if err != nil {
+			return "", err
+		}
+		err = k.Import(cfg.Mining.Key, privateKey)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		_, err = k.Generate(cfg.Mining.Key)
+		if err != nil {
+			return "", err
+		}
+	}
+	publicKey, err := k.PublicKey(cfg.Mining.Key)
+	if err != nil {
+		return "", err
+	}
+	return address.Encode(params.AddressPrefix, publicKey)
 }
@@ -2,18 +2,20 @@ package miner
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/InitialShape/cryptocurrency/blockchain"
-	"github.com/InitialShape/cryptocurrency/utils"
+	"golang.org/x/crypto/ed25519"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
-	"os"
 )
 
+var ErrNoWorkers = errors.New("Mining needs at least one worker")
+
 func DownloadTransactions(path string) ([]blockchain.Transaction, error) {
 	var transactions []blockchain.Transaction
 	transactionsUrl := fmt.Sprintf("%s/mempool/transactions", path)
@@ -56,71 +58,276 @@ func DownloadRoot(path string) (blockchain.Block, error) {
 	return block, err
 }
 
-func GenerateBlock(path string, ch chan<- blockchain.Block) {
-	root, err := DownloadRoot(path)
+func DownloadParams(path string) (blockchain.ChainParams, error) {
+	var params blockchain.ChainParams
+	paramsUrl := fmt.Sprintf("%s/params", path)
+	res, err := http.Get(paramsUrl)
+	if err != nil {
+		return blockchain.ChainParams{}, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return blockchain.ChainParams{}, err
+	}
+
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		return blockchain.ChainParams{}, err
+	}
+
+	return params, err
+}
+
+// DownloadHeaders returns up to limit headers of the node's main chain from
+// height from on.
+func DownloadHeaders(path string, from int, limit int) ([]blockchain.Header,
+	error) {
+	var headers []blockchain.Header
+	if from < 0 {
+		limit += from
+		from = 0
+	}
+	headersUrl := fmt.Sprintf("%s/blocks?from=%d&limit=%d", path, from,
+		limit)
+	res, err := http.Get(headersUrl)
+	if err != nil {
+		return headers, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Fatal(err)
+		return headers, err
 	}
-	transactions, err := DownloadTransactions(path)
-	SearchBlock(root.Height+1, root.Difficulty, root.Hash, transactions, ch)
+
+	err = json.Unmarshal(body, &headers)
+	return headers, err
 }
 
-func SearchBlock(height int, difficulty int, previousBlock []byte,
-	transactions []blockchain.Transaction, ch chan<- blockchain.Block) {
+// Template is what the next block on top of a node's root is mined from.
+// Its transactions are those of the mempool that are valid and final in
+// the block and don't spend the same outputs, Fees are what they pay.
+type Template struct {
+	Height        int                      `json:"height"`
+	PreviousBlock []byte                   `json:"previous_block"`
+	Difficulty    int                      `json:"difficulty"`
+	Timestamp     int64                    `json:"timestamp"`
+	Transactions  []blockchain.Transaction `json:"transactions"`
+	Fees          int                      `json:"fees"`
+}
 
-	publicKey, privateKey, err := utils.GetWallet()
+// NewTemplate builds the template of the block on top of the store's root.
+func NewTemplate(store *blockchain.Store) (Template, error) {
+	root, err := store.GetRoot()
+	if err != nil {
+		return Template{}, err
+	}
+	mempool, err := store.GetTransactions()
 	if err != nil {
-		log.Fatal(err)
+		return Template{}, err
 	}
-	coinbase, err := blockchain.GenerateCoinbase(publicKey, privateKey, 25)
+	medianTime, err := store.MedianTimePast(root.Hash)
 	if err != nil {
-		log.Fatal(err)
+		return Template{}, err
+	}
+
+	template := Template{root.Height + 1, root.Hash, store.Params.Difficulty,
+		blockchain.NextTimestamp(medianTime), []blockchain.Transaction{}, 0}
+	spent := make(map[string]bool)
+	for _, transaction := range mempool {
+		fee, err := store.TransactionFee(transaction,
+			len(template.Transactions)+1)
+		if err == nil {
+			err = store.CheckLocks(transaction, template.Height, medianTime)
+		}
+		if err == nil && !spendsAny(transaction, spent) {
+			template.Transactions = append(template.Transactions,
+				transaction)
+			template.Fees += fee
+		}
+	}
+	return template, nil
+}
+
+// DownloadTemplate returns the template of the node's next block.
+func DownloadTemplate(path string) (Template, error) {
+	var template Template
+	res, err := http.Get(fmt.Sprintf("%s/template", path))
+	if err != nil {
+		return template, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return template, errors.New(fmt.Sprintf(
+			"Expected status code 200 but got %d", res.StatusCode))
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&template)
+	return template, err
+}
+
+// GenerateBlocks mines count blocks directly on top of the store's root,
+// including the mempool's valid transactions, paying the coinbases and the
+// fees to privateKey. It's meant for regtest networks where blocks are
+// generated on demand.
+func GenerateBlocks(store *blockchain.Store, privateKey ed25519.PrivateKey,
+	count int) ([]blockchain.Block, error) {
+	var blocks []blockchain.Block
+	for i := 0; i < count; i++ {
+		template, err := NewTemplate(store)
+		if err != nil {
+			return blocks, err
+		}
+
+		block, err := SearchBlock(context.Background(), privateKey,
+			template.Height, template.Difficulty,
+			store.Params.CoinbaseAmount+template.Fees, template.PreviousBlock,
+			template.Timestamp, template.Transactions)
+		if err != nil {
+			return blocks, err
+		}
+
+		err = store.AddBlock(block)
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// spendsAny reports whether transaction spends one of the outputs spent
+// does, and adds those it spends otherwise. The mempool may hold
+// transactions that spend the same output, only one of them can be mined.
+func spendsAny(transaction blockchain.Transaction,
+	spent map[string]bool) bool {
+	var pointers []string
+	for _, input := range transaction.Inputs {
+		pointer := fmt.Sprintf("%x-%d", input.TransactionHash,
+			input.OutputID)
+		if spent[pointer] {
+			return true
+		}
+		pointers = append(pointers, pointer)
+	}
+	for _, pointer := range pointers {
+		spent[pointer] = true
+	}
+	return false
+}
+
+// SearchBlock returns the first block found with a coinbase paying to
+// privateKey, or the error of ctx once it's done.
+func SearchBlock(ctx context.Context, privateKey ed25519.PrivateKey,
+	height int, difficulty int, reward int, previousBlock []byte,
+	timestamp int64, transactions []blockchain.Transaction) (blockchain.Block,
+	error) {
+
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	coinbase, err := blockchain.GenerateCoinbase(publicKey, privateKey,
+		height, reward)
+	if err != nil {
+		return blockchain.Block{}, err
 	}
 	// preprend
 	transactions = append([]blockchain.Transaction{coinbase}, transactions...)
 	newBlock := blockchain.Block{height, []byte{}, transactions, previousBlock,
-		difficulty, 0}
+		difficulty, 0, timestamp}
+	// only the nonce changes, the merkle root is computed once
+	header := newBlock.Header()
 
 	for {
+		select {
+		case <-ctx.Done():
+			return blockchain.Block{}, ctx.Err()
+		default:
+		}
 		// TODO: Use 256 bits
-		newBlock.Nonce = rand.Int31()
+		header.Nonce = rand.Int31()
 
-		hash, err := newBlock.GetHash()
+		hash, err := header.GetHash()
 		if err != nil {
-			log.Fatal(err)
+			return blockchain.Block{}, err
 		}
 		if blockchain.HashMatchesDifficulty(hash, difficulty) {
+			newBlock.Nonce = header.Nonce
 			newBlock.Hash = hash
-			ch <- newBlock
-			break
+			return newBlock, nil
 		}
 	}
 }
 
-func SubmitBlock(block blockchain.Block) {
-	fmt.Println(block.Nonce)
+type searchResult struct {
+	block blockchain.Block
+	err   error
+}
+
+// Mine lets the given number of workers search for the next block of the
+// node's template and submits the first one found. Its coinbase pays the
+// reward and the fees to privateKey. The other workers are stopped once a
+// block is found or ctx is done, and Mine returns only after they have.
+func Mine(ctx context.Context, path string, privateKey ed25519.PrivateKey,
+	workers int) error {
+	if workers < 1 {
+		return ErrNoWorkers
+	}
+	params, err := DownloadParams(path)
+	if err != nil {
+		return err
+	}
+	template, err := DownloadTemplate(path)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// buffered so that no worker blocks on sending its result
+	results := make(chan searchResult, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			block, err := SearchBlock(ctx, privateKey, template.Height,
+				template.Difficulty, params.CoinbaseAmount+template.Fees,
+				template.PreviousBlock, template.Timestamp,
+				template.Transactions)
+			results <- searchResult{block, err}
+		}()
+	}
+	result := <-results
+	cancel()
+	for i := 1; i < workers; i++ {
+		<-results
+	}
+	if result.err != nil {
+		return result.err
+	}
+	return SubmitBlock(path, result.block)
+}
 
+func SubmitBlock(path string, block blockchain.Block) error {
 	blockJSON, err := json.Marshal(block)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	client := &http.Client{}
-	blocksUrl := fmt.Sprintf("%s/blocks", os.Args[1])
-	fmt.Println(blocksUrl)
+	blocksUrl := fmt.Sprintf("%s/blocks", path)
 	req, err := http.NewRequest(http.MethodPut, blocksUrl,
 		bytes.NewReader(blockJSON))
-	fmt.Println("Sending new found block")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	log.Println("Sending new found block", block.Nonce)
 	res, err := client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != 201 {
-		errors.New(fmt.Sprintf("Expected status code 201 but got %d",
+		return errors.New(fmt.Sprintf("Expected status code 201 but got %d",
 			res.StatusCode))
 	}
+	return nil
 }
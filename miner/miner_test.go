@@ -0,0 +1,34 @@
+package miner
+
+import (
+	"context"
+	"crypto/rand"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"testing"
+)
+
+func TestSearchBlockCancelled(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// no hash has 256 leading zeros, only the cancellation ends the search
+	_, err = SearchBlock(ctx, privateKey, 1, 256, 25, []byte{1}, 1, nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestSpendsAny(t *testing.T) {
+	spend := func(hash string, id int) blockchain.Transaction {
+		return blockchain.Transaction{[]byte{}, []blockchain.Input{
+			{[]byte{}, []byte(hash), id, nil, 0}}, nil, 0}
+	}
+	spent := make(map[string]bool)
+	assert.False(t, spendsAny(spend("a", 0), spent))
+	assert.False(t, spendsAny(spend("a", 1), spent))
+	assert.True(t, spendsAny(spend("a", 0), spent))
+	assert.False(t, spendsAny(spend("b", 0), spent))
+}
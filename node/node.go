@@ -0,0 +1,253 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/config"
+	"github.com/InitialShape/cryptocurrency/miner"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"github.com/InitialShape/cryptocurrency/web"
+	"github.com/mr-tron/base58/base58"
+	"golang.org/x/crypto/ed25519"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	SHUTDOWN_TIMEOUT = 10 * time.Second
+	// SNAPSHOT_RETRY_INTERVAL is how long to wait before downloading the
+	// history below a snapshot again after it couldn't be validated.
+	SNAPSHOT_RETRY_INTERVAL = 30 * time.Second
+)
+
+// Node owns everything a running node is made of: the chain store, the p2p
+// peer and the HTTP API. Blocks it mines or generates pay to Coinbase.
+type Node struct {
+	Config   config.Config
+	Params   *blockchain.ChainParams
+	Store    blockchain.Store
+	Peer     *blockchain.Peer
+	Coinbase ed25519.PrivateKey
+
+	server   *http.Server
+	listener net.Listener
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// New opens the node's database. Nothing is listening until Start is called.
+func New(cfg config.Config) (*Node, error) {
+	params, err := blockchain.ParamsForNetwork(cfg.Network)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(cfg.DataDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	seeds := cfg.P2P.Seeds
+	if seeds == nil {
+		seeds = params.Seeds
+	}
+
+	n := &Node{Config: cfg, Params: params, Peer: &blockchain.Peer{}}
+	n.Store.PruneDepth = cfg.Storage.PruneDepth
+	err = n.Store.Open(cfg.DatabasePath(), n.Peer, params)
+	if err != nil {
+		return nil, err
+	}
+	*n.Peer = blockchain.Peer{ListenAddress: cfg.P2P.Listen,
+		AdvertiseAddress: cfg.P2P.Advertise, Seeds: seeds, Store: n.Store}
+
+	if cfg.Snapshot.File != "" {
+		err = n.importSnapshot()
+		if err != nil {
+			n.Store.Close()
+			return nil, err
+		}
+	}
+	if info, err := n.Store.Snapshot(); err == nil && info.Invalid {
+		n.Store.Close()
+		return nil, blockchain.ErrSnapshotInvalid
+	}
+	if cfg.Mining.Enabled || params.GenerateBlocks {
+		n.Coinbase, err = n.coinbaseKey()
+		if err != nil {
+			n.Store.Close()
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// coinbaseKey reads the mining key from the wallet, unlocked with the
+// passphrase of the environment. Networks that generate blocks create a
+// missing wallet.
+func (n *Node) coinbaseKey() (ed25519.PrivateKey, error) {
+	path := n.Config.WalletPath()
+	passphrase := os.Getenv(wallet.PASSPHRASE_ENV)
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) && n.Params.GenerateBlocks {
+		k, err := wallet.Create(path, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		defer k.Lock()
+		_, err = k.Generate(n.Config.Mining.Key)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Created wallet", path)
+	}
+	return wallet.OpenKey(path, n.Config.Mining.Key, passphrase)
+}
+
+// importSnapshot starts a new database from the configured snapshot.
+// Databases that have blocks already keep them.
+func (n *Node) importSnapshot() error {
+	hash, err := base58.Decode(n.Config.Snapshot.Hash)
+	if err != nil {
+		return err
+	}
+	info, err := n.Store.Snapshot()
+	if err == nil && bytes.Equal(info.Hash, hash) {
+		return nil
+	} else if err != nil && err != blockchain.ErrNotFound {
+		return err
+	}
+
+	root, err := n.Store.GetRoot()
+	if err != nil {
+		return err
+	}
+	if root.Height > 0 {
+		log.Println("Database has blocks already, ignoring snapshot",
+			n.Config.Snapshot.File)
+		return nil
+	}
+	_, err = n.Store.ImportSnapshot(n.Config.Snapshot.File, hash)
+	return err
+}
+
+// Start binds the p2p and HTTP listeners and serves them in the background
+// until ctx is cancelled or Stop is called.
+func (n *Node) Start(ctx context.Context) error {
+	ctx, n.cancel = context.WithCancel(ctx)
+
+	err := n.Peer.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	n.listener, err = net.Listen("tcp", n.Config.HTTP.Listen)
+	if err != nil {
+		n.Peer.Stop()
+		return err
+	}
+	log.Printf("HTTP API is listening on %s\n", n.listener.Addr().String())
+
+	n.server = &http.Server{Handler: web.Handlers(n.Store, n.Coinbase)}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		err := n.server.Serve(n.listener)
+		if err != http.ErrServerClosed {
+			log.Println("Error serving HTTP: ", err)
+		}
+	}()
+
+	if info, err := n.Store.Snapshot(); err == nil && !info.Validated {
+		n.wg.Add(1)
+		go n.validateSnapshot(ctx)
+	}
+
+	if n.Config.Mining.Enabled {
+		n.wg.Add(1)
+		go n.mine(ctx)
+	}
+	return nil
+}
+
+// Stop drains the HTTP and p2p connections and waits for the miner, then
+// flushes and closes the database.
+func (n *Node) Stop() error {
+	if n.cancel != nil {
+		n.cancel()
+	}
+
+	if n.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			SHUTDOWN_TIMEOUT)
+		defer cancel()
+		err := n.server.Shutdown(ctx)
+		if err != nil {
+			log.Println("Error shutting down HTTP API: ", err)
+		}
+		n.wg.Wait()
+	}
+
+	n.Peer.Stop()
+	return n.Store.Close()
+}
+
+// HTTPAddress returns the URL of the HTTP API once the node is started.
+func (n *Node) HTTPAddress() string {
+	if n.listener == nil {
+		return ""
+	}
+	host, port, _ := net.SplitHostPort(n.listener.Addr().String())
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "localhost"
+	}
+	return fmt.Sprintf("http://%s", net.JoinHostPort(host, port))
+}
+
+// P2PAddress returns the address the p2p listener is bound to.
+func (n *Node) P2PAddress() string {
+	return n.Peer.ListenerAddress()
+}
+
+// validateSnapshot checks the history below the snapshot the chain was
+// started from, retrying until a peer served a chain that leads to it. A
+// history that proves the snapshot wrong isn't retried, the store refuses
+// to extend the chain from then on.
+func (n *Node) validateSnapshot(ctx context.Context) {
+	defer n.wg.Done()
+	for {
+		err := n.Store.ValidateSnapshotFromPeers()
+		if err == nil {
+			log.Println("Validated the history below the snapshot")
+			return
+		} else if err == blockchain.ErrSnapshotHashMismatch {
+			log.Println("Error validating snapshot: ",
+				blockchain.ErrSnapshotInvalid)
+			return
+		}
+		log.Println("Couldn't validate snapshot yet: ", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(SNAPSHOT_RETRY_INTERVAL):
+		}
+	}
+}
+
+// mine mines blocks until ctx is cancelled, which stops the search in
+// progress.
+func (n *Node) mine(ctx context.Context) {
+	defer n.wg.Done()
+	for ctx.Err() == nil {
+		err := miner.Mine(ctx, n.HTTPAddress(), n.Coinbase,
+			n.Config.Mining.Workers)
+		if err != nil && ctx.Err() == nil {
+			log.Println("Error mining block: ", err)
+		}
+	}
+}
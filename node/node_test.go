@@ -0,0 +1,265 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/config"
+	"github.com/InitialShape/cryptocurrency/wallet"
+	"github.com/mr-tron/base58/base58"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	wallet.ScryptN = 1 << 10
+}
+
+func newConfig(t *testing.T) (config.Config, func()) {
+	dir, err := ioutil.TempDir("", "node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.DataDir = dir
+	cfg.Network = "regtest"
+	cfg.P2P = config.P2PConfig{Listen: "127.0.0.1:0",
+		Advertise: "127.0.0.1:0", Seeds: []string{}}
+	cfg.HTTP.Listen = "127.0.0.1:0"
+	return cfg, func() { os.RemoveAll(dir) }
+}
+
+func getRoot(t *testing.T, n *Node) blockchain.Block {
+	res, err := http.Get(fmt.Sprintf("%s/root", n.HTTPAddress()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var block blockchain.Block
+	err = json.NewDecoder(res.Body).Decode(&block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func TestStartStop(t *testing.T) {
+	cfg, cleanup := newConfig(t)
+	defer cleanup()
+
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, blockchain.RegTestParams.GenesisHash, getRoot(t, n).Hash)
+	p2p := n.P2PAddress()
+	assert.Equal(t, p2p, n.Peer.AdvertiseAddress)
+
+	err = n.Stop()
+	assert.NoError(t, err)
+
+	_, err = net.Dial("tcp", p2p)
+	assert.Error(t, err)
+	_, err = http.Get(fmt.Sprintf("%s/root", n.HTTPAddress()))
+	assert.Error(t, err)
+}
+
+func TestStopOnCancel(t *testing.T) {
+	cfg, cleanup := newConfig(t)
+	defer cleanup()
+
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	err = n.Start(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	// the p2p listener goes away with the context, Stop still cleans up
+	assert.NoError(t, n.Stop())
+	_, err = net.Dial("tcp", n.P2PAddress())
+	assert.Error(t, err)
+}
+
+func TestStopMining(t *testing.T) {
+	cfg, cleanup := newConfig(t)
+	defer cleanup()
+	cfg.Mining.Enabled = true
+	cfg.Mining.Workers = 2
+
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && getRoot(t, n).Height == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotEqual(t, 0, getRoot(t, n).Height)
+
+	// the miner is stopped before the database is closed
+	assert.NoError(t, n.Stop())
+}
+
+func TestRestartKeepsChain(t *testing.T) {
+	cfg, cleanup := newConfig(t)
+	defer cleanup()
+
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Post(fmt.Sprintf("%s/generate/2", n.HTTPAddress()),
+		"application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	root := getRoot(t, n)
+	assert.Equal(t, 2, root.Height)
+	assert.NoError(t, n.Stop())
+
+	n, err = New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	assert.Equal(t, root, getRoot(t, n))
+}
+
+func TestTwoNodes(t *testing.T) {
+	cfg, cleanup := newConfig(t)
+	defer cleanup()
+	otherCfg, otherCleanup := newConfig(t)
+	defer otherCleanup()
+
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+
+	otherCfg.P2P.Seeds = []string{n.P2PAddress()}
+	other, err := New(otherCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Stop()
+
+	chain, err := other.Peer.DownloadChain(n.P2PAddress())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(chain))
+	assert.NotEqual(t, n.HTTPAddress(), other.HTTPAddress())
+}
+
+func TestStartFromSnapshot(t *testing.T) {
+	cfg, cleanup := newConfig(t)
+	defer cleanup()
+	otherCfg, otherCleanup := newConfig(t)
+	defer otherCleanup()
+
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Stop()
+	res, err := http.Post(fmt.Sprintf("%s/generate/3", n.HTTPAddress()),
+		"application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	root := getRoot(t, n)
+
+	path := filepath.Join(otherCfg.DataDir, "utxo.snap")
+	header, err := n.Store.ExportSnapshot(path, root.Height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCfg.Snapshot = config.SnapshotConfig{File: path,
+		Hash: base58.Encode(header.Hash)}
+	other, err := New(otherCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = other.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Stop()
+	assert.Equal(t, root, getRoot(t, other))
+
+	// the history below the snapshot is validated against the peers
+	assert.NoError(t, other.Store.AddPeer(n.P2PAddress()))
+	assert.NoError(t, other.Store.ValidateSnapshotFromPeers())
+	info, err := other.Store.Snapshot()
+	assert.NoError(t, err)
+	assert.True(t, info.Validated)
+}
+
+func TestCoinbaseKey(t *testing.T) {
+	cfg, cleanup := newConfig(t)
+	defer cleanup()
+
+	// regtest creates the wallet with the mining key
+	n, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, n.Stop())
+	k, err := wallet.Open(cfg.WalletPath())
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{cfg.Mining.Key}, k.Names())
+	}
+
+	cfg.Mining.Key = "missing"
+	_, err = New(cfg)
+	assert.Equal(t, wallet.ErrKeyNotFound, err)
+
+	// other networks don't
+	cfg.Network = "testnet"
+	cfg.DataDir = filepath.Join(cfg.DataDir, "testnet")
+	cfg.Wallet = ""
+	cfg.Mining.Enabled = true
+	_, err = New(cfg)
+	assert.True(t, os.IsNotExist(err))
+}
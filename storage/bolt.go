@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"github.com/boltdb/bolt"
+	"time"
+)
+
+type boltDB struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+type boltBucket struct {
+	*bolt.Bucket
+}
+
+// OpenBolt opens or creates a BoltDB file.
+func OpenBolt(location string) (DB, error) {
+	db, err := bolt.Open(location, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltDB{db}, nil
+}
+
+func (d *boltDB) View(fn func(Tx) error) error {
+	return d.db.View(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx})
+	})
+}
+
+func (d *boltDB) Update(fn func(Tx) error) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		return fn(&boltTx{tx})
+	})
+}
+
+func (d *boltDB) Sync() error {
+	return d.db.Sync()
+}
+
+func (d *boltDB) Close() error {
+	return d.db.Close()
+}
+
+func (t *boltTx) Bucket(name []byte) Bucket {
+	b := t.tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+func (t *boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if !t.tx.Writable() {
+		return nil, ErrTxNotWritable
+	}
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (t *boltTx) ForEach(fn func(name []byte, b Bucket) error) error {
+	return t.tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return fn(name, boltBucket{b})
+	})
+}
+
+func (b boltBucket) Cursor() Cursor {
+	return b.Bucket.Cursor()
+}
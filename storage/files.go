@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrFileRemoved    = errors.New("Block file was removed")
+	ErrRemoveCurrent  = errors.New("Can't remove the file that's appended to")
+	ErrInvalidRecord  = errors.New("Invalid record location")
+	ErrRecordTooLarge = errors.New("Record is larger than a block file")
+)
+
+// Location points at a record in the block files.
+type Location struct {
+	File   int   `json:"file"`
+	Offset int64 `json:"offset"`
+	Length int   `json:"length"`
+}
+
+// Files is an append-only store of records, i.e. serialized blocks, spread
+// over numbered files of a maximum size. Old files can be removed as a
+// whole, which is how blocks get pruned.
+type Files interface {
+	Append(data []byte) (Location, error)
+	Read(location Location) ([]byte, error)
+	// Current returns the number of the file appended to.
+	Current() int
+	Remove(file int) error
+	Sync() error
+	Close() error
+}
+
+type diskFiles struct {
+	mutex   sync.Mutex
+	dir     string
+	maxSize int64
+	current int
+	size    int64
+	file    *os.File
+}
+
+type memoryFiles struct {
+	mutex   sync.Mutex
+	maxSize int64
+	current int
+	files   map[int][]byte
+}
+
+// OpenFiles opens the block files in dir, creating it if necessary, and
+// continues appending to the last file.
+func OpenFiles(dir string, maxSize int64) (Files, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "blk*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	f := &diskFiles{dir: dir, maxSize: maxSize}
+	if len(names) > 0 {
+		_, err = fmt.Sscanf(filepath.Base(names[len(names)-1]), "blk%05d.dat",
+			&f.current)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return f, f.open(f.current)
+}
+
+func (f *diskFiles) path(file int) string {
+	return filepath.Join(f.dir, fmt.Sprintf("blk%05d.dat", file))
+}
+
+func (f *diskFiles) open(file int) error {
+	handle, err := os.OpenFile(f.path(file), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	size, err := handle.Seek(0, io.SeekEnd)
+	if err != nil {
+		handle.Close()
+		return err
+	}
+	f.current, f.size, f.file = file, size, handle
+	return nil
+}
+
+func (f *diskFiles) Append(data []byte) (Location, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// records are prefixed with their length, so the files can be read
+	// without the index
+	length := int64(len(data)) + 4
+	if length > f.maxSize {
+		return Location{}, ErrRecordTooLarge
+	}
+	if f.size > 0 && f.size+length > f.maxSize {
+		err := f.file.Close()
+		if err != nil {
+			return Location{}, err
+		}
+		err = f.open(f.current + 1)
+		if err != nil {
+			return Location{}, err
+		}
+	}
+
+	record := make([]byte, 4, length)
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	record = append(record, data...)
+	_, err := f.file.WriteAt(record, f.size)
+	if err != nil {
+		return Location{}, err
+	}
+	location := Location{f.current, f.size + 4, len(data)}
+	f.size += length
+	return location, nil
+}
+
+func (f *diskFiles) Read(location Location) ([]byte, error) {
+	if location.Length < 0 || location.Offset < 0 {
+		return nil, ErrInvalidRecord
+	}
+	handle, err := os.Open(f.path(location.File))
+	if os.IsNotExist(err) {
+		return nil, ErrFileRemoved
+	} else if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	data := make([]byte, location.Length)
+	_, err = handle.ReadAt(data, location.Offset)
+	if err == io.EOF {
+		return nil, ErrInvalidRecord
+	}
+	return data, err
+}
+
+func (f *diskFiles) Current() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.current
+}
+
+func (f *diskFiles) Remove(file int) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if file == f.current {
+		return ErrRemoveCurrent
+	}
+	err := os.Remove(f.path(file))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (f *diskFiles) Sync() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Sync()
+}
+
+func (f *diskFiles) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
+
+// NewMemoryFiles keeps the block files in memory, for tests.
+func NewMemoryFiles(maxSize int64) Files {
+	return &memoryFiles{maxSize: maxSize, files: map[int][]byte{0: {}}}
+}
+
+func (f *memoryFiles) Append(data []byte) (Location, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	length := int64(len(data)) + 4
+	if length > f.maxSize {
+		return Location{}, ErrRecordTooLarge
+	}
+	size := int64(len(f.files[f.current]))
+	if size > 0 && size+length > f.maxSize {
+		f.current++
+		f.files[f.current] = []byte{}
+		size = 0
+	}
+
+	record := make([]byte, 4, length)
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	f.files[f.current] = append(append(f.files[f.current], record...),
+		data...)
+	return Location{f.current, size + 4, len(data)}, nil
+}
+
+func (f *memoryFiles) Read(location Location) ([]byte, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	file, ok := f.files[location.File]
+	if !ok {
+		return nil, ErrFileRemoved
+	}
+	end := location.Offset + int64(location.Length)
+	if location.Offset < 0 || location.Length < 0 || end > int64(len(file)) {
+		return nil, ErrInvalidRecord
+	}
+	return append([]byte{}, file[location.Offset:end]...), nil
+}
+
+func (f *memoryFiles) Current() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.current
+}
+
+func (f *memoryFiles) Remove(file int) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if file == f.current {
+		return ErrRemoveCurrent
+	}
+	delete(f.files, file)
+	return nil
+}
+
+func (f *memoryFiles) Sync() error {
+	return nil
+}
+
+func (f *memoryFiles) Close() error {
+	return nil
+}
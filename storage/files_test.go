@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// fileBackends runs a test against the block files on disk and in memory.
+func fileBackends(t *testing.T, maxSize int64, test func(t *testing.T, f Files)) {
+	dir, err := ioutil.TempDir("", "blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	disk, err := OpenFiles(dir, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+
+	for name, f := range map[string]Files{"disk": disk,
+		"memory": NewMemoryFiles(maxSize)} {
+		t.Run(name, func(t *testing.T) { test(t, f) })
+	}
+}
+
+func TestAppendRead(t *testing.T) {
+	fileBackends(t, 1024, func(t *testing.T, f Files) {
+		first, err := f.Append([]byte("first"))
+		assert.NoError(t, err)
+		second, err := f.Append([]byte("second"))
+		assert.NoError(t, err)
+		assert.Equal(t, Location{0, 4, 5}, first)
+		assert.Equal(t, Location{0, 13, 6}, second)
+
+		data, err := f.Read(first)
+		assert.NoError(t, err)
+		assert.Equal(t, "first", string(data))
+		data, err = f.Read(second)
+		assert.NoError(t, err)
+		assert.Equal(t, "second", string(data))
+
+		_, err = f.Read(Location{0, 4, 100})
+		assert.Equal(t, ErrInvalidRecord, err)
+	})
+}
+
+func TestAppendRotates(t *testing.T) {
+	fileBackends(t, 16, func(t *testing.T, f Files) {
+		first, err := f.Append([]byte("0123456789"))
+		assert.NoError(t, err)
+		second, err := f.Append([]byte("0123456789"))
+		assert.NoError(t, err)
+		assert.Equal(t, 0, first.File)
+		assert.Equal(t, 1, second.File)
+		assert.Equal(t, 1, f.Current())
+
+		_, err = f.Append(make([]byte, 16))
+		assert.Equal(t, ErrRecordTooLarge, err)
+	})
+}
+
+func TestRemove(t *testing.T) {
+	fileBackends(t, 16, func(t *testing.T, f Files) {
+		first, _ := f.Append([]byte("0123456789"))
+		second, _ := f.Append([]byte("0123456789"))
+
+		assert.Equal(t, ErrRemoveCurrent, f.Remove(second.File))
+		assert.NoError(t, f.Remove(first.File))
+		_, err := f.Read(first)
+		assert.Equal(t, ErrFileRemoved, err)
+		_, err = f.Read(second)
+		assert.NoError(t, err)
+	})
+}
+
+func TestOpenFilesContinuesLastFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := OpenFiles(dir, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Append([]byte("0123456789"))
+	first, _ := f.Append([]byte("0123"))
+	assert.NoError(t, f.Close())
+
+	f, err = OpenFiles(dir, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	assert.Equal(t, 1, f.Current())
+	second, err := f.Append([]byte("4567"))
+	assert.NoError(t, err)
+	assert.Equal(t, Location{1, 12, 4}, second)
+	data, err := f.Read(first)
+	assert.NoError(t, err)
+	assert.Equal(t, "0123", string(data))
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// memoryDB keeps everything in maps. It's meant for tests: nothing survives
+// Close.
+type memoryDB struct {
+	mutex   sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+type memoryTx struct {
+	db       *memoryDB
+	writable bool
+	// buckets holds the copies a writable transaction works on until it's
+	// committed
+	buckets map[string]map[string][]byte
+}
+
+type memoryBucket struct {
+	tx   *memoryTx
+	data map[string][]byte
+}
+
+type memoryCursor struct {
+	data  map[string][]byte
+	keys  []string
+	index int
+}
+
+func NewMemory() DB {
+	return &memoryDB{buckets: make(map[string]map[string][]byte)}
+}
+
+func (d *memoryDB) View(fn func(Tx) error) error {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return fn(&memoryTx{db: d})
+}
+
+func (d *memoryDB) Update(fn func(Tx) error) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	tx := &memoryTx{db: d, writable: true,
+		buckets: make(map[string]map[string][]byte)}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	for name, data := range tx.buckets {
+		d.buckets[name] = data
+	}
+	return nil
+}
+
+func (d *memoryDB) Sync() error {
+	return nil
+}
+
+func (d *memoryDB) Close() error {
+	return nil
+}
+
+func (t *memoryTx) bucket(name string) map[string][]byte {
+	if data, ok := t.buckets[name]; ok {
+		return data
+	}
+	data, ok := t.db.buckets[name]
+	if !ok {
+		return nil
+	}
+	if t.writable {
+		copied := make(map[string][]byte, len(data))
+		for k, v := range data {
+			copied[k] = v
+		}
+		t.buckets[name] = copied
+		return copied
+	}
+	return data
+}
+
+func (t *memoryTx) Bucket(name []byte) Bucket {
+	data := t.bucket(string(name))
+	if data == nil {
+		return nil
+	}
+	return &memoryBucket{t, data}
+}
+
+func (t *memoryTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if !t.writable {
+		return nil, ErrTxNotWritable
+	}
+	data := t.bucket(string(name))
+	if data == nil {
+		data = make(map[string][]byte)
+		t.buckets[string(name)] = data
+	}
+	return &memoryBucket{t, data}, nil
+}
+
+func (t *memoryTx) ForEach(fn func(name []byte, b Bucket) error) error {
+	names := make(map[string]bool)
+	for name := range t.db.buckets {
+		names[name] = true
+	}
+	for name := range t.buckets {
+		names[name] = true
+	}
+	for _, name := range sortedKeys(names) {
+		err := fn([]byte(name), t.Bucket([]byte(name)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBucket) Get(key []byte) []byte {
+	return b.data[string(key)]
+}
+
+func (b *memoryBucket) Put(key []byte, value []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	// values may be reused by the caller
+	b.data[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (b *memoryBucket) Delete(key []byte) error {
+	if !b.tx.writable {
+		return ErrTxNotWritable
+	}
+	delete(b.data, string(key))
+	return nil
+}
+
+func (b *memoryBucket) ForEach(fn func(k, v []byte) error) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		err := fn(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBucket) Cursor() Cursor {
+	keys := make(map[string]bool, len(b.data))
+	for k := range b.data {
+		keys[k] = true
+	}
+	return &memoryCursor{data: b.data, keys: sortedKeys(keys)}
+}
+
+func (c *memoryCursor) current() ([]byte, []byte) {
+	if c.index < 0 || c.index >= len(c.keys) {
+		return nil, nil
+	}
+	key := c.keys[c.index]
+	return []byte(key), c.data[key]
+}
+
+func (c *memoryCursor) First() ([]byte, []byte) {
+	c.index = 0
+	return c.current()
+}
+
+func (c *memoryCursor) Last() ([]byte, []byte) {
+	c.index = len(c.keys) - 1
+	return c.current()
+}
+
+func (c *memoryCursor) Seek(key []byte) ([]byte, []byte) {
+	c.index = sort.Search(len(c.keys), func(i int) bool {
+		return bytes.Compare([]byte(c.keys[i]), key) >= 0
+	})
+	return c.current()
+}
+
+func (c *memoryCursor) Next() ([]byte, []byte) {
+	if c.index < len(c.keys) {
+		c.index++
+	}
+	return c.current()
+}
+
+func (c *memoryCursor) Prev() ([]byte, []byte) {
+	if c.index >= 0 {
+		c.index--
+	}
+	return c.current()
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"errors"
+)
+
+var ErrTxNotWritable = errors.New("Transaction isn't writable")
+
+// DB is a key value store with buckets. All reads and writes happen within
+// a transaction: the writes of an Update are applied all at once when the
+// function returns nil and discarded otherwise, which makes an Update the
+// unit of batching.
+type DB interface {
+	View(fn func(Tx) error) error
+	Update(fn func(Tx) error) error
+	Sync() error
+	Close() error
+}
+
+type Tx interface {
+	// Bucket returns nil if the bucket doesn't exist.
+	Bucket(name []byte) Bucket
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	ForEach(fn func(name []byte, b Bucket) error) error
+}
+
+type Bucket interface {
+	// Get returns nil if the key doesn't exist. The value is only valid
+	// during the transaction.
+	Get(key []byte) []byte
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	ForEach(fn func(k, v []byte) error) error
+	Cursor() Cursor
+}
+
+// Cursor iterates over a bucket in byte order of its keys. All methods
+// return a nil key once the cursor moved past either end.
+type Cursor interface {
+	First() (key []byte, value []byte)
+	Last() (key []byte, value []byte)
+	Seek(seek []byte) (key []byte, value []byte)
+	Next() (key []byte, value []byte)
+	Prev() (key []byte, value []byte)
+}
@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// backends runs a test against every implementation.
+func backends(t *testing.T, test func(t *testing.T, db DB)) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bolt, err := OpenBolt(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bolt.Close()
+
+	for name, db := range map[string]DB{"bolt": bolt, "memory": NewMemory()} {
+		t.Run(name, func(t *testing.T) { test(t, db) })
+	}
+}
+
+func put(t *testing.T, db DB, bucket string, pairs ...string) {
+	err := db.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(pairs); i += 2 {
+			err = b.Put([]byte(pairs[i]), []byte(pairs[i+1]))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(db DB, bucket string, key string) []byte {
+	var value []byte
+	db.View(func(tx Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			value = append(value, b.Get([]byte(key))...)
+		}
+		return nil
+	})
+	return value
+}
+
+func TestPutGetDelete(t *testing.T) {
+	backends(t, func(t *testing.T, db DB) {
+		assert.Nil(t, get(db, "a", "key"))
+		put(t, db, "a", "key", "value")
+		assert.Equal(t, []byte("value"), get(db, "a", "key"))
+		assert.Nil(t, get(db, "b", "key"))
+
+		err := db.Update(func(tx Tx) error {
+			return tx.Bucket([]byte("a")).Delete([]byte("key"))
+		})
+		assert.NoError(t, err)
+		assert.Nil(t, get(db, "a", "key"))
+	})
+}
+
+func TestUpdateRollsBack(t *testing.T) {
+	backends(t, func(t *testing.T, db DB) {
+		put(t, db, "a", "key", "value")
+		failure := errors.New("failure")
+
+		err := db.Update(func(tx Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("a"))
+			if err != nil {
+				return err
+			}
+			b.Put([]byte("key"), []byte("changed"))
+			b.Put([]byte("other"), []byte("value"))
+			tx.CreateBucketIfNotExists([]byte("new"))
+			return failure
+		})
+		assert.Equal(t, failure, err)
+
+		assert.Panics(t, func() {
+			db.Update(func(tx Tx) error {
+				tx.Bucket([]byte("a")).Delete([]byte("key"))
+				panic("crash")
+			})
+		})
+
+		assert.Equal(t, []byte("value"), get(db, "a", "key"))
+		assert.Nil(t, get(db, "a", "other"))
+		db.View(func(tx Tx) error {
+			assert.Nil(t, tx.Bucket([]byte("new")))
+			return nil
+		})
+	})
+}
+
+func TestViewIsReadOnly(t *testing.T) {
+	backends(t, func(t *testing.T, db DB) {
+		put(t, db, "a", "key", "value")
+		db.View(func(tx Tx) error {
+			_, err := tx.CreateBucketIfNotExists([]byte("b"))
+			assert.Error(t, err)
+			assert.Error(t, tx.Bucket([]byte("a")).Put([]byte("k"), []byte("v")))
+			return nil
+		})
+	})
+}
+
+func TestIterate(t *testing.T) {
+	backends(t, func(t *testing.T, db DB) {
+		put(t, db, "a", "b", "2", "a", "1", "d", "4", "c", "3")
+		put(t, db, "z")
+
+		var keys []string
+		db.View(func(tx Tx) error {
+			return tx.Bucket([]byte("a")).ForEach(func(k, v []byte) error {
+				keys = append(keys, string(k)+"="+string(v))
+				return nil
+			})
+		})
+		assert.Equal(t, []string{"a=1", "b=2", "c=3", "d=4"}, keys)
+
+		db.View(func(tx Tx) error {
+			c := tx.Bucket([]byte("a")).Cursor()
+			k, v := c.Seek([]byte("bb"))
+			assert.Equal(t, "c", string(k))
+			assert.Equal(t, "3", string(v))
+			k, _ = c.Prev()
+			assert.Equal(t, "b", string(k))
+			k, _ = c.Last()
+			assert.Equal(t, "d", string(k))
+			k, _ = c.Next()
+			assert.Nil(t, k)
+			k, _ = c.First()
+			assert.Equal(t, "a", string(k))
+			k, _ = c.Seek([]byte("e"))
+			assert.Nil(t, k)
+			return nil
+		})
+
+		var buckets []string
+		db.View(func(tx Tx) error {
+			return tx.ForEach(func(name []byte, b Bucket) error {
+				buckets = append(buckets, string(name))
+				return nil
+			})
+		})
+		assert.Equal(t, []string{"a", "z"}, buckets)
+	})
+}
@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// SetLogLevel configures the standard logger. "debug" adds the source
+// location to every line, "silent" discards the log output entirely.
+func SetLogLevel(level string) error {
+	switch level {
+	case "debug":
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
+	case "info":
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	case "silent":
+		log.SetOutput(ioutil.Discard)
+	default:
+		return fmt.Errorf("Unknown log level %q", level)
+	}
+	return nil
+}
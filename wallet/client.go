@@ -0,0 +1,90 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/web"
+	"net/http"
+)
+
+// Client talks to the HTTP API of a node.
+type Client struct {
+	URL  string
+	HTTP *http.Client
+}
+
+func NewClient(url string) *Client {
+	return &Client{url, http.DefaultClient}
+}
+
+// get decodes the JSON body of path into v. Failed requests return the
+// node's error.
+func (c *Client) get(path string, v interface{}) error {
+	res, err := c.HTTP.Get(c.URL + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return readError(res)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func readError(res *http.Response) error {
+	var body web.Error
+	err := json.NewDecoder(res.Body).Decode(&body)
+	if err != nil || body.Error == "" {
+		return fmt.Errorf("Node answered %s", res.Status)
+	}
+	return errors.New(body.Error)
+}
+
+// Params returns the parameters of the node's network.
+func (c *Client) Params() (blockchain.ChainParams, error) {
+	var params blockchain.ChainParams
+	err := c.get("/params", &params)
+	return params, err
+}
+
+// Address returns the confirmed outputs paid to an address.
+func (c *Client) Address(text string) (web.AddressOutputs, error) {
+	var outputs web.AddressOutputs
+	err := c.get("/addresses/"+text, &outputs)
+	return outputs, err
+}
+
+// Mempool returns the transactions waiting to be mined.
+func (c *Client) Mempool() ([]blockchain.Transaction, error) {
+	var transactions []blockchain.Transaction
+	err := c.get("/mempool/transactions", &transactions)
+	return transactions, err
+}
+
+// PutTransaction adds a transaction to the node's mempool.
+func (c *Client) PutTransaction(
+	transaction blockchain.Transaction) (web.TransactionID, error) {
+	var id web.TransactionID
+	data, err := json.Marshal(transaction)
+	if err != nil {
+		return id, err
+	}
+	req, err := http.NewRequest(http.MethodPut,
+		c.URL+"/mempool/transactions", bytes.NewReader(data))
+	if err != nil {
+		return id, err
+	}
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return id, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return id, readError(res)
+	}
+	err = json.NewDecoder(res.Body).Decode(&id)
+	return id, err
+}
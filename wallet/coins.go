@@ -0,0 +1,74 @@
+package wallet
+
+import (
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/address"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/mr-tron/base58/base58"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Coin is an unspent output paid to a key of the wallet.
+type Coin struct {
+	TransactionHash []byte
+	OutputID        int
+	Amount          int
+	Height          int
+	// Key is the name of the key the output is paid to.
+	Key       string
+	PublicKey ed25519.PublicKey
+}
+
+// Output is the output the coin is, as an input signs it.
+func (c Coin) Output() blockchain.Output {
+	return blockchain.Output{c.PublicKey, c.Amount, []byte{}}
+}
+
+func outpoint(hash []byte, id int) string {
+	return fmt.Sprintf("%s-%d", base58.Encode(hash), id)
+}
+
+// Coins returns the confirmed outputs paid to the wallet's keys that are
+// neither spent on chain nor by a transaction in the node's mempool.
+func (k *Keystore) Coins(c *Client) ([]Coin, error) {
+	params, err := c.Params()
+	if err != nil {
+		return nil, err
+	}
+	mempool, err := c.Mempool()
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[string]bool)
+	for _, transaction := range mempool {
+		for _, input := range transaction.Inputs {
+			pending[outpoint(input.TransactionHash, input.OutputID)] = true
+		}
+	}
+
+	coins := []Coin{}
+	for _, name := range k.Names() {
+		publicKey, err := k.PublicKey(name)
+		if err != nil {
+			return nil, err
+		}
+		text, err := address.Encode(params.AddressPrefix, publicKey)
+		if err != nil {
+			return nil, err
+		}
+		outputs, err := c.Address(text)
+		if err != nil {
+			return nil, err
+		}
+		for _, output := range outputs.Outputs {
+			if output.SpentBy != nil ||
+				pending[outpoint(output.TransactionHash, output.OutputID)] {
+				continue
+			}
+			coins = append(coins, Coin{output.TransactionHash,
+				output.OutputID, output.Amount, output.Height, name,
+				publicKey})
+		}
+	}
+	return coins, nil
+}
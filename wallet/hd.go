@@ -0,0 +1,306 @@
+package wallet
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/tyler-smith/go-bip39"
+	"golang.org/x/crypto/ed25519"
+)
+
+// HD keys are derived from the seed of a BIP-39 mnemonic by SLIP-0010 at
+// m/PURPOSE'/COIN_TYPE'/account'/chain'/index'. Ed25519 has no public
+// derivation, every level is hardened.
+const (
+	PURPOSE = 44
+	// COIN_TYPE isn't registered in SLIP-0044.
+	COIN_TYPE = 1984
+	HARDENED  = 0x80000000
+	// EXTERNAL is the chain of receive addresses, INTERNAL the one of
+	// change.
+	EXTERNAL = 0
+	INTERNAL = 1
+	// GAP_LIMIT is how many unused addresses in a row end a scan.
+	GAP_LIMIT        = 20
+	MNEMONIC_ENTROPY = 256
+)
+
+var (
+	ErrNoSeed          = errors.New("Wallet has no HD seed")
+	ErrSeedExists      = errors.New("Wallet has an HD seed already")
+	ErrInvalidMnemonic = errors.New("Invalid mnemonic")
+	ErrInvalidChain    = errors.New("Chain is neither external nor internal")
+)
+
+// seedData is the additional data the seed is sealed with.
+var seedData = []byte("seed")
+
+// Account counts the addresses handed out of each chain of an HD account.
+type Account struct {
+	Index   uint32 `json:"index"`
+	Receive uint32 `json:"receive"`
+	Change  uint32 `json:"change"`
+}
+
+// next returns the counter of chain.
+func (a *Account) next(chain uint32) *uint32 {
+	if chain == INTERNAL {
+		return &a.Change
+	}
+	return &a.Receive
+}
+
+// UsedFunc tells whether a public key ever received an output.
+type UsedFunc func(publicKey ed25519.PublicKey) (bool, error)
+
+type extendedKey struct {
+	key       []byte
+	chainCode []byte
+}
+
+func masterKey(seed []byte) extendedKey {
+	mac := hmac.New(sha512.New, []byte("ed25519 seed"))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+	return extendedKey{sum[:32], sum[32:]}
+}
+
+// child derives the hardened child index.
+func (e extendedKey) child(index uint32) extendedKey {
+	data := make([]byte, 37)
+	copy(data[1:33], e.key)
+	binary.BigEndian.PutUint32(data[33:], index|HARDENED)
+	mac := hmac.New(sha512.New, e.chainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+	return extendedKey{sum[:32], sum[32:]}
+}
+
+// NewMnemonic returns a new random 24 word mnemonic.
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(MNEMONIC_ENTROPY)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// MnemonicSeed returns the seed of a mnemonic and its optional password.
+func MnemonicSeed(mnemonic string, password string) ([]byte, error) {
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, password)
+	if err != nil {
+		return nil, ErrInvalidMnemonic
+	}
+	return seed, nil
+}
+
+// DeriveKey returns the key of seed at path. Indexes are hardened.
+func DeriveKey(seed []byte, path ...uint32) ed25519.PrivateKey {
+	key := masterKey(seed)
+	for _, index := range path {
+		key = key.child(index)
+	}
+	return ed25519.NewKeyFromSeed(key.key)
+}
+
+// KeyPath returns the path of an address.
+func KeyPath(account uint32, chain uint32, index uint32) []uint32 {
+	return []uint32{PURPOSE, COIN_TYPE, account, chain, index}
+}
+
+// hdKeyName is the name an HD key is kept under.
+func hdKeyName(account uint32, chain uint32, index uint32) string {
+	return fmt.Sprintf("hd-%d-%d-%d", account, chain, index)
+}
+
+// SetMnemonic keeps the seed of mnemonic for HD keys. The mnemonic itself
+// isn't kept, it's the backup.
+func (k *Keystore) SetMnemonic(mnemonic string, password string) error {
+	seed, err := MnemonicSeed(mnemonic, password)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.aead == nil {
+		return ErrLocked
+	}
+	if len(k.file.Seed) > 0 {
+		return ErrSeedExists
+	}
+	k.file.SeedNonce, k.file.Seed, err = seal(k.aead, seed, seedData)
+	if err != nil {
+		return err
+	}
+	return k.save()
+}
+
+// HasSeed tells whether the keystore has HD keys.
+func (k *Keystore) HasSeed() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return len(k.file.Seed) > 0
+}
+
+// Accounts returns the HD accounts that handed out addresses.
+func (k *Keystore) Accounts() []Account {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]Account{}, k.file.Accounts...)
+}
+
+// seed decrypts the HD seed. The mutex has to be held.
+func (k *Keystore) seed() ([]byte, error) {
+	if k.aead == nil {
+		return nil, ErrLocked
+	}
+	if len(k.file.Seed) == 0 {
+		return nil, ErrNoSeed
+	}
+	seed, err := k.aead.Open(nil, k.file.SeedNonce, k.file.Seed, seedData)
+	if err != nil {
+		return nil, ErrMalformedWallet
+	}
+	return seed, nil
+}
+
+// account returns the counters of account, adding them if it's new. The
+// mutex has to be held.
+func (k *Keystore) account(index uint32) *Account {
+	for i := range k.file.Accounts {
+		if k.file.Accounts[i].Index == index {
+			return &k.file.Accounts[i]
+		}
+	}
+	k.file.Accounts = append(k.file.Accounts, Account{Index: index})
+	return &k.file.Accounts[len(k.file.Accounts)-1]
+}
+
+// NewAddress derives the next key of a chain of account and adds it to the
+// keystore. It returns its name and public key.
+func (k *Keystore) NewAddress(account uint32,
+	chain uint32) (string, ed25519.PublicKey, error) {
+	if chain != EXTERNAL && chain != INTERNAL {
+		return "", nil, ErrInvalidChain
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	seed, err := k.seed()
+	if err != nil {
+		return "", nil, err
+	}
+	next := k.account(account).next(chain)
+	privateKey := DeriveKey(seed, KeyPath(account, chain, *next)...)
+	name := hdKeyName(account, chain, *next)
+	*next++
+	if _, ok := k.find(name); !ok {
+		err = k.add(name, privateKey)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return name, privateKey.Public().(ed25519.PublicKey), k.save()
+}
+
+// NewReceiveAddress hands out a fresh receive key of account, one per
+// payment.
+func (k *Keystore) NewReceiveAddress(
+	account uint32) (string, ed25519.PublicKey, error) {
+	return k.NewAddress(account, EXTERNAL)
+}
+
+// NewChangeAddress hands out a fresh change key of account.
+func (k *Keystore) NewChangeAddress(
+	account uint32) (string, ed25519.PublicKey, error) {
+	return k.NewAddress(account, INTERNAL)
+}
+
+// Scan recovers the HD keys that received outputs, e.g. after restoring the
+// mnemonic. Each chain of an account is scanned until GAP_LIMIT addresses in
+// a row are unused, accounts until one has no used address. The keys up to
+// the last used one of each chain are added and the counters moved past
+// them. It returns the number of keys up to the last used ones.
+func (k *Keystore) Scan(used UsedFunc) (int, error) {
+	k.mu.Lock()
+	seed, err := k.seed()
+	k.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	found := 0
+	for account := uint32(0); ; account++ {
+		var keys [2][]ed25519.PrivateKey
+		for _, chain := range []uint32{EXTERNAL, INTERNAL} {
+			keys[chain], err = scanChain(seed, account, chain, used)
+			if err != nil {
+				return found, err
+			}
+		}
+		if len(keys[EXTERNAL]) == 0 && len(keys[INTERNAL]) == 0 {
+			return found, nil
+		}
+
+		k.mu.Lock()
+		for chain, chainKeys := range keys {
+			err = k.addScanned(account, uint32(chain), chainKeys)
+			if err != nil {
+				k.mu.Unlock()
+				return found, err
+			}
+			found += len(chainKeys)
+		}
+		err = k.save()
+		k.mu.Unlock()
+		if err != nil {
+			return found, err
+		}
+	}
+}
+
+// scanChain returns the keys of a chain up to the last used one.
+func scanChain(seed []byte, account uint32, chain uint32,
+	used UsedFunc) ([]ed25519.PrivateKey, error) {
+	var keys []ed25519.PrivateKey
+	last := -1
+	for index := 0; index-last <= GAP_LIMIT; index++ {
+		privateKey := DeriveKey(seed,
+			KeyPath(account, chain, uint32(index))...)
+		keys = append(keys, privateKey)
+		ok, err := used(privateKey.Public().(ed25519.PublicKey))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			last = index
+		}
+	}
+	return keys[:last+1], nil
+}
+
+// addScanned adds the keys of a chain found by a scan. The mutex has to be
+// held.
+func (k *Keystore) addScanned(account uint32, chain uint32,
+	keys []ed25519.PrivateKey) error {
+	if k.aead == nil {
+		return ErrLocked
+	}
+	for index, privateKey := range keys {
+		name := hdKeyName(account, chain, uint32(index))
+		if _, ok := k.find(name); ok {
+			continue
+		}
+		err := k.add(name, privateKey)
+		if err != nil {
+			return err
+		}
+	}
+	next := k.account(account).next(chain)
+	if uint32(len(keys)) > *next {
+		*next = uint32(len(keys))
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package wallet
+
+import (
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"strings"
+	"testing"
+)
+
+const testMnemonic = "abandon abandon abandon abandon abandon abandon " +
+	"abandon abandon abandon abandon abandon about"
+
+func TestSLIP10Vectors(t *testing.T) {
+	// test vector 1 for ed25519 of SLIP-0010
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	vectors := []struct {
+		path      []uint32
+		chainCode string
+		key       string
+		publicKey string
+	}{
+		{nil,
+			"90046a93de5380a72b5e45010748567d5ea02bbf6522f979e05c0d8d8ca9fffb",
+			"2b4be7f19ee27bbf30c667b642d5f4aa69fd169872f8fc3059c08ebae2eb19e7",
+			"a4b2856bfec510abab89753fac1ac0e1112364e7d250545963f135f2a33188ed"},
+		{[]uint32{0},
+			"8b59aa11380b624e81507a27fedda59fea6d0b779a778918a2fd3590e16e9c69",
+			"68e0fe46dfb67e368c75379acec591dad19df3cde26e63b93a8e704f1dade7a3",
+			"8c8a13df77a28f3445213a0f432fde644acaa215fc72dcdf300d5efaa85d350c"},
+		{[]uint32{0, 1},
+			"a320425f77d1b5c2505a6b1b27382b37368ee640e3557c315416801243552f14",
+			"b1d0bad404bf35da785a64ca1ac54b2617211d2777696fbffaf208f746ae84f2",
+			"1932a5270f335bed617d5b935c80aedb1a35bd9fc1e31acafd5372c30f5c1187"},
+		{[]uint32{0, 1, 2},
+			"2e69929e00b5ab250f49c3fb1c12f252de4fed2c1db88387094a0f8c4c9ccd6c",
+			"92a5b23c0b8a99e37d07df3fb9966917f5d06e02ddbd909c7e184371463e9fc9",
+			"ae98736566d30ed0e9d2f4486a64bc95740d89c7db33f52121f8ea8f76ff0fc1"},
+	}
+	for _, v := range vectors {
+		key := masterKey(seed)
+		for _, index := range v.path {
+			key = key.child(index)
+		}
+		assert.Equal(t, v.chainCode, hex.EncodeToString(key.chainCode))
+		assert.Equal(t, v.key, hex.EncodeToString(key.key))
+		privateKey := DeriveKey(seed, v.path...)
+		assert.Equal(t, v.publicKey, hex.EncodeToString(
+			privateKey.Public().(ed25519.PublicKey)))
+	}
+}
+
+func TestMnemonic(t *testing.T) {
+	mnemonic, err := NewMnemonic()
+	assert.NoError(t, err)
+	assert.Len(t, strings.Fields(mnemonic), 24)
+	_, err = MnemonicSeed(mnemonic, "")
+	assert.NoError(t, err)
+
+	seed, err := MnemonicSeed(testMnemonic, "TREZOR")
+	assert.NoError(t, err)
+	assert.Equal(t, "c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa37"+
+		"08e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f0016"+
+		"98e7463b04", hex.EncodeToString(seed))
+
+	_, err = MnemonicSeed(strings.Replace(testMnemonic, "about", "abandon",
+		1), "")
+	assert.Equal(t, ErrInvalidMnemonic, err)
+}
+
+func TestReceiveAddresses(t *testing.T) {
+	path, cleanup := tempWallet(t)
+	defer cleanup()
+	k, err := Create(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = k.NewReceiveAddress(0)
+	assert.Equal(t, ErrNoSeed, err)
+	assert.NoError(t, k.SetMnemonic(testMnemonic, ""))
+	assert.Equal(t, ErrSeedExists, k.SetMnemonic(testMnemonic, ""))
+	seed, err := MnemonicSeed(testMnemonic, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every payment gets a fresh key
+	for index := uint32(0); index < 3; index++ {
+		name, publicKey, err := k.NewReceiveAddress(0)
+		assert.NoError(t, err)
+		assert.Equal(t, hdKeyName(0, EXTERNAL, index), name)
+		privateKey := DeriveKey(seed, KeyPath(0, EXTERNAL, index)...)
+		assert.Equal(t, privateKey.Public(), publicKey)
+		stored, err := k.PrivateKey(name)
+		assert.NoError(t, err)
+		assert.Equal(t, privateKey, stored)
+	}
+	name, _, err := k.NewChangeAddress(0)
+	assert.NoError(t, err)
+	assert.Equal(t, "hd-0-1-0", name)
+	_, _, err = k.NewAddress(0, 2)
+	assert.Equal(t, ErrInvalidChain, err)
+
+	// the counters are kept, the seed needs the passphrase
+	k, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, k.HasSeed())
+	assert.Equal(t, []Account{{0, 3, 1}}, k.Accounts())
+	_, _, err = k.NewReceiveAddress(0)
+	assert.Equal(t, ErrLocked, err)
+	assert.NoError(t, k.Unlock("secret", 0))
+	name, _, err = k.NewReceiveAddress(0)
+	assert.NoError(t, err)
+	assert.Equal(t, "hd-0-0-3", name)
+}
+
+func TestScan(t *testing.T) {
+	path, cleanup := tempWallet(t)
+	defer cleanup()
+	k, err := Create(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = k.Scan(func(ed25519.PublicKey) (bool, error) {
+		return false, nil
+	})
+	assert.Equal(t, ErrNoSeed, err)
+	assert.NoError(t, k.SetMnemonic(testMnemonic, ""))
+	seed, err := MnemonicSeed(testMnemonic, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the key at 40 is past the gap after 15
+	used := make(map[string]bool)
+	for _, path := range [][]uint32{KeyPath(0, EXTERNAL, 0),
+		KeyPath(0, EXTERNAL, 15), KeyPath(0, EXTERNAL, 40),
+		KeyPath(0, INTERNAL, 3), KeyPath(1, EXTERNAL, 0),
+		KeyPath(3, EXTERNAL, 0)} {
+		publicKey := DeriveKey(seed, path...).Public().(ed25519.PublicKey)
+		used[string(publicKey)] = true
+	}
+	found, err := k.Scan(func(publicKey ed25519.PublicKey) (bool, error) {
+		return used[string(publicKey)], nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 16+4+1, found)
+	assert.Equal(t, []Account{{0, 16, 4}, {1, 1, 0}}, k.Accounts())
+	assert.Len(t, k.Names(), 21)
+	_, err = k.PrivateKey(hdKeyName(0, INTERNAL, 3))
+	assert.NoError(t, err)
+
+	// scanning again finds the same keys and hands out new ones after them
+	found, err = k.Scan(func(publicKey ed25519.PublicKey) (bool, error) {
+		return used[string(publicKey)], nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 21, found)
+	assert.Len(t, k.Names(), 21)
+	name, _, err := k.NewReceiveAddress(0)
+	assert.NoError(t, err)
+	assert.Equal(t, "hd-0-0-16", name)
+}
@@ -0,0 +1,410 @@
+// Package wallet keeps private keys in a keystore file encrypted with a
+// passphrase. The passphrase is stretched with scrypt into the key of an
+// AES-256-GCM cipher that seals each private key. Names and public keys are
+// readable while the keystore is locked, private keys only once it's
+// unlocked.
+package wallet
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"github.com/mr-tron/base58/base58"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/scrypt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KEYSTORE_VERSION = 1
+	SALT_SIZE        = 32
+	// PASSPHRASE_ENV is the environment variable the node, the miner and
+	// txtool read the passphrase from.
+	PASSPHRASE_ENV = "CRYPTOCURRENCY_WALLET_PASSPHRASE"
+	// DEFAULT_KEY is the key used when none is named.
+	DEFAULT_KEY = "default"
+)
+
+// The scrypt cost of new keystores. Tests lower ScryptN.
+var (
+	ScryptN = 1 << 15
+	ScryptR = 8
+	ScryptP = 1
+)
+
+var (
+	ErrLocked          = errors.New("Wallet is locked")
+	ErrWrongPassphrase = errors.New("Wrong wallet passphrase")
+	ErrKeyNotFound     = errors.New("No key with that name in the wallet")
+	ErrKeyExists       = errors.New("A key with that name exists already")
+	ErrWalletExists    = errors.New("Wallet exists already")
+	ErrMalformedWallet = errors.New("Malformed wallet file")
+	ErrInvalidKeyName  = errors.New("Key names are letters, digits, ., _ and -")
+	ErrInvalidKey      = errors.New("Invalid private key")
+)
+
+var keyName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type kdfParams struct {
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+// encryptedKey is a private key sealed with its public key as additional
+// data, so the public key listed can't be swapped.
+type encryptedKey struct {
+	Name       string `json:"name"`
+	PublicKey  string `json:"public_key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type keystoreFile struct {
+	Version int       `json:"version"`
+	KDF     kdfParams `json:"kdf"`
+	// Check is nothing sealed with the key, a wrong passphrase fails to open
+	// it even if there are no keys yet.
+	CheckNonce []byte         `json:"check_nonce"`
+	Check      []byte         `json:"check"`
+	Keys       []encryptedKey `json:"keys"`
+	// Seed is the sealed seed of the HD keys, see hd.go.
+	SeedNonce []byte    `json:"seed_nonce,omitempty"`
+	Seed      []byte    `json:"seed,omitempty"`
+	Accounts  []Account `json:"accounts,omitempty"`
+}
+
+// Keystore is an encrypted keystore file. It's safe for concurrent use.
+type Keystore struct {
+	Path string
+
+	mu    sync.Mutex
+	file  keystoreFile
+	aead  cipher.AEAD
+	timer *time.Timer
+}
+
+func newAEAD(passphrase string, params kdfParams) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), params.Salt, params.N,
+		params.R, params.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext []byte,
+	additional []byte) ([]byte, []byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, additional), nil
+}
+
+// Create writes a new keystore without keys to path. It's left unlocked.
+func Create(path string, passphrase string) (*Keystore, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return nil, ErrWalletExists
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	params := kdfParams{make([]byte, SALT_SIZE), ScryptN, ScryptR, ScryptP}
+	_, err = rand.Read(params.Salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(passphrase, params)
+	if err != nil {
+		return nil, err
+	}
+	nonce, check, err := seal(aead, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	k := &Keystore{Path: path, aead: aead, file: keystoreFile{
+		Version: KEYSTORE_VERSION, KDF: params, CheckNonce: nonce,
+		Check: check, Keys: []encryptedKey{}}}
+	return k, k.save()
+}
+
+// Open reads the keystore at path. It's locked.
+func Open(path string) (*Keystore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Printf("Wallet %s is accessible by other users", path)
+	}
+	var file keystoreFile
+	err = json.Unmarshal(data, &file)
+	if err != nil || file.Version != KEYSTORE_VERSION ||
+		len(file.KDF.Salt) == 0 || len(file.Check) == 0 {
+		return nil, ErrMalformedWallet
+	}
+	for _, key := range file.Keys {
+		publicKey, err := base58.Decode(key.PublicKey)
+		if err != nil || len(publicKey) != ed25519.PublicKeySize ||
+			!keyName.MatchString(key.Name) {
+			return nil, ErrMalformedWallet
+		}
+	}
+	return &Keystore{Path: path, file: file}, nil
+}
+
+// save writes the keystore to a temporary file that replaces the old one,
+// so it's never half written.
+func (k *Keystore) save() error {
+	data, err := json.MarshalIndent(k.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(k.Path),
+		filepath.Base(k.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	closeErr := temp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	err = os.Chmod(temp.Name(), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), k.Path)
+}
+
+// Unlock derives the key of the keystore from passphrase. After timeout it
+// locks again, a timeout of 0 keeps it unlocked until Lock is called.
+func (k *Keystore) Unlock(passphrase string, timeout time.Duration) error {
+	aead, err := newAEAD(passphrase, k.file.KDF)
+	if err != nil {
+		return err
+	}
+	_, err = aead.Open(nil, k.file.CheckNonce, k.file.Check, nil)
+	if err != nil {
+		return ErrWrongPassphrase
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.aead = aead
+	if k.timer != nil {
+		k.timer.Stop()
+		k.timer = nil
+	}
+	if timeout > 0 {
+		k.timer = time.AfterFunc(timeout, k.Lock)
+	}
+	return nil
+}
+
+// Lock forgets the key of the keystore.
+func (k *Keystore) Lock() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.aead = nil
+	if k.timer != nil {
+		k.timer.Stop()
+		k.timer = nil
+	}
+}
+
+func (k *Keystore) Locked() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.aead == nil
+}
+
+// Names returns the names of the keys, sorted.
+func (k *Keystore) Names() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	names := []string{}
+	for _, key := range k.file.Keys {
+		names = append(names, key.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (k *Keystore) find(name string) (encryptedKey, bool) {
+	for _, key := range k.file.Keys {
+		if key.Name == name {
+			return key, true
+		}
+	}
+	return encryptedKey{}, false
+}
+
+// PublicKey returns the public key of the key name, locked or not.
+func (k *Keystore) PublicKey(name string) (ed25519.PublicKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, ok := k.find(name)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return base58.Decode(key.PublicKey)
+}
+
+// KeyName returns the name of the key with publicKey.
+func (k *Keystore) KeyName(publicKey ed25519.PublicKey) (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	text := base58.Encode(publicKey)
+	for _, key := range k.file.Keys {
+		if key.PublicKey == text {
+			return key.Name, nil
+		}
+	}
+	return "", ErrKeyNotFound
+}
+
+// PrivateKey decrypts the key name.
+func (k *Keystore) PrivateKey(name string) (ed25519.PrivateKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.aead == nil {
+		return nil, ErrLocked
+	}
+	key, ok := k.find(name)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	publicKey, err := base58.Decode(key.PublicKey)
+	if err != nil {
+		return nil, ErrMalformedWallet
+	}
+	privateKey, err := k.aead.Open(nil, key.Nonce, key.Ciphertext, publicKey)
+	if err != nil || len(privateKey) != ed25519.PrivateKeySize ||
+		!bytes.Equal(privateKey[32:], publicKey) {
+		return nil, ErrMalformedWallet
+	}
+	return privateKey, nil
+}
+
+// Export returns the private key name to back it up or to import it into
+// another wallet.
+func (k *Keystore) Export(name string) (ed25519.PrivateKey, error) {
+	return k.PrivateKey(name)
+}
+
+// Import adds privateKey as the key name.
+func (k *Keystore) Import(name string, privateKey ed25519.PrivateKey) error {
+	if !keyName.MatchString(name) {
+		return ErrInvalidKeyName
+	}
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return ErrInvalidKey
+	}
+	// the public key half has to be the one of the seed
+	derived := ed25519.NewKeyFromSeed(privateKey[:32])
+	if !bytes.Equal(derived, privateKey) {
+		return ErrInvalidKey
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.aead == nil {
+		return ErrLocked
+	}
+	if _, ok := k.find(name); ok {
+		return ErrKeyExists
+	}
+	err := k.add(name, privateKey)
+	if err != nil {
+		return err
+	}
+	return k.save()
+}
+
+// add seals privateKey as the key name without saving the keystore. The
+// mutex has to be held and the keystore unlocked.
+func (k *Keystore) add(name string, privateKey ed25519.PrivateKey) error {
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	nonce, ciphertext, err := seal(k.aead, privateKey, publicKey)
+	if err != nil {
+		return err
+	}
+	k.file.Keys = append(k.file.Keys, encryptedKey{name,
+		base58.Encode(publicKey), nonce, ciphertext})
+	return nil
+}
+
+// Generate adds a new random key name and returns its public key.
+func (k *Keystore) Generate(name string) (ed25519.PublicKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return publicKey, k.Import(name, privateKey)
+}
+
+// OpenKey returns the key name of the keystore at path, unlocking it with
+// passphrase just for that.
+func OpenKey(path string, name string,
+	passphrase string) (ed25519.PrivateKey, error) {
+	k, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	err = k.Unlock(passphrase, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer k.Lock()
+	return k.PrivateKey(name)
+}
+
+// ReadLegacyWallet reads the private key of a wallet.txt of older versions:
+// a base58 public key and a base58 private key on two lines.
+func ReadLegacyWallet(path string) (ed25519.PrivateKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		return nil, ErrMalformedWallet
+	}
+	publicKey, err := base58.Decode(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return nil, ErrMalformedWallet
+	}
+	privateKey, err := base58.Decode(strings.TrimSpace(lines[1]))
+	if err != nil || len(privateKey) != ed25519.PrivateKeySize ||
+		!bytes.Equal(privateKey[32:], publicKey) {
+		return nil, ErrMalformedWallet
+	}
+	return privateKey, nil
+}
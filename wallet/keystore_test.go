@@ -0,0 +1,163 @@
+package wallet
+
+import (
+	"crypto/rand"
+	"github.com/mr-tron/base58/base58"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	ScryptN = 1 << 10
+}
+
+func tempWallet(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "wallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "wallet.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestCreateAndOpen(t *testing.T) {
+	path, cleanup := tempWallet(t)
+	defer cleanup()
+
+	k, err := Create(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, k.Locked())
+	publicKey, err := k.Generate("default")
+	assert.NoError(t, err)
+	_, err = k.Generate("default")
+	assert.Equal(t, ErrKeyExists, err)
+	_, err = k.Generate("not a name")
+	assert.Equal(t, ErrInvalidKeyName, err)
+	_, err = Create(path, "secret")
+	assert.Equal(t, ErrWalletExists, err)
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	k, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, k.Locked())
+	assert.Equal(t, []string{"default"}, k.Names())
+	stored, err := k.PublicKey("default")
+	assert.NoError(t, err)
+	assert.Equal(t, publicKey, stored)
+	_, err = k.PrivateKey("default")
+	assert.Equal(t, ErrLocked, err)
+
+	assert.Equal(t, ErrWrongPassphrase, k.Unlock("wrong", 0))
+	assert.NoError(t, k.Unlock("secret", 0))
+	privateKey, err := k.PrivateKey("default")
+	assert.NoError(t, err)
+	assert.Equal(t, publicKey, privateKey.Public())
+	_, err = k.PrivateKey("other")
+	assert.Equal(t, ErrKeyNotFound, err)
+	k.Lock()
+	_, err = k.PrivateKey("default")
+	assert.Equal(t, ErrLocked, err)
+}
+
+func TestUnlockTimeout(t *testing.T) {
+	path, cleanup := tempWallet(t)
+	defer cleanup()
+	k, err := Create(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Lock()
+
+	assert.NoError(t, k.Unlock("secret", 50*time.Millisecond))
+	assert.False(t, k.Locked())
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, k.Locked())
+	_, err = k.Generate("default")
+	assert.Equal(t, ErrLocked, err)
+}
+
+func TestImportExport(t *testing.T) {
+	path, cleanup := tempWallet(t)
+	defer cleanup()
+	k, err := Create(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, k.Import("imported", privateKey))
+	_, err = k.Generate("generated")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"generated", "imported"}, k.Names())
+
+	// a private key whose public half doesn't belong to it
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	mismatched := append(append([]byte{}, other[:32]...), publicKey...)
+	assert.Equal(t, ErrInvalidKey, k.Import("mismatched", mismatched))
+	assert.Equal(t, ErrInvalidKey, k.Import("short", privateKey[:32]))
+
+	privateKey2, err := OpenKey(path, "imported", "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey, privateKey2)
+	exported, err := k.Export("imported")
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey, exported)
+	_, err = OpenKey(path, "imported", "wrong")
+	assert.Equal(t, ErrWrongPassphrase, err)
+}
+
+func TestMalformedWallet(t *testing.T) {
+	path, cleanup := tempWallet(t)
+	defer cleanup()
+	for _, content := range []string{"", "{}", `{"version": 2}`,
+		"not json"} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		_, err := Open(path)
+		assert.Equal(t, ErrMalformedWallet, err, content)
+	}
+
+	// a listed public key swapped for another
+	os.Remove(path)
+	k, err := Create(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = k.Generate("default")
+	assert.NoError(t, err)
+	publicKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	k.file.Keys[0].PublicKey = base58.Encode(publicKey)
+	_, err = k.PrivateKey("default")
+	assert.Equal(t, ErrMalformedWallet, err)
+}
+
+func TestReadLegacyWallet(t *testing.T) {
+	path, cleanup := tempWallet(t)
+	defer cleanup()
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	legacy := base58.Encode(publicKey) + "\n" + base58.Encode(privateKey)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(legacy), 0600))
+	read, err := ReadLegacyWallet(path)
+	assert.NoError(t, err)
+	assert.Equal(t, privateKey, read)
+
+	// older versions panicked on these
+	for _, content := range []string{"", base58.Encode(publicKey),
+		base58.Encode(publicKey) + "\nnot base58 0OIl"} {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		_, err = ReadLegacyWallet(path)
+		assert.Equal(t, ErrMalformedWallet, err, content)
+	}
+}
@@ -0,0 +1,368 @@
+package wallet
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/mr-tron/base58/base58"
+	"golang.org/x/crypto/ed25519"
+)
+
+// PARTIAL_VERSION is the version of the format of partially signed
+// transactions.
+const PARTIAL_VERSION = 1
+
+var (
+	ErrPartialVersion = errors.New(
+		"Unknown version of partially signed transaction")
+	ErrPartialMismatch = errors.New(
+		"Partially signed transactions of different transactions")
+	ErrEmptyTransaction = errors.New("Transaction has no inputs or outputs")
+	ErrSignedInput      = errors.New("Input is signed already")
+	ErrDuplicateInput   = errors.New("Output is spent twice")
+	ErrUnsupportedSpend = errors.New(
+		"Output is neither locked to a key nor multisig")
+	ErrNegativeFee = errors.New("Outputs are worth more than the inputs")
+	ErrForeignKey  = errors.New(
+		"Signature of a key that doesn't sign the input")
+	ErrInvalidSignature  = errors.New("Invalid signature")
+	ErrMissingSignatures = errors.New("Not enough signatures")
+	ErrNothingToCombine  = errors.New(
+		"No partially signed transactions to combine")
+)
+
+// InputError is what's wrong with an input of a partially signed
+// transaction.
+type InputError struct {
+	Index int
+	Err   error
+}
+
+func (e *InputError) Error() string {
+	return fmt.Sprintf("Input %d: %s", e.Index, e.Err)
+}
+
+// PartialInput is what signing an input needs and the transaction doesn't
+// carry: the output it spends, with its amount and its key or multisig
+// script. Signatures are those made so far by base58 public key, each
+// followed by its hash type as in an input.
+type PartialInput struct {
+	Spent      blockchain.Output `json:"spent"`
+	Signatures map[string][]byte `json:"signatures,omitempty"`
+}
+
+// PartialTransaction is a transaction passed around while it's signed, so
+// the keys never have to be where it's built. It's created unsigned, signed
+// by each wallet that has keys of its inputs, offline, and the copies
+// signed by different wallets are combined. Once every input has the
+// signatures it needs it's finalized into the transaction sent to the node.
+// The transaction itself stays unsigned until then and every step checks
+// the whole of it, see Validate.
+type PartialTransaction struct {
+	Version     int                    `json:"version"`
+	Transaction blockchain.Transaction `json:"transaction"`
+	Inputs      []PartialInput         `json:"inputs"`
+}
+
+// NewPartialTransaction returns the partially signed transaction of an
+// unsigned transaction whose inputs spend spent.
+func NewPartialTransaction(transaction blockchain.Transaction,
+	spent []blockchain.Output) (*PartialTransaction, error) {
+	p := &PartialTransaction{PARTIAL_VERSION, transaction,
+		make([]PartialInput, len(spent))}
+	for i, output := range spent {
+		p.Inputs[i].Spent = output
+	}
+	if len(p.Transaction.Hash) == 0 {
+		hash, err := p.Transaction.GetHash()
+		if err != nil {
+			return nil, err
+		}
+		p.Transaction.Hash = hash
+	}
+	return p, p.Validate()
+}
+
+// DecodePartialTransaction decodes and validates the JSON of a partially
+// signed transaction.
+func DecodePartialTransaction(data []byte) (*PartialTransaction, error) {
+	var p PartialTransaction
+	err := json.Unmarshal(data, &p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, p.Validate()
+}
+
+func (p *PartialTransaction) Encode() ([]byte, error) {
+	return json.MarshalIndent(p, "", "  ")
+}
+
+// signers returns the keys that can sign input index and how many of them
+// have to.
+func (p *PartialTransaction) signers(index int) ([][]byte, int, error) {
+	spent := p.Inputs[index].Spent
+	if len(spent.Script) == 0 {
+		if len(spent.PublicKey) != ed25519.PublicKeySize {
+			return nil, 0, ErrUnsupportedSpend
+		}
+		return [][]byte{spent.PublicKey}, 1, nil
+	}
+	m, publicKeys, err := blockchain.ParseMultisigScript(spent.Script)
+	if err != nil {
+		return nil, 0, ErrUnsupportedSpend
+	}
+	return publicKeys, m, nil
+}
+
+// Validate checks that the transaction is unsigned, has its hash, spends
+// each output once and no more than it's worth and that every signature is
+// a valid one of a key that signs its input.
+func (p *PartialTransaction) Validate() error {
+	if p.Version != PARTIAL_VERSION {
+		return ErrPartialVersion
+	}
+	transaction := p.Transaction
+	if len(transaction.Inputs) == 0 || len(transaction.Outputs) == 0 {
+		return ErrEmptyTransaction
+	}
+	if len(p.Inputs) != len(transaction.Inputs) {
+		return ErrSpentMismatch
+	}
+	err := transaction.CheckHash()
+	if err != nil {
+		return err
+	}
+
+	spentOutputs := make(map[string]bool)
+	fee := 0
+	for i, input := range transaction.Inputs {
+		if len(input.Signature) > 0 || len(input.Witness) > 0 {
+			return &InputError{i, ErrSignedInput}
+		}
+		pointer := outpoint(input.TransactionHash, input.OutputID)
+		if spentOutputs[pointer] {
+			return &InputError{i, ErrDuplicateInput}
+		}
+		spentOutputs[pointer] = true
+		if p.Inputs[i].Spent.Amount <= 0 {
+			return &InputError{i, ErrInvalidAmount}
+		}
+		fee += p.Inputs[i].Spent.Amount
+		err = p.checkSignatures(transaction, i)
+		if err != nil {
+			return &InputError{i, err}
+		}
+	}
+	for _, output := range transaction.Outputs {
+		if output.Amount <= 0 {
+			return ErrInvalidAmount
+		}
+		fee -= output.Amount
+	}
+	if fee < 0 {
+		return ErrNegativeFee
+	}
+	return nil
+}
+
+func keyIndex(publicKeys [][]byte, publicKey []byte) int {
+	for i, key := range publicKeys {
+		if bytes.Equal(key, publicKey) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *PartialTransaction) checkSignatures(
+	transaction blockchain.Transaction, index int) error {
+	publicKeys, _, err := p.signers(index)
+	if err != nil {
+		return err
+	}
+	for text, signature := range p.Inputs[index].Signatures {
+		publicKey, err := base58.Decode(text)
+		if err != nil || keyIndex(publicKeys, publicKey) < 0 {
+			return ErrForeignKey
+		}
+		if len(signature) != SIGNATURE_SIZE {
+			return ErrInvalidSignature
+		}
+		hash, err := transaction.SignatureHash(index, p.Inputs[index].Spent,
+			blockchain.SigHashType(signature[ed25519.SignatureSize]))
+		if err != nil {
+			return err
+		}
+		if !ed25519.Verify(publicKey, hash,
+			signature[:ed25519.SignatureSize]) {
+			return ErrInvalidSignature
+		}
+	}
+	return nil
+}
+
+// Spent returns the outputs the inputs spend.
+func (p *PartialTransaction) Spent() []blockchain.Output {
+	var spent []blockchain.Output
+	for _, input := range p.Inputs {
+		spent = append(spent, input.Spent)
+	}
+	return spent
+}
+
+// Fee returns what the outputs spent are worth beyond the outputs.
+func (p *PartialTransaction) Fee() int {
+	fee := 0
+	for _, input := range p.Inputs {
+		fee += input.Spent.Amount
+	}
+	for _, output := range p.Transaction.Outputs {
+		fee -= output.Amount
+	}
+	return fee
+}
+
+// Missing returns how many more signatures input index needs.
+func (p *PartialTransaction) Missing(index int) int {
+	_, m, err := p.signers(index)
+	if err != nil {
+		return 0
+	}
+	missing := m - len(p.Inputs[index].Signatures)
+	if missing < 0 {
+		return 0
+	}
+	return missing
+}
+
+// SignPartial adds the signatures of the wallet's keys to the inputs of p
+// they sign and returns how many it added. It doesn't need a node, the
+// outputs spent are part of p.
+func (k *Keystore) SignPartial(p *PartialTransaction) (int, error) {
+	err := p.Validate()
+	if err != nil {
+		return 0, err
+	}
+	signed := 0
+	for i := range p.Inputs {
+		publicKeys, _, _ := p.signers(i)
+		for _, publicKey := range publicKeys {
+			text := base58.Encode(publicKey)
+			if _, ok := p.Inputs[i].Signatures[text]; ok {
+				continue
+			}
+			name, err := k.KeyName(publicKey)
+			if err == ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return signed, err
+			}
+			privateKey, err := k.PrivateKey(name)
+			if err != nil {
+				return signed, err
+			}
+			hash, err := p.Transaction.SignatureHash(i, p.Inputs[i].Spent,
+				blockchain.SIGHASH_ALL)
+			if err != nil {
+				return signed, err
+			}
+			if p.Inputs[i].Signatures == nil {
+				p.Inputs[i].Signatures = make(map[string][]byte)
+			}
+			p.Inputs[i].Signatures[text] = append(
+				ed25519.Sign(privateKey, hash), byte(blockchain.SIGHASH_ALL))
+			signed++
+		}
+	}
+	return signed, nil
+}
+
+// CombinePartial merges the signatures of copies of the same partially
+// signed transaction, signed by different wallets.
+func CombinePartial(
+	partials ...*PartialTransaction) (*PartialTransaction, error) {
+	if len(partials) == 0 {
+		return nil, ErrNothingToCombine
+	}
+	for _, p := range partials {
+		err := p.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	first := partials[0]
+	combined := &PartialTransaction{first.Version, first.Transaction,
+		make([]PartialInput, len(first.Inputs))}
+	for i, input := range first.Inputs {
+		combined.Inputs[i].Spent = input.Spent
+	}
+	for _, p := range partials {
+		if !bytes.Equal(p.Transaction.Hash, combined.Transaction.Hash) {
+			return nil, ErrPartialMismatch
+		}
+		for i, input := range p.Inputs {
+			spent := combined.Inputs[i].Spent
+			if !bytes.Equal(input.Spent.PublicKey, spent.PublicKey) ||
+				input.Spent.Amount != spent.Amount ||
+				!bytes.Equal(input.Spent.Script, spent.Script) {
+				return nil, ErrPartialMismatch
+			}
+			for text, signature := range input.Signatures {
+				if combined.Inputs[i].Signatures == nil {
+					combined.Inputs[i].Signatures = make(map[string][]byte)
+				}
+				if _, ok := combined.Inputs[i].Signatures[text]; !ok {
+					combined.Inputs[i].Signatures[text] = signature
+				}
+			}
+		}
+	}
+	return combined, combined.Validate()
+}
+
+// Finalize returns the transaction with the signatures in its inputs, once
+// every input has enough, after checking that they unlock the outputs
+// spent. Multisig inputs take the signatures of the first keys of their
+// script.
+func (p *PartialTransaction) Finalize() (blockchain.Transaction, error) {
+	err := p.Validate()
+	if err != nil {
+		return blockchain.Transaction{}, err
+	}
+	transaction := p.Transaction
+	transaction.Inputs = append([]blockchain.Input{}, p.Transaction.Inputs...)
+	for i, input := range p.Inputs {
+		publicKeys, m, _ := p.signers(i)
+		var witness [][]byte
+		for index, publicKey := range publicKeys {
+			signature, ok := input.Signatures[base58.Encode(publicKey)]
+			if !ok || len(witness) == m {
+				continue
+			}
+			witness = append(witness,
+				append([]byte{byte(index)}, signature...))
+		}
+		if len(witness) < m {
+			return blockchain.Transaction{},
+				&InputError{i, ErrMissingSignatures}
+		}
+		if len(input.Spent.Script) == 0 {
+			transaction.Inputs[i].Signature = witness[0][1:]
+		} else {
+			transaction.Inputs[i].Witness = witness
+		}
+	}
+	for i, input := range p.Inputs {
+		valid, err := transaction.Verify(input.Spent, i)
+		if !valid {
+			if err == nil {
+				err = ErrInvalidSignature
+			}
+			return blockchain.Transaction{}, &InputError{i, err}
+		}
+	}
+	return transaction, nil
+}
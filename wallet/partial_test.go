@@ -0,0 +1,168 @@
+package wallet
+
+import (
+	"crypto/rand"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/mr-tron/base58/base58"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"testing"
+)
+
+func newSigner(t *testing.T, name string) (*Keystore, ed25519.PublicKey,
+	func()) {
+	path, cleanup := tempWallet(t)
+	k, err := Create(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := k.Generate(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, publicKey, cleanup
+}
+
+// newPartial returns a transaction spending an output of first and a 2 of
+// 3 multisig output of first, second and a third key.
+func newPartial(t *testing.T, first ed25519.PublicKey,
+	second ed25519.PublicKey) *PartialTransaction {
+	third, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := blockchain.MultisigScript(2,
+		[][]byte{first, second, third})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction := blockchain.Transaction{[]byte{}, []blockchain.Input{
+		{[]byte{}, []byte("a"), 0, nil, 0},
+		{[]byte{}, []byte("b"), 0, nil, 0}},
+		[]blockchain.Output{{third, 10, []byte{}}}, 0}
+	p, err := NewPartialTransaction(transaction, []blockchain.Output{
+		{first, 5, []byte{}}, {[]byte{}, 7, script}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPartialTransaction(t *testing.T) {
+	k, first, cleanup := newSigner(t, "first")
+	defer cleanup()
+	other, second, otherCleanup := newSigner(t, "second")
+	defer otherCleanup()
+	p := newPartial(t, first, second)
+	assert.Equal(t, 2, p.Fee())
+	assert.Equal(t, 1, p.Missing(0))
+	assert.Equal(t, 2, p.Missing(1))
+
+	// each wallet signs its copy, offline
+	data, err := p.Encode()
+	assert.NoError(t, err)
+	copied, err := DecodePartialTransaction(data)
+	assert.NoError(t, err)
+	signed, err := k.SignPartial(p)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, signed)
+	signed, err = k.SignPartial(p)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, signed)
+	signed, err = other.SignPartial(copied)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, signed)
+	assert.Equal(t, 0, p.Missing(0))
+	assert.Equal(t, 1, p.Missing(1))
+	_, err = p.Finalize()
+	assert.Equal(t, &InputError{1, ErrMissingSignatures}, err)
+
+	combined, err := CombinePartial(p, copied)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, combined.Missing(1))
+	assert.Len(t, p.Inputs[1].Signatures, 1)
+	transaction, err := combined.Finalize()
+	assert.NoError(t, err)
+	assert.Len(t, transaction.Inputs[1].Witness, 2)
+	for index, spent := range combined.Spent() {
+		ok, err := transaction.Verify(spent, index)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+
+	mismatch := newPartial(t, first, second)
+	_, err = CombinePartial(p, mismatch)
+	assert.Equal(t, ErrPartialMismatch, err)
+	_, err = CombinePartial()
+	assert.Equal(t, ErrNothingToCombine, err)
+
+	k.Lock()
+	_, err = k.SignPartial(copied)
+	assert.Equal(t, ErrLocked, err)
+}
+
+func TestValidatePartial(t *testing.T) {
+	k, first, cleanup := newSigner(t, "first")
+	defer cleanup()
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		change func(p *PartialTransaction)
+		err    string
+	}{
+		{func(p *PartialTransaction) {}, ""},
+		{func(p *PartialTransaction) {
+			p.Version = 2
+		}, ErrPartialVersion.Error()},
+		{func(p *PartialTransaction) {
+			p.Inputs = p.Inputs[:1]
+		}, ErrSpentMismatch.Error()},
+		{func(p *PartialTransaction) {
+			p.Transaction.Outputs[0].Amount = 11
+		}, "Transaction hash doesn't match its contents"},
+		{func(p *PartialTransaction) {
+			p.Transaction.Inputs[0].Signature = []byte{1}
+		}, (&InputError{0, ErrSignedInput}).Error()},
+		{func(p *PartialTransaction) {
+			p.Inputs[1].Spent.Script = []byte{1}
+		}, (&InputError{1, ErrUnsupportedSpend}).Error()},
+		{func(p *PartialTransaction) {
+			p.Inputs[0].Spent.Amount = 0
+		}, (&InputError{0, ErrInvalidAmount}).Error()},
+		{func(p *PartialTransaction) {
+			p.Inputs[0].Signatures = nil
+			p.Inputs[0].Spent.Amount = 2
+		}, ErrNegativeFee.Error()},
+		// signatures commit to the amounts spent
+		{func(p *PartialTransaction) {
+			p.Inputs[1].Spent.Amount = 8
+		}, (&InputError{1, ErrInvalidSignature}).Error()},
+		{func(p *PartialTransaction) {
+			p.Inputs[0].Signatures = p.Inputs[1].Signatures
+		}, (&InputError{0, ErrInvalidSignature}).Error()},
+		{func(p *PartialTransaction) {
+			p.Inputs[0].Signatures[base58.Encode(other)] =
+				p.Inputs[0].Signatures[base58.Encode(first)]
+		}, (&InputError{0, ErrForeignKey}).Error()},
+	} {
+		p := newPartial(t, first, other)
+		_, err = k.SignPartial(p)
+		assert.NoError(t, err)
+		test.change(p)
+		err = p.Validate()
+		if test.err == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, test.err)
+		}
+	}
+
+	p := newPartial(t, first, other)
+	p.Transaction.Inputs[1].TransactionHash = []byte("a")
+	p.Transaction.Hash, err = p.Transaction.GetHash()
+	assert.NoError(t, err)
+	assert.Equal(t, &InputError{1, ErrDuplicateInput}, p.Validate())
+}
@@ -0,0 +1,214 @@
+package wallet
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+)
+
+const (
+	// BNB_TRIES bounds the branches the branch and bound search visits.
+	BNB_TRIES = 100000
+	// KNAPSACK_ITERATIONS is how many random subsets the knapsack tries.
+	KNAPSACK_ITERATIONS = 1000
+	// MIN_CHANGE is the change a transaction aims for if its coins can't
+	// pay exactly.
+	MIN_CHANGE = 1
+)
+
+var ErrInsufficientFunds = errors.New("Insufficient funds")
+
+// sortedCoins returns the indexes of the coins worth more than nothing,
+// most valuable first.
+func sortedCoins(values []int) []int {
+	indexes := []int{}
+	for i, value := range values {
+		if value > 0 {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return values[indexes[i]] > values[indexes[j]]
+	})
+	return indexes
+}
+
+type bnbSearch struct {
+	values []int
+	// remaining is the sum of values from each index on
+	remaining []int
+	target    int
+	upper     int
+	tries     int
+
+	selected []bool
+	best     []bool
+	excess   int
+}
+
+// search decides whether to include values[index] with the values before it
+// adding up to sum. Including is tried first, leaving out a coin also
+// leaves out the ones of the same value after it, which would give the
+// same sums.
+func (b *bnbSearch) search(index int, sum int) {
+	if b.tries <= 0 || sum > b.upper {
+		return
+	}
+	b.tries--
+	if sum >= b.target {
+		if b.best == nil || sum-b.target < b.excess {
+			b.best = append([]bool{}, b.selected...)
+			b.excess = sum - b.target
+			if b.excess == 0 {
+				b.tries = 0
+			}
+		}
+		return
+	}
+	if index == len(b.values) || sum+b.remaining[index] < b.target {
+		return
+	}
+	b.selected[index] = true
+	b.search(index+1, sum+b.values[index])
+	b.selected[index] = false
+	next := index + 1
+	for next < len(b.values) && b.values[next] == b.values[index] {
+		next++
+	}
+	b.search(next, sum)
+}
+
+// branchAndBound searches for the coins worth at least target and at most
+// costOfChange more, which pay without a change output. It returns the
+// indexes of those closest to target, or nil. values are what the coins
+// are worth once the fee of spending them is paid.
+func branchAndBound(values []int, target int, costOfChange int) []int {
+	indexes := sortedCoins(values)
+	b := bnbSearch{values: make([]int, len(indexes)),
+		remaining: make([]int, len(indexes)+1), target: target,
+		upper: target + costOfChange, tries: BNB_TRIES,
+		selected: make([]bool, len(indexes))}
+	for i, index := range indexes {
+		b.values[i] = values[index]
+	}
+	for i := len(indexes) - 1; i >= 0; i-- {
+		b.remaining[i] = b.remaining[i+1] + b.values[i]
+	}
+	b.search(0, 0)
+	if b.best == nil {
+		return nil
+	}
+	selected := []int{}
+	for i, ok := range b.best {
+		if ok {
+			selected = append(selected, indexes[i])
+		}
+	}
+	return selected
+}
+
+// knapsack picks coins for a payment with change the way Bitcoin Core's
+// knapsack solver does: a coin worth exactly target, all smaller coins if
+// they add up to it, or the better of the smallest larger coin and the
+// closest random subset of the smaller coins, preferably one leaving at
+// least minChange more.
+func knapsack(values []int, target int, minChange int,
+	rng *rand.Rand) ([]int, error) {
+	if target <= 0 {
+		return []int{}, nil
+	}
+	indexes := sortedCoins(values)
+	// ties are broken at random
+	rng.Shuffle(len(indexes), func(i, j int) {
+		indexes[i], indexes[j] = indexes[j], indexes[i]
+	})
+	lower := []int{}
+	lowerTotal := 0
+	larger := -1
+	for _, index := range indexes {
+		value := values[index]
+		if value == target {
+			return []int{index}, nil
+		}
+		if value < target+minChange {
+			lower = append(lower, index)
+			lowerTotal += value
+		} else if larger < 0 || value < values[larger] {
+			larger = index
+		}
+	}
+	if lowerTotal == target {
+		return lower, nil
+	}
+	if lowerTotal < target {
+		if larger < 0 {
+			return nil, ErrInsufficientFunds
+		}
+		return []int{larger}, nil
+	}
+
+	sort.SliceStable(lower, func(i, j int) bool {
+		return values[lower[i]] > values[lower[j]]
+	})
+	lowerValues := make([]int, len(lower))
+	for i, index := range lower {
+		lowerValues[i] = values[index]
+	}
+	best, bestValue := bestSubset(lowerValues, lowerTotal, target, rng)
+	if bestValue != target && lowerTotal >= target+minChange {
+		best, bestValue = bestSubset(lowerValues, lowerTotal,
+			target+minChange, rng)
+	}
+	if larger >= 0 && (bestValue != target &&
+		bestValue < target+minChange || values[larger] <= bestValue) {
+		return []int{larger}, nil
+	}
+	selected := []int{}
+	for i, ok := range best {
+		if ok {
+			selected = append(selected, lower[i])
+		}
+	}
+	return selected, nil
+}
+
+// bestSubset approximates the subset of values, sorted descending and
+// adding up to total, closest to target without falling short. Each try
+// includes random values, then the rest in order, and leaves out every
+// value that reaches target to look for a closer one.
+func bestSubset(values []int, total int, target int,
+	rng *rand.Rand) ([]bool, int) {
+	best := make([]bool, len(values))
+	for i := range best {
+		best[i] = true
+	}
+	bestValue := total
+	included := make([]bool, len(values))
+	for try := 0; try < KNAPSACK_ITERATIONS && bestValue != target; try++ {
+		for i := range included {
+			included[i] = false
+		}
+		sum := 0
+		reached := false
+		for pass := 0; pass < 2 && !reached; pass++ {
+			for i, value := range values {
+				if pass == 0 && rng.Intn(2) == 0 ||
+					pass == 1 && included[i] {
+					continue
+				}
+				sum += value
+				included[i] = true
+				if sum >= target {
+					reached = true
+					if sum < bestValue {
+						bestValue = sum
+						copy(best, included)
+					}
+					sum -= value
+					included[i] = false
+				}
+			}
+		}
+	}
+	return best, bestValue
+}
@@ -0,0 +1,76 @@
+package wallet
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func sum(values []int, selected []int) int {
+	total := 0
+	for _, index := range selected {
+		total += values[index]
+	}
+	return total
+}
+
+func TestBranchAndBound(t *testing.T) {
+	for _, test := range []struct {
+		values       []int
+		target       int
+		costOfChange int
+		selected     []int
+	}{
+		// exact matches
+		{[]int{1, 2, 3, 4}, 6, 0, []int{1, 3}},
+		{[]int{10, 7, 5, 3}, 12, 0, []int{1, 2}},
+		// the least excess within the cost of change
+		{[]int{10, 7, 5}, 9, 2, []int{0}},
+		{[]int{9, 4, 4}, 8, 1, []int{1, 2}},
+		// none without change
+		{[]int{10, 7}, 11, 2, nil},
+		{[]int{1, 1}, 3, 5, nil},
+		// worthless coins are never picked
+		{[]int{-1, 0, 5}, 5, 0, []int{2}},
+	} {
+		selected := branchAndBound(test.values, test.target,
+			test.costOfChange)
+		sort.Ints(selected)
+		assert.Equal(t, test.selected, selected, "%v", test)
+	}
+}
+
+func TestBranchAndBoundTries(t *testing.T) {
+	// many equal coins and an unreachable target end the search early
+	values := make([]int, 200)
+	for i := range values {
+		values[i] = 2
+	}
+	assert.Nil(t, branchAndBound(values, 101, 0))
+}
+
+func TestKnapsack(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, test := range []struct {
+		values []int
+		target int
+		total  int
+		err    error
+	}{
+		// a coin worth exactly the target
+		{[]int{3, 7, 12}, 7, 7, nil},
+		// all smaller coins add up to it
+		{[]int{2, 3, 20}, 5, 5, nil},
+		// the smallest larger coin
+		{[]int{1, 2, 9, 30}, 8, 9, nil},
+		// a subset of the smaller coins leaving change
+		{[]int{4, 4, 4, 4, 50}, 11, 12, nil},
+		{[]int{}, 1, 0, ErrInsufficientFunds},
+		{[]int{2, 3}, 6, 0, ErrInsufficientFunds},
+	} {
+		selected, err := knapsack(test.values, test.target, 1, rng)
+		assert.Equal(t, test.err, err, "%v", test)
+		assert.Equal(t, test.total, sum(test.values, selected), "%v", test)
+	}
+}
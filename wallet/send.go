@@ -0,0 +1,242 @@
+package wallet
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"golang.org/x/crypto/ed25519"
+	mathrand "math/rand"
+)
+
+const (
+	// DEFAULT_FEE_RATE is the fee paid per 1000 bytes of transaction.
+	DEFAULT_FEE_RATE = 1
+	// SIGNATURE_SIZE is the size of an input's signature, the hash type
+	// included.
+	SIGNATURE_SIZE = ed25519.SignatureSize + 1
+)
+
+var (
+	ErrInvalidAmount  = errors.New("Amounts have to be positive")
+	ErrInvalidFeeRate = errors.New("Fee rate can't be negative")
+	ErrNoPayments     = errors.New("Transaction pays nobody")
+	ErrSpentMismatch  = errors.New("Spent outputs don't match the inputs")
+)
+
+// Fee returns the fee of size bytes at feeRate, rounded up.
+func Fee(size int, feeRate int) int {
+	return (size*feeRate + 999) / 1000
+}
+
+// EstimateSize returns the size of transaction once every input is signed.
+func EstimateSize(transaction blockchain.Transaction) (int, error) {
+	inputs := make([]blockchain.Input, len(transaction.Inputs))
+	for i, input := range transaction.Inputs {
+		inputs[i] = input
+		if len(input.Signature) < SIGNATURE_SIZE {
+			inputs[i].Signature = make([]byte, SIGNATURE_SIZE)
+		}
+	}
+	transaction.Inputs = inputs
+	data, err := transaction.Encode()
+	return len(data), err
+}
+
+// sizes returns the size of a transaction with payments and no inputs, and
+// how much an input spending a key and a change output add to it.
+func sizes(payments []blockchain.Output) (int, int, int, error) {
+	transaction := blockchain.Transaction{[]byte{}, []blockchain.Input{},
+		payments, 0}
+	base, err := EstimateSize(transaction)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	transaction.Inputs = []blockchain.Input{
+		blockchain.Input{[]byte{}, make([]byte, 32), 0, nil, 0}}
+	withInput, err := EstimateSize(transaction)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	transaction.Outputs = append(append([]blockchain.Output{}, payments...),
+		blockchain.Output{make([]byte, ed25519.PublicKeySize), 0,
+			[]byte{}})
+	withChange, err := EstimateSize(transaction)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return base, withInput - base, withChange - withInput, nil
+}
+
+func newRand() *mathrand.Rand {
+	var seed [8]byte
+	rand.Read(seed[:])
+	return mathrand.New(mathrand.NewSource(
+		int64(binary.BigEndian.Uint64(seed[:]))))
+}
+
+// NewTransaction pays payments from coins and signs every input, see
+// BuildTransaction. The keystore has to be unlocked.
+func (k *Keystore) NewTransaction(coins []Coin, payments []blockchain.Output,
+	feeRate int) (blockchain.Transaction, error) {
+	transaction, spent, err := k.buildTransaction(coins, payments, feeRate,
+		newRand())
+	if err != nil {
+		return transaction, err
+	}
+	return transaction, k.signCoins(&transaction, spent)
+}
+
+// BuildTransaction pays payments from coins without signing. Each byte
+// pays feeRate per 1000 bytes, see Fee. What the coins picked are worth
+// beyond the payments and the fee goes to a change output, unless the
+// change wouldn't pay for the output and for spending it later, then it's
+// left to the fee. The change goes to a fresh HD change address of account
+// 0 if the wallet has a seed, which needs the keystore unlocked, and back
+// to the key of the first coin otherwise. It returns the transaction with
+// its hash and the coins its inputs spend.
+func (k *Keystore) BuildTransaction(coins []Coin,
+	payments []blockchain.Output,
+	feeRate int) (blockchain.Transaction, []Coin, error) {
+	return k.buildTransaction(coins, payments, feeRate, newRand())
+}
+
+func (k *Keystore) buildTransaction(coins []Coin,
+	payments []blockchain.Output, feeRate int,
+	rng *mathrand.Rand) (blockchain.Transaction, []Coin, error) {
+	var transaction blockchain.Transaction
+	if feeRate < 0 {
+		return transaction, nil, ErrInvalidFeeRate
+	}
+	if len(payments) == 0 {
+		return transaction, nil, ErrNoPayments
+	}
+	total := 0
+	for _, payment := range payments {
+		if payment.Amount <= 0 {
+			return transaction, nil, ErrInvalidAmount
+		}
+		total += payment.Amount
+	}
+	for _, coin := range coins {
+		if coin.Amount <= 0 {
+			return transaction, nil, ErrInvalidAmount
+		}
+	}
+
+	baseSize, inputSize, changeSize, err := sizes(payments)
+	if err != nil {
+		return transaction, nil, err
+	}
+	// values are in thousandths so the fees of the parts add up to the
+	// fee of the whole
+	values := make([]int, len(coins))
+	for i, coin := range coins {
+		values[i] = coin.Amount*1000 - inputSize*feeRate
+	}
+	target := total*1000 + baseSize*feeRate
+	// the change output and the input spending it later
+	costOfChange := (changeSize + inputSize) * feeRate
+	selected := branchAndBound(values, target, costOfChange)
+	if selected == nil {
+		selected, err = knapsack(values, target+changeSize*feeRate,
+			MIN_CHANGE*1000, rng)
+		if err != nil {
+			return transaction, nil, err
+		}
+	}
+
+	inputs := make([]blockchain.Input, len(selected))
+	spent := make([]Coin, len(selected))
+	value := 0
+	for i, index := range selected {
+		spent[i] = coins[index]
+		inputs[i] = blockchain.Input{[]byte{}, coins[index].TransactionHash,
+			coins[index].OutputID, nil, 0}
+		value += coins[index].Amount
+	}
+	outputs := append([]blockchain.Output{}, payments...)
+	size := baseSize + len(inputs)*inputSize + changeSize
+	change := value - total - Fee(size, feeRate)
+	if change > Fee(inputSize, feeRate) {
+		changeKey, err := k.changeKey(spent[0])
+		if err != nil {
+			return transaction, nil, err
+		}
+		outputs = append(outputs,
+			blockchain.Output{changeKey, change, []byte{}})
+	}
+
+	transaction = blockchain.Transaction{[]byte{}, inputs, outputs, 0}
+	transaction.Hash, err = transaction.GetHash()
+	return transaction, spent, err
+}
+
+// changeKey returns the key change is paid to.
+func (k *Keystore) changeKey(first Coin) (ed25519.PublicKey, error) {
+	if !k.HasSeed() {
+		return first.PublicKey, nil
+	}
+	_, publicKey, err := k.NewChangeAddress(0)
+	return publicKey, err
+}
+
+// signCoins signs the inputs of transaction, which spend coins.
+func (k *Keystore) signCoins(transaction *blockchain.Transaction,
+	coins []Coin) error {
+	for i, coin := range coins {
+		privateKey, err := k.PrivateKey(coin.Key)
+		if err != nil {
+			return err
+		}
+		err = transaction.Sign(privateKey, i, coin.Output(),
+			blockchain.SIGHASH_ALL)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SignTransaction signs the inputs of transaction spending outputs locked
+// to keys of the wallet, spent holds the output each input spends. It
+// returns how many it signed.
+func (k *Keystore) SignTransaction(transaction *blockchain.Transaction,
+	spent []blockchain.Output) (int, error) {
+	if len(spent) != len(transaction.Inputs) {
+		return 0, ErrSpentMismatch
+	}
+	signed := 0
+	for i, output := range spent {
+		if len(output.Script) > 0 {
+			continue
+		}
+		name, err := k.KeyName(output.PublicKey)
+		if err == ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return signed, err
+		}
+		privateKey, err := k.PrivateKey(name)
+		if err != nil {
+			return signed, err
+		}
+		err = transaction.Sign(privateKey, i, output, blockchain.SIGHASH_ALL)
+		if err != nil {
+			return signed, err
+		}
+		signed++
+	}
+	return signed, nil
+}
+
+// Pay pays payments from the wallet's coins on the node at feeRate. The
+// transaction returned is signed but not sent, see Client.PutTransaction.
+func (k *Keystore) Pay(c *Client, payments []blockchain.Output,
+	feeRate int) (blockchain.Transaction, error) {
+	coins, err := k.Coins(c)
+	if err != nil {
+		return blockchain.Transaction{}, err
+	}
+	return k.NewTransaction(coins, payments, feeRate)
+}
@@ -0,0 +1,277 @@
+package wallet
+
+import (
+	"encoding/json"
+	"github.com/InitialShape/cryptocurrency/address"
+	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/web"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeNode serves the outputs of addresses and a mempool.
+type fakeNode struct {
+	params  blockchain.ChainParams
+	outputs map[string][]blockchain.AddressOutput
+	mempool []blockchain.Transaction
+}
+
+func (n *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/params":
+		json.NewEncoder(w).Encode(n.params)
+	case strings.HasPrefix(r.URL.Path, "/addresses/"):
+		text := strings.TrimPrefix(r.URL.Path, "/addresses/")
+		json.NewEncoder(w).Encode(web.AddressOutputs{Address: text,
+			Outputs: n.outputs[text]})
+	case r.URL.Path == "/mempool/transactions" && r.Method == "GET":
+		json.NewEncoder(w).Encode(n.mempool)
+	case r.URL.Path == "/mempool/transactions" && r.Method == "PUT":
+		var transaction blockchain.Transaction
+		json.NewDecoder(r.Body).Decode(&transaction)
+		n.mempool = append(n.mempool, transaction)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(web.TransactionID{Hash: "hash"})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(web.Error{Error: "Not found"})
+	}
+}
+
+func (n *fakeNode) pay(t *testing.T, publicKey ed25519.PublicKey,
+	hash string, amounts ...int) {
+	text, err := address.Encode(n.params.AddressPrefix, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, amount := range amounts {
+		n.outputs[text] = append(n.outputs[text], blockchain.AddressOutput{
+			[]byte(hash), id, amount, 1, nil})
+	}
+}
+
+func newFakeNode(t *testing.T) *fakeNode {
+	params, err := blockchain.ParamsForNetwork("regtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeNode{*params,
+		make(map[string][]blockchain.AddressOutput), nil}
+}
+
+func TestCoins(t *testing.T) {
+	path, cleanup := tempWallet(t)
+	defer cleanup()
+	k, err := Create(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := k.Generate("first")
+	assert.NoError(t, err)
+	second, err := k.Generate("second")
+	assert.NoError(t, err)
+
+	node := newFakeNode(t)
+	node.pay(t, first, "a", 5, 7)
+	node.pay(t, second, "b", 9)
+	text, err := address.Encode(node.params.AddressPrefix, second)
+	assert.NoError(t, err)
+	node.outputs[text][0].SpentBy = []byte("c")
+	node.pay(t, second, "d", 3)
+	// spent by a transaction that isn't mined yet
+	node.mempool = []blockchain.Transaction{{Inputs: []blockchain.Input{
+		{TransactionHash: []byte("a"), OutputID: 1}}}}
+	server := httptest.NewServer(node)
+	defer server.Close()
+
+	coins, err := k.Coins(NewClient(server.URL))
+	assert.NoError(t, err)
+	assert.Equal(t, []Coin{{[]byte("a"), 0, 5, 1, "first", first},
+		{[]byte("d"), 0, 3, 1, "second", second}}, coins)
+
+	_, err = k.Coins(NewClient(server.URL + "/nothing"))
+	assert.Equal(t, "Not found", err.Error())
+}
+
+// checkTransaction checks that transaction spends coins with valid
+// signatures and returns its fee.
+func checkTransaction(t *testing.T, transaction blockchain.Transaction,
+	coins []Coin) int {
+	assert.NoError(t, transaction.CheckHash())
+	fee := 0
+	for i, input := range transaction.Inputs {
+		for _, coin := range coins {
+			if string(coin.TransactionHash) == string(input.TransactionHash) &&
+				coin.OutputID == input.OutputID {
+				ok, err := transaction.Verify(coin.Output(), i)
+				assert.NoError(t, err)
+				assert.True(t, ok)
+				fee += coin.Amount
+			}
+		}
+	}
+	for _, output := range transaction.Outputs {
+		fee -= output.Amount
+	}
+	return fee
+}
+
+func TestNewTransaction(t *testing.T) {
+	path, cleanup := tempWallet(t)
+	defer cleanup()
+	k, err := Create(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := k.Generate("default")
+	assert.NoError(t, err)
+	payee := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	payee[0] = 1
+
+	coins := []Coin{}
+	for i, amount := range []int{25, 25, 10, 4} {
+		coins = append(coins, Coin{[]byte{byte(i)}, 0, amount, 1,
+			"default", publicKey})
+	}
+	rng := rand.New(rand.NewSource(1))
+	for _, test := range []struct {
+		amount  int
+		feeRate int
+		inputs  int
+		change  int
+		fee     int
+		err     error
+	}{
+		// no change if the coins pay exactly
+		{35, 0, 2, 0, 0, nil},
+		// change back to the key of the coins
+		{30, 0, 2, 5, 0, nil},
+		{15, 10, 1, 7, 3, nil},
+		// change that doesn't pay for spending it goes to the fee
+		{30, 10, 2, 0, 5, nil},
+		// as does an excess within the cost of change
+		{20, 100, 2, 0, 30, nil},
+		{64, 0, 4, 0, 0, nil},
+		{64, 10, 0, 0, 0, ErrInsufficientFunds},
+		{0, 1, 0, 0, 0, ErrInvalidAmount},
+		{1, -1, 0, 0, 0, ErrInvalidFeeRate},
+	} {
+		payments := []blockchain.Output{{payee, test.amount, []byte{}}}
+		transaction, spent, err := k.buildTransaction(coins, payments,
+			test.feeRate, rng)
+		assert.Equal(t, test.err, err, "%v", test)
+		if err != nil {
+			continue
+		}
+		assert.NoError(t, k.signCoins(&transaction, spent))
+		assert.Len(t, transaction.Inputs, test.inputs, "%v", test)
+		assert.Equal(t, payments[0], transaction.Outputs[0])
+		fee := checkTransaction(t, transaction, coins)
+		size, err := EstimateSize(transaction)
+		assert.NoError(t, err)
+		assert.True(t, fee >= Fee(size, test.feeRate), "%v", test)
+		assert.Equal(t, test.fee, fee, "%v", test)
+		if test.change > 0 {
+			assert.Equal(t, []blockchain.Output{payments[0],
+				{publicKey, test.change, []byte{}}}, transaction.Outputs)
+		} else {
+			assert.Len(t, transaction.Outputs, 1, "%v", test)
+		}
+	}
+
+	k.Lock()
+	_, err = k.NewTransaction(coins, []blockchain.Output{{payee, 1,
+		[]byte{}}}, 0)
+	assert.Equal(t, ErrLocked, err)
+}
+
+func TestSignTransaction(t *testing.T) {
+	path, cleanup := tempWallet(t)
+	defer cleanup()
+	k, err := Create(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := k.Generate("default")
+	assert.NoError(t, err)
+	name, err := k.KeyName(publicKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "default", name)
+	other := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	_, err = k.KeyName(other)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// only the input spending the wallet's key is signed
+	spent := []blockchain.Output{{other, 5, []byte{}},
+		{publicKey, 7, []byte{}}, {nil, 3, []byte{1}}}
+	transaction := blockchain.Transaction{[]byte{}, []blockchain.Input{
+		{[]byte{}, []byte("a"), 0, nil, 0},
+		{[]byte{}, []byte("a"), 1, nil, 0},
+		{[]byte{}, []byte("a"), 2, nil, 0}},
+		[]blockchain.Output{{other, 15, []byte{}}}, 0}
+	transaction.Hash, err = transaction.GetHash()
+	assert.NoError(t, err)
+	signed, err := k.SignTransaction(&transaction, spent)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, signed)
+	assert.Empty(t, transaction.Inputs[0].Signature)
+	ok, err := transaction.Verify(spent[1], 1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	_, err = k.SignTransaction(&transaction, spent[:2])
+	assert.Equal(t, ErrSpentMismatch, err)
+	k.Lock()
+	_, err = k.SignTransaction(&transaction, spent)
+	assert.Equal(t, ErrLocked, err)
+}
+
+func TestPay(t *testing.T) {
+	path, cleanup := tempWallet(t)
+	defer cleanup()
+	k, err := Create(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, k.SetMnemonic(testMnemonic, ""))
+	_, publicKey, err := k.NewReceiveAddress(0)
+	assert.NoError(t, err)
+	node := newFakeNode(t)
+	node.pay(t, publicKey, "a", 25, 25)
+	server := httptest.NewServer(node)
+	defer server.Close()
+	client := NewClient(server.URL)
+
+	payee := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	payments := []blockchain.Output{{payee, 30, []byte{}}}
+	transaction, err := k.Pay(client, payments, DEFAULT_FEE_RATE)
+	assert.NoError(t, err)
+	coins, err := k.Coins(client)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, checkTransaction(t, transaction, coins))
+
+	// the change goes to a new HD change key
+	changeKey := DeriveKey(mustSeed(t), KeyPath(0, INTERNAL, 0)...)
+	assert.Len(t, transaction.Outputs, 2)
+	assert.Equal(t, changeKey.Public(), transaction.Outputs[1].PublicKey)
+	assert.Equal(t, []Account{{0, 1, 1}}, k.Accounts())
+
+	_, err = client.PutTransaction(transaction)
+	assert.NoError(t, err)
+	// its coins are spent by the mempool now
+	_, err = k.Pay(client, payments, DEFAULT_FEE_RATE)
+	assert.Equal(t, ErrInsufficientFunds, err)
+}
+
+func mustSeed(t *testing.T) []byte {
+	seed, err := MnemonicSeed(testMnemonic, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seed
+}
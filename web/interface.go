@@ -1,153 +1,333 @@
 package web
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
+	"github.com/InitialShape/cryptocurrency/address"
 	"github.com/InitialShape/cryptocurrency/blockchain"
+	"github.com/InitialShape/cryptocurrency/miner"
 	"github.com/gorilla/mux"
 	"github.com/mr-tron/base58/base58"
-	cbor "github.com/whyrusleeping/cbor/go"
+	"golang.org/x/crypto/ed25519"
 	"log"
 	"net/http"
+	"strconv"
 )
 
-var Store blockchain.Store
+const (
+	DEFAULT_PAGE_LIMIT = 100
+	MAX_PAGE_LIMIT     = 1000
+	// MAX_GENERATE_COUNT bounds the blocks generated by one request, which
+	// hold the store until they're all mined.
+	MAX_GENERATE_COUNT = 1000
+)
+
+var (
+	ErrInvalidHash         = errors.New("Couldn't decode base58 hash")
+	ErrInvalidCount        = errors.New("Invalid block count")
+	ErrInvalidHeight       = errors.New("Invalid block height")
+	ErrInvalidRange        = errors.New("Invalid block range")
+	ErrGenerateNotAllowed  = errors.New("Block generation not allowed on this network")
+	ErrNoCoinbaseKey       = errors.New("No wallet key to pay generated blocks to")
+	ErrInvalidJSON         = errors.New("Couldn't decode JSON body")
+	ErrInvalidAddress      = errors.New("Invalid address of this network")
+	ErrInternalServerError = errors.New("Internal server error")
+)
+
+// API serves the HTTP interface of a single node. Generated blocks pay
+// their coinbase to Coinbase.
+type API struct {
+	Store    blockchain.Store
+	Coinbase ed25519.PrivateKey
+}
+
+// Error is the JSON body of every failed request. Reason is set when a block
+// or transaction was rejected.
+type Error struct {
+	Error  string            `json:"error"`
+	Reason blockchain.Reason `json:"reason,omitempty"`
+}
+
+// AddressOutputs is the body of an address: the confirmed outputs paid to
+// it and the sum of the unspent ones.
+type AddressOutputs struct {
+	Address string                     `json:"address"`
+	Balance int                        `json:"balance"`
+	Outputs []blockchain.AddressOutput `json:"outputs"`
+}
 
-func Handlers(store blockchain.Store) *mux.Router {
-	Store = store
+// TransactionID is the body of an accepted transaction: the ID the node
+// derived and the witness hash, which covers the signatures too.
+type TransactionID struct {
+	Hash        string `json:"hash"`
+	WitnessHash string `json:"witness_hash"`
+}
+
+func Handlers(store blockchain.Store,
+	coinbase ed25519.PrivateKey) *mux.Router {
+	api := &API{Store: store, Coinbase: coinbase}
 	r := mux.NewRouter()
-	r.HandleFunc("/blocks/{hash}", GetBlock).Methods("GET")
-	r.HandleFunc("/blocks", PutBlock).Methods("PUT")
-	r.HandleFunc("/mempool/transactions", PutTransaction).Methods("PUT")
-	r.HandleFunc("/mempool/transactions", GetTransactions).Methods("GET")
-	r.HandleFunc("/mempool/transactions/{hash}", GetTransaction).Methods("GET")
-	r.HandleFunc("/root", GetRootBlock).Methods("GET")
+	r.HandleFunc("/blocks/height/{height}", api.GetBlockByHeight).Methods("GET")
+	r.HandleFunc("/blocks/{hash}", api.GetBlock).Methods("GET")
+	r.HandleFunc("/blocks", api.GetBlocks).Methods("GET")
+	r.HandleFunc("/blocks", api.PutBlock).Methods("PUT")
+	r.HandleFunc("/mempool/transactions", api.PutTransaction).Methods("PUT")
+	r.HandleFunc("/mempool/transactions", api.GetTransactions).Methods("GET")
+	r.HandleFunc("/mempool/transactions/{hash}", api.GetTransaction).Methods("GET")
+	r.HandleFunc("/root", api.GetRootBlock).Methods("GET")
+	r.HandleFunc("/params", api.GetParams).Methods("GET")
+	r.HandleFunc("/template", api.GetTemplate).Methods("GET")
+	r.HandleFunc("/addresses/{address}", api.GetAddress).Methods("GET")
+	r.HandleFunc("/generate/{count}", api.GenerateBlocks).Methods("POST")
 	return r
 }
 
-func GetTransactions(w http.ResponseWriter, r *http.Request) {
-	transactions, err := Store.GetTransactions()
-	if err != nil && err.Error() == "Bucket access error" {
-		json.NewEncoder(w).Encode([]blockchain.Transaction{})
-	} else if err == nil {
-		json.NewEncoder(w).Encode(transactions)
-	} else {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - couldn't get transactions"))
+// StatusCode maps an error to the HTTP status it's reported with.
+func StatusCode(err error) int {
+	switch {
+	case err == blockchain.ErrNotFound:
+		return http.StatusNotFound
+	case err == blockchain.ErrPruned:
+		return http.StatusGone
+	case err == blockchain.ErrTransactionExists:
+		return http.StatusConflict
+	case err == ErrGenerateNotAllowed, err == ErrNoCoinbaseKey:
+		return http.StatusForbidden
+	case err == ErrInvalidHash, err == ErrInvalidCount, err == ErrInvalidJSON,
+		err == ErrInvalidHeight, err == ErrInvalidRange,
+		err == ErrInvalidAddress, blockchain.IsInvalid(err):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := StatusCode(err)
+	body := Error{Error: err.Error(), Reason: blockchain.ReasonOf(err)}
+	if status == http.StatusInternalServerError {
+		// internals are logged, but not handed out
+		log.Println(err)
+		body.Error = ErrInternalServerError.Error()
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
 }
 
-func GetTransaction(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
+func decodeHash(r *http.Request) ([]byte, error) {
+	hash, err := base58.Decode(mux.Vars(r)["hash"])
+	if err != nil || len(hash) == 0 {
+		return nil, ErrInvalidHash
+	}
+	return hash, nil
+}
 
-	hash, err := base58.Decode(params["hash"])
+func (a *API) GetTransactions(w http.ResponseWriter, r *http.Request) {
+	transactions, err := a.Store.GetTransactions()
 	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - Couldn't decode base58"))
+		writeError(w, err)
+		return
+	}
+	if transactions == nil {
+		transactions = []blockchain.Transaction{}
 	}
+	json.NewEncoder(w).Encode(transactions)
+}
 
-	transaction, err := Store.GetTransaction(hash, true)
+func (a *API) GetTransaction(w http.ResponseWriter, r *http.Request) {
+	hash, err := decodeHash(r)
 	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - couldn't get transaction"))
+		writeError(w, err)
+		return
+	}
+
+	transaction, err := a.Store.GetTransaction(hash, true)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
 	json.NewEncoder(w).Encode(transaction)
 }
 
-func GetBlock(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-
-	hash, err := base58.Decode(params["hash"])
+func (a *API) GetBlock(w http.ResponseWriter, r *http.Request) {
+	hash, err := decodeHash(r)
 	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - Couldn't decode base58"))
+		writeError(w, err)
+		return
 	}
 
-	data, err := Store.Get([]byte("blocks"), hash)
+	block, err := a.Store.GetBlock(hash)
 	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - couldn't get block"))
+		writeError(w, err)
+		return
 	}
+	json.NewEncoder(w).Encode(block)
+}
 
-	var block blockchain.Block
-	dec := cbor.NewDecoder(bytes.NewReader(data))
-	err = dec.Decode(&block)
-	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - couldn't unmarshal binary"))
+func (a *API) GetBlockByHeight(w http.ResponseWriter, r *http.Request) {
+	height, err := strconv.Atoi(mux.Vars(r)["height"])
+	if err != nil || height < 0 {
+		writeError(w, ErrInvalidHeight)
+		return
 	}
 
+	block, err := a.Store.BlockByHeight(height)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 	json.NewEncoder(w).Encode(block)
 }
 
-func GetRootBlock(w http.ResponseWriter, r *http.Request) {
-	hash, err := Store.Get([]byte("blocks"), []byte("root"))
-	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - couldn't get block"))
+// GetBlocks pages through the headers of the main chain, e.g.
+// /blocks?from=100&limit=50. The next page starts at the height following
+// the last header returned.
+func (a *API) GetBlocks(w http.ResponseWriter, r *http.Request) {
+	from, limit := 0, DEFAULT_PAGE_LIMIT
+	var err error
+	query := r.URL.Query()
+	if value := query.Get("from"); value != "" {
+		from, err = strconv.Atoi(value)
+		if err != nil || from < 0 {
+			writeError(w, ErrInvalidRange)
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > MAX_PAGE_LIMIT {
+			writeError(w, ErrInvalidRange)
+			return
+		}
 	}
 
-	blockData, err := Store.Get([]byte("blocks"), hash)
+	headers, err := a.Store.HeaderRange(from, from+limit-1)
 	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - couldn't get block"))
+		writeError(w, err)
+		return
 	}
+	json.NewEncoder(w).Encode(headers)
+}
 
-	var block blockchain.Block
-	dec := cbor.NewDecoder(bytes.NewReader(blockData))
-	err = dec.Decode(&block)
+func (a *API) GetRootBlock(w http.ResponseWriter, r *http.Request) {
+	block, err := a.Store.GetRoot()
 	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - couldn't unmarshal binary"))
+		writeError(w, err)
+		return
 	}
-
 	json.NewEncoder(w).Encode(block)
 }
 
-func PutBlock(w http.ResponseWriter, r *http.Request) {
-	dec := json.NewDecoder(r.Body)
+func (a *API) PutBlock(w http.ResponseWriter, r *http.Request) {
 	var block blockchain.Block
-	err := dec.Decode(&block)
+	err := blockchain.DecodeJSON(r.Body, &block)
 	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - couldn't decode block"))
+		writeError(w, ErrInvalidJSON)
+		return
 	}
-	err = Store.AddBlock(block)
+	err = a.Store.AddBlock(block)
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - block isn't valid"))
+		writeError(w, err)
+		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
 
-func PutTransaction(w http.ResponseWriter, r *http.Request) {
-	dec := json.NewDecoder(r.Body)
+func (a *API) PutTransaction(w http.ResponseWriter, r *http.Request) {
 	var transaction blockchain.Transaction
-	err := dec.Decode(&transaction)
+	err := blockchain.DecodeJSON(r.Body, &transaction)
 	if err != nil {
-		log.Fatal(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("500 - couldn't decode transaction"))
+		writeError(w, ErrInvalidJSON)
+		return
 	}
-	err = Store.AddTransaction(transaction)
+	err = a.Store.AddTransaction(transaction)
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(""))
+		writeError(w, err)
+		return
+	}
+	hash, err := transaction.GetHash()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	witnessHash, err := transaction.WitnessHash()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(TransactionID{base58.Encode(hash),
+		base58.Encode(witnessHash)})
+}
+
+func (a *API) GetParams(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(a.Store.Params)
+}
+
+// GetTemplate returns the template of the next block for external miners.
+func (a *API) GetTemplate(w http.ResponseWriter, r *http.Request) {
+	template, err := miner.NewTemplate(&a.Store)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(template)
+}
+
+// GetAddress returns the outputs paid to an address of the node's network.
+func (a *API) GetAddress(w http.ResponseWriter, r *http.Request) {
+	text := mux.Vars(r)["address"]
+	publicKey, err := address.Decode(text, a.Store.Params.AddressPrefix)
+	if err != nil {
+		writeError(w, ErrInvalidAddress)
+		return
+	}
+	outputs, err := a.Store.AddressOutputs(publicKey)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
+	body := AddressOutputs{Address: text, Outputs: outputs}
+	for _, output := range outputs {
+		if output.SpentBy == nil {
+			body.Balance += output.Amount
+		}
+	}
+	json.NewEncoder(w).Encode(body)
+}
 
+// GenerateBlocks mines the requested number of blocks right away. It's only
+// available on networks that allow it, i.e. regtest.
+func (a *API) GenerateBlocks(w http.ResponseWriter, r *http.Request) {
+	if !a.Store.Params.GenerateBlocks {
+		writeError(w, ErrGenerateNotAllowed)
+		return
+	}
+	if a.Coinbase == nil {
+		writeError(w, ErrNoCoinbaseKey)
+		return
+	}
+
+	params := mux.Vars(r)
+	count, err := strconv.Atoi(params["count"])
+	if err != nil || count < 1 || count > MAX_GENERATE_COUNT {
+		writeError(w, ErrInvalidCount)
+		return
+	}
+
+	blocks, err := miner.GenerateBlocks(&a.Store, a.Coinbase, count)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var hashes []string
+	for _, block := range blocks {
+		hashes = append(hashes, base58.Encode(block.Hash))
+	}
 	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hashes)
 }
@@ -2,20 +2,25 @@ package web
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/InitialShape/cryptocurrency/address"
 	"github.com/InitialShape/cryptocurrency/blockchain"
 	"github.com/InitialShape/cryptocurrency/miner"
+	"github.com/InitialShape/cryptocurrency/storage"
 	"github.com/mr-tron/base58/base58"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 )
 
-const DB = "/tmp/smthnew321"
-
 var (
 	server          *httptest.Server
 	blocksUrl       string
@@ -23,13 +28,25 @@ var (
 	rootUrl         string
 	store           blockchain.Store
 	peer            blockchain.Peer
+	coinbaseKey     ed25519.PrivateKey
 )
 
 func init() {
+	var err error
+	_, coinbaseKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
 	store = blockchain.Store{}
-	store.Open(DB, &peer)
-	peer = blockchain.Peer{"localhost", "1234", store}
-	server = httptest.NewServer(Handlers(store))
+	err = store.OpenDB(storage.NewMemory(),
+		storage.NewMemoryFiles(blockchain.BLOCK_FILE_SIZE), &peer,
+		&blockchain.RegTestParams)
+	if err != nil {
+		log.Fatal(err)
+	}
+	peer = blockchain.Peer{ListenAddress: "localhost:1234",
+		AdvertiseAddress: "localhost:1234", Store: store}
+	server = httptest.NewServer(Handlers(store, coinbaseKey))
 
 	blocksUrl = fmt.Sprintf("%s/blocks", server.URL)
 	transactionsUrl = fmt.Sprintf("%s/mempool/transactions", server.URL)
@@ -38,9 +55,10 @@ func init() {
 
 func TestPutTransaction(t *testing.T) {
 	publicKey, _ := base58.Decode("6zjRZQyp47BjwArFoLpvzo8SHwwWeW571kJNiqWfSrFT")
-	outputs := []blockchain.Output{blockchain.Output{publicKey, 10}}
-	inputs := []blockchain.Input{blockchain.Input{[]byte{}, []byte{}, 0}}
-	transaction := blockchain.Transaction{[]byte{}, inputs, outputs}
+	outputs := []blockchain.Output{blockchain.Output{publicKey, 10, []byte{}}}
+	inputs := []blockchain.Input{
+		blockchain.Input{[]byte{}, []byte{}, 0, nil, 0}}
+	transaction := blockchain.Transaction{[]byte{}, inputs, outputs, 0}
 	hash, err := transaction.GetHash()
 	if err != nil {
 		t.Error(err)
@@ -64,13 +82,61 @@ func TestPutTransaction(t *testing.T) {
 	if res.StatusCode != 201 {
 		t.Errorf("Expected status code 201 but got %d", res.StatusCode)
 	}
+	var id TransactionID
+	err = json.NewDecoder(res.Body).Decode(&id)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, base58.Encode(hash), id.Hash)
+	assert.NotEmpty(t, id.WitnessHash)
+}
+
+func TestPutTransactionWithoutHash(t *testing.T) {
+	publicKey, _ := base58.Decode("6zjRZQyp47BjwArFoLpvzo8SHwwWeW571kJNiqWfSrFT")
+	outputs := []blockchain.Output{blockchain.Output{publicKey, 11, []byte{}}}
+	inputs := []blockchain.Input{
+		blockchain.Input{[]byte{}, []byte{}, 0, nil, 0}}
+	transaction := blockchain.Transaction{[]byte{}, inputs, outputs, 0}
+
+	req, err := http.NewRequest(http.MethodPut, transactionsUrl,
+		bytes.NewReader(mustJSON(t, transaction)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id TransactionID
+	err = json.NewDecoder(res.Body).Decode(&id)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+
+	// the node derived the ID
+	hash, err := transaction.GetBase58Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, hash, id.Hash)
+	stored, err := store.GetTransaction(base58Decode(t, id.Hash), true)
+	assert.NoError(t, err)
+	assert.Equal(t, base58Decode(t, id.Hash), stored.Hash)
+}
+
+func base58Decode(t *testing.T, s string) []byte {
+	data, err := base58.Decode(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
 }
 
 func TestGetTransactions(t *testing.T) {
 	publicKey, _ := base58.Decode("6zjRZQyp47BjwArFoLpvzo8SHwwWeW571kJNiqWfSrFT")
-	outputs := []blockchain.Output{blockchain.Output{publicKey, 10}}
-	inputs := []blockchain.Input{blockchain.Input{[]byte{}, []byte{}, 0}}
-	transaction := blockchain.Transaction{[]byte{}, inputs, outputs}
+	outputs := []blockchain.Output{blockchain.Output{publicKey, 10, []byte{}}}
+	inputs := []blockchain.Input{
+		blockchain.Input{[]byte{}, []byte{}, 0, nil, 0}}
+	transaction := blockchain.Transaction{[]byte{}, inputs, outputs, 0}
 	hash, err := transaction.GetHash()
 	if err != nil {
 		t.Error(err)
@@ -117,9 +183,10 @@ func TestGetTransactions(t *testing.T) {
 
 func TestGetTransaction(t *testing.T) {
 	publicKey, _ := base58.Decode("6zjRZQyp47BjwArFoLpvzo8SHwwWeW571kJNiqWfSrFT")
-	outputs := []blockchain.Output{blockchain.Output{publicKey, 10}}
-	inputs := []blockchain.Input{blockchain.Input{[]byte{}, []byte{}, 0}}
-	transaction := blockchain.Transaction{[]byte{}, inputs, outputs}
+	outputs := []blockchain.Output{blockchain.Output{publicKey, 10, []byte{}}}
+	inputs := []blockchain.Input{
+		blockchain.Input{[]byte{}, []byte{}, 0, nil, 0}}
+	transaction := blockchain.Transaction{[]byte{}, inputs, outputs, 0}
 	hash, err := transaction.GetHash()
 	if err != nil {
 		t.Error(err)
@@ -171,15 +238,15 @@ func TestGetTransaction(t *testing.T) {
 }
 
 func TestPutBlock(t *testing.T) {
-	genesis, err := store.StoreGenesisBlock(5)
+	genesis := store.Params.GenesisBlock
+
+	newBlock, err := miner.SearchBlock(context.Background(), coinbaseKey, 1,
+		genesis.Difficulty, store.Params.CoinbaseAmount, genesis.Hash,
+		genesis.Timestamp+1, nil)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	ch := make(chan blockchain.Block)
-	go miner.SearchBlock(2, 5, genesis.Hash, nil, ch)
-	newBlock := <-ch
-
 	newBlockJSON, err := json.Marshal(newBlock)
 	if err != nil {
 		t.Error(err)
@@ -221,3 +288,286 @@ func TestPutBlock(t *testing.T) {
 
 	assert.Equal(t, newBlock, root)
 }
+
+func TestGetParams(t *testing.T) {
+	res, err := http.Get(fmt.Sprintf("%s/params", server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params blockchain.ChainParams
+	err = json.NewDecoder(res.Body).Decode(&params)
+	if err != nil {
+		t.Error(err)
+	}
+
+	assert.Equal(t, blockchain.RegTestParams, params)
+}
+
+func TestGenerateBlocks(t *testing.T) {
+	root, err := store.GetRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Post(fmt.Sprintf("%s/generate/3", server.URL), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 201 {
+		t.Errorf("Expected status code 201 but got %d", res.StatusCode)
+	}
+	var hashes []string
+	err = json.NewDecoder(res.Body).Decode(&hashes)
+	if err != nil {
+		t.Error(err)
+	}
+	if !assert.Len(t, hashes, 3) {
+		return
+	}
+
+	newRoot, err := store.GetRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, root.Height+3, newRoot.Height)
+	assert.Equal(t, hashes[2], base58.Encode(newRoot.Hash))
+}
+
+func TestErrorResponses(t *testing.T) {
+	forged := blockchain.RegTestParams.GenesisBlock.Transactions[0]
+	forged.Hash = []byte("forged")
+
+	var cases = []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		reason blockchain.Reason
+	}{
+		{"malformed block", http.MethodPut, "/blocks", "{", 400, ""},
+		{"malformed transaction", http.MethodPut, "/mempool/transactions",
+			"[]", 400, ""},
+		{"forged transaction hash", http.MethodPut, "/mempool/transactions",
+			string(mustJSON(t, forged)), 400, blockchain.REASON_INVALID_HASH},
+		{"genesis block", http.MethodPut, "/blocks",
+			string(mustJSON(t, blockchain.RegTestParams.GenesisBlock)), 400,
+			blockchain.REASON_GENESIS_EXISTS},
+		{"invalid hash", http.MethodGet, "/blocks/0OIl", "", 400, ""},
+		{"unknown block", http.MethodGet, "/blocks/" +
+			base58.Encode([]byte("unknown")), "", 404, ""},
+		{"unknown transaction", http.MethodGet, "/mempool/transactions/" +
+			base58.Encode([]byte("unknown")), "", 404, ""},
+		{"invalid count", http.MethodPost, "/generate/none", "", 400, ""},
+		{"too many blocks", http.MethodPost, "/generate/1001", "", 400, ""},
+	}
+
+	client := &http.Client{}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, server.URL+c.path,
+			bytes.NewReader([]byte(c.body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body Error
+		err = json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+		if err != nil {
+			t.Error(c.name, err)
+		}
+		assert.Equal(t, c.status, res.StatusCode, c.name)
+		assert.NotEmpty(t, body.Error, c.name)
+		assert.Equal(t, c.reason, body.Reason, c.name)
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, StatusCode(blockchain.ErrNotFound))
+	assert.Equal(t, http.StatusConflict,
+		StatusCode(blockchain.ErrTransactionExists))
+	assert.Equal(t, http.StatusGone, StatusCode(blockchain.ErrPruned))
+	assert.Equal(t, http.StatusBadRequest,
+		StatusCode(&blockchain.ErrInvalidBlock{
+			Reason: blockchain.REASON_DIFFICULTY_TOO_LOW}))
+	assert.Equal(t, http.StatusInternalServerError,
+		StatusCode(errors.New("disk on fire")))
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestGetBlocksByHeight(t *testing.T) {
+	_, err := miner.GenerateBlocks(&store, coinbaseKey, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := store.GetRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get(fmt.Sprintf("%s/blocks/height/%d", server.URL,
+		root.Height))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var block blockchain.Block
+	err = json.NewDecoder(res.Body).Decode(&block)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, root, block)
+
+	res, err = http.Get(fmt.Sprintf("%s/blocks?from=%d&limit=5", server.URL,
+		root.Height-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var headers []blockchain.Header
+	err = json.NewDecoder(res.Body).Decode(&headers)
+	res.Body.Close()
+	assert.NoError(t, err)
+	if assert.Len(t, headers, 2) {
+		assert.Equal(t, root.Height-1, headers[0].Height)
+		assert.Equal(t, root.Header(), headers[1])
+	}
+
+	for path, status := range map[string]int{
+		"/blocks/height/-1":        400,
+		"/blocks/height/x":         400,
+		"/blocks/height/100000":    404,
+		"/blocks?from=-1":          400,
+		"/blocks?limit=0":          400,
+		"/blocks?limit=1001":       400,
+		"/blocks?from=100000":      200,
+		"/blocks?from=0&limit=abc": 400,
+	} {
+		res, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, status, res.StatusCode, path)
+	}
+}
+
+func TestGetAddress(t *testing.T) {
+	_, err := miner.GenerateBlocks(&store, coinbaseKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := coinbaseKey.Public().(ed25519.PublicKey)
+	text, err := address.Encode(store.Params.AddressPrefix, publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Get(fmt.Sprintf("%s/addresses/%s", server.URL, text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var body AddressOutputs
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+	assert.Equal(t, text, body.Address)
+	assert.NotEmpty(t, body.Outputs)
+	// each block's coinbase is a new output of the key
+	assert.Equal(t, store.Params.CoinbaseAmount*len(body.Outputs),
+		body.Balance)
+
+	// addresses of other networks are rejected
+	mainnet, err := address.Encode(blockchain.MainNetParams.AddressPrefix,
+		publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{mainnet, base58.Encode(publicKey)} {
+		res, err = http.Get(fmt.Sprintf("%s/addresses/%s", server.URL, text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	}
+}
+
+// spendOutput spends the first output of spent, which pays to privateKey,
+// to a new key and leaves fee to the miner.
+func spendOutput(t *testing.T, spent blockchain.Transaction,
+	privateKey ed25519.PrivateKey, fee int) blockchain.Transaction {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transaction := blockchain.Transaction{[]byte{},
+		[]blockchain.Input{{[]byte{}, spent.Hash, 0, nil, 0}},
+		[]blockchain.Output{{publicKey, spent.Outputs[0].Amount - fee,
+			[]byte{}}}, 0}
+	transaction.Hash, err = transaction.GetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = transaction.Sign(privateKey, 0, spent.Outputs[0],
+		blockchain.SIGHASH_ALL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transaction
+}
+
+func TestMineWithConflictingTransactions(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := miner.GenerateBlocks(&store, key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := blocks[0].Transactions[0]
+	// the mempool takes both, a block only one of them
+	first := spendOutput(t, coinbase, key, 0)
+	second := spendOutput(t, coinbase, key, 0)
+	assert.NoError(t, store.AddTransaction(first))
+	assert.NoError(t, store.AddTransaction(second))
+
+	assert.NoError(t, miner.Mine(context.Background(), server.URL,
+		coinbaseKey, 2))
+	root, err := store.GetRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, blocks[0].Height+1, root.Height)
+	assert.Len(t, root.Transactions, 2)
+}
+
+func TestMineCollectsFees(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := miner.GenerateBlocks(&store, key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spend := spendOutput(t, blocks[0].Transactions[0], key, 3)
+	assert.NoError(t, store.AddTransaction(spend))
+
+	assert.NoError(t, miner.Mine(context.Background(), server.URL,
+		coinbaseKey, 1))
+	root, err := store.GetRoot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, spend, root.Transactions[1])
+	assert.Equal(t, store.Params.CoinbaseAmount+3,
+		root.Transactions[0].Outputs[0].Amount)
+}